@@ -0,0 +1,220 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"database/sql"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maxAliasDepth limits the nested alias expansions of a single recipient
+const maxAliasDepth = 10
+
+var errAliasLoop = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 4, 6}, Message: "Alias expansion loop detected"}
+
+// AliasResolver maps a recipient address to its internal destinations (like the Postfix
+// virtual_alias_maps), it returns nil if the address isn't an alias
+type AliasResolver interface {
+	Resolve(address string) ([]string, error)
+}
+
+// AliasResolverFunc adapts a function to the AliasResolver interface
+type AliasResolverFunc func(address string) ([]string, error)
+
+// Resolve implements AliasResolver
+func (fn AliasResolverFunc) Resolve(address string) ([]string, error) {
+	return fn(address)
+}
+
+// AliasTable is an AliasResolver loaded from a text file, one alias per line:
+//
+//	sales@example.com john@example.com, jane@example.com
+//	info@example.com sales@example.com
+//
+// the subaddresses are resolved as their base address (e.g: "sales+eu@example.com"),
+// empty lines and lines starting with # are ignored.
+type AliasTable struct {
+	Filename string
+
+	mu      sync.RWMutex
+	aliases map[string][]string
+}
+
+// NewAliasTable loads the specified file
+func NewAliasTable(filename string) (*AliasTable, error) {
+	t := &AliasTable{Filename: filename}
+
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Reload re-reads the underlying file
+func (t *AliasTable) Reload() error {
+	f, err := os.Open(t.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	aliases := map[string][]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		aliases[strings.ToLower(fields[0])] = splitAliases(strings.Join(fields[1:], ","))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.aliases = aliases
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Resolve implements AliasResolver
+func (t *AliasTable) Resolve(address string) ([]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if destinations, ok := t.aliases[strings.ToLower(address)]; ok {
+		return destinations, nil
+	}
+
+	if canonical, err := CanonicalizeEmail(address); err == nil {
+		return t.aliases[canonical], nil
+	}
+
+	return nil, nil
+}
+
+// DefaultSQLAliasQuery is the query used by SQLAliasTable when none is specified
+const DefaultSQLAliasQuery = "SELECT destinations FROM aliases WHERE address = ?"
+
+// SQLAliasTable is an AliasResolver backed by an SQL database, the query receives the
+// (lower cased) address and must select a comma separated destinations list; no rows means no alias.
+type SQLAliasTable struct {
+	DB    *sql.DB
+	Query string
+}
+
+// Resolve implements AliasResolver
+func (t *SQLAliasTable) Resolve(address string) ([]string, error) {
+	query := t.Query
+	if query == "" {
+		query = DefaultSQLAliasQuery
+	}
+
+	var destinations sql.NullString
+
+	err := t.DB.QueryRow(query, strings.ToLower(address)).Scan(&destinations)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return splitAliases(destinations.String), nil
+}
+
+// resolveAliases expands the recipient to its destinations using ServerConfig.Aliases recursively,
+// it returns nil if the recipient isn't an alias
+func (s *Session) resolveAliases(address string) ([]string, error) {
+	if s.config.Aliases == nil {
+		return nil, nil
+	}
+
+	destinations, err := s.expandAlias(address, map[string]bool{}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(destinations) == 1 && strings.EqualFold(destinations[0], address) {
+		return nil, nil
+	}
+
+	return destinations, nil
+}
+
+// aliasKey identifies the addresses during an expansion, the subaddresses resolve as their base address
+func aliasKey(address string) string {
+	if canonical, err := CanonicalizeEmail(address); err == nil {
+		return canonical
+	}
+
+	return strings.ToLower(address)
+}
+
+// appendDestinations appends the destinations not already in the list
+func appendDestinations(list []string, destinations []string) []string {
+	for _, destination := range destinations {
+		found := false
+
+		for _, existing := range list {
+			if strings.EqualFold(existing, destination) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, destination)
+		}
+	}
+
+	return list
+}
+
+func (s *Session) expandAlias(address string, seen map[string]bool, depth int) ([]string, error) {
+	if depth > maxAliasDepth {
+		return nil, errAliasLoop
+	}
+
+	seen[aliasKey(address)] = true
+
+	targets, err := s.config.Aliases.Resolve(address)
+	if err != nil {
+		if reply, ok := toSMTPError(err).(*smtp.SMTPError); ok {
+			return nil, reply
+		}
+
+		return nil, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Alias lookup failed, try again later"}
+	}
+
+	if len(targets) < 1 {
+		return []string{address}, nil
+	}
+
+	destinations := []string{}
+
+	for _, target := range targets {
+		// an alias including itself (e.g: to keep a copy) is delivered as is
+		if seen[aliasKey(target)] {
+			destinations = append(destinations, target)
+			continue
+		}
+
+		expanded, err := s.expandAlias(target, seen, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		destinations = append(destinations, expanded...)
+	}
+
+	return destinations, nil
+}
@@ -0,0 +1,168 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const contentTypeMultipartReport = "multipart/report"
+const contentTypeFeedbackReport = "message/feedback-report"
+const contentTypeMessageRFC822 = "message/rfc822"
+const contentTypeTextRFC822Headers = "text/rfc822-headers"
+
+// FeedbackReport is an RFC 5965 (ARF) abuse report
+type FeedbackReport struct {
+	// the human readable part of the report
+	Description string
+
+	FeedbackType          string
+	UserAgent             string
+	Version               string
+	OriginalMailFrom      string
+	OriginalRcptTo        []string
+	ArrivalDate           time.Time
+	ReportingMTA          string
+	SourceIP              net.IP
+	Incidents             int
+	ReportedDomain        []string
+	ReportedURI           []string
+	AuthenticationResults []string
+
+	// all the fields of the machine readable part
+	Fields textproto.MIMEHeader
+
+	// the headers of the reported message and its Message-ID
+	OriginalHeader    mail.Header
+	OriginalMessageID string
+}
+
+// ParseARF parses an ARF feedback report read from io.Reader
+func ParseARF(r io.Reader) (*FeedbackReport, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType, params, err := parseContentType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != contentTypeMultipartReport || !strings.EqualFold(params["report-type"], "feedback-report") {
+		return nil, ErrNotFeedbackReport
+	}
+
+	report := &FeedbackReport{}
+	found := false
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		partType, _, err := parseContentType(part.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, err
+		}
+
+		switch partType {
+		case contentTypeTextPlain:
+			data, err := ioutil.ReadAll(content)
+			if err != nil {
+				return nil, err
+			}
+
+			report.Description = strings.TrimSpace(string(data))
+		case contentTypeFeedbackReport:
+			fields, err := textproto.NewReader(bufio.NewReader(content)).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			report.setFields(fields)
+			found = true
+		case contentTypeMessageRFC822, contentTypeTextRFC822Headers:
+			header, err := textproto.NewReader(bufio.NewReader(content)).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			report.OriginalHeader = mail.Header(header)
+			report.OriginalMessageID = strings.Trim(report.OriginalHeader.Get("Message-ID"), "<> ")
+		}
+	}
+
+	if !found {
+		return nil, ErrNotFeedbackReport
+	}
+
+	return report, nil
+}
+
+func (report *FeedbackReport) setFields(fields textproto.MIMEHeader) {
+	report.Fields = fields
+	report.FeedbackType = strings.ToLower(fields.Get("Feedback-Type"))
+	report.UserAgent = fields.Get("User-Agent")
+	report.Version = fields.Get("Version")
+	report.OriginalMailFrom = strings.Trim(fields.Get("Original-Mail-From"), "<> ")
+	report.ReportingMTA = fields.Get("Reporting-MTA")
+	report.SourceIP = net.ParseIP(strings.Trim(fields.Get("Source-IP"), "[] "))
+	report.ReportedDomain = fields["Reported-Domain"]
+	report.ReportedURI = fields["Reported-Uri"]
+	report.AuthenticationResults = fields["Authentication-Results"]
+
+	for _, rcpt := range fields["Original-Rcpt-To"] {
+		report.OriginalRcptTo = append(report.OriginalRcptTo, strings.Trim(rcpt, "<> "))
+	}
+
+	if incidents, err := strconv.Atoi(fields.Get("Incidents")); err == nil {
+		report.Incidents = incidents
+	}
+
+	if date := fields.Get("Arrival-Date"); date != "" {
+		report.ArrivalDate, _ = mail.ParseDate(date)
+	}
+}
+
+// ReportedRecipient returns the first recipient of the reported message
+func (report *FeedbackReport) ReportedRecipient() string {
+	if len(report.OriginalRcptTo) > 0 {
+		return report.OriginalRcptTo[0]
+	}
+
+	if report.OriginalHeader != nil {
+		if to, err := report.OriginalHeader.AddressList("To"); err == nil && len(to) > 0 {
+			return to[0].Address
+		}
+	}
+
+	return ""
+}
+
+// IsFeedbackReport reports whether the given Content-Type header is an ARF report
+func IsFeedbackReport(contentTypeHeader string) bool {
+	contentType, params, err := mime.ParseMediaType(contentTypeHeader)
+	if err != nil {
+		return false
+	}
+
+	return contentType == contentTypeMultipartReport && strings.EqualFold(params["report-type"], "feedback-report")
+}
@@ -0,0 +1,137 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+// DefaultDeniedExtensions are executables, scripts and macro-enabled office documents
+var DefaultDeniedExtensions = []string{
+	"exe", "bat", "cmd", "com", "scr", "pif", "cpl", "msi", "msp", "jar",
+	"js", "jse", "vbs", "vbe", "wsf", "wsh", "hta", "ps1", "lnk", "reg",
+	"docm", "dotm", "xlsm", "xltm", "xlam", "pptm", "potm", "ppam", "ppsm", "sldm",
+}
+
+// DefaultDeniedTypes are the executables content types, as declared or sniffed
+var DefaultDeniedTypes = []string{
+	"application/x-msdownload", "application/x-executable", "application/x-mach-binary",
+	"application/x-dosexec", "application/x-sh", "text/x-shellscript",
+}
+
+// AttachmentPolicy rejects messages carrying attachments that match the deny
+// lists, or (when any allow list is set) aren't on the allow lists.
+type AttachmentPolicy struct {
+	// DenyExtensions and DenyTypes default to DefaultDeniedExtensions and DefaultDeniedTypes
+	// when they are both nil, DenyTypes is matched against the declared and the sniffed type
+	DenyExtensions []string
+	DenyTypes      []string
+
+	AllowExtensions []string
+	AllowTypes      []string
+
+	// AcceptMalformed checks what can be parsed of the messages with a malformed MIME structure,
+	// by default they are rejected (see ErrMalformedMIME) since they could hide an attachment
+	AcceptMalformed bool
+}
+
+// Check walks the MIME tree of the message and returns an error describing the first offending
+// attachment, the parsing errors wrap ErrMalformedMIME
+func (p *AttachmentPolicy) Check(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return p.malformed(err)
+	}
+
+	w := &mimeWalker{Messages: true, Malformed: p.malformed}
+
+	return w.walk(textproto.MIMEHeader(msg.Header), msg.Body, p.checkPart)
+}
+
+// malformed fails the check on a parsing error unless AcceptMalformed is set
+func (p *AttachmentPolicy) malformed(err error) error {
+	if p.AcceptMalformed {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", ErrMalformedMIME, err)
+}
+
+func (p *AttachmentPolicy) checkPart(part *mimePart) error {
+	if part.Err != nil {
+		// an unparsable type is checked as an opaque attachment
+		if err := p.malformed(part.Err); err != nil {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(part.ContentType, "multipart/") {
+		return nil
+	}
+
+	// a name that sanitizes to nothing still marks an attachment
+	dispositionHeader := part.Header.Get("Content-Disposition")
+	disposition, _, _ := mime.ParseMediaType(dispositionHeader)
+	filename := entityFilename(part.Params, dispositionHeader)
+	attachment := filename != "" || disposition == "attachment"
+
+	// the attached messages are checked as a whole then for their own attachments
+	if part.ContentType == contentTypeMessageRFC822 || part.ContentType == "message/global" {
+		if attachment {
+			return p.checkAttachment(filename, part.ContentType, "")
+		}
+
+		return nil
+	}
+
+	if !attachment {
+		return nil
+	}
+
+	detected, _ := sniffReader(transferDecoder(part.Body, part.Header.Get("Content-Transfer-Encoding")))
+
+	return p.checkAttachment(filename, part.ContentType, detected)
+}
+
+func (p *AttachmentPolicy) checkAttachment(filename, contentType, detected string) error {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+
+	denyExtensions, denyTypes := p.DenyExtensions, p.DenyTypes
+	if denyExtensions == nil && denyTypes == nil {
+		denyExtensions, denyTypes = DefaultDeniedExtensions, DefaultDeniedTypes
+	}
+
+	if containsFold(denyExtensions, ext) {
+		return fmt.Errorf("attachment %q has a forbidden extension", filename)
+	}
+
+	if containsFold(denyTypes, contentType) {
+		return fmt.Errorf("attachment %q has a forbidden type %s", filename, contentType)
+	}
+
+	if containsFold(denyTypes, detected) {
+		return fmt.Errorf("attachment %q is actually of the forbidden type %s", filename, detected)
+	}
+
+	if len(p.AllowExtensions) > 0 || len(p.AllowTypes) > 0 {
+		if !containsFold(p.AllowExtensions, ext) && !containsFold(p.AllowTypes, contentType) {
+			return fmt.Errorf("attachment %q is not of an allowed type", filename)
+		}
+	}
+
+	return nil
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimPrefix(item, "."), value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,47 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentPolicy(t *testing.T) {
+	exe := base64.StdEncoding.EncodeToString(append([]byte("MZ\x90\x00"), make([]byte, 64)...))
+
+	attached := func(boundary, header, body string) string {
+		return "Content-Type: multipart/mixed; boundary=" + boundary + "\n\n--" + boundary + "\nContent-Type: text/plain\n\nhello\n--" + boundary + "\n" + header + "\n\n" + body + "\n--" + boundary + "--\n"
+	}
+
+	for _, tt := range []struct {
+		name      string
+		message   string
+		malformed bool
+		rejected  bool
+	}{
+		{"plain text", "Subject: hi\n\nhello\n", false, false},
+		{"pdf", attached("b", "Content-Type: application/pdf; name=report.pdf", "%PDF-1.4"), false, false},
+		{"exe extension", attached("b", "Content-Type: application/octet-stream; name=setup.exe", "data"), false, true},
+		{"base64 sniffed exe", attached("b", "Content-Type: application/octet-stream; name=report.pdf\nContent-Transfer-Encoding: base64", exe), false, true},
+		{"nested message", attached("b", "Content-Type: message/rfc822", attached("inner", "Content-Type: application/octet-stream; name=run.js", "alert(1)")), false, true},
+		{"base64 nested message", attached("b", "Content-Type: message/rfc822\nContent-Transfer-Encoding: base64", base64.StdEncoding.EncodeToString([]byte(attached("inner", "Content-Disposition: attachment; filename=run.vbs", "x")))), false, true},
+		{"bad content type", "Content-Type: multipart/mixed; boundary\n\n--b--\n", true, true},
+		{"truncated multipart", "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nhello\n", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&AttachmentPolicy{}).Check(strings.NewReader(tt.message))
+			if (err != nil) != tt.rejected || errors.Is(err, ErrMalformedMIME) != tt.malformed {
+				t.Fatalf("got %v, want rejected %v and malformed %v", err, tt.rejected, tt.malformed)
+			}
+
+			if !tt.malformed {
+				return
+			}
+
+			if err := (&AttachmentPolicy{AcceptMalformed: true}).Check(strings.NewReader(tt.message)); err != nil {
+				t.Fatalf("AcceptMalformed: got %v", err)
+			}
+		})
+	}
+}
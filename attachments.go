@@ -0,0 +1,187 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// AttachmentHeader describes an attachment streamed by WalkAttachments
+type AttachmentHeader struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+
+	// DetectedType is the content type sniffed from the first bytes of the content
+	DetectedType string
+
+	// Inline is set for the parts referenced by the HTML body (Content-ID or inline disposition)
+	Inline bool
+
+	// Header is the raw MIME header of the part
+	Header textproto.MIMEHeader
+}
+
+// AttachmentWalkFunc is called for each attachment, r yields the decoded content and
+// is only valid during the call, returning an error stops the walk
+type AttachmentWalkFunc func(hdr AttachmentHeader, r io.Reader) error
+
+// WalkAttachments streams the attachments of the message read from r one by one, without
+// buffering them in memory like ParseEmail does
+func WalkAttachments(r io.Reader, fn AttachmentWalkFunc) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+
+	w := &mimeWalker{}
+
+	return w.walk(textproto.MIMEHeader(msg.Header), msg.Body, func(part *mimePart) error {
+		// only the multipart messages have attachments
+		if part.Parent == nil {
+			return part.Err
+		}
+
+		// the parts of unparsable types are skipped
+		if part.Err != nil {
+			return errSkipChildren
+		}
+
+		if strings.HasPrefix(part.ContentType, "multipart/") {
+			return nil
+		}
+
+		disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		filename := entityFilename(part.Params, part.Header.Get("Content-Disposition"))
+		cid := strings.Trim(part.Header.Get("Content-Id"), "<> ")
+
+		if filename == "" && disposition != "attachment" && cid == "" && strings.HasPrefix(part.ContentType, "text/") {
+			// a body part
+			return nil
+		}
+
+		detected, content := sniffReader(transferDecoder(part.Body, part.Header.Get("Content-Transfer-Encoding")))
+
+		hdr := AttachmentHeader{
+			Filename:     filename,
+			ContentType:  part.ContentType,
+			ContentID:    cid,
+			DetectedType: detected,
+			Inline:       disposition == "inline" || (disposition == "" && cid != ""),
+			Header:       part.Header,
+		}
+
+		return fn(hdr, content)
+	})
+}
+
+// entityFilename returns the decoded and sanitized filename of a MIME entity, taken
+// from the Content-Disposition filename or the Content-Type name parameter
+func entityFilename(contentTypeParams map[string]string, dispositionHeader string) string {
+	filename := contentTypeParams["name"]
+	if _, dparams, err := mime.ParseMediaType(dispositionHeader); err == nil && dparams["filename"] != "" {
+		filename = dparams["filename"]
+	}
+
+	return SanitizeFilename(decodeMimeSentence(filename))
+}
+
+// SanitizeFilename makes a (decoded) attachment filename safe to be used on disk, the
+// directories, control and reserved characters are removed, the leading dots and the
+// trailing dots and spaces are trimmed and the name is limited to 255 bytes
+func SanitizeFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, "/\\"); i >= 0 {
+		filename = filename[i+1:]
+	}
+
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError || unicode.In(r, unicode.Cf) || strings.ContainsRune(`<>:"|?*`, r) {
+			return -1
+		}
+
+		return r
+	}, filename)
+
+	filename = strings.TrimLeft(strings.TrimSpace(filename), ".")
+	filename = strings.TrimRight(filename, ". ")
+
+	if len(filename) > maxFilenameLength {
+		ext := path.Ext(filename)
+		if len(ext) > 16 {
+			ext = ""
+		}
+
+		base := filename[:maxFilenameLength-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+
+		filename = base + ext
+	}
+
+	return filename
+}
+
+const maxFilenameLength = 255
+
+// the signatures http.DetectContentType doesn't know about
+var contentSignatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+	{"#!", "text/x-shellscript"},
+}
+
+// SniffContentType detects the content type of data from its first bytes (magic bytes),
+// the result has no parameters and defaults to application/octet-stream
+func SniffContentType(data []byte) string {
+	for _, sig := range contentSignatures {
+		if bytes.HasPrefix(data, []byte(sig.prefix)) {
+			return sig.contentType
+		}
+	}
+
+	contentType := http.DetectContentType(data)
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return contentType
+}
+
+// sniffReader detects the content type of r, the returned reader yields the whole content
+func sniffReader(r io.Reader) (string, io.Reader) {
+	br := bufio.NewReaderSize(r, 512)
+	data, _ := br.Peek(512)
+
+	return SniffContentType(data), br
+}
+
+// transferDecoder decodes the Content-Transfer-Encoding on the fly
+func transferDecoder(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+
+	return r
+}
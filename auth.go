@@ -0,0 +1,292 @@
+package smtpsrv
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// CRAMMD5 is the name of the CRAM-MD5 (RFC 2195) SASL mechanism
+const CRAMMD5 = "CRAM-MD5"
+
+// XOAUTH2 is the name of the Google/Microsoft OAuth 2.0 bearer token SASL mechanism
+const XOAUTH2 = "XOAUTH2"
+
+var errNoClientCertificate = &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "No verified client certificate"}
+
+var errInvalidCredentials = &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Authentication credentials invalid"}
+
+var errAlreadyAuthenticated = &smtp.SMTPError{Code: 503, EnhancedCode: smtp.EnhancedCode{5, 5, 1}, Message: "Already authenticated"}
+
+var errAuthInTransaction = &smtp.SMTPError{Code: 503, EnhancedCode: smtp.EnhancedCode{5, 5, 1}, Message: "AUTH not permitted during a mail transaction"}
+
+var errAuthLockedOut = &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many authentication failures, try again later"}
+
+var errAuthLockedOutDrop = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many authentication failures, closing connection"}
+
+var errEncryptionRequired = &smtp.SMTPError{Code: 538, EnhancedCode: smtp.EnhancedCode{5, 7, 11}, Message: "Encryption required for requested authentication mechanism"}
+
+var errMechanismUnsupported = &smtp.SMTPError{Code: 504, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Unrecognized authentication type"}
+
+// enableAuthMechanisms registers the supported SASL mechanisms, they are
+// advertised in the EHLO response as well
+func enableAuthMechanisms(s *smtp.Server, bkd *Backend) {
+	enable := func(name string, f smtp.SaslServerFactory) {
+		s.EnableAuth(name, bkd.authOnce(f))
+	}
+
+	if bkd.auther != nil {
+		enable(sasl.Plain, func(conn *smtp.Conn) sasl.Server {
+			return sasl.NewPlainServer(func(identity, username, password string) error {
+				if identity != "" && identity != username {
+					return errors.New("Identities not supported")
+				}
+
+				state := conn.State()
+				session, err := bkd.login(&state, sasl.Plain, username, password)
+				if err != nil {
+					return err
+				}
+
+				conn.SetSession(session)
+				return nil
+			})
+		})
+
+		enable(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+			return sasl.NewLoginServer(func(username, password string) error {
+				state := conn.State()
+				session, err := bkd.login(&state, sasl.Login, username, password)
+				if err != nil {
+					return err
+				}
+
+				conn.SetSession(session)
+				return nil
+			})
+		})
+	} else {
+		// go-smtp always registers its own PLAIN, it can't be removed so it's replaced
+		// by one rejecting the mechanism behind the same AUTH checks as the others
+		enable(sasl.Plain, func(conn *smtp.Conn) sasl.Server {
+			return authRejected{errMechanismUnsupported}
+		})
+	}
+
+	if bkd.config != nil && bkd.config.Secret != nil {
+		enable(CRAMMD5, func(conn *smtp.Conn) sasl.Server {
+			return &cramMD5Server{
+				domain: s.Domain,
+				authenticate: func(username string, verify func(secret string) bool) error {
+					secret, err := bkd.config.Secret(username)
+					if err == nil && !verify(secret) {
+						err = errInvalidCredentials
+					}
+
+					state := conn.State()
+					session, err := bkd.authenticated(&state, CRAMMD5, username, nil, err)
+					if err != nil {
+						return err
+					}
+
+					conn.SetSession(session)
+					return nil
+				},
+			}
+		})
+	}
+
+	if bkd.config != nil && bkd.config.OAuth != nil {
+		enable(XOAUTH2, func(conn *smtp.Conn) sasl.Server {
+			return &xoauth2Server{
+				authenticate: func(username, token string) error {
+					state := conn.State()
+					session, err := bkd.authenticated(&state, XOAUTH2, username, nil, bkd.config.OAuth(username, token))
+					if err != nil {
+						return err
+					}
+
+					conn.SetSession(session)
+					return nil
+				},
+			}
+		})
+	}
+
+	if bkd.config != nil && bkd.config.CertAuth != nil {
+		enable(sasl.External, func(conn *smtp.Conn) sasl.Server {
+			return &externalServer{
+				authenticate: func(identity string) error {
+					state := conn.State()
+					bkd.tlsState(&state)
+
+					cert := clientCertificate(&state.TLS)
+					if cert == nil {
+						return errNoClientCertificate
+					}
+
+					username, err := bkd.config.CertAuth(identity, cert)
+					if err == nil && username == "" {
+						username = cert.Subject.CommonName
+					}
+
+					session, err := bkd.authenticated(&state, sasl.External, username, nil, err)
+					if err != nil {
+						return err
+					}
+
+					conn.SetSession(session)
+					return nil
+				},
+			}
+		})
+	}
+}
+
+// authOnce rejects AUTH with 503 (RFC 4954 section 4) once the client is authenticated or while
+// a mail transaction is in progress, with 538 on the unencrypted connections when ServerConfig.AuthRequiresTLS
+// is set, and IPs locked out by the AuthLimiter
+func (bkd *Backend) authOnce(f smtp.SaslServerFactory) smtp.SaslServerFactory {
+	return func(conn *smtp.Conn) sasl.Server {
+		state := conn.State()
+		if bkd.tlsState(&state); bkd.config.AuthRequiresTLS && !state.TLS.HandshakeComplete {
+			return authRejected{errEncryptionRequired}
+		}
+
+		if limiter := bkd.config.AuthLimiter; limiter != nil && !limiter.Allow(remoteIP(conn.State().RemoteAddr).String()) {
+			if !bkd.config.AuthLockoutDrop {
+				return authRejected{errAuthLockedOut}
+			}
+
+			if c := bkd.conns.get(conn.State().RemoteAddr); c != nil {
+				c.closeAfterReply()
+			}
+
+			return authRejected{errAuthLockedOutDrop}
+		}
+
+		if s, ok := conn.Session().(*Session); ok {
+			if s.username != nil {
+				return authRejected{errAlreadyAuthenticated}
+			}
+
+			if s.transaction {
+				return authRejected{errAuthInTransaction}
+			}
+		}
+
+		return f(conn)
+	}
+}
+
+// authRejected fails the AUTH command before the first challenge
+type authRejected struct {
+	err error
+}
+
+func (a authRejected) Next(response []byte) ([]byte, bool, error) {
+	return nil, true, a.err
+}
+
+// externalServer implements the server side of EXTERNAL (RFC 4422 appendix A),
+// the credentials are the TLS client certificate and the client only sends an
+// optional authorization identity
+type externalServer struct {
+	started      bool
+	authenticate func(identity string) error
+}
+
+func (a *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil && !a.started {
+		a.started = true
+		return []byte{}, false, nil
+	}
+
+	return nil, true, a.authenticate(string(response))
+}
+
+// cramMD5Server implements the server side of CRAM-MD5, the client answers
+// the challenge with its username and the HMAC-MD5 of the challenge keyed by the shared secret
+type cramMD5Server struct {
+	domain       string
+	challenge    []byte
+	authenticate func(username string, verify func(secret string) bool) error
+}
+
+func (a *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if a.challenge == nil {
+		if len(response) > 0 {
+			return nil, true, errors.New("CRAM-MD5 doesn't accept an initial response")
+		}
+
+		b := make([]byte, 8)
+		rand.Read(b)
+		a.challenge = []byte(fmt.Sprintf("<%s.%s@%s>", hex.EncodeToString(b), newTraceID(nil), a.domain))
+
+		return a.challenge, false, nil
+	}
+
+	parts := strings.Fields(string(response))
+	if len(parts) != 2 {
+		return nil, true, errors.New("malformed CRAM-MD5 response")
+	}
+
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, true, errors.New("malformed CRAM-MD5 response")
+	}
+
+	return nil, true, a.authenticate(parts[0], func(secret string) bool {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(a.challenge)
+
+		return hmac.Equal(mac.Sum(nil), digest)
+	})
+}
+
+// xoauth2Server implements the server side of XOAUTH2, the client sends
+// "user={user}^Aauth=Bearer {token}^A^A", a rejected token is answered with
+// a JSON error challenge the client acknowledges with an empty line
+type xoauth2Server struct {
+	err          error
+	authenticate func(username, token string) error
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if a.err != nil {
+		return nil, true, a.err
+	}
+
+	if len(response) < 1 {
+		return []byte{}, false, nil
+	}
+
+	var username, token string
+	for _, field := range strings.Split(string(response), "\x01") {
+		switch {
+		case strings.HasPrefix(field, "user="):
+			username = strings.TrimPrefix(field, "user=")
+		case strings.HasPrefix(strings.ToLower(field), "auth=bearer "):
+			token = strings.TrimSpace(field[len("auth=bearer "):])
+		}
+	}
+
+	if username == "" || token == "" {
+		return nil, true, errors.New("malformed XOAUTH2 response")
+	}
+
+	if err := a.authenticate(username, token); err != nil {
+		a.err = err
+
+		return []byte(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`), false, nil
+	}
+
+	return nil, true, nil
+}
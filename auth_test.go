@@ -0,0 +1,73 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+type denyAllLimiter struct{}
+
+func (denyAllLimiter) Allow(ip string) bool { return false }
+func (denyAllLimiter) Failed(ip string)     {}
+func (denyAllLimiter) Succeeded(ip string)  {}
+
+func TestAuthPlainWithoutAuther(t *testing.T) {
+	plain := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00john\x00secret"))
+	secret := func(username string) (string, error) { return "secret", nil }
+
+	for _, tt := range []struct {
+		name string
+		cfg  *ServerConfig
+		code int
+	}{
+		{"unsupported", &ServerConfig{Secret: secret}, 504},
+		{"locked out", &ServerConfig{Secret: secret, AuthLimiter: denyAllLimiter{}, AuthLockoutDrop: true}, 421},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, addr := startTestServer(t, tt.cfg)
+			defer srv.Close()
+
+			c := dialTestServer(t, addr)
+			defer c.Close()
+
+			c.expectCmd("EHLO client.example.org", 250)
+			c.expectCmd(plain, tt.code)
+		})
+	}
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{
+		AuthRequiresTLS: true,
+		Auther:          func(username, password string) error { return nil },
+		Handler:         func(c *Context) error { return nil },
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	if reply := c.expectCmd("EHLO client.example.org", 250); strings.Contains(reply, "AUTH") {
+		t.Fatalf("AUTH is advertised in plaintext:\n%s", reply)
+	}
+
+	c.expectCmd("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00john\x00secret")), 538)
+}
+
+func TestRequireAuth(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{
+		RequireAuth: true,
+		Auther:      func(username, password string) error { return nil },
+		Handler:     func(c *Context) error { return nil },
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<john@example.org>", 530)
+	c.expectCmd("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00john\x00secret")), 235)
+	c.expectCmd("MAIL FROM:<john@example.org>", 250)
+}
@@ -0,0 +1,139 @@
+package smtpsrv
+
+import (
+	"sync"
+	"time"
+)
+
+// AuthLimiter decides whether a remote IP is allowed to attempt AUTH, it is
+// told about the outcome of every attempt
+type AuthLimiter interface {
+	Allow(ip string) bool
+	Failed(ip string)
+	Succeeded(ip string)
+}
+
+// AuthLockout is the built-in AuthLimiter, it locks an IP out for Cooldown once
+// it failed MaxFailures times within Window
+type AuthLockout struct {
+	MaxFailures int
+	Window      time.Duration
+	Cooldown    time.Duration
+	Clock       Clock
+
+	// failures and locked are swept once per window, so the IPs that stopped trying are forgotten
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+	swept    time.Time
+}
+
+// NewAuthLockout creates an AuthLockout with the given threshold, window and cooldown
+func NewAuthLockout(maxFailures int, window, cooldown time.Duration) *AuthLockout {
+	return &AuthLockout{
+		MaxFailures: maxFailures,
+		Window:      window,
+		Cooldown:    cooldown,
+	}
+}
+
+// Allow implements AuthLimiter
+func (l *AuthLockout) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.locked[ip]
+	if !ok {
+		return true
+	}
+
+	if clockOrDefault(l.Clock).Now().Before(until) {
+		return false
+	}
+
+	delete(l.locked, ip)
+
+	return true
+}
+
+// Failed implements AuthLimiter
+func (l *AuthLockout) Failed(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failures == nil {
+		l.failures = map[string][]time.Time{}
+		l.locked = map[string]time.Time{}
+	}
+
+	now := clockOrDefault(l.Clock).Now()
+	l.sweep(now)
+
+	recent := []time.Time{now}
+	for _, at := range l.failures[ip] {
+		if now.Sub(at) < l.window() {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= l.maxFailures() {
+		delete(l.failures, ip)
+		l.locked[ip] = now.Add(l.cooldown())
+		return
+	}
+
+	l.failures[ip] = recent
+}
+
+// sweep drops the failures out of the window and the ended lockouts
+func (l *AuthLockout) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window() {
+		return
+	}
+
+	for ip, failures := range l.failures {
+		if now.Sub(failures[0]) >= l.window() {
+			delete(l.failures, ip)
+		}
+	}
+
+	for ip, until := range l.locked {
+		if !now.Before(until) {
+			delete(l.locked, ip)
+		}
+	}
+
+	l.swept = now
+}
+
+// Succeeded implements AuthLimiter
+func (l *AuthLockout) Succeeded(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, ip)
+}
+
+func (l *AuthLockout) maxFailures() int {
+	if l.MaxFailures < 1 {
+		return 5
+	}
+
+	return l.MaxFailures
+}
+
+func (l *AuthLockout) window() time.Duration {
+	if l.Window <= 0 {
+		return 15 * time.Minute
+	}
+
+	return l.Window
+}
+
+func (l *AuthLockout) cooldown() time.Duration {
+	if l.Cooldown <= 0 {
+		return 15 * time.Minute
+	}
+
+	return l.Cooldown
+}
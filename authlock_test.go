@@ -0,0 +1,44 @@
+package smtpsrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthLockout(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	l := &AuthLockout{MaxFailures: 3, Window: time.Minute, Cooldown: time.Hour, Clock: clock}
+
+	l.Failed("192.0.2.1")
+	l.Failed("192.0.2.1")
+	l.Failed("192.0.2.2")
+
+	if !l.Allow("192.0.2.1") {
+		t.Fatal("locked out before MaxFailures")
+	}
+
+	l.Failed("192.0.2.1")
+
+	if l.Allow("192.0.2.1") {
+		t.Fatal("not locked out after MaxFailures")
+	}
+
+	// the failures of 192.0.2.2 left the window, the lockout of 192.0.2.1 still holds
+	clock.now = clock.now.Add(2 * time.Minute)
+	l.Failed("192.0.2.3")
+
+	if _, ok := l.failures["192.0.2.2"]; ok {
+		t.Fatal("the failures out of the window weren't swept")
+	}
+
+	if l.Allow("192.0.2.1") {
+		t.Fatal("the lockout ended before Cooldown")
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	l.Failed("192.0.2.3")
+
+	if _, ok := l.locked["192.0.2.1"]; ok {
+		t.Fatal("the ended lockout wasn't swept")
+	}
+}
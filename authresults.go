@@ -0,0 +1,70 @@
+package smtpsrv
+
+import (
+	"strings"
+)
+
+// authenticationResults builds the value of the Authentication-Results header (RFC 8601)
+// of the current message
+func (s *Session) authenticationResults(c *Context) string {
+	methods := []string{}
+
+	if s.username != nil && *s.username != "" {
+		methods = append(methods, "auth=pass smtp.auth="+authResultsValue(*s.username))
+	}
+
+	// only when it was looked up, a header isn't worth an extra lookup
+	if s.rdns != nil {
+		if rdns := c.ReverseDNS(); rdns.IP != nil {
+			result := "fail"
+			if rdns.Verified {
+				result = "pass"
+			} else if rdns.Err != nil {
+				result = "temperror"
+			}
+
+			methods = append(methods, "iprev="+result+" policy.iprev="+rdns.IP.String())
+		}
+	}
+
+	if s.From != nil && s.From.Address != "" {
+		if _, domain, err := SplitAddress(s.From.Address); err == nil {
+			result, _, _ := c.SPF()
+			methods = append(methods, "spf="+result.String()+" smtp.mailfrom="+authResultsValue(domain))
+		}
+	}
+
+	if dkim, err := s.verifyDKIM(c); err == nil && dkim != nil {
+		if len(dkim) < 1 {
+			methods = append(methods, "dkim=none")
+		}
+
+		for _, sig := range dkim {
+			method := "dkim=" + strings.ToLower(sig.Result) + " header.d=" + authResultsValue(sig.Domain)
+			if sig.Selector != "" {
+				method += " header.s=" + authResultsValue(sig.Selector)
+			}
+
+			methods = append(methods, method)
+		}
+	}
+
+	if s.dmarc != nil {
+		methods = append(methods, "dmarc="+s.dmarc.Result+" header.from="+authResultsValue(s.dmarc.Domain))
+	}
+
+	if len(methods) < 1 {
+		return s.config.BannerDomain + "; none"
+	}
+
+	return s.config.BannerDomain + ";\n\t" + strings.Join(methods, ";\n\t")
+}
+
+// authResultsValue quotes the property values that aren't a plain token
+func authResultsValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, "()<>,;:\\\"[]?= \t\r\n") {
+		return value
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", "").Replace(value) + `"`
+}
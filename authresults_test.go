@@ -0,0 +1,119 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAuthResultsValue(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+	}{
+		{"example.com", "example.com"},
+		{"john", "john"},
+		{"john@example.com", "john@example.com"},
+		{"", `""`},
+		{"john doe", `"john doe"`},
+		{"a;b", `"a;b"`},
+		{`say "hi"\`, `"say \"hi\"\\"`},
+		{"in\r\njected", `"injected"`},
+	} {
+		if got := authResultsValue(tt.value); got != tt.want {
+			t.Errorf("authResultsValue(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	type received struct {
+		header, full string
+	}
+
+	messages := make(chan received, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		BannerDomain:          "mx.example.com",
+		AuthenticationResults: true,
+		Auther:                func(username, password string) error { return nil },
+		Resolver: &staticResolver{txt: map[string][]string{
+			"example.com":        {"v=spf1 ip4:127.0.0.1 -all"},
+			"_dmarc.example.com": {"v=DMARC1; p=none"},
+		}},
+		DMARC: &DMARCVerifier{DKIM: func(message []byte) ([]DMARCAuthResult, error) {
+			if strings.Contains(string(message), "DKIM-Signature") {
+				return []DMARCAuthResult{{Domain: "example.com", Selector: "s1", Result: "pass"}}, nil
+			}
+
+			return nil, nil
+		}},
+		Handler: func(c *Context) error {
+			full, err := ioutil.ReadAll(c)
+			if err != nil {
+				return err
+			}
+
+			messages <- received{c.Header().Get("Authentication-Results"), string(full)}
+
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+
+	c.send("bounces@example.net", []string{"rcpt@example.org"}, "From: sender@example.net\nSubject: hi\n\nhi")
+
+	if m := <-messages; m.header != "mx.example.com; spf=none smtp.mailfrom=example.net; dkim=none; dmarc=none header.from=example.net" {
+		t.Errorf("anonymous message: got %q", m.header)
+	}
+
+	c.expectCmd("AUTH PLAIN AGpvaG4Ac2VjcmV0", 235)
+	c.send("sender@example.com", []string{"rcpt@example.org"}, "DKIM-Signature: v=1\nFrom: sender@example.com\nSubject: hi\n\nhi")
+
+	m := <-messages
+
+	want := "mx.example.com;\n\tauth=pass smtp.auth=john;\n\tspf=pass smtp.mailfrom=example.com;\n\t" +
+		"dkim=pass header.d=example.com header.s=s1;\n\tdmarc=pass header.from=example.com"
+
+	if !strings.Contains(m.full, "Authentication-Results: "+want+"\n") {
+		t.Errorf("authenticated message: got %q, want %q", m.full, want)
+	}
+
+	if m.header != strings.Replace(want, "\n\t", " ", -1) {
+		t.Errorf("authenticated message: Header() got %q", m.header)
+	}
+}
+
+func TestAuthenticationResultsNone(t *testing.T) {
+	messages := make(chan string, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		BannerDomain:          "mx.example.com",
+		AuthenticationResults: true,
+		Handler: func(c *Context) error {
+			full, err := ioutil.ReadAll(c)
+			if err != nil {
+				return err
+			}
+
+			messages <- string(full)
+
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.send("", []string{"rcpt@example.org"}, "Subject: bounce\n\nhi")
+
+	if full := <-messages; !strings.Contains(full, "Authentication-Results: mx.example.com; none\n") {
+		t.Errorf("got %q, want none", full)
+	}
+}
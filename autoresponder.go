@@ -0,0 +1,277 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AutoResponse is the vacation/autoresponse settings of a single recipient,
+// Subject and Body are text/template(s) executed with AutoResponseData.
+type AutoResponse struct {
+	From     string
+	Subject  string
+	Body     string
+	Start    time.Time
+	End      time.Time
+	Interval time.Duration
+}
+
+// AutoResponseData is passed to the AutoResponse templates
+type AutoResponseData struct {
+	From      string
+	To        string
+	Subject   string
+	MessageID string
+}
+
+// AutoResponseLookup returns the active autoresponse of the specified recipient, nil means none
+type AutoResponseLookup func(rcpt string) (*AutoResponse, error)
+
+// AutoResponseSender delivers the generated reply, from is the envelope sender which is
+// always empty (the null reverse-path, RFC 3834 section 3.3) so the reply can't bounce back
+type AutoResponseSender func(from, to string, msg []byte) error
+
+// AutoResponder is an RFC 3834 compliant autoresponse engine
+type AutoResponder struct {
+	Lookup AutoResponseLookup
+	Send   AutoResponseSender
+	Clock  Clock
+
+	// OnError (if set) receives the errors of the autoresponses sent once the server accepted
+	// a message, they are written to stderr otherwise
+	OnError func(rcpt string, err error)
+
+	// sent holds when each recipient/sender pair may be answered again, the expired
+	// entries are swept every autoResponseSweepInterval
+	mu    sync.Mutex
+	sent  map[string]time.Time
+	swept time.Time
+}
+
+const autoResponseSweepInterval = time.Hour
+
+// Respond sends the autoresponse of rcpt (if any) to the envelope sender of a
+// message, unless RFC 3834 says we must not.
+func (a *AutoResponder) Respond(from, rcpt string, header mail.Header) error {
+	if a.Lookup == nil || a.Send == nil || !ShouldAutoRespond(from, header) || !addressedTo(rcpt, header) {
+		return nil
+	}
+
+	resp, err := a.Lookup(rcpt)
+	if err != nil || resp == nil {
+		return err
+	}
+
+	now := clockOrDefault(a.Clock).Now()
+	if (!resp.Start.IsZero() && now.Before(resp.Start)) || (!resp.End.IsZero() && now.After(resp.End)) {
+		return nil
+	}
+
+	interval := resp.Interval
+	if interval < 1 {
+		interval = 7 * 24 * time.Hour
+	}
+
+	key := strings.ToLower(rcpt + "|" + from)
+
+	a.mu.Lock()
+	if a.sent == nil {
+		a.sent = map[string]time.Time{}
+	}
+	if now.Sub(a.swept) >= autoResponseSweepInterval {
+		for k, until := range a.sent {
+			if !now.Before(until) {
+				delete(a.sent, k)
+			}
+		}
+		a.swept = now
+	}
+	if until, ok := a.sent[key]; ok && now.Before(until) {
+		a.mu.Unlock()
+		return nil
+	}
+	a.sent[key] = now.Add(interval)
+	a.mu.Unlock()
+
+	replyFrom := resp.From
+	if replyFrom == "" {
+		replyFrom = rcpt
+	}
+
+	msg, err := buildAutoResponse(replyFrom, from, rcpt, resp, header, now)
+	if err != nil {
+		return err
+	}
+
+	return a.Send("", from, msg)
+}
+
+func (a *AutoResponder) reportError(rcpt string, err error) {
+	if a.OnError != nil {
+		a.OnError(rcpt, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "smtpsrv: autoresponse of %s: %v\n", rcpt, err)
+	}
+}
+
+// autoRespond runs the AutoResponder for each delivered recipient in the background, so
+// a slow Send doesn't delay the reply to DATA
+func (s *Session) autoRespond() {
+	responder, from, header := s.config.AutoResponder, s.From.Address, s.header
+
+	var rcpts []string
+	for _, rcpt := range s.accepted {
+		if s.failures[strings.ToLower(rcpt.address)] == nil {
+			rcpts = append(rcpts, rcpt.address)
+		}
+	}
+
+	go func() {
+		var err error
+		defer s.recoverPanic(&err)
+
+		for _, rcpt := range rcpts {
+			if err := responder.Respond(from, rcpt, header); err != nil {
+				responder.reportError(rcpt, err)
+			}
+		}
+	}()
+}
+
+// addressedTo reports whether rcpt appears in the recipient fields of the header, RFC 3834
+// section 2 says not to answer the messages that reached it otherwise (e.g: through a list)
+func addressedTo(rcpt string, header mail.Header) bool {
+	want, err := CanonicalizeEmail(rcpt)
+	if err != nil {
+		want = strings.ToLower(rcpt)
+	}
+
+	for _, name := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		list, err := header.AddressList(name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range list {
+			got, err := CanonicalizeEmail(addr.Address)
+			if err != nil {
+				got = strings.ToLower(addr.Address)
+			}
+
+			if got == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ShouldAutoRespond applies the RFC 3834 section 2 rules on the envelope
+// sender and the message header.
+func ShouldAutoRespond(from string, header mail.Header) bool {
+	if from == "" {
+		return false
+	}
+
+	local, _, err := SplitAddress(from)
+	if err != nil {
+		return false
+	}
+
+	local = strings.ToLower(local)
+	if local == "mailer-daemon" || local == "postmaster" || strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+
+	if autoSubmitted := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); autoSubmitted != "" && autoSubmitted != "no" {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+
+	for _, name := range []string{"List-Id", "List-Unsubscribe", "List-Post", "X-Auto-Response-Suppress"} {
+		if header.Get(name) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+func buildAutoResponse(from, to, rcpt string, resp *AutoResponse, header mail.Header, now time.Time) ([]byte, error) {
+	data := AutoResponseData{
+		From:      to,
+		To:        rcpt,
+		Subject:   decodeMimeSentence(header.Get("Subject")),
+		MessageID: header.Get("Message-ID"),
+	}
+
+	subject, err := executeAutoResponseTemplate(resp.Subject, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if subject == "" {
+		subject = "Auto: " + data.Subject
+	}
+
+	// the decoded subject of the message may hold line breaks, they would start new header fields
+	subject = strings.Join(strings.FieldsFunc(subject, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+
+	body, err := executeAutoResponseTemplate(resp.Body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", headerAddress(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerAddress(to))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	if data.MessageID != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", data.MessageID)
+		fmt.Fprintf(&buf, "References: %s\r\n", strings.TrimSpace(header.Get("References")+" "+data.MessageID))
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+
+	return buf.Bytes(), nil
+}
+
+// headerAddress formats an address header field, AutoResponse.From may have a display name
+func headerAddress(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		return parsed.String()
+	}
+
+	return (&mail.Address{Address: addr}).String()
+}
+
+func executeAutoResponseTemplate(text string, data AutoResponseData) (string, error) {
+	tpl, err := template.New("autoresponse").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,153 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddressedTo(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		rcpt   string
+		want   bool
+	}{
+		{"To: John <john@example.com>", "john@example.com", true},
+		{"To: someone@example.org\r\nCc: John.Doe@Example.com", "john.doe@example.com", true},
+		{"To: john+work@example.com", "john@example.com", true},
+		{"Resent-To: john@example.com", "john@example.com", true},
+		{"To: list@example.org", "john@example.com", false},
+		{"Subject: no recipients", "john@example.com", false},
+	} {
+		msg, err := mail.ReadMessage(strings.NewReader(tt.header + "\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := addressedTo(tt.rcpt, msg.Header); got != tt.want {
+			t.Errorf("addressedTo(%q) with %q = %v, want %v", tt.rcpt, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAutoResponse(t *testing.T) {
+	type sent struct {
+		from, to string
+		msg      []byte
+	}
+
+	replies := make(chan sent, 2)
+	responder := &AutoResponder{
+		Lookup: func(rcpt string) (*AutoResponse, error) {
+			return &AutoResponse{Body: "I'm away"}, nil
+		},
+		Send: func(from, to string, msg []byte) error {
+			replies <- sent{from, to, msg}
+			return nil
+		},
+	}
+
+	srv, addr := startTestServer(t, &ServerConfig{AutoResponder: responder, Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+
+	reply := c.send("sender@example.org", []string{"john@example.com", "bcc@example.com"}, "From: sender@example.org\nTo: john@example.com\nSubject: hello\n\nhi")
+	if !strings.HasPrefix(reply, "250") {
+		t.Fatalf("DATA: got %q", reply)
+	}
+
+	select {
+	case r := <-replies:
+		if r.from != "" || r.to != "sender@example.org" {
+			t.Fatalf("got the envelope %q -> %q, want <> -> sender@example.org", r.from, r.to)
+		}
+
+		if !strings.Contains(string(r.msg), "From: <john@example.com>\r\n") {
+			t.Fatalf("the reply isn't from the recipient:\n%s", r.msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no autoresponse")
+	}
+
+	select {
+	case r := <-replies:
+		t.Fatalf("the recipient missing from the header got answered: %q", r.msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAutoResponseSubjectInjection(t *testing.T) {
+	header := mail.Header{"Subject": {"=?utf-8?q?hello=0D=0ABcc:_victim@example.net?="}}
+
+	msg, err := buildAutoResponse("john@example.com", "sender@example.org", "john@example.com", &AutoResponse{}, header, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bcc := parsed.Header.Get("Bcc"); bcc != "" {
+		t.Fatalf("the subject injected Bcc: %q", bcc)
+	}
+
+	if subject := decodeMimeSentence(parsed.Header.Get("Subject")); subject != "Auto: hello Bcc: victim@example.net" {
+		t.Fatalf("got the subject %q", subject)
+	}
+}
+
+func TestAutoResponderInterval(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	sent := 0
+
+	responder := &AutoResponder{
+		Clock: clock,
+		Lookup: func(rcpt string) (*AutoResponse, error) {
+			return &AutoResponse{Body: "I'm away", Interval: 24 * time.Hour}, nil
+		},
+		Send: func(from, to string, msg []byte) error {
+			sent++
+			return nil
+		},
+	}
+
+	header := mail.Header{"To": {"john@example.com"}}
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{0, 1},
+		{time.Hour, 1},
+		{25 * time.Hour, 2},
+	} {
+		clock.now = clock.now.Add(tt.elapsed)
+
+		if err := responder.Respond("sender@example.org", "john@example.com", header); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent != tt.want {
+			t.Fatalf("after %v: sent %d autoresponses, want %d", tt.elapsed, sent, tt.want)
+		}
+	}
+
+	// the entry of another sender expired a day ago
+	responder.sent["john@example.com|old@example.org"] = clock.now.Add(-24 * time.Hour)
+	clock.now = clock.now.Add(2 * time.Hour)
+
+	if err := responder.Respond("sender@example.org", "john@example.com", header); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := responder.sent["john@example.com|old@example.org"]; ok {
+		t.Fatal("the expired entry wasn't swept")
+	}
+}
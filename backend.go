@@ -2,7 +2,10 @@ package smtpsrv
 
 import (
 	"errors"
+	"net"
+	"sync/atomic"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
@@ -10,6 +13,10 @@ import (
 type Backend struct {
 	handler HandlerFunc
 	auther  AuthFunc
+	config  *ServerConfig
+	abuse   abuseTracker
+	conns   connRegistry
+	paused  int32
 }
 
 func NewBackend(auther AuthFunc, handler HandlerFunc) *Backend {
@@ -21,14 +28,178 @@ func NewBackend(auther AuthFunc, handler HandlerFunc) *Backend {
 
 // Login handles a login command with username and password.
 func (bkd *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return bkd.login(state, sasl.Plain, username, password)
+}
+
+func (bkd *Backend) login(state *smtp.ConnectionState, mechanism, username, password string) (smtp.Session, error) {
 	if nil == bkd.auther {
 		return nil, errors.New("invalid command specified")
 	}
 
-	return NewSession(state, bkd.handler, &username, &password), nil
+	return bkd.authenticated(state, mechanism, username, &password, bkd.auther(username, password))
+}
+
+// authenticated finishes an authentication attempt of any mechanism, err is its outcome
+func (bkd *Backend) authenticated(state *smtp.ConnectionState, mechanism, username string, password *string, err error) (smtp.Session, error) {
+	bkd.tlsState(state)
+
+	if bkd.config != nil && bkd.config.OnAuthEvent != nil {
+		bkd.config.OnAuthEvent(AuthEvent{
+			Time:       clockOrDefault(bkd.config.Clock).Now(),
+			Success:    err == nil,
+			Mechanism:  mechanism,
+			Username:   username,
+			RemoteAddr: state.RemoteAddr,
+			TLS:        state.TLS.HandshakeComplete,
+			Err:        err,
+		})
+	}
+
+	err = toSMTPError(err)
+
+	// the temporary failures (e.g: ErrAuthUnavailable) don't count against the client
+	if isTemporaryReply(err) {
+		return nil, err
+	}
+
+	if bkd.config != nil && bkd.config.AuthLimiter != nil {
+		if err != nil {
+			bkd.config.AuthLimiter.Failed(remoteIP(state.RemoteAddr).String())
+		} else {
+			bkd.config.AuthLimiter.Succeeded(remoteIP(state.RemoteAddr).String())
+		}
+	}
+
+	if err != nil {
+		if bkd.config != nil && bkd.config.Reputation != nil {
+			bkd.config.Reputation.Record(remoteIP(state.RemoteAddr).String(), ReputationAuthFailure)
+		}
+
+		bkd.reportAbuse(remoteIP(state.RemoteAddr), BanAuthFailures)
+
+		if _, ok := err.(*smtp.SMTPError); !ok {
+			err = errInvalidCredentials
+		}
+
+		return nil, err
+	}
+
+	if err := bkd.checkConn(state); err != nil {
+		return nil, err
+	}
+
+	if err := bkd.checkReputation(state); err != nil {
+		return nil, err
+	}
+
+	session := bkd.newSession(state, &username, password)
+
+	if err := session.startHooks(mechanism, username); err != nil {
+		return nil, err
+	}
+
+	return session, nil
 }
 
 // AnonymousLogin requires clients to authenticate using SMTP AUTH before sending emails
 func (bkd *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return NewSession(state, bkd.handler, nil, nil), nil
+	bkd.tlsState(state)
+
+	if err := bkd.checkConn(state); err != nil {
+		return nil, err
+	}
+
+	if err := bkd.checkReputation(state); err != nil {
+		return nil, err
+	}
+
+	session := bkd.newSession(state, nil, nil)
+
+	if err := session.startHooks("", ""); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// checkConn refuses the implicit TLS clients refused at connect time, as their greeting can't be replaced
+func (bkd *Backend) checkConn(state *smtp.ConnectionState) error {
+	c := bkd.conns.get(state.RemoteAddr)
+	if c == nil {
+		return nil
+	}
+
+	reply := c.refusal
+	if reply == nil && c.policy != nil {
+		reply = c.policy.decide(remoteIP(state.RemoteAddr))
+	}
+
+	if reply == nil && c.reputation != nil {
+		reply = c.reputation.decide(remoteIP(state.RemoteAddr))
+	}
+
+	if reply == nil {
+		return nil
+	}
+
+	c.closeAfterReply()
+
+	return reply
+}
+
+// tlsState sets the TLS state of the connection, go-smtp doesn't know about the TLS sessions
+// as the connection terminates them itself (see conn.startTLS)
+func (bkd *Backend) tlsState(state *smtp.ConnectionState) {
+	if c := bkd.conns.get(state.RemoteAddr); c != nil && c.tls != nil {
+		state.TLS = c.tls.ConnectionState()
+	}
+}
+
+func (bkd *Backend) checkReputation(state *smtp.ConnectionState) error {
+	if bkd.config == nil || bkd.config.Reputation == nil {
+		return nil
+	}
+
+	if bkd.config.Reputation.Blocked(remoteIP(state.RemoteAddr).String()) {
+		return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Temporarily blocked due to poor reputation"}
+	}
+
+	return nil
+}
+
+// reportAbuse emits the abuse event and notifies the BanManager once the IP reached the ban threshold
+func (bkd *Backend) reportAbuse(ip net.IP, reason BanReason) {
+	if bkd.config == nil || ip == nil {
+		return
+	}
+
+	now := clockOrDefault(bkd.config.Clock).Now()
+
+	banned := bkd.config.BanManager != nil && bkd.abuse.hit(ip.String(), reason, bkd.config.BanThreshold, bkd.config.BanWindow, now)
+	if banned {
+		bkd.config.BanManager.Ban(ip, reason)
+	}
+
+	if bkd.config.OnAbuseEvent != nil {
+		bkd.config.OnAbuseEvent(AbuseEvent{Time: now, IP: ip, Reason: reason, Banned: banned})
+	}
+}
+
+func (bkd *Backend) isPaused() bool {
+	return atomic.LoadInt32(&bkd.paused) == 1
+}
+
+func (bkd *Backend) newSession(state *smtp.ConnectionState, username, password *string) *Session {
+	s := NewSession(state, bkd.handler, username, password)
+	s.backend = bkd
+
+	if c := bkd.conns.get(state.RemoteAddr); c != nil {
+		c.session = s
+	}
+
+	if bkd.config != nil {
+		s.config = bkd.config
+	}
+
+	return s
 }
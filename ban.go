@@ -0,0 +1,200 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanReason is the kind of abuse an IP got banned for
+type BanReason string
+
+const (
+	BanAuthFailures BanReason = "auth-failures"
+	BanHarvesting   BanReason = "harvesting"
+	BanDNSBL        BanReason = "dnsbl"
+
+	// BanProtocolErrors is reported when a connection gets dropped for exceeding ServerConfig.MaxErrors
+	BanProtocolErrors BanReason = "protocol-errors"
+)
+
+// BanManager is notified when an IP repeatedly abuses the server, so it can be blocked at the network level
+type BanManager interface {
+	Ban(ip net.IP, reason BanReason) error
+}
+
+// BanChecker is optionally implemented by the BanManagers keeping track of their bans,
+// the banned clients are disconnected as soon as they are accepted (see TempBanManager)
+type BanChecker interface {
+	Banned(ip net.IP) bool
+}
+
+// TempBanManager bans the IPs in memory for Duration (1 hour by default) and optionally
+// forwards the bans to Next (e.g: a CommandBanManager)
+type TempBanManager struct {
+	Duration time.Duration
+	Next     BanManager
+	Clock    Clock
+
+	mu   sync.Mutex
+	bans map[string]time.Time
+}
+
+// Ban implements BanManager
+func (m *TempBanManager) Ban(ip net.IP, reason BanReason) error {
+	duration := m.Duration
+	if duration <= 0 {
+		duration = time.Hour
+	}
+
+	now := clockOrDefault(m.Clock).Now()
+
+	m.mu.Lock()
+	if m.bans == nil {
+		m.bans = map[string]time.Time{}
+	}
+
+	for banned, until := range m.bans {
+		if !now.Before(until) {
+			delete(m.bans, banned)
+		}
+	}
+
+	m.bans[ip.String()] = now.Add(duration)
+	m.mu.Unlock()
+
+	if m.Next != nil {
+		return m.Next.Ban(ip, reason)
+	}
+
+	return nil
+}
+
+// Banned implements BanChecker
+func (m *TempBanManager) Banned(ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.bans[ip.String()]
+
+	return ok && clockOrDefault(m.Clock).Now().Before(until)
+}
+
+// Unban lifts the ban of ip (if any)
+func (m *TempBanManager) Unban(ip net.IP) {
+	m.mu.Lock()
+	delete(m.bans, ip.String())
+	m.mu.Unlock()
+}
+
+// LogBanManager writes fail2ban friendly lines, a matching failregex is:
+//
+//	^.* smtpsrv\[\d+\]: ban <HOST> reason=.*$
+type LogBanManager struct {
+	Writer io.Writer
+	Clock  Clock
+}
+
+// Ban implements BanManager
+func (m *LogBanManager) Ban(ip net.IP, reason BanReason) error {
+	w := m.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+
+	_, err := fmt.Fprintf(w, "%s smtpsrv[%d]: ban %s reason=%s\n", clockOrDefault(m.Clock).Now().Format("2006-01-02 15:04:05"), os.Getpid(), ip, reason)
+
+	return err
+}
+
+// CommandBanManager executes an external command (e.g. ipset) per ban,
+// the "{ip}" and "{reason}" placeholders of Args are replaced.
+type CommandBanManager struct {
+	Command string
+	Args    []string
+}
+
+// Ban implements BanManager
+func (m *CommandBanManager) Ban(ip net.IP, reason BanReason) error {
+	replacer := strings.NewReplacer("{ip}", ip.String(), "{reason}", string(reason))
+
+	args := make([]string, len(m.Args))
+	for i, arg := range m.Args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	return exec.Command(m.Command, args...).Run()
+}
+
+// HTTPBanManager posts {"ip": "...", "reason": "..."} to the specified URL
+type HTTPBanManager struct {
+	URL    string
+	Client *http.Client
+}
+
+// Ban implements BanManager
+func (m *HTTPBanManager) Ban(ip net.IP, reason BanReason) error {
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	body, err := json.Marshal(map[string]string{"ip": ip.String(), "reason": string(reason)})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(m.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("ban manager: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// abuseTracker counts the abuse events per IP and reason within a window
+type abuseTracker struct {
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+// hit records an event and reports whether the threshold got reached
+func (t *abuseTracker) hit(ip string, reason BanReason, threshold int, window time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.events == nil {
+		t.events = map[string][]time.Time{}
+	}
+
+	key := ip + "|" + string(reason)
+
+	recent := []time.Time{now}
+	for _, at := range t.events[key] {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= threshold {
+		delete(t.events, key)
+		return true
+	}
+
+	t.events[key] = recent
+
+	return false
+}
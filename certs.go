@@ -0,0 +1,175 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+)
+
+// CertificateStore holds a certificate/key pair loaded from disk that can be
+// reloaded while serving, e.g: after a Let's Encrypt renewal
+type CertificateStore struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// NewCertificateStore loads the specified certificate/key pair
+func NewCertificateStore(certFile, keyFile string) (*CertificateStore, error) {
+	store := &CertificateStore{}
+	if err := store.Load(certFile, keyFile); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Load replaces the certificate with the specified pair, the current one is
+// kept if loading fails
+func (s *CertificateStore) Load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.certFile, s.keyFile, s.cert = certFile, keyFile, &cert
+
+	return nil
+}
+
+// Reload reads the certificate/key files again
+func (s *CertificateStore) Reload() error {
+	s.mu.RLock()
+	certFile, keyFile := s.certFile, s.keyFile
+	s.mu.RUnlock()
+
+	return s.Load(certFile, keyFile)
+}
+
+// Certificate returns the current certificate, nil if none got loaded
+func (s *CertificateStore) Certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cert
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (s *CertificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Certificate(), nil
+}
+
+// CertificateProvider selects the certificate presented for the SNI server name
+// of a TLS handshake, a nil certificate falls back to the TLSConfig ones
+type CertificateProvider interface {
+	Certificate(serverName string) (*tls.Certificate, error)
+}
+
+// SNICertificates is a CertificateProvider keyed by domain, wildcard entries
+// (e.g: "*.example.org") match a single label
+type SNICertificates struct {
+	mu    sync.RWMutex
+	certs map[string]*CertificateStore
+}
+
+// Set sets (or replaces) the certificate of the specified domain
+func (p *SNICertificates) Set(domain string, store *CertificateStore) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.certs == nil {
+		p.certs = map[string]*CertificateStore{}
+	}
+
+	p.certs[strings.ToLower(domain)] = store
+}
+
+// Remove removes the certificate of the specified domain
+func (p *SNICertificates) Remove(domain string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.certs, strings.ToLower(domain))
+}
+
+// Certificate implements CertificateProvider
+func (p *SNICertificates) Certificate(serverName string) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil, nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	store := p.certs[name]
+	if store == nil {
+		if i := strings.Index(name, "."); i > 0 {
+			store = p.certs["*"+name[i:]]
+		}
+	}
+
+	if store == nil {
+		return nil, nil
+	}
+
+	return store.Certificate(), nil
+}
+
+// tlsConfig returns a copy of the specified config that serves the certificate picked
+// by the configured CertificateProvider or the one loaded by ReloadTLS, and the TLS
+// policy of the listener the connection was accepted on, it behaves like the original otherwise
+func (srv *Server) tlsConfig(base *tls.Config) *tls.Config {
+	wrapped := base.Clone()
+
+	if srv.config.SessionTickets != nil {
+		srv.config.SessionTickets.attach(wrapped)
+	}
+
+	wrapped.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var cert *tls.Certificate
+
+		// the listener config (if any) takes precedence over the server wide one
+		current := base
+		if t, ok := hello.Conn.(tlsTransport); ok && t.tlsConfig != nil {
+			current = t.tlsConfig
+		}
+
+		if srv.config.Certificates != nil {
+			var err error
+			if cert, err = srv.config.Certificates.Certificate(hello.ServerName); err != nil {
+				return nil, err
+			}
+		}
+
+		if cert == nil {
+			cert = srv.certs.Certificate()
+		}
+
+		if cert == nil {
+			if current.GetConfigForClient != nil {
+				return current.GetConfigForClient(hello)
+			}
+
+			if current == base {
+				return nil, nil
+			}
+
+			return current, nil
+		}
+
+		// the returned config keeps using the session ticket keys of the wrapped one
+		cfg := current.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.GetCertificate = nil
+		cfg.Certificates = []tls.Certificate{*cert}
+
+		return cfg, nil
+	}
+
+	return wrapped
+}
@@ -0,0 +1,137 @@
+package smtpsrv
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultLookupTimeout bounds the SPF, MX, reverse DNS and DNSBL checks when ServerConfig.LookupTimeout isn't set
+const DefaultLookupTimeout = 10 * time.Second
+
+// SenderChecks selects the checks started in the background right after MAIL FROM, so
+// they run concurrently with the rest of the transaction instead of delaying the replies,
+// Context.SPF and Context.Mailable then wait for their results
+type SenderChecks struct {
+	SPF bool
+	MX  bool
+
+	// ReverseDNS looks up the reverse DNS of the client once per connection
+	ReverseDNS bool
+}
+
+// spfCheck is the (pending) SPF result of a transaction
+type spfCheck struct {
+	done        chan struct{}
+	result      SPFResult
+	explanation string
+	err         error
+	recorded    bool
+}
+
+// mxCheck is the (pending) MX lookup of the sender domain
+type mxCheck struct {
+	done chan struct{}
+	ok   bool
+	err  error
+}
+
+func (s *Session) lookupTimeout() time.Duration {
+	return lookupTimeout(s.config)
+}
+
+func lookupTimeout(cfg *ServerConfig) time.Duration {
+	if cfg.LookupTimeout > 0 {
+		return cfg.LookupTimeout
+	}
+
+	return DefaultLookupTimeout
+}
+
+// startSPF starts the SPF check of the sender, bounded by the lookup timeout
+func (s *Session) startSPF() *spfCheck {
+	check := &spfCheck{done: make(chan struct{})}
+	s.spf = check
+
+	// the null sender is checked as postmaster@<helo> (RFC 7208 section 2.4)
+	sender := s.From.Address
+	if sender == "" {
+		sender = "postmaster@" + s.connState.Hostname
+	}
+
+	_, host, err := SplitAddress(sender)
+	if err != nil || host == "" {
+		check.result, check.err = SPFNone, err
+		close(check.done)
+		return check
+	}
+
+	checker := &SPFChecker{
+		Resolver: s.config.Resolver,
+		Helo:     s.connState.Hostname,
+		Receiver: s.config.BannerDomain,
+		Clock:    s.config.Clock,
+	}
+
+	ip := remoteIP(s.connState.RemoteAddr)
+	ctx, cancel := context.WithTimeout(s.context(), s.lookupTimeout())
+
+	go func() {
+		defer close(check.done)
+		defer cancel()
+
+		check.result, check.explanation, check.err = checker.Check(ctx, ip, host, sender)
+	}()
+
+	return check
+}
+
+// startMX starts the MX lookup of the sender domain, bounded by the lookup timeout
+func (s *Session) startMX() *mxCheck {
+	check := &mxCheck{done: make(chan struct{})}
+	s.mx = check
+
+	_, host, err := SplitAddress(s.From.Address)
+	if err != nil {
+		check.err = err
+		close(check.done)
+		return check
+	}
+
+	resolver := resolverOrDefault(s.config.Resolver)
+	ctx, cancel := context.WithTimeout(s.context(), s.lookupTimeout())
+
+	go func() {
+		defer close(check.done)
+		defer cancel()
+
+		check.ok, check.err = hasMX(ctx, resolver, host)
+	}()
+
+	return check
+}
+
+// startSenderChecks starts the configured background checks of the new sender, and the SPF
+// check of the SPFPolicy so it runs concurrently with the other checks of MAIL FROM
+func (s *Session) startSenderChecks() {
+	if s.From == nil || s.From.Address == "" {
+		return
+	}
+
+	checks := s.config.SenderChecks
+
+	if s.config.SPFPolicy != nil || checks != nil && checks.SPF {
+		s.startSPF()
+	}
+
+	if checks == nil {
+		return
+	}
+
+	if checks.MX {
+		s.startMX()
+	}
+
+	if checks.ReverseDNS && s.rdns == nil {
+		s.startReverseDNS()
+	}
+}
@@ -0,0 +1,139 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var replyVirusDetected = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Virus detected"}
+
+// clamdChunkSize is the size of the INSTREAM chunks, it has to stay below the StreamMaxLength of clamd
+const clamdChunkSize = 64 << 10
+
+// ClamAVFilter is a SpamFilter streaming the messages to clamd (INSTREAM command), the infected
+// messages are rejected with 554 and the signature is exposed through SpamVerdict.Virus
+type ClamAVFilter struct {
+	// Network and Addr locate clamd, tcp and 127.0.0.1:3310 by default (e.g: unix and /var/run/clamav/clamd.ctl)
+	Network string
+	Addr    string
+
+	// Quarantine delivers the infected messages with the X-Virus-Found header instead of rejecting them
+	Quarantine bool
+
+	// OnVirus (if set) is called for every infected message (e.g: for logging)
+	OnVirus func(envelope *SpamEnvelope, signature string)
+}
+
+// Check implements SpamFilter
+func (f *ClamAVFilter) Check(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error) {
+	signature, err := f.scan(ctx, message)
+	if err != nil || signature == "" {
+		return SpamVerdict{}, err
+	}
+
+	if f.OnVirus != nil {
+		f.OnVirus(envelope, signature)
+	}
+
+	if f.Quarantine {
+		return SpamVerdict{
+			Action:  SpamQuarantine,
+			Virus:   signature,
+			Headers: []SpamHeader{{Name: "X-Virus-Found", Value: "Yes"}, {Name: "X-Virus-Signature", Value: signature}},
+		}, nil
+	}
+
+	return SpamVerdict{Action: SpamReject, Virus: signature, Reply: replyVirusDetected}, nil
+}
+
+// scan returns the signature found in the message, empty if it is clean
+func (f *ClamAVFilter) scan(ctx context.Context, message io.Reader) (string, error) {
+	network, addr := f.Network, f.Addr
+	if network == "" {
+		network = "tcp"
+	}
+
+	if addr == "" {
+		addr = "127.0.0.1:3310"
+	}
+
+	var dialer net.Dialer
+
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriterSize(c, clamdChunkSize+4)
+
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+
+	for {
+		n, err := io.ReadFull(message, chunk)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+
+			// bufio.Writer errors are sticky, the second write reports the first one
+			w.Write(size[:])
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return "", err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// the zero length chunk ends the stream
+	if _, err := w.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(c).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply parses "stream: OK", "stream: <signature> FOUND" and "<reason> ERROR" replies
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+
+	return "", fmt.Errorf("clamd: %s", reply)
+}
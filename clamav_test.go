@@ -0,0 +1,171 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startClamd serves INSTREAM scans, the streams containing "EICAR" are infected, the
+// sizes of the received chunks are sent on chunks
+func startClamd(t *testing.T) (net.Listener, chan []int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make(chan []int, 10)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+
+				r := bufio.NewReader(c)
+
+				command, err := r.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					io.WriteString(c, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				var stream bytes.Buffer
+				var sizes []int
+
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(r, size[:]); err != nil {
+						return
+					}
+
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+
+					sizes = append(sizes, int(n))
+
+					if _, err := io.CopyN(&stream, r, int64(n)); err != nil {
+						return
+					}
+				}
+
+				chunks <- sizes
+
+				if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+					io.WriteString(c, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(c, "stream: OK\x00")
+				}
+			}(c)
+		}
+	}()
+
+	return l, chunks
+}
+
+func TestClamAVFilter(t *testing.T) {
+	l, chunks := startClamd(t)
+	defer l.Close()
+
+	envelope := &SpamEnvelope{ID: "1", From: "sender@example.com", To: []string{"rcpt@example.com"}}
+	infected := "Subject: test\r\n\r\nX5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*\r\n"
+
+	for _, tt := range []struct {
+		name       string
+		quarantine bool
+		message    string
+		action     SpamAction
+		virus      string
+		chunks     []int
+	}{
+		{"clean", false, "Subject: test\r\n\r\nhello\r\n", SpamAccept, "", []int{24}},
+		{"infected", false, infected, SpamReject, "Eicar-Test-Signature", []int{len(infected)}},
+		{"quarantine", true, infected, SpamQuarantine, "Eicar-Test-Signature", []int{len(infected)}},
+		{"chunked", false, strings.Repeat("a", clamdChunkSize+10), SpamAccept, "", []int{clamdChunkSize, 10}},
+		{"empty", false, "", SpamAccept, "", nil},
+	} {
+		var found string
+
+		filter := &ClamAVFilter{
+			Addr:       l.Addr().String(),
+			Quarantine: tt.quarantine,
+			OnVirus: func(e *SpamEnvelope, signature string) {
+				if e != envelope {
+					t.Errorf("%s: OnVirus called with %v", tt.name, e)
+				}
+
+				found = signature
+			},
+		}
+
+		verdict, err := filter.Check(context.Background(), envelope, strings.NewReader(tt.message))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if sizes := <-chunks; !equalInts(sizes, tt.chunks) {
+			t.Errorf("%s: chunks = %v, want %v", tt.name, sizes, tt.chunks)
+		}
+
+		if verdict.Action != tt.action || verdict.Virus != tt.virus || found != tt.virus {
+			t.Errorf("%s: verdict = %d %q (OnVirus %q), want %d %q", tt.name, verdict.Action, verdict.Virus, found, tt.action, tt.virus)
+		}
+
+		switch tt.action {
+		case SpamReject:
+			if verdict.Reply == nil || verdict.Reply.Code != 554 {
+				t.Errorf("%s: reply = %v, want 554", tt.name, verdict.Reply)
+			}
+		case SpamQuarantine:
+			if len(verdict.Headers) != 2 || verdict.Headers[0].Name != "X-Virus-Found" || verdict.Headers[1].Value != tt.virus {
+				t.Errorf("%s: headers = %v", tt.name, verdict.Headers)
+			}
+		default:
+			if verdict.Reply != nil || len(verdict.Headers) > 0 {
+				t.Errorf("%s: verdict = %+v, want none", tt.name, verdict)
+			}
+		}
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	for _, tt := range []struct {
+		reply, signature string
+		err              bool
+	}{
+		{"stream: OK\x00", "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND\x00", "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR\x00", "", true},
+		{"", "", true},
+	} {
+		signature, err := parseClamdReply(tt.reply)
+		if signature != tt.signature || (err != nil) != tt.err {
+			t.Errorf("parseClamdReply(%q) = %q, %v", tt.reply, signature, err)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
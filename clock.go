@@ -0,0 +1,31 @@
+package smtpsrv
+
+import "time"
+
+// Clock is the time source of the server and its policies, replace it to
+// advance time deterministically in tests or to replay traffic.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the real clock, it is the default everywhere
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+
+	return c
+}
@@ -0,0 +1,131 @@
+// Command smtpsrv is a reference smtp server built on the smtpsrv package, it spools the
+// received messages to a directory and can run directly under systemd:
+//
+//	smtpsrv -addr :25 -user smtpsrv -pidfile /run/smtpsrv.pid -spool /var/spool/smtpsrv
+//
+// SIGHUP reloads the TLS certificate and the directory, SIGTERM shuts the server down gracefully.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+func main() {
+	addr := flag.String("addr", ":25", "the smtp (STARTTLS) listen address")
+	smtpsAddr := flag.String("smtps-addr", "", "the smtps (implicit TLS) listen address, requires -cert and -key")
+	banner := flag.String("banner", "localhost", "the domain announced in the greeting")
+	certFile := flag.String("cert", "", "the TLS certificate file")
+	keyFile := flag.String("key", "", "the TLS key file")
+	directoryFile := flag.String("directory", "", "the file listing the local mailboxes (see smtpsrv.FileDirectory)")
+	spool := flag.String("spool", ".", "the directory the received messages are written to")
+	maxSize := flag.Int("max-size", 10<<20, "the maximum message size in bytes")
+	pidFile := flag.String("pidfile", "", "the file the process id is written to, it is removed on exit when -user can delete it")
+	username := flag.String("user", "", "the user to switch to once the listeners are bound")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long the active connections get to finish on SIGTERM")
+	flag.Parse()
+
+	cfg := &smtpsrv.ServerConfig{
+		ListenAddr:      *addr,
+		BannerDomain:    *banner,
+		MaxMessageBytes: *maxSize,
+		Handler:         spoolHandler(*spool),
+	}
+
+	var directory *smtpsrv.FileDirectory
+	if *directoryFile != "" {
+		var err error
+		if directory, err = smtpsrv.NewFileDirectory(*directoryFile); err != nil {
+			log.Fatal(err)
+		}
+
+		cfg.Directory = directory
+	}
+
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	srv := smtpsrv.NewServer(cfg)
+
+	// the listeners are bound before dropping the privileges, port 25 and 465 require root
+	listeners := []smtpsrv.ListenerConfig{{Addr: *addr}}
+	if *smtpsAddr != "" {
+		listeners = append(listeners, smtpsrv.ListenerConfig{Addr: *smtpsAddr, ImplicitTLS: true})
+	}
+
+	bound := make([]net.Listener, len(listeners))
+	for i, lc := range listeners {
+		l, err := net.Listen("tcp", lc.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bound[i] = l
+	}
+
+	if *pidFile != "" {
+		remove, err := smtpsrv.WritePIDFile(*pidFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer remove()
+	}
+
+	if *username != "" {
+		if err := smtpsrv.DropPrivileges(*username); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for i, lc := range listeners {
+		go func(l net.Listener, lc smtpsrv.ListenerConfig) {
+			if err := srv.ServeListener(l, lc); err != nil && err != smtpsrv.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(bound[i], lc)
+	}
+
+	err := srv.HandleSignals(*shutdownTimeout, func() {
+		if *certFile != "" {
+			if err := srv.ReloadTLS(*certFile, *keyFile); err != nil {
+				log.Println("reloading the TLS certificate:", err)
+			}
+		}
+
+		if directory != nil {
+			if err := directory.Reload(); err != nil {
+				log.Println("reloading the directory:", err)
+			}
+		}
+	})
+
+	if err != nil {
+		log.Println("shutdown:", err)
+	}
+}
+
+// spoolHandler writes every message to its own file named after the session id
+func spoolHandler(dir string) smtpsrv.HandlerFunc {
+	return func(c *smtpsrv.Context) error {
+		data, err := c.Raw()
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(filepath.Join(dir, c.ID()+".eml"), data, 0600)
+	}
+}
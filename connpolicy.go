@@ -0,0 +1,119 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// connectionPolicy is the (lazily computed) ServerConfig.ConnectionPolicy and ServerConfig.OnConnect
+// decision of a connection
+type connectionPolicy struct {
+	once  sync.Once
+	fn    ConnectionPolicyFunc
+	score float64
+	reply *smtp.SMTPError
+}
+
+// decide runs the policy once and returns the reply refusing the client, nil if it is accepted
+func (p *connectionPolicy) decide(ip net.IP) *smtp.SMTPError {
+	p.once.Do(func() {
+		score, err := p.fn(ip)
+		p.score = score
+
+		if err == nil {
+			return
+		}
+
+		if e, ok := toSMTPError(err).(*smtp.SMTPError); ok {
+			p.reply = e
+		} else {
+			p.reply = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Connection policy failed, try again later"}
+		}
+	})
+
+	return p.reply
+}
+
+// connectHooks combines ServerConfig.ConnectionPolicy and ServerConfig.OnConnect
+func connectHooks(cfg *ServerConfig, addr net.Addr) ConnectionPolicyFunc {
+	return func(ip net.IP) (float64, error) {
+		score := 0.0
+
+		if cfg.ConnectionPolicy != nil {
+			var err error
+			if score, err = cfg.ConnectionPolicy(ip); err != nil {
+				return score, err
+			}
+		}
+
+		if cfg.OnConnect != nil {
+			return score, cfg.OnConnect(addr)
+		}
+
+		return score, nil
+	}
+}
+
+// CountryLookup returns the ISO code of the country of an address, empty if it is unknown
+type CountryLookup interface {
+	Country(ip net.IP) (string, error)
+}
+
+// ASNLookup returns the autonomous system number and organization of an address, 0 if it is
+// unknown
+type ASNLookup interface {
+	ASN(ip net.IP) (uint, string, error)
+}
+
+// GeoIPPolicy refuses or scores the clients by country and autonomous system, its Check
+// method is a ConnectionPolicyFunc
+type GeoIPPolicy struct {
+	// Countries (if set) looks up the country of the clients, e.g: a GeoIP2/GeoLite2 Country
+	// or City database opened with the maxmind subpackage
+	Countries CountryLookup
+
+	// ASNs (if set) looks up the autonomous system of the clients, e.g: a GeoLite2 ASN database
+	ASNs ASNLookup
+
+	// DenyCountries (ISO codes) and DenyASNs are replied "554 5.7.1 Access denied"
+	DenyCountries []string
+	DenyASNs      []uint
+
+	// CountryScores and ASNScores are added to the connection score (see Context.ConnectionScore)
+	CountryScores map[string]float64
+	ASNScores     map[uint]float64
+}
+
+// Check implements ConnectionPolicyFunc, the clients that can't be looked up are accepted
+func (p *GeoIPPolicy) Check(ip net.IP) (float64, error) {
+	score := 0.0
+
+	if p.Countries != nil {
+		country, err := p.Countries.Country(ip)
+		if err == nil && country != "" {
+			if containsFold(p.DenyCountries, country) {
+				return score, replyAccessDenied
+			}
+
+			score += p.CountryScores[strings.ToUpper(country)]
+		}
+	}
+
+	if p.ASNs != nil {
+		asn, _, err := p.ASNs.ASN(ip)
+		if err == nil && asn != 0 {
+			for _, denied := range p.DenyASNs {
+				if asn == denied {
+					return score, replyAccessDenied
+				}
+			}
+
+			score += p.ASNScores[asn]
+		}
+	}
+
+	return score, nil
+}
@@ -0,0 +1,66 @@
+package smtpsrv
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// geoTable is a CountryLookup and ASNLookup keyed by address
+type geoTable map[string]struct {
+	country string
+	asn     uint
+}
+
+func (g geoTable) Country(ip net.IP) (string, error) {
+	entry, ok := g[ip.String()]
+	if !ok {
+		return "", errors.New("not found")
+	}
+
+	return entry.country, nil
+}
+
+func (g geoTable) ASN(ip net.IP) (uint, string, error) {
+	entry, ok := g[ip.String()]
+	if !ok {
+		return 0, "", errors.New("not found")
+	}
+
+	return entry.asn, "", nil
+}
+
+func TestGeoIPPolicy(t *testing.T) {
+	table := geoTable{
+		"192.0.2.1":    {"fr", 64496},
+		"192.0.2.2":    {"KP", 64497},
+		"192.0.2.3":    {"US", 64666},
+		"198.51.100.1": {"DE", 0},
+	}
+
+	policy := &GeoIPPolicy{
+		Countries:     table,
+		ASNs:          table,
+		DenyCountries: []string{"kp"},
+		DenyASNs:      []uint{64666},
+		CountryScores: map[string]float64{"FR": 1.5},
+		ASNScores:     map[uint]float64{64496: 2},
+	}
+
+	for _, tt := range []struct {
+		ip     string
+		score  float64
+		denied bool
+	}{
+		{"192.0.2.1", 3.5, false},
+		{"192.0.2.2", 0, true},
+		{"192.0.2.3", 0, true},
+		{"198.51.100.1", 0, false},
+		{"203.0.113.1", 0, false},
+	} {
+		score, err := policy.Check(net.ParseIP(tt.ip))
+		if (err != nil) != tt.denied || !tt.denied && score != tt.score {
+			t.Errorf("Check(%s) = %v, %v, want %v (denied: %v)", tt.ip, score, err, tt.score, tt.denied)
+		}
+	}
+}
@@ -1,17 +1,27 @@
 package smtpsrv
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net"
 	"net/mail"
-
-	"github.com/zaccone/spf"
+	"strings"
+	"time"
 )
 
 type Context struct {
 	session *Session
 }
 
+// ID returns the tracing ID of the message, it is added as the X-SMTPSRV-ID
+// header and returned to the client in the 250 reply
+func (c Context) ID() string {
+	return c.session.id
+}
+
 func (c Context) From() *mail.Address {
 	return c.session.From
 }
@@ -20,11 +30,160 @@ func (c Context) To() *mail.Address {
 	return c.session.To
 }
 
+// Recipients returns the number of recipients accepted in the transaction
+func (c Context) Recipients() int {
+	return c.session.rcpts
+}
+
+// Destinations returns the envelope recipients of the message once the aliases are expanded
+// (see ServerConfig.Aliases), each one once
+func (c Context) Destinations() []string {
+	return c.session.destinations
+}
+
+// RcptTo returns the addresses accepted by RCPT TO in the transaction, in order
+func (c Context) RcptTo() []string {
+	rcpts := make([]string, 0, len(c.session.accepted))
+	for _, rcpt := range c.session.accepted {
+		rcpts = append(rcpts, rcpt.address)
+	}
+
+	return rcpts
+}
+
+// TruncatedRecipients returns the number of recipients refused because of ServerConfig.MaxRecipients,
+// the client is expected to send the message again to them
+func (c Context) TruncatedRecipients() int {
+	return c.session.truncatedRcpts
+}
+
+// RouteMatches returns the capture groups of the Mux regexp route of the recipient (the whole match
+// first, as regexp.FindStringSubmatch does), nil if it wasn't routed by a regexp
+func (c Context) RouteMatches() []string {
+	if c.session.route == nil || c.session.route.pattern == nil || c.session.To == nil {
+		return nil
+	}
+
+	return c.session.route.pattern.FindStringSubmatch(c.session.To.Address)
+}
+
+// CatchAll returns the recipients unknown to the Directory accepted by a Mux catch-all route
+// (see Mux.HandleCatchAll), as the client specified them
+func (c Context) CatchAll() []string {
+	return c.session.catchAll
+}
+
+// Subaddress returns the subaddress of the recipient local part (e.g: "1234" of "support+1234@example.com"),
+// empty if there is none
+func (c Context) Subaddress() string {
+	if c.session.To == nil {
+		return ""
+	}
+
+	local, _, _ := SplitAddress(c.session.To.Address)
+	_, subaddress := SplitSubaddress(local)
+
+	return subaddress
+}
+
+// Mailbox returns the Directory entry of the recipient, nil if no Directory is configured
+func (c Context) Mailbox() *Mailbox {
+	return c.session.mailbox
+}
+
+// RequireTLS reports whether the client sent the REQUIRETLS (RFC 8689) MAIL parameter,
+// the message must then never be relayed over an unencrypted or unverified connection
+func (c Context) RequireTLS() bool {
+	return c.session.requireTLS
+}
+
+// DSN returns the delivery status notification parameters (NOTIFY and ORCPT) of the
+// last recipient (see To), nil if the client didn't specify any, see RecipientDSN
+func (c Context) DSN() *DSNRecipient {
+	if len(c.session.accepted) < 1 {
+		return nil
+	}
+
+	return c.session.accepted[len(c.session.accepted)-1].dsn
+}
+
+// RecipientDSN returns the delivery status notification parameters of the specified
+// recipient (see RcptTo), nil if the client didn't specify any
+func (c Context) RecipientDSN(address string) *DSNRecipient {
+	for _, rcpt := range c.session.accepted {
+		if strings.EqualFold(rcpt.address, address) {
+			return rcpt.dsn
+		}
+	}
+
+	return nil
+}
+
+// DSNEnvelope returns the delivery status notification parameters of MAIL (RET and ENVID),
+// nil if the client didn't specify any
+func (c Context) DSNEnvelope() *DSNEnvelope {
+	return c.session.dsnEnvelope
+}
+
+// MailParam returns the value of a MAIL FROM parameter of an extension (see MailParamExtension)
+// and whether the client gave it
+func (c Context) MailParam(name string) (string, bool) {
+	value, ok := c.session.mailParams[strings.ToUpper(name)]
+	return value, ok
+}
+
+// ReleaseTime returns the time the client asked the message to be released at (see
+// FutureReleasePolicy), zero unless the message is held
+func (c Context) ReleaseTime() time.Time {
+	return c.session.release
+}
+
+// DeliverBy returns the DELIVERBY request of the message (see DeliverByPolicy), nil if the
+// client didn't make any
+func (c Context) DeliverBy() *DeliverBy {
+	return c.session.deliverBy
+}
+
+// Priority returns the MT-PRIORITY of the message (see MTPriorityPolicy), lowered to what
+// the user may ask for, 0 if the client didn't set any
+func (c Context) Priority() int {
+	return c.session.priority
+}
+
+// BODY values (RFC 6152), see Context.BodyType
+const (
+	BodyType7Bit     = "7BIT"
+	BodyType8BitMIME = "8BITMIME"
+)
+
+// BodyType returns the BODY MAIL FROM parameter (RFC 6152): BodyType7Bit or BodyType8BitMIME,
+// empty if the client didn't give it. The message is handed as received either way, 8-bit
+// content included
+func (c Context) BodyType() string {
+	return c.session.bodyType
+}
+
+// Disposable reports whether the sender (MAIL FROM) uses a disposable email provider
+func (c Context) Disposable() bool {
+	return c.session.disposableFrom
+}
+
+// DisposableRecipient reports whether a recipient uses a disposable email provider
+func (c Context) DisposableRecipient() bool {
+	return c.session.disposableTo
+}
+
+// User returns the authenticated username and password, the password is
+// empty for challenge/response mechanisms such as CRAM-MD5
 func (c Context) User() (string, string, error) {
-	if c.session.username == nil || c.session.password == nil {
+	if c.session.username == nil {
 		return "", "", ErrAuthDisabled
 	}
 
+	if c.session.password == nil {
+		return *c.session.username, "", nil
+	}
+
 	return *c.session.username, *c.session.password, nil
 }
 
@@ -36,32 +195,245 @@ func (c Context) TLS() *tls.ConnectionState {
 	return &c.session.connState.TLS
 }
 
+// DMARC returns the DMARC evaluation of the message, nil if no DMARCVerifier is configured
+// or the message has no usable From header
+func (c Context) DMARC() *DMARCResult {
+	return c.session.dmarc
+}
+
+// TLSInfo summarizes the TLS session (version, cipher, SNI, resumption, peer certificates),
+// nil on unencrypted connections
+func (c Context) TLSInfo() *TLSInfo {
+	return NewTLSInfo(&c.session.connState.TLS)
+}
+
+// ClientCertificate returns the verified TLS client certificate, nil if the client didn't
+// present one or TLSConfig.ClientAuth doesn't verify it
+func (c Context) ClientCertificate() *x509.Certificate {
+	return clientCertificate(&c.session.connState.TLS)
+}
+
+// ClientCertificateChains returns the verified chains of the TLS client certificate
+func (c Context) ClientCertificateChains() [][]*x509.Certificate {
+	return c.session.connState.TLS.VerifiedChains
+}
+
+// Header returns the message header when it was already read (i.e. OnHeaders is set), nil otherwise
+func (c Context) Header() mail.Header {
+	return c.session.header
+}
+
 func (c Context) Read(p []byte) (int, error) {
 	return c.session.body.Read(p)
 }
 
+// Parse parses the message, the nested messages are parsed up to ServerConfig.MaxMessageDepth
 func (c Context) Parse() (*Email, error) {
-	return ParseEmail(c.session.body)
+	depth := c.session.config.MaxMessageDepth
+	if depth == 0 {
+		depth = DefaultMessageDepth
+	}
+
+	return ParseEmailDepth(c.session.body, depth)
 }
 
-func (c Context) Mailable() (bool, error) {
-	_, host, err := SplitAddress(c.From().Address)
-	if err != nil {
-		return false, err
+// Raw returns the message exactly as received (without the tracing header), it buffers the
+// message on the first call and rewinds the body so Read, Parse ... can still be used afterwards,
+// call it before consuming the body
+func (c Context) Raw() ([]byte, error) {
+	if c.session.raw == nil {
+		data, err := ioutil.ReadAll(c.session.body)
+		if err != nil {
+			return nil, err
+		}
+
+		c.session.raw = data
+		c.session.body = bytes.NewReader(data)
 	}
 
-	mxhosts, err := net.LookupMX(host)
+	if len(c.session.raw) < c.session.traceLen {
+		return c.session.raw, nil
+	}
+
+	return c.session.raw[c.session.traceLen:], nil
+}
+
+// Message parses the message and returns it along with its envelope, ready to be
+// marshaled as JSON (e.g: by webhook handlers)
+func (c Context) Message() (*ReceivedMessage, error) {
+	email, err := c.Parse()
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	msg := &ReceivedMessage{
+		ID:      c.ID(),
+		Message: email,
+		Envelope: Envelope{
+			TLS: c.TLS().HandshakeComplete,
+		},
+	}
+
+	if from := c.From(); from != nil {
+		msg.Envelope.MailFrom = from.Address
+	}
+
+	if to := c.To(); to != nil {
+		msg.Envelope.RcptTo = to.Address
+	}
+
+	if addr := c.RemoteAddr(); addr != nil {
+		msg.Envelope.RemoteAddr = addr.String()
+	}
+
+	if user, _, err := c.User(); err == nil {
+		msg.Envelope.User = user
+	}
+
+	return msg, nil
+}
+
+// WalkAttachments streams the attachments of the message straight from the connection,
+// like Parse it consumes the message body
+func (c Context) WalkAttachments(fn AttachmentWalkFunc) error {
+	return WalkAttachments(c.session.body, fn)
+}
+
+// VERPRecipient decodes the original recipient of a bounce sent to a VERP return path
+func (c Context) VERPRecipient() (string, error) {
+	if c.To() == nil {
+		return "", ErrNotVERP
+	}
+
+	_, rcpt, err := VERPDecode(c.To().Address)
+
+	return rcpt, err
+}
+
+// Mailable reports whether the sender domain has MX records, the lookup is done once per
+// transaction (possibly in the background, see ServerConfig.SenderChecks)
+func (c Context) Mailable() (bool, error) {
+	check := c.session.mx
+	if check == nil {
+		check = c.session.startMX()
+	}
+
+	<-check.done
+
+	return check.ok, check.err
+}
+
+// ReverseDNS returns the reverse DNS of the client and whether it is forward-confirmed (FCrDNS),
+// it is looked up once per connection (possibly in the background, see ServerConfig.SenderChecks)
+func (c Context) ReverseDNS() *ReverseDNS {
+	check := c.session.rdns
+	if check == nil {
+		check = c.session.startReverseDNS()
+	}
+
+	<-check.done
+
+	return check.result
+}
+
+// HeloFailures returns the HeloPolicy checks the EHLO/HELO hostname of the client failed
+func (c Context) HeloFailures() []HeloCheck {
+	return c.session.heloFailures
+}
+
+// Helo returns the hostname the client announced with EHLO/HELO
+func (c Context) Helo() string {
+	return c.session.connState.Hostname
+}
+
+// Quarantine returns the reason a milter quarantined the message for, empty if it didn't
+func (c Context) Quarantine() string {
+	return c.session.quarantine
+}
+
+// Context returns the context of the connection, it is cancelled once the connection is closed,
+// the lookups and the filters of the session honor it
+func (c Context) Context() context.Context {
+	return c.session.context()
+}
+
+// SpamVerdict returns the ServerConfig.SpamFilter verdict of the message, nil if no filter is configured
+func (c Context) SpamVerdict() *SpamVerdict {
+	return c.session.spam
+}
+
+// ReputationChecks returns the ServerConfig.ReputationProvider scores of the client, the
+// connect time one (if any) first
+func (c Context) ReputationChecks() []ReputationCheck {
+	return c.session.reputationChecks()
+}
+
+// ConnectionScore returns the score given to the client by ServerConfig.ConnectionPolicy
+func (c Context) ConnectionScore() float64 {
+	conn := c.session.conn()
+	if conn == nil || conn.policy == nil {
+		return 0
+	}
+
+	conn.policy.decide(remoteIP(c.session.connState.RemoteAddr))
+
+	return conn.policy.score
+}
+
+// DNSBL returns the DNS blocklists (see ServerConfig.DNSBL) listing the client
+func (c Context) DNSBL() []DNSBLResult {
+	if !dnsListsEnabled(c.session.config) {
+		return nil
 	}
 
-	return len(mxhosts) > 0, nil
+	return c.session.dnsbl().results
 }
+
+// DNSWL returns the DNS allowlists (see ServerConfig.DNSWL) listing the client
+func (c Context) DNSWL() []DNSWLResult {
+	if !dnsListsEnabled(c.session.config) {
+		return nil
+	}
+
+	return c.session.dnsbl().allowed
+}
+
+// Allowlisted reports whether a DNS allowlist lists the client
+func (c Context) Allowlisted() bool {
+	return c.session.allowlisted()
+}
+
+// SPF checks the SPF policy of the sender domain, the result is computed once per transaction
+// (possibly in the background, see ServerConfig.SenderChecks), a timeout is a temperror
 func (c Context) SPF() (SPFResult, string, error) {
-	_, host, err := SplitAddress(c.From().Address)
-	if err != nil {
-		return spf.None, "", err
+	check := c.session.spf
+	if check == nil {
+		check = c.session.startSPF()
 	}
 
-	return spf.CheckHost(net.ParseIP(c.RemoteAddr().String()), host, c.From().Address)
+	<-check.done
+
+	if !check.recorded {
+		check.recorded = true
+
+		switch check.result {
+		case SPFPass:
+			c.session.recordReputation(ReputationSPFPass)
+		case SPFFail, SPFSoftfail:
+			c.session.recordReputation(ReputationSPFFail)
+		}
+	}
+
+	return check.result, check.explanation, check.err
+}
+
+// Reputation returns the reputation score of the remote IP, zero when no Reputation is configured
+func (c Context) Reputation() float64 {
+	if c.session.config.Reputation == nil {
+		return 0
+	}
+
+	score, _ := c.session.config.Reputation.ScoreOf(remoteIP(c.RemoteAddr()).String())
+
+	return score
 }
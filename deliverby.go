@@ -0,0 +1,99 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DELIVERBY modes (RFC 2852 section 4)
+const (
+	DeliverByNotify = "N"
+	DeliverByReturn = "R"
+)
+
+var errBadDeliverBy = &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Invalid BY parameter"}
+
+// DeliverByPolicy enables the DELIVERBY extension (RFC 2852): the clients set, with the BY MAIL
+// FROM parameter, a deadline for the delivery of their message, see Context.DeliverBy
+type DeliverByPolicy struct {
+	// MinTime (if set) is the shortest deadline accepted in return mode, it is advertised
+	MinTime time.Duration
+}
+
+// DeliverBy is the DELIVERBY request of a message
+type DeliverBy struct {
+	// Deadline is the time the message has to be delivered by
+	Deadline time.Time
+
+	// Mode is what happens once the deadline passed: DeliverByReturn (the message is returned
+	// as undeliverable) or DeliverByNotify (a delay DSN is sent and the delivery goes on)
+	Mode string
+
+	// Trace asks for a DSN reporting the delivery
+	Trace bool
+}
+
+// deliverBy is the Extension of DeliverByPolicy
+type deliverBy struct {
+	policy *DeliverByPolicy
+	clock  Clock
+}
+
+func (d deliverBy) Keyword() string {
+	if d.policy.MinTime < time.Second {
+		return "DELIVERBY"
+	}
+
+	return fmt.Sprintf("DELIVERBY %d", int64(d.policy.MinTime/time.Second))
+}
+
+func (d deliverBy) MailParams() []string {
+	return []string{"BY"}
+}
+
+// Mail parses BY=<seconds>;<mode>[T], the deadline is counted from MAIL FROM
+func (d deliverBy) Mail(c *Context, params map[string]string) error {
+	c.session.deliverBy = nil
+
+	value, ok := params["BY"]
+	if !ok {
+		return nil
+	}
+
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 || len(strings.TrimPrefix(parts[0], "-")) > 9 {
+		return errBadDeliverBy
+	}
+
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errBadDeliverBy
+	}
+
+	by := &DeliverBy{Deadline: d.clock.Now().Add(time.Duration(seconds) * time.Second)}
+
+	mode := strings.ToUpper(parts[1])
+	if strings.HasSuffix(mode, "T") {
+		by.Trace, mode = true, mode[:len(mode)-1]
+	}
+
+	switch mode {
+	case DeliverByNotify:
+	case DeliverByReturn:
+		// the return mode needs time to deliver (RFC 2852 section 4)
+		if seconds < 1 || time.Duration(seconds)*time.Second < d.policy.MinTime {
+			return errBadDeliverBy
+		}
+	default:
+		return errBadDeliverBy
+	}
+
+	by.Mode = mode
+	c.session.deliverBy = by
+
+	return nil
+}
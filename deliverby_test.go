@@ -0,0 +1,52 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliverBy(t *testing.T) {
+	requests := make(chan *DeliverBy, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Clock:     frozenClock{},
+		DeliverBy: &DeliverByPolicy{MinTime: time.Minute},
+		Handler: func(c *Context) error {
+			requests <- c.DeliverBy()
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); !strings.Contains(ehlo, "DELIVERBY 60") {
+		t.Fatalf("DELIVERBY isn't advertised:\n%s", ehlo)
+	}
+
+	for _, by := range []string{"120", "120;X", "30;R", "-10;R", "0;R", "1234567890;N", "soon;N"} {
+		c.expectCmd("MAIL FROM:<sender@example.org> BY="+by, 501)
+	}
+
+	for _, tt := range []struct {
+		params string
+		want   *DeliverBy
+	}{
+		{"BY=120;R", &DeliverBy{Deadline: time.Unix(120, 0), Mode: DeliverByReturn}},
+		{"BY=-10;nt", &DeliverBy{Deadline: time.Unix(-10, 0), Mode: DeliverByNotify, Trace: true}},
+		{"", nil},
+	} {
+		c.expectCmd("MAIL FROM:<sender@example.org> "+tt.params, 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write("Subject: hi\r\n\r\nhello\r\n.\r\n")
+		c.expect(250)
+
+		got := <-requests
+		if (got == nil) != (tt.want == nil) || got != nil && (!got.Deadline.Equal(tt.want.Deadline) || got.Mode != tt.want.Mode || got.Trace != tt.want.Trace) {
+			t.Errorf("%q: DeliverBy() = %+v, want %+v", tt.params, got, tt.want)
+		}
+	}
+}
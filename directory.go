@@ -0,0 +1,246 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Mailbox is what a Directory knows about a single address
+type Mailbox struct {
+	Address     string
+	Exists      bool
+	DisplayName string
+
+	// Quota is the mailbox size limit in bytes (0 means unlimited) and Used is the current usage
+	Quota int64
+	Used  int64
+
+	// Aliases are the addresses this address resolves to when it is an alias
+	Aliases []string
+}
+
+// Directory is the single source of truth about the local users, Lookup may return ErrNoSuchUser
+// for the unknown addresses (550) and an SMTPError to choose the reply of the temporary failures (451 by default)
+type Directory interface {
+	Lookup(address string) (*Mailbox, error)
+}
+
+var errMailboxFull = &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Mailbox full"}
+
+// checkQuota reads the message and refuses it if it doesn't fit the quota of a recipient mailbox
+// (the SIZE parameter of MAIL is optional), it returns the reader replaying the message
+func (s *Session) checkQuota(r io.Reader) (io.Reader, error) {
+	limited := false
+	for _, rcpt := range s.accepted {
+		limited = limited || rcpt.mailbox != nil && rcpt.mailbox.Quota > 0
+	}
+
+	if !limited {
+		return r, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rcpt := range s.accepted {
+		if rcpt.mailbox != nil && !rcpt.mailbox.Fits(int64(len(data))) {
+			return nil, errMailboxFull
+		}
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// Fits reports whether a message of the specified size fits into the mailbox quota
+func (m *Mailbox) Fits(size int64) bool {
+	return m.Quota < 1 || m.Used+size <= m.Quota
+}
+
+// FileDirectory is a Directory loaded from a text file, one mailbox per line:
+//
+//	john@example.com name="John Doe" quota=104857600
+//	sales@example.com alias=john@example.com,jane@example.com
+//
+// empty lines and lines starting with # are ignored.
+type FileDirectory struct {
+	Filename string
+
+	mu        sync.RWMutex
+	mailboxes map[string]*Mailbox
+}
+
+// NewFileDirectory loads the specified file
+func NewFileDirectory(filename string) (*FileDirectory, error) {
+	d := &FileDirectory{Filename: filename}
+
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Reload re-reads the underlying file
+func (d *FileDirectory) Reload() error {
+	f, err := os.Open(d.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mailboxes := map[string]*Mailbox{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		mailbox := parseDirectoryLine(line)
+		mailboxes[strings.ToLower(mailbox.Address)] = mailbox
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.mailboxes = mailboxes
+	d.mu.Unlock()
+
+	return nil
+}
+
+// Lookup implements Directory
+func (d *FileDirectory) Lookup(address string) (*Mailbox, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	mailbox, ok := d.mailboxes[strings.ToLower(address)]
+	if !ok {
+		return &Mailbox{Address: address}, nil
+	}
+
+	found := *mailbox
+
+	return &found, nil
+}
+
+func parseDirectoryLine(line string) *Mailbox {
+	mailbox := &Mailbox{Exists: true}
+
+	fields := splitDirectoryFields(line)
+	mailbox.Address = fields[0]
+
+	for _, field := range fields[1:] {
+		sepInd := strings.Index(field, "=")
+		if sepInd == -1 {
+			continue
+		}
+
+		key, value := strings.ToLower(field[:sepInd]), strings.Trim(field[sepInd+1:], "\"")
+
+		switch key {
+		case "name":
+			mailbox.DisplayName = value
+		case "quota":
+			mailbox.Quota, _ = strconv.ParseInt(value, 10, 64)
+		case "used":
+			mailbox.Used, _ = strconv.ParseInt(value, 10, 64)
+		case "alias":
+			mailbox.Aliases = splitAliases(value)
+		}
+	}
+
+	return mailbox
+}
+
+// splitDirectoryFields splits on whitespace, honoring double quoted values
+func splitDirectoryFields(line string) []string {
+	fields := []string{}
+	quoted := false
+	current := ""
+
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current += string(r)
+		case (r == ' ' || r == '\t') && !quoted:
+			if current != "" {
+				fields = append(fields, current)
+				current = ""
+			}
+		default:
+			current += string(r)
+		}
+	}
+
+	if current != "" {
+		fields = append(fields, current)
+	}
+
+	return fields
+}
+
+func splitAliases(value string) []string {
+	aliases := []string{}
+
+	for _, alias := range strings.Split(value, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	return aliases
+}
+
+// DefaultSQLDirectoryQuery is the query used by SQLDirectory when none is specified
+const DefaultSQLDirectoryQuery = "SELECT display_name, quota, used, aliases FROM mailboxes WHERE address = ?"
+
+// SQLDirectory is a Directory backed by an SQL database, the query receives
+// the (lower cased) address and must select the display name, quota, used
+// bytes and a comma separated aliases list; no rows means no such mailbox.
+type SQLDirectory struct {
+	DB    *sql.DB
+	Query string
+}
+
+// Lookup implements Directory
+func (d *SQLDirectory) Lookup(address string) (*Mailbox, error) {
+	query := d.Query
+	if query == "" {
+		query = DefaultSQLDirectoryQuery
+	}
+
+	var name, aliases sql.NullString
+	var quota, used sql.NullInt64
+
+	err := d.DB.QueryRow(query, strings.ToLower(address)).Scan(&name, &quota, &used, &aliases)
+	if err == sql.ErrNoRows {
+		return &Mailbox{Address: address}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Mailbox{
+		Address:     address,
+		Exists:      true,
+		DisplayName: name.String,
+		Quota:       quota.Int64,
+		Used:        used.Int64,
+		Aliases:     splitAliases(aliases.String),
+	}, nil
+}
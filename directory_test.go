@@ -0,0 +1,53 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+)
+
+type directoryFunc func(address string) (*Mailbox, error)
+
+func (f directoryFunc) Lookup(address string) (*Mailbox, error) {
+	return f(address)
+}
+
+func TestMailboxFits(t *testing.T) {
+	for _, tt := range []struct {
+		quota, used, size int64
+		want              bool
+	}{
+		{0, 500, 1000, true},
+		{100, 50, 50, true},
+		{100, 50, 51, false},
+		{100, 100, 1, false},
+	} {
+		m := &Mailbox{Quota: tt.quota, Used: tt.used}
+		if got := m.Fits(tt.size); got != tt.want {
+			t.Errorf("Fits(%d) with quota %d used %d = %v, want %v", tt.size, tt.quota, tt.used, got, tt.want)
+		}
+	}
+}
+
+func TestDirectoryQuota(t *testing.T) {
+	dir := directoryFunc(func(address string) (*Mailbox, error) {
+		if address == "nil@example.com" {
+			return nil, nil
+		}
+		return &Mailbox{Address: address, Exists: true, Quota: 100, Used: 50}, nil
+	})
+	srv, addr := startTestServer(t, &ServerConfig{Directory: dir, Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("RCPT TO:<nil@example.com>", 550)
+	c.expectCmd("RCPT TO:<john@example.com>", 250)
+	c.expectCmd("DATA", 354)
+	c.write("Subject: quota\r\n\r\n" + strings.Repeat("x", 100) + "\r\n.\r\n")
+	if reply := c.reply(); !strings.HasPrefix(reply, "552 5.2.2") {
+		t.Fatalf("DATA over the quota: got %q, want 552 5.2.2", reply)
+	}
+}
@@ -0,0 +1,134 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+)
+
+// disposableDomainsSnapshot is the bundled list of well known throwaway providers
+var disposableDomainsSnapshot = []string{
+	"10minutemail.com", "20minutemail.com", "33mail.com", "anonbox.net", "burnermail.io",
+	"discard.email", "dispostable.com", "dropmail.me", "emailondeck.com", "fakeinbox.com",
+	"getairmail.com", "getnada.com", "guerrillamail.biz", "guerrillamail.com", "guerrillamail.de",
+	"guerrillamail.info", "guerrillamail.net", "guerrillamail.org", "guerrillamailblock.com",
+	"harakirimail.com", "incognitomail.org", "jetable.org", "mailcatch.com", "maildrop.cc",
+	"mailinator.com", "mailinator.net", "mailnesia.com", "mintemail.com", "moakt.com",
+	"mohmal.com", "mytemp.email", "sharklasers.com", "spam4.me", "spambox.us",
+	"spamgourmet.com", "temp-mail.io", "temp-mail.org", "tempail.com", "tempmail.net",
+	"tempmailo.com", "tempr.email", "throwawaymail.com", "trashmail.com", "trashmail.de",
+	"trashmail.net", "yopmail.com", "yopmail.fr", "yopmail.net",
+}
+
+// DisposableDomains is an updatable set of disposable email domains
+type DisposableDomains struct {
+	mu      sync.RWMutex
+	domains map[string]struct{}
+}
+
+// NewDisposableDomains creates a set of the specified domains, the bundled snapshot is used when none specified
+func NewDisposableDomains(domains ...string) *DisposableDomains {
+	if len(domains) < 1 {
+		domains = disposableDomainsSnapshot
+	}
+
+	d := &DisposableDomains{}
+	d.Update(domains)
+
+	return d
+}
+
+// Update replaces the current list
+func (d *DisposableDomains) Update(domains []string) {
+	set := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			set[domain] = struct{}{}
+		}
+	}
+
+	d.mu.Lock()
+	d.domains = set
+	d.mu.Unlock()
+}
+
+// Refresh replaces the current list with the one returned by fetch, the list is kept on error
+func (d *DisposableDomains) Refresh(fetch func() ([]string, error)) error {
+	domains, err := fetch()
+	if err != nil {
+		return err
+	}
+
+	d.Update(domains)
+
+	return nil
+}
+
+// Contains reports whether the domain (or one of its parents) is disposable
+func (d *DisposableDomains) Contains(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for domain != "" {
+		if _, ok := d.domains[domain]; ok {
+			return true
+		}
+
+		dotInd := strings.Index(domain, ".")
+		if dotInd == -1 {
+			break
+		}
+
+		domain = domain[dotInd+1:]
+	}
+
+	return false
+}
+
+// ContainsAddress reports whether the domain of the address is disposable
+func (d *DisposableDomains) ContainsAddress(address string) bool {
+	_, domain, err := SplitAddress(address)
+
+	return err == nil && d.Contains(domain)
+}
+
+// ReadDomainList reads a domain per line, empty lines and # comments are skipped
+func ReadDomainList(r io.Reader) ([]string, error) {
+	domains := []string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		domains = append(domains, line)
+	}
+
+	return domains, scanner.Err()
+}
+
+// DisposablePolicy flags (and optionally rejects) disposable senders and recipients
+type DisposablePolicy struct {
+	// Domains defaults to the bundled snapshot
+	Domains *DisposableDomains
+
+	RejectSender    bool
+	RejectRecipient bool
+
+	once sync.Once
+}
+
+func (p *DisposablePolicy) list() *DisposableDomains {
+	p.once.Do(func() {
+		if p.Domains == nil {
+			p.Domains = NewDisposableDomains()
+		}
+	})
+
+	return p.Domains
+}
@@ -0,0 +1,313 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DMARCMode tells what a DMARCVerifier does with the messages failing DMARC
+type DMARCMode int
+
+const (
+	// DMARCMonitor only exposes the result to the handler (Context.DMARC)
+	DMARCMonitor DMARCMode = iota
+
+	// DMARCEnforce also rejects the messages whose policy disposition is reject
+	DMARCEnforce
+)
+
+// the DMARC results (RFC 7489 section 11.2)
+const (
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none"
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// the DMARC dispositions
+const (
+	DMARCDispositionNone       = "none"
+	DMARCDispositionQuarantine = "quarantine"
+	DMARCDispositionReject     = "reject"
+)
+
+var errBadDMARCRecord = errors.New("invalid DMARC record")
+
+// DMARCResult is the DMARC evaluation of a message
+type DMARCResult struct {
+	// Result is one of DMARCPass, DMARCFail, DMARCNone, DMARCTempError or DMARCPermError
+	Result string
+
+	// Domain is the RFC5322.From domain, the one the policy is looked up for
+	Domain string
+
+	// Policy is the published policy, nil if the domain doesn't publish one
+	Policy *DMARCPolicyPublished
+
+	// Disposition is what the policy asks to do with the message, after
+	// the pct sampling, always DMARCDispositionNone when DMARC passes
+	Disposition string
+
+	SPFDomain  string
+	SPFResult  SPFResult
+	SPFAligned bool
+
+	// DKIMDomain is the domain of the first passing and aligned signature
+	DKIMDomain  string
+	DKIMResults []DMARCAuthResult
+	DKIMAligned bool
+}
+
+// DMARCVerifier evaluates the DMARC policy of the sender domain (RFC 7489) from the SPF
+// and DKIM results of a message
+type DMARCVerifier struct {
+	Mode DMARCMode
+
+	// Resolver defaults to ServerConfig.Resolver, then net.DefaultResolver
+	Resolver Resolver
+
+	// OrganizationalDomain returns the organizational domain used by the policy discovery
+	// and the relaxed alignment, it defaults to the last two labels of the domain, plug a
+	// public suffix list lookup for accurate results on e.g: co.uk domains
+	OrganizationalDomain func(domain string) string
+
+	// DKIM (if set) verifies the DKIM signatures of the message, without it DMARC can only
+	// pass through SPF alignment
+	DKIM DKIMVerifyFunc
+
+	// Aggregator (if set) receives each evaluation for the aggregate reports
+	Aggregator *DMARCAggregator
+}
+
+// ParseDMARCRecord parses a DMARC TXT record of the specified domain
+func ParseDMARCRecord(domain, txt string) (*DMARCPolicyPublished, error) {
+	policy := &DMARCPolicyPublished{Domain: domain, ADKIM: "r", ASPF: "r", PCT: 100}
+
+	for i, tag := range strings.Split(txt, ";") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		sep := strings.IndexByte(tag, '=')
+		if sep < 0 {
+			return nil, errBadDMARCRecord
+		}
+
+		name, value := strings.ToLower(strings.TrimSpace(tag[:sep])), strings.TrimSpace(tag[sep+1:])
+
+		if i == 0 {
+			if name != "v" || value != "DMARC1" {
+				return nil, errBadDMARCRecord
+			}
+
+			continue
+		}
+
+		switch name {
+		case "p":
+			policy.P = strings.ToLower(value)
+		case "sp":
+			policy.SP = strings.ToLower(value)
+		case "adkim":
+			policy.ADKIM = strings.ToLower(value)
+		case "aspf":
+			policy.ASPF = strings.ToLower(value)
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, errBadDMARCRecord
+			}
+
+			policy.PCT = pct
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					policy.RUA = append(policy.RUA, uri)
+				}
+			}
+		}
+	}
+
+	switch policy.P {
+	case DMARCDispositionNone, DMARCDispositionQuarantine, DMARCDispositionReject:
+	default:
+		return nil, errBadDMARCRecord
+	}
+
+	return policy, nil
+}
+
+// LookupPolicy discovers the DMARC policy of the domain, falling back to the one of its
+// organizational domain, it returns nil and no error when no policy is published
+func (v *DMARCVerifier) LookupPolicy(ctx context.Context, domain string) (*DMARCPolicyPublished, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	policy, err := v.lookupPolicy(ctx, domain)
+	if policy != nil || err != nil {
+		return policy, err
+	}
+
+	if org := v.orgDomain(domain); org != domain {
+		return v.lookupPolicy(ctx, org)
+	}
+
+	return nil, nil
+}
+
+func (v *DMARCVerifier) lookupPolicy(ctx context.Context, domain string) (*DMARCPolicyPublished, error) {
+	records, err := resolverOrDefault(v.Resolver).LookupTXT(ctx, "_dmarc."+domain)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var policy *DMARCPolicyPublished
+	for _, txt := range records {
+		if !strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			continue
+		}
+
+		// more than one record means no policy (RFC 7489 section 6.6.3)
+		if policy != nil {
+			return nil, nil
+		}
+
+		if policy, err = ParseDMARCRecord(domain, txt); err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// Evaluate evaluates the DMARC policy of fromDomain (the RFC5322.From domain) given the SPF
+// result of spfDomain (the RFC5321.MailFrom domain) and the DKIM results of the message
+func (v *DMARCVerifier) Evaluate(ctx context.Context, fromDomain, spfDomain string, spfResult SPFResult, dkim []DMARCAuthResult) (*DMARCResult, error) {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+
+	result := &DMARCResult{
+		Result:      DMARCNone,
+		Domain:      fromDomain,
+		Disposition: DMARCDispositionNone,
+		SPFDomain:   spfDomain,
+		SPFResult:   spfResult,
+		DKIMResults: dkim,
+	}
+
+	policy, err := v.LookupPolicy(ctx, fromDomain)
+	if err == errBadDMARCRecord {
+		result.Result = DMARCPermError
+		return result, err
+	} else if err != nil {
+		result.Result = DMARCTempError
+		return result, err
+	}
+
+	if policy == nil {
+		return result, nil
+	}
+
+	result.Policy = policy
+	result.SPFAligned = spfResult == SPFPass && v.aligned(fromDomain, spfDomain, policy.ASPF)
+
+	for _, sig := range dkim {
+		if strings.EqualFold(sig.Result, DMARCPass) && v.aligned(fromDomain, sig.Domain, policy.ADKIM) {
+			result.DKIMAligned, result.DKIMDomain = true, sig.Domain
+			break
+		}
+	}
+
+	if result.SPFAligned || result.DKIMAligned {
+		result.Result = DMARCPass
+		return result, nil
+	}
+
+	result.Result = DMARCFail
+	result.Disposition = policy.P
+	if policy.SP != "" && policy.Domain != fromDomain {
+		result.Disposition = policy.SP
+	}
+
+	// the messages outside of the pct sample get the next less strict disposition (RFC 7489 section 6.6.4)
+	if policy.PCT < 100 && rand.Intn(100) >= policy.PCT {
+		switch result.Disposition {
+		case DMARCDispositionReject:
+			result.Disposition = DMARCDispositionQuarantine
+		case DMARCDispositionQuarantine:
+			result.Disposition = DMARCDispositionNone
+		}
+	}
+
+	return result, nil
+}
+
+// aligned reports whether domain is aligned with the From domain in the strict ("s") or relaxed mode
+func (v *DMARCVerifier) aligned(fromDomain, domain, mode string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+
+	if domain == fromDomain {
+		return true
+	}
+
+	return mode != "s" && v.orgDomain(domain) == v.orgDomain(fromDomain)
+}
+
+func (v *DMARCVerifier) orgDomain(domain string) string {
+	if v.OrganizationalDomain != nil {
+		return strings.ToLower(v.OrganizationalDomain(domain))
+	}
+
+	return defaultOrgDomain(domain)
+}
+
+// defaultOrgDomain returns the last two labels of the domain
+func defaultOrgDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// record adds the evaluation of a message from ip to the Aggregator
+func (v *DMARCVerifier) record(ip net.IP, result *DMARCResult) {
+	if v.Aggregator == nil || result.Policy == nil {
+		return
+	}
+
+	rec := DMARCRecord{
+		SourceIP:     ip,
+		HeaderFrom:   result.Domain,
+		EnvelopeFrom: result.SPFDomain,
+		Disposition:  result.Disposition,
+		DKIM:         DMARCFail,
+		SPF:          DMARCFail,
+		DKIMResults:  result.DKIMResults,
+		Policy:       *result.Policy,
+	}
+
+	if result.DKIMAligned {
+		rec.DKIM = DMARCPass
+	}
+
+	if result.SPFAligned {
+		rec.SPF = DMARCPass
+	}
+
+	if result.SPFDomain != "" {
+		rec.SPFResults = []DMARCAuthResult{{Domain: result.SPFDomain, Result: result.SPFResult.String()}}
+	}
+
+	v.Aggregator.Add(rec)
+}
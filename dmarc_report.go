@@ -0,0 +1,420 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DMARCPolicyPublished is the DMARC policy record of a sending domain as it was
+// discovered while evaluating a message.
+type DMARCPolicyPublished struct {
+	Domain string   `xml:"domain"`
+	ADKIM  string   `xml:"adkim,omitempty"`
+	ASPF   string   `xml:"aspf,omitempty"`
+	P      string   `xml:"p"`
+	SP     string   `xml:"sp,omitempty"`
+	PCT    int      `xml:"pct"`
+	RUA    []string `xml:"-"`
+}
+
+// DMARCRecord is a single per-message DMARC evaluation that should be
+// included in the aggregate reports.
+type DMARCRecord struct {
+	SourceIP     net.IP
+	HeaderFrom   string
+	EnvelopeFrom string
+	Disposition  string
+	DKIM         string
+	SPF          string
+	DKIMResults  []DMARCAuthResult
+	SPFResults   []DMARCAuthResult
+	Policy       DMARCPolicyPublished
+}
+
+// DMARCAuthResult is a raw SPF or DKIM result as reported inside <auth_results>.
+type DMARCAuthResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+// DMARCFeedback is the RFC 7489 (Appendix C) aggregate report document.
+type DMARCFeedback struct {
+	XMLName         xml.Name             `xml:"feedback"`
+	Metadata        DMARCReportMetadata  `xml:"report_metadata"`
+	PolicyPublished DMARCPolicyPublished `xml:"policy_published"`
+	Records         []DMARCReportRecord  `xml:"record"`
+}
+
+// DMARCReportMetadata identifies the reporting organization and the report.
+type DMARCReportMetadata struct {
+	OrgName          string         `xml:"org_name"`
+	Email            string         `xml:"email"`
+	ExtraContactInfo string         `xml:"extra_contact_info,omitempty"`
+	ReportID         string         `xml:"report_id"`
+	DateRange        DMARCDateRange `xml:"date_range"`
+}
+
+// DMARCDateRange is the period covered by a report, as UNIX timestamps.
+type DMARCDateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+// DMARCReportRecord counts the messages sharing the same source IP, identifiers
+// and evaluation results.
+type DMARCReportRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int    `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom   string `xml:"header_from"`
+		EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		DKIM []DMARCAuthResult `xml:"dkim"`
+		SPF  []DMARCAuthResult `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+// DMARCReport is a generated aggregate report ready to be delivered to the
+// rua addresses of the reported domain.
+type DMARCReport struct {
+	Domain   string
+	RUA      []string
+	Feedback *DMARCFeedback
+	XML      []byte
+}
+
+// Filename returns the RFC 7489 section 7.2.1.1 file name of the report.
+func (r *DMARCReport) Filename(receiver string) string {
+	return fmt.Sprintf("%s!%s!%d!%d.xml.gz", receiver, r.Domain, r.Feedback.Metadata.DateRange.Begin, r.Feedback.Metadata.DateRange.End)
+}
+
+// Gzip returns the gzip compressed XML document, as it should be attached to
+// the report email.
+func (r *DMARCReport) Gzip() ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(r.XML); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DMARCReportSender delivers a generated report, usually by emailing it to
+// each of the report rua addresses.
+type DMARCReportSender func(*DMARCReport) error
+
+// DMARCAggregator rolls up per-message DMARC results per sending domain and
+// periodically emits aggregate reports.
+type DMARCAggregator struct {
+	OrgName  string
+	Email    string
+	Interval time.Duration
+	Sender   DMARCReportSender
+	Clock    Clock
+
+	// ErrorLog receives the errors returned by Sender, if set.
+	ErrorLog func(error)
+
+	// Resolver verifies the external rua destinations, it defaults to the one of the
+	// DMARCVerifier, then net.DefaultResolver.
+	Resolver Resolver
+
+	// OrganizationalDomain tells the external rua destinations apart, it defaults to the
+	// one of the DMARCVerifier (see DMARCVerifier.OrganizationalDomain).
+	OrganizationalDomain func(domain string) string
+
+	mu      sync.Mutex
+	begin   time.Time
+	domains map[string]*dmarcDomainAggregate
+	seq     int
+	done    chan struct{}
+	pending []pendingDMARCReport
+}
+
+// maxDMARCReportAttempts is how many flushes try to send a report before it is dropped
+const maxDMARCReportAttempts = 3
+
+// pendingDMARCReport is a report the Sender failed to deliver, it is retried on the next flush
+type pendingDMARCReport struct {
+	report   *DMARCReport
+	attempts int
+}
+
+type dmarcDomainAggregate struct {
+	policy DMARCPolicyPublished
+	rows   map[string]*DMARCReportRecord
+	order  []string
+}
+
+// Add records a single message evaluation.
+func (a *DMARCAggregator) Add(rec DMARCRecord) {
+	domain := strings.ToLower(rec.Policy.Domain)
+	if domain == "" {
+		domain = strings.ToLower(rec.HeaderFrom)
+	}
+
+	if domain == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.domains == nil {
+		a.domains = map[string]*dmarcDomainAggregate{}
+	}
+
+	// the first report period starts with the first message, the next ones with the flushes
+	if a.begin.IsZero() {
+		a.begin = clockOrDefault(a.Clock).Now()
+	}
+
+	agg := a.domains[domain]
+	if agg == nil {
+		agg = &dmarcDomainAggregate{rows: map[string]*DMARCReportRecord{}}
+		a.domains[domain] = agg
+	}
+
+	agg.policy = rec.Policy
+	agg.policy.Domain = domain
+
+	key := strings.Join([]string{
+		rec.SourceIP.String(), rec.HeaderFrom, rec.EnvelopeFrom,
+		rec.Disposition, rec.DKIM, rec.SPF,
+		fmt.Sprint(rec.DKIMResults), fmt.Sprint(rec.SPFResults),
+	}, "|")
+
+	row := agg.rows[key]
+	if row == nil {
+		row = &DMARCReportRecord{}
+		row.Row.SourceIP = rec.SourceIP.String()
+		row.Row.PolicyEvaluated.Disposition = rec.Disposition
+		row.Row.PolicyEvaluated.DKIM = rec.DKIM
+		row.Row.PolicyEvaluated.SPF = rec.SPF
+		row.Identifiers.HeaderFrom = rec.HeaderFrom
+		row.Identifiers.EnvelopeFrom = rec.EnvelopeFrom
+		row.AuthResults.DKIM = rec.DKIMResults
+		row.AuthResults.SPF = rec.SPFResults
+		agg.rows[key] = row
+		agg.order = append(agg.order, key)
+	}
+
+	row.Row.Count++
+}
+
+// Reports builds the aggregate reports for everything added since the last
+// call and resets the aggregator.
+func (a *DMARCAggregator) Reports() ([]*DMARCReport, error) {
+	end := clockOrDefault(a.Clock).Now()
+
+	a.mu.Lock()
+	domains, begin := a.domains, a.begin
+	a.domains, a.begin = nil, end
+	a.mu.Unlock()
+
+	reports := []*DMARCReport{}
+
+	for domain, agg := range domains {
+		a.mu.Lock()
+		a.seq++
+		seq := a.seq
+		a.mu.Unlock()
+
+		feedback := &DMARCFeedback{
+			Metadata: DMARCReportMetadata{
+				OrgName:  a.OrgName,
+				Email:    a.Email,
+				ReportID: fmt.Sprintf("%d.%d@%s", end.Unix(), seq, domain),
+				DateRange: DMARCDateRange{
+					Begin: begin.Unix(),
+					End:   end.Unix(),
+				},
+			},
+			PolicyPublished: agg.policy,
+		}
+
+		for _, key := range agg.order {
+			feedback.Records = append(feedback.Records, *agg.rows[key])
+		}
+
+		data, err := xml.MarshalIndent(feedback, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		reports = append(reports, &DMARCReport{
+			Domain:   domain,
+			RUA:      agg.policy.RUA,
+			Feedback: feedback,
+			XML:      append([]byte(xml.Header), data...),
+		})
+	}
+
+	return reports, nil
+}
+
+// Flush generates the pending reports and hands the ones that have rua
+// addresses to the Sender, the ones it fails to send are retried by the
+// next flushes.
+func (a *DMARCAggregator) Flush() error {
+	reports, err := a.Reports()
+	if err != nil {
+		return err
+	}
+
+	if a.Sender == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	queue := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	for _, report := range reports {
+		if report.RUA = a.verifiedRUA(report.Domain, report.RUA); len(report.RUA) > 0 {
+			queue = append(queue, pendingDMARCReport{report: report})
+		}
+	}
+
+	var failed []pendingDMARCReport
+
+	for _, p := range queue {
+		err := a.Sender(p.report)
+		if err == nil {
+			continue
+		}
+
+		if p.attempts++; p.attempts < maxDMARCReportAttempts {
+			failed = append(failed, p)
+		} else {
+			err = fmt.Errorf("dropping the DMARC report %s: %w", p.report.Feedback.Metadata.ReportID, err)
+		}
+
+		if a.ErrorLog != nil {
+			a.ErrorLog(err)
+		}
+	}
+
+	a.mu.Lock()
+	a.pending = append(a.pending, failed...)
+	a.mu.Unlock()
+
+	return nil
+}
+
+// verifiedRUA returns the rua URIs of domain that may receive its reports: the ones outside
+// of its organizational domain have to publish a "<domain>._report._dmarc" record accepting
+// them (RFC 7489 section 7.1)
+func (a *DMARCAggregator) verifiedRUA(domain string, rua []string) []string {
+	orgDomain := a.OrganizationalDomain
+	if orgDomain == nil {
+		orgDomain = defaultOrgDomain
+	}
+
+	verified := []string{}
+
+	for _, uri := range rua {
+		host := uri
+		if i := strings.LastIndex(host, "!"); i >= 0 {
+			host = host[:i]
+		}
+
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+		if strings.EqualFold(orgDomain(host), orgDomain(domain)) || a.acceptsReports(host, domain) {
+			verified = append(verified, uri)
+		}
+	}
+
+	return verified
+}
+
+// acceptsReports looks up the authorization of host to receive the reports of domain
+func (a *DMARCAggregator) acceptsReports(host, domain string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLookupTimeout)
+	defer cancel()
+
+	records, err := resolverOrDefault(a.Resolver).LookupTXT(ctx, domain+"._report._dmarc."+host)
+	if err != nil {
+		return false
+	}
+
+	for _, txt := range records {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Start flushes the aggregator every Interval (24h by default) until Stop is called,
+// it does nothing if the aggregator is already started.
+func (a *DMARCAggregator) Start() {
+	interval := a.Interval
+	if interval < 1 {
+		interval = 24 * time.Hour
+	}
+
+	a.mu.Lock()
+	if a.done != nil {
+		a.mu.Unlock()
+		return
+	}
+	a.done = make(chan struct{})
+	done := a.done
+	a.mu.Unlock()
+
+	go func() {
+		clock := clockOrDefault(a.Clock)
+
+		for {
+			select {
+			case <-clock.After(interval):
+				if err := a.Flush(); err != nil && a.ErrorLog != nil {
+					a.ErrorLog(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the schedule started by Start.
+func (a *DMARCAggregator) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.done != nil {
+		close(a.done)
+		a.done = nil
+	}
+}
@@ -0,0 +1,110 @@
+package smtpsrv
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDMARCAggregatorRetries(t *testing.T) {
+	var sent []string
+	fail := true
+
+	a := &DMARCAggregator{
+		OrgName: "example.com",
+		Email:   "dmarc@example.com",
+		Sender: func(r *DMARCReport) error {
+			if fail {
+				return errors.New("unreachable")
+			}
+
+			sent = append(sent, r.Domain)
+			return nil
+		},
+	}
+
+	var logged int
+	a.ErrorLog = func(error) { logged++ }
+
+	a.Add(DMARCRecord{SourceIP: net.ParseIP("192.0.2.1"), HeaderFrom: "example.org", Policy: DMARCPolicyPublished{Domain: "example.org", RUA: []string{"mailto:rua@example.org"}}})
+
+	a.Flush()
+
+	fail = false
+	a.Flush()
+
+	if len(sent) != 1 || sent[0] != "example.org" || logged != 1 {
+		t.Fatalf("got %v sent and %d errors, want the report retried once", sent, logged)
+	}
+
+	fail, sent = true, nil
+	a.Add(DMARCRecord{SourceIP: net.ParseIP("192.0.2.1"), HeaderFrom: "example.org", Policy: DMARCPolicyPublished{Domain: "example.org", RUA: []string{"mailto:rua@example.org"}}})
+
+	for i := 0; i < maxDMARCReportAttempts+1; i++ {
+		a.Flush()
+	}
+
+	if len(a.pending) != 0 {
+		t.Fatalf("got %d pending reports after %d attempts", len(a.pending), maxDMARCReportAttempts)
+	}
+}
+
+func TestDMARCAggregatorExternalRUA(t *testing.T) {
+	var sent [][]string
+
+	a := &DMARCAggregator{
+		Resolver: &staticResolver{txt: map[string][]string{
+			"example.org._report._dmarc.reports.example.net": {"v=DMARC1"},
+		}},
+		Sender: func(r *DMARCReport) error {
+			sent = append(sent, r.RUA)
+			return nil
+		},
+	}
+
+	rua := []string{"mailto:dmarc@mail.example.org", "mailto:rua@reports.example.net!10m", "mailto:rua@example.com"}
+	a.Add(DMARCRecord{SourceIP: net.ParseIP("192.0.2.1"), HeaderFrom: "example.org", Policy: DMARCPolicyPublished{Domain: "example.org", RUA: rua}})
+	a.Add(DMARCRecord{SourceIP: net.ParseIP("192.0.2.1"), HeaderFrom: "example.edu", Policy: DMARCPolicyPublished{Domain: "example.edu", RUA: []string{"mailto:rua@example.com"}}})
+	a.Flush()
+
+	want := "mailto:dmarc@mail.example.org mailto:rua@reports.example.net!10m"
+	if len(sent) != 1 || strings.Join(sent[0], " ") != want {
+		t.Fatalf("sent the reports to %v, want [%s]", sent, want)
+	}
+}
+
+func TestDMARCAggregatorDateRange(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	a := &DMARCAggregator{Clock: clock}
+
+	add := func() {
+		a.Add(DMARCRecord{SourceIP: net.ParseIP("192.0.2.1"), HeaderFrom: "example.org", Policy: DMARCPolicyPublished{Domain: "example.org"}})
+	}
+
+	dateRange := func() DMARCDateRange {
+		t.Helper()
+
+		reports, err := a.Reports()
+		if err != nil || len(reports) != 1 {
+			t.Fatalf("got %d reports, %v", len(reports), err)
+		}
+
+		return reports[0].Feedback.Metadata.DateRange
+	}
+
+	add()
+	clock.now = clock.now.Add(time.Hour)
+	if got := dateRange(); got.Begin != 1000 || got.End != 4600 {
+		t.Errorf("first report: got %+v, want 1000 to 4600", got)
+	}
+
+	// the next period starts at the flush, not at its first message
+	clock.now = clock.now.Add(time.Hour)
+	add()
+	clock.now = clock.now.Add(time.Hour)
+	if got := dateRange(); got.Begin != 4600 || got.End != 11800 {
+		t.Errorf("second report: got %+v, want 4600 to 11800", got)
+	}
+}
@@ -0,0 +1,153 @@
+package smtpsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// failingResolver fails every TXT lookup with a temporary error
+type failingResolver struct {
+	staticResolver
+}
+
+func (r *failingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	for _, tt := range []struct {
+		txt  string
+		want *DMARCPolicyPublished
+	}{
+		{"v=DMARC1; p=none", &DMARCPolicyPublished{Domain: "example.com", ADKIM: "r", ASPF: "r", P: "none", PCT: 100}},
+		{"v=DMARC1;p=Reject;sp=quarantine;adkim=s;aspf=s;pct=20;rua=mailto:a@example.com, mailto:b@example.net;",
+			&DMARCPolicyPublished{Domain: "example.com", ADKIM: "s", ASPF: "s", P: "reject", SP: "quarantine", PCT: 20, RUA: []string{"mailto:a@example.com", "mailto:b@example.net"}}},
+		{"v=DMARC1; p=none; fo=1; ruf=mailto:f@example.com", &DMARCPolicyPublished{Domain: "example.com", ADKIM: "r", ASPF: "r", P: "none", PCT: 100}},
+		{"p=none; v=DMARC1", nil},
+		{"v=DMARC2; p=none", nil},
+		{"v=DMARC1", nil},
+		{"v=DMARC1; p=bogus", nil},
+		{"v=DMARC1; p=none; pct=101", nil},
+		{"v=DMARC1; p=none; garbage", nil},
+	} {
+		policy, err := ParseDMARCRecord("example.com", tt.txt)
+
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.txt, policy)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.txt, err)
+			continue
+		}
+
+		if got, want := fmt.Sprintf("%+v", *policy), fmt.Sprintf("%+v", *tt.want); got != want {
+			t.Errorf("%q: got %+v, want %+v", tt.txt, policy, tt.want)
+		}
+	}
+}
+
+func TestDMARCEvaluate(t *testing.T) {
+	v := &DMARCVerifier{Resolver: &staticResolver{txt: map[string][]string{
+		"_dmarc.example.com":     {"v=DMARC1; p=reject; sp=quarantine; adkim=s"},
+		"_dmarc.relaxed.example": {"v=DMARC1; p=quarantine"},
+		"_dmarc.dup.example":     {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.bad.example":     {"v=DMARC1; p=bogus"},
+		"_dmarc.sampled.example": {"v=DMARC1; p=reject; pct=0"},
+		"_dmarc.spf.example":     {"v=spf1 -all"},
+	}}}
+
+	pass := func(domain string) []DMARCAuthResult {
+		return []DMARCAuthResult{{Domain: "unrelated.example", Result: "pass"}, {Domain: domain, Selector: "s1", Result: "pass"}}
+	}
+
+	for _, tt := range []struct {
+		from, spfDomain string
+		spf             SPFResult
+		dkim            []DMARCAuthResult
+		result          string
+		disposition     string
+		dkimDomain      string
+	}{
+		{"example.com", "example.com", SPFPass, nil, DMARCPass, DMARCDispositionNone, ""},
+		{"Example.COM.", "bounces.example.com", SPFPass, nil, DMARCPass, DMARCDispositionNone, ""},
+		{"example.com", "example.net", SPFPass, nil, DMARCFail, DMARCDispositionReject, ""},
+		{"example.com", "example.com", SPFSoftfail, nil, DMARCFail, DMARCDispositionReject, ""},
+		{"example.com", "", SPFNone, pass("example.com"), DMARCPass, DMARCDispositionNone, "example.com"},
+		{"example.com", "", SPFNone, pass("mail.example.com"), DMARCFail, DMARCDispositionReject, ""},
+		{"example.com", "", SPFNone, []DMARCAuthResult{{Domain: "example.com", Result: "fail"}}, DMARCFail, DMARCDispositionReject, ""},
+		{"sub.example.com", "", SPFNone, nil, DMARCFail, DMARCDispositionQuarantine, ""},
+		{"relaxed.example", "", SPFNone, pass("mail.relaxed.example"), DMARCPass, DMARCDispositionNone, "mail.relaxed.example"},
+		{"relaxed.example", "", SPFNone, nil, DMARCFail, DMARCDispositionQuarantine, ""},
+		{"sampled.example", "", SPFNone, nil, DMARCFail, DMARCDispositionQuarantine, ""},
+		{"none.example", "", SPFNone, nil, DMARCNone, DMARCDispositionNone, ""},
+		{"dup.example", "", SPFNone, nil, DMARCNone, DMARCDispositionNone, ""},
+		{"spf.example", "", SPFNone, nil, DMARCNone, DMARCDispositionNone, ""},
+		{"bad.example", "", SPFNone, nil, DMARCPermError, DMARCDispositionNone, ""},
+	} {
+		result, _ := v.Evaluate(context.Background(), tt.from, tt.spfDomain, tt.spf, tt.dkim)
+
+		if result.Result != tt.result || result.Disposition != tt.disposition || result.DKIMDomain != tt.dkimDomain {
+			t.Errorf("%s (spf %s %s, dkim %v): got %s %s %q, want %s %s %q", tt.from, tt.spfDomain, tt.spf, tt.dkim,
+				result.Result, result.Disposition, result.DKIMDomain, tt.result, tt.disposition, tt.dkimDomain)
+		}
+	}
+
+	v.Resolver = &failingResolver{}
+
+	if result, err := v.Evaluate(context.Background(), "example.com", "example.com", SPFPass, nil); err == nil || result.Result != DMARCTempError {
+		t.Errorf("got %s %v, want temperror", result.Result, err)
+	}
+}
+
+func TestDMARCSession(t *testing.T) {
+	resolver := &staticResolver{txt: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+		"example.com":        {"v=spf1 ip4:127.0.0.1 -all"},
+	}}
+
+	for _, mode := range []DMARCMode{DMARCMonitor, DMARCEnforce} {
+		results := make(chan string, 1)
+
+		srv, addr := startTestServer(t, &ServerConfig{
+			Resolver: resolver,
+			DMARC:    &DMARCVerifier{Mode: mode},
+			Handler: func(c *Context) error {
+				results <- c.DMARC().Result + " " + c.DMARC().Disposition
+				return nil
+			},
+		})
+
+		c := dialTestServer(t, addr)
+		c.expectCmd("EHLO client.example.org", 250)
+
+		// the envelope domain passes SPF and is aligned
+		if reply := c.send("bounces@example.com", []string{"rcpt@example.org"}, "From: sender@example.com\nSubject: hi\n\nhi"); reply[:3] != "250" {
+			t.Errorf("mode %d: aligned message: got %q", mode, reply)
+		} else if result := <-results; result != "pass none" {
+			t.Errorf("mode %d: aligned message: got %q, want pass", mode, result)
+		}
+
+		reply := c.send("sender@example.org", []string{"rcpt@example.org"}, "From: sender@example.com\nSubject: hi\n\nhi")
+
+		switch {
+		case mode == DMARCEnforce && reply != "550 5.7.1 Message rejected by the DMARC policy of example.com":
+			t.Errorf("enforced failing message: got %q, want 550", reply)
+		case mode == DMARCMonitor && reply[:3] != "250":
+			t.Errorf("monitored failing message: got %q, want 250", reply)
+		case mode == DMARCMonitor:
+			if result := <-results; result != "fail reject" {
+				t.Errorf("monitored failing message: got %q, want fail reject", result)
+			}
+		}
+
+		c.Close()
+		srv.Close()
+	}
+}
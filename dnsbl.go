@@ -0,0 +1,307 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errConnectionRefused is returned to go-smtp instead of writing the greeting of a refused client
+var errConnectionRefused = errors.New("connection refused")
+
+// DNSBLAction is what happens to the clients listed by a DNSBL
+type DNSBLAction int
+
+const (
+	// DNSBLTag only reports the listing through Context.DNSBL
+	DNSBLTag DNSBLAction = iota
+
+	// DNSBLScore also lowers the client reputation (see ServerConfig.Reputation)
+	DNSBLScore
+
+	// DNSBLGreylist greylists the client (see ServerConfig.Greylist and Greylist.OnlyDNSBL)
+	DNSBLGreylist
+
+	// DNSBLDefer replies 450 to MAIL FROM (421 and disconnects at connect time)
+	DNSBLDefer
+
+	// DNSBLReject replies 554 to MAIL FROM (and at connect time), the client is also
+	// reported to the BanManager
+	DNSBLReject
+)
+
+// DNSBL is a DNS blocklist zone, e.g: zen.spamhaus.org
+type DNSBL struct {
+	Zone string
+
+	// Codes restricts the listing to specific answers (e.g: "127.0.0.2"), any
+	// 127.0.0.0/8 answer lists the client by default
+	Codes []string
+
+	Action DNSBLAction
+}
+
+// DNSBLPolicy looks up the clients IPs in DNS blocklists
+type DNSBLPolicy struct {
+	Lists []DNSBL
+
+	// OnConnect looks the client up as soon as it connects and refuses it instead
+	// of greeting it (on the plaintext listeners, the implicit TLS ones can only
+	// reply once the handshake is done so they act at MAIL FROM)
+	OnConnect bool
+}
+
+// DNSBLResult is the listing of the client by a DNSBL
+type DNSBLResult struct {
+	Zone   string
+	Codes  []string
+	Reason string
+	Action DNSBLAction
+}
+
+// dnsblCheck is the (pending) lookup of the client in the blocklists and allowlists
+type dnsblCheck struct {
+	done     chan struct{}
+	results  []DNSBLResult
+	allowed  []DNSWLResult
+	recorded bool
+}
+
+// dnsListsEnabled reports whether ServerConfig.DNSBL or ServerConfig.DNSWL has lists
+func dnsListsEnabled(cfg *ServerConfig) bool {
+	return cfg.DNSBL != nil && len(cfg.DNSBL.Lists) > 0 || cfg.DNSWL != nil && len(cfg.DNSWL.Lists) > 0
+}
+
+// LookupDNSBL looks up ip in the specified zone, it returns nil if the ip isn't listed
+func LookupDNSBL(ctx context.Context, resolver Resolver, ip net.IP, list DNSBL) (*DNSBLResult, error) {
+	name := dnsblName(ip, list.Zone)
+	if name == "" {
+		return nil, nil
+	}
+
+	resolver = resolverOrDefault(resolver)
+
+	addrs, err := resolver.LookupIPAddr(ctx, name)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := &DNSBLResult{Zone: list.Zone, Action: list.Action}
+
+	for _, addr := range addrs {
+		ip4 := addr.IP.To4()
+
+		// 127.255.255.0/24 are the errors codes of e.g: spamhaus (blocked public resolvers ...)
+		if ip4 == nil || ip4[0] != 127 || ip4[1] == 255 && ip4[2] == 255 {
+			continue
+		}
+
+		if len(list.Codes) > 0 && !containsFold(list.Codes, ip4.String()) {
+			continue
+		}
+
+		result.Codes = append(result.Codes, ip4.String())
+	}
+
+	if len(result.Codes) < 1 {
+		return nil, nil
+	}
+
+	if txts, err := resolver.LookupTXT(ctx, name); err == nil && len(txts) > 0 {
+		result.Reason = txts[0]
+	}
+
+	return result, nil
+}
+
+// dnsblName returns the name to look up for ip in zone, IPv6 addresses are nibble reversed
+func dnsblName(ip net.IP, zone string) string {
+	zone = strings.Trim(zone, ".")
+	if ip == nil || zone == "" {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], zone)
+	}
+
+	nibbles := strings.Split(spfDottedIP(ip), ".")
+	for i, j := 0, len(nibbles)-1; i < j; i, j = i+1, j-1 {
+		nibbles[i], nibbles[j] = nibbles[j], nibbles[i]
+	}
+
+	return strings.Join(nibbles, ".") + "." + zone
+}
+
+// startDNSBL looks up ip in all the blocklists and allowlists concurrently
+func startDNSBL(ctx context.Context, cfg *ServerConfig, ip net.IP) *dnsblCheck {
+	check := &dnsblCheck{done: make(chan struct{})}
+
+	var blocklists []DNSBL
+	if cfg.DNSBL != nil {
+		blocklists = cfg.DNSBL.Lists
+	}
+
+	var allowlists []DNSWL
+	if cfg.DNSWL != nil {
+		allowlists = cfg.DNSWL.Lists
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout(cfg))
+
+	go func() {
+		defer close(check.done)
+		defer cancel()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for _, list := range blocklists {
+			wg.Add(1)
+
+			go func(list DNSBL) {
+				defer wg.Done()
+
+				// a failing list doesn't list anyone
+				result, _ := LookupDNSBL(ctx, cfg.Resolver, ip, list)
+				if result == nil {
+					return
+				}
+
+				mu.Lock()
+				check.results = append(check.results, *result)
+				mu.Unlock()
+			}(list)
+		}
+
+		for _, list := range allowlists {
+			wg.Add(1)
+
+			go func(list DNSWL) {
+				defer wg.Done()
+
+				result, _ := LookupDNSWL(ctx, cfg.Resolver, ip, list)
+				if result == nil {
+					return
+				}
+
+				mu.Lock()
+				check.allowed = append(check.allowed, *result)
+				mu.Unlock()
+			}(list)
+		}
+
+		wg.Wait()
+	}()
+
+	return check
+}
+
+// worst returns the listing with the strongest action, nil if there is none or if
+// the client is allowlisted
+func (check *dnsblCheck) worst() *DNSBLResult {
+	if len(check.allowed) > 0 {
+		return nil
+	}
+
+	var worst *DNSBLResult
+	for i := range check.results {
+		if worst == nil || check.results[i].Action > worst.Action {
+			worst = &check.results[i]
+		}
+	}
+
+	return worst
+}
+
+// dnsblGreylisted reports whether a DNSBL with the DNSBLGreylist action lists the client
+func (s *Session) dnsblGreylisted() bool {
+	if !dnsListsEnabled(s.config) {
+		return false
+	}
+
+	worst := s.dnsbl().worst()
+
+	return worst != nil && worst.Action == DNSBLGreylist
+}
+
+// dnsblReply returns the reply refusing a client listed with an action of defer or reject
+func dnsblReply(ip net.IP, result *DNSBLResult, connecting bool) *smtp.SMTPError {
+	if result == nil || result.Action < DNSBLDefer {
+		return nil
+	}
+
+	message := "Client host [" + ip.String() + "] blocked using " + result.Zone
+	if result.Reason != "" {
+		message += "; " + result.Reason
+	}
+
+	if result.Action == DNSBLReject {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: message}
+	}
+
+	if connecting {
+		return &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: message}
+	}
+
+	return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: message}
+}
+
+// dnsbl returns the lookup of the client, started at connect time or now
+func (s *Session) dnsbl() *dnsblCheck {
+	check := s.startDNSLists()
+	<-check.done
+
+	return check
+}
+
+// startDNSLists starts the DNSBL and DNSWL lookups of the client, once per session (or connection
+// with DNSBLPolicy.OnConnect)
+func (s *Session) startDNSLists() *dnsblCheck {
+	if s.dnsblCheck == nil {
+		if c := s.conn(); c != nil && c.dnsbl != nil {
+			s.dnsblCheck = c.dnsbl
+		} else {
+			s.dnsblCheck = startDNSBL(s.context(), s.config, remoteIP(s.connState.RemoteAddr))
+		}
+	}
+
+	return s.dnsblCheck
+}
+
+// checkDNSBL applies ServerConfig.DNSBL at MAIL FROM
+func (s *Session) checkDNSBL() error {
+	if s.config.DNSBL == nil || len(s.config.DNSBL.Lists) < 1 {
+		return nil
+	}
+
+	check := s.dnsbl()
+
+	if !check.recorded && len(check.allowed) < 1 {
+		check.recorded = true
+
+		for _, result := range check.results {
+			if result.Action >= DNSBLScore {
+				s.recordReputation(ReputationDNSBL)
+			}
+		}
+	}
+
+	worst := check.worst()
+	if worst != nil && worst.Action == DNSBLReject {
+		s.reportAbuse(BanDNSBL)
+	}
+
+	if reply := dnsblReply(remoteIP(s.connState.RemoteAddr), worst, false); reply != nil {
+		return reply
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSBLName(t *testing.T) {
+	for _, tt := range []struct {
+		ip, want string
+	}{
+		{"192.0.2.1", "1.2.0.192.zen.example"},
+		{"::ffff:192.0.2.1", "1.2.0.192.zen.example"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example"},
+	} {
+		if got := dnsblName(net.ParseIP(tt.ip), ".zen.example."); got != tt.want {
+			t.Errorf("dnsblName(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestLookupDNSBL(t *testing.T) {
+	resolver := &staticResolver{
+		ip: map[string][]string{
+			"1.2.0.192.zen.example": {"127.0.0.2", "127.0.0.10"},
+			"2.2.0.192.zen.example": {"127.255.255.254"},
+			"3.2.0.192.zen.example": {"192.0.2.3"},
+		},
+		txt: map[string][]string{
+			"1.2.0.192.zen.example": {"listed, see https://zen.example/query/192.0.2.1"},
+		},
+	}
+
+	for _, tt := range []struct {
+		ip     string
+		codes  []string
+		listed []string
+	}{
+		{"192.0.2.1", nil, []string{"127.0.0.2", "127.0.0.10"}},
+		{"192.0.2.1", []string{"127.0.0.10"}, []string{"127.0.0.10"}},
+		{"192.0.2.1", []string{"127.0.0.4"}, nil},
+		{"192.0.2.2", nil, nil},
+		{"192.0.2.3", nil, nil},
+		{"192.0.2.4", nil, nil},
+	} {
+		result, err := LookupDNSBL(context.Background(), resolver, net.ParseIP(tt.ip), DNSBL{Zone: "zen.example", Codes: tt.codes, Action: DNSBLReject})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.listed == nil {
+			if result != nil {
+				t.Errorf("%s %v: listed with %v", tt.ip, tt.codes, result.Codes)
+			}
+
+			continue
+		}
+
+		if result == nil || strings.Join(result.Codes, ",") != strings.Join(tt.listed, ",") || result.Action != DNSBLReject || !strings.HasPrefix(result.Reason, "listed") {
+			t.Errorf("%s %v: got %+v, want the codes %v", tt.ip, tt.codes, result, tt.listed)
+		}
+	}
+}
+
+func TestDNSBLSession(t *testing.T) {
+	resolver := &staticResolver{ip: map[string][]string{
+		"1.0.0.127.reject.example": {"127.0.0.2"},
+		"1.0.0.127.defer.example":  {"127.0.0.2"},
+		"1.0.0.127.allow.example":  {"127.0.0.2"},
+	}}
+
+	for _, tt := range []struct {
+		name     string
+		policy   *DNSBLPolicy
+		allow    *DNSWLPolicy
+		greeting string
+		mail     string
+	}{
+		{"reject", &DNSBLPolicy{Lists: []DNSBL{{Zone: "reject.example", Action: DNSBLReject}}}, nil, "220", "554 5.7.1 Client host [127.0.0.1] blocked using reject.example"},
+		{"defer", &DNSBLPolicy{Lists: []DNSBL{{Zone: "defer.example", Action: DNSBLDefer}, {Zone: "reject.example", Action: DNSBLTag}}}, nil, "220", "450 4.7.1"},
+		{"tag", &DNSBLPolicy{Lists: []DNSBL{{Zone: "reject.example", Action: DNSBLTag}}}, nil, "220", "250"},
+		{"unlisted", &DNSBLPolicy{Lists: []DNSBL{{Zone: "unlisted.example", Action: DNSBLReject}}}, nil, "220", "250"},
+		{"allowlisted", &DNSBLPolicy{Lists: []DNSBL{{Zone: "reject.example", Action: DNSBLReject}}}, &DNSWLPolicy{Lists: []DNSWL{{Zone: "allow.example"}}}, "220", "250"},
+		{"on connect", &DNSBLPolicy{Lists: []DNSBL{{Zone: "reject.example", Action: DNSBLReject}}, OnConnect: true}, nil, "554 5.7.1", ""},
+		{"defer on connect", &DNSBLPolicy{Lists: []DNSBL{{Zone: "defer.example", Action: DNSBLDefer}}, OnConnect: true}, nil, "421 4.7.1", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, addr := startTestServer(t, &ServerConfig{Resolver: resolver, DNSBL: tt.policy, DNSWL: tt.allow})
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+			if greeting := c.reply(); !strings.HasPrefix(greeting, tt.greeting) {
+				t.Fatalf("got the greeting %q, want %s", greeting, tt.greeting)
+			}
+
+			if tt.mail == "" {
+				return
+			}
+
+			c.expectCmd("EHLO client.example.org", 250)
+
+			if reply := c.cmd("MAIL FROM:<sender@example.org>"); !strings.HasPrefix(reply, tt.mail) {
+				t.Fatalf("MAIL FROM: got %q, want %s", reply, tt.mail)
+			}
+		})
+	}
+}
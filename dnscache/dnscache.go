@@ -0,0 +1,348 @@
+// Package dnscache is a stub resolver caching the answers of the recursive resolvers, it
+// implements smtpsrv.Resolver
+package dnscache
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Clock is the time source of the cache, smtpsrv.Clock implements it
+type Clock interface {
+	Now() time.Time
+}
+
+// Resolver caches the answers of the recursive resolvers for their TTL (and the negative
+// answers for the SOA minimum, RFC 2308)
+type Resolver struct {
+	// Servers are the "host:port" addresses of the recursive resolvers
+	Servers []string
+
+	// Timeout of each query, 5s by default
+	Timeout time.Duration
+
+	// MinTTL and MaxTTL (1h by default) clamp the TTL of the cached answers
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL is used for the negative answers without SOA, 1m by default
+	NegativeTTL time.Duration
+
+	// MaxEntries bounds the cache size, the least recently used answers are evicted first,
+	// 10000 by default
+	MaxEntries int
+
+	// Clock (if set) replaces the system clock
+	Clock Clock
+
+	mu      sync.Mutex
+	entries map[key]*list.Element
+	lru     list.List
+}
+
+type key struct {
+	name  string
+	qtype uint16
+}
+
+type entry struct {
+	key     key
+	answers []dns.RR
+	err     error
+	expires time.Time
+}
+
+// New creates a Resolver querying the nameservers of /etc/resolv.conf
+func New() *Resolver {
+	servers := []string{"127.0.0.1:53"}
+
+	if conf, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil && len(conf.Servers) > 0 {
+		servers = servers[:0]
+		for _, server := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(server, conf.Port))
+		}
+	}
+
+	return &Resolver{Servers: servers}
+}
+
+// LookupTXT returns the TXT records of name, the strings of each record are concatenated
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answers, err := r.query(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := []string{}
+	for _, rr := range answers {
+		txts = append(txts, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+
+	return txts, nil
+}
+
+// LookupMX returns the MX records of name sorted by preference
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answers, err := r.query(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	mxs := []*net.MX{}
+	for _, rr := range answers {
+		mx := rr.(*dns.MX)
+		mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	return mxs, nil
+}
+
+// LookupAddr returns the PTR names of addr
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+
+	answers, err := r.query(ctx, arpa, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, rr := range answers {
+		names = append(names, rr.(*dns.PTR).Ptr)
+	}
+
+	return names, nil
+}
+
+// LookupIPAddr returns the A and AAAA addresses of host
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	addrs := []net.IPAddr{}
+
+	a, errA := r.query(ctx, host, dns.TypeA)
+	for _, rr := range a {
+		addrs = append(addrs, net.IPAddr{IP: rr.(*dns.A).A})
+	}
+
+	aaaa, errAAAA := r.query(ctx, host, dns.TypeAAAA)
+	for _, rr := range aaaa {
+		addrs = append(addrs, net.IPAddr{IP: rr.(*dns.AAAA).AAAA})
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	if errA != nil && !isNotFound(errA) {
+		return nil, errA
+	}
+
+	if errAAAA != nil {
+		return nil, errAAAA
+	}
+
+	return nil, errA
+}
+
+// Flush empties the cache
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	r.entries = nil
+	r.lru.Init()
+	r.mu.Unlock()
+}
+
+// query returns the answers of type qtype, from the cache when they haven't expired
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	k := key{name: strings.ToLower(dns.Fqdn(name)), qtype: qtype}
+	now := r.now()
+
+	if cached := r.lookup(k, now); cached != nil {
+		return cached.answers, cached.err
+	}
+
+	msg, err := r.exchange(ctx, k.name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &entry{key: k}
+	ttl := r.NegativeTTL
+	if ttl < 1 {
+		ttl = time.Minute
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		first := true
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+
+			if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; first || rrTTL < ttl {
+				ttl, first = rrTTL, false
+			}
+
+			e.answers = append(e.answers, rr)
+		}
+	case dns.RcodeNameError:
+	default:
+		// SERVFAIL, REFUSED ... aren't cached
+		return nil, &net.DNSError{Err: dns.RcodeToString[msg.Rcode], Name: name, IsTemporary: true}
+	}
+
+	if len(e.answers) < 1 {
+		e.err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = time.Duration(soa.Minttl) * time.Second
+				if hdrTTL := time.Duration(soa.Hdr.Ttl) * time.Second; hdrTTL < ttl {
+					ttl = hdrTTL
+				}
+			}
+		}
+	}
+
+	maxTTL := r.MaxTTL
+	if maxTTL < 1 {
+		maxTTL = time.Hour
+	}
+
+	if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	e.expires = now.Add(ttl)
+	r.store(e)
+
+	return e.answers, e.err
+}
+
+// exchange sends the query to the servers in turn, retrying over TCP when the answer is truncated
+func (r *Resolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	timeout := r.Timeout
+	if timeout < 1 {
+		timeout = 5 * time.Second
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, false)
+
+	var lastErr error = &net.DNSError{Err: "no DNS servers configured", Name: name}
+
+	for _, server := range r.Servers {
+		client := &dns.Client{Timeout: timeout}
+
+		msg, _, err := client.ExchangeContext(ctx, req, server)
+		if err == nil && msg.Truncated {
+			client.Net = "tcp"
+			msg, _, err = client.ExchangeContext(ctx, req, server)
+		}
+
+		if err != nil {
+			lastErr = &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTimeout: isTimeout(err), IsTemporary: true}
+			continue
+		}
+
+		return msg, nil
+	}
+
+	return nil, lastErr
+}
+
+func (r *Resolver) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+
+	return r.Clock.Now()
+}
+
+// lookup returns the cached answer of k if it hasn't expired
+func (r *Resolver) lookup(k key, now time.Time) *entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elem, ok := r.entries[k]
+	if !ok {
+		return nil
+	}
+
+	e := elem.Value.(*entry)
+	if !now.Before(e.expires) {
+		r.lru.Remove(elem)
+		delete(r.entries, k)
+
+		return nil
+	}
+
+	r.lru.MoveToFront(elem)
+
+	return e
+}
+
+// store caches e, evicting the least recently used answers beyond MaxEntries
+func (r *Resolver) store(e *entry) {
+	maxEntries := r.MaxEntries
+	if maxEntries < 1 {
+		maxEntries = 10000
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.entries == nil {
+		r.entries = map[key]*list.Element{}
+	}
+
+	if elem, ok := r.entries[e.key]; ok {
+		elem.Value = e
+		r.lru.MoveToFront(elem)
+
+		return
+	}
+
+	r.entries[e.key] = r.lru.PushFront(e)
+
+	for r.lru.Len() > maxEntries {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*entry).key)
+	}
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+
+	return ok && dnsErr.IsNotFound
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
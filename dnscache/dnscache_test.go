@@ -0,0 +1,164 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// startTestServer answers TXT "v=test" (TTL 60s) for the names under example.org and NXDOMAIN
+// (SOA minimum 30s) for the others, queries returns the number of queries per name
+func startTestServer(t *testing.T) (srv *dns.Server, addr string, queries func(name string) int) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	srv = &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		name := req.Question[0].Name
+
+		mu.Lock()
+		counts[name]++
+		mu.Unlock()
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		if dns.IsSubDomain("example.org.", name) {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{"v=test"},
+			})
+		} else {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = append(resp.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "invalid.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:     "ns.invalid.",
+				Mbox:   "hostmaster.invalid.",
+				Minttl: 30,
+			})
+		}
+
+		w.WriteMsg(resp)
+	})}
+
+	go srv.ActivateAndServe()
+
+	return srv, pc.LocalAddr().String(), func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return counts[dns.Fqdn(name)]
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	srv, addr, queries := startTestServer(t)
+	defer srv.Shutdown()
+
+	clock := &manualClock{now: time.Unix(0, 0)}
+	r := &Resolver{Servers: []string{addr}, Clock: clock}
+
+	lookup := func(wantQueries int) {
+		t.Helper()
+
+		txts, err := r.LookupTXT(context.Background(), "a.example.org")
+		if err != nil || len(txts) != 1 || txts[0] != "v=test" {
+			t.Fatalf("LookupTXT() = %q, %v", txts, err)
+		}
+
+		if got := queries("a.example.org"); got != wantQueries {
+			t.Fatalf("%d queries, want %d", got, wantQueries)
+		}
+	}
+
+	lookup(1)
+	clock.advance(59 * time.Second)
+	lookup(1)
+	clock.advance(time.Second)
+	lookup(2)
+
+	r.MaxTTL = 10 * time.Second
+	clock.advance(time.Minute)
+	lookup(3)
+	clock.advance(10 * time.Second)
+	lookup(4)
+}
+
+func TestNegativeCaching(t *testing.T) {
+	srv, addr, queries := startTestServer(t)
+	defer srv.Shutdown()
+
+	clock := &manualClock{now: time.Unix(0, 0)}
+	r := &Resolver{Servers: []string{addr}, Clock: clock}
+
+	lookup := func(wantQueries int) {
+		t.Helper()
+
+		_, err := r.LookupTXT(context.Background(), "missing.invalid")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Fatalf("LookupTXT() error = %v, want not found", err)
+		}
+
+		if got := queries("missing.invalid"); got != wantQueries {
+			t.Fatalf("%d queries, want %d", got, wantQueries)
+		}
+	}
+
+	lookup(1)
+	clock.advance(29 * time.Second)
+	lookup(1)
+	clock.advance(time.Second)
+	lookup(2)
+}
+
+func TestMaxEntries(t *testing.T) {
+	srv, addr, queries := startTestServer(t)
+	defer srv.Shutdown()
+
+	r := &Resolver{Servers: []string{addr}, MaxEntries: 2}
+
+	for _, name := range []string{"a.example.org", "b.example.org", "a.example.org", "c.example.org", "a.example.org", "b.example.org"} {
+		if _, err := r.LookupTXT(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b is the least recently used when c is stored
+	for name, want := range map[string]int{"a.example.org": 1, "b.example.org": 2, "c.example.org": 1} {
+		if got := queries(name); got != want {
+			t.Errorf("%s: %d queries, want %d", name, got, want)
+		}
+	}
+
+	if r.lru.Len() != 2 || len(r.entries) != 2 {
+		t.Errorf("%d cached answers, want 2", r.lru.Len())
+	}
+}
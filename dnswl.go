@@ -0,0 +1,60 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+)
+
+// DNSWL is a DNS allowlist zone, e.g: list.dnswl.org
+type DNSWL struct {
+	Zone string
+
+	// Codes restricts the listing to specific answers (e.g: "127.0.15.3" for the
+	// high trust dnswl.org entries), any 127.0.0.0/8 answer lists the client by default
+	Codes []string
+}
+
+// DNSWLPolicy looks up the clients IPs in DNS allowlists, the allowlisted clients bypass
+// the DNSBL actions, the greylisting and the rate limits (ServerConfig.SenderDomainThrottle and
+// the MAIL FROM and RCPT TO stages of ServerConfig.RateLimiter)
+type DNSWLPolicy struct {
+	Lists []DNSWL
+}
+
+// DNSWLResult is the listing of the client by a DNSWL
+type DNSWLResult struct {
+	Zone   string
+	Codes  []string
+	Reason string
+}
+
+// LookupDNSWL looks up ip in the specified zone, it returns nil if the ip isn't listed
+func LookupDNSWL(ctx context.Context, resolver Resolver, ip net.IP, list DNSWL) (*DNSWLResult, error) {
+	result, err := LookupDNSBL(ctx, resolver, ip, DNSBL{Zone: list.Zone, Codes: list.Codes})
+	if result == nil || err != nil {
+		return nil, err
+	}
+
+	allowed := &DNSWLResult{Zone: result.Zone, Reason: result.Reason}
+	for _, code := range result.Codes {
+		// 127.0.0.255 is the "over the query limit" answer of dnswl.org
+		if code != "127.0.0.255" {
+			allowed.Codes = append(allowed.Codes, code)
+		}
+	}
+
+	if len(allowed.Codes) < 1 {
+		return nil, nil
+	}
+
+	return allowed, nil
+}
+
+// allowlisted reports whether a DNSWL lists the client
+func (s *Session) allowlisted() bool {
+	if !dnsListsEnabled(s.config) {
+		return false
+	}
+
+	return len(s.dnsbl().allowed) > 0
+}
@@ -0,0 +1,269 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DSN NOTIFY values (RFC 3461 section 4.1)
+const (
+	DSNNotifyNever   = "NEVER"
+	DSNNotifySuccess = "SUCCESS"
+	DSNNotifyFailure = "FAILURE"
+	DSNNotifyDelay   = "DELAY"
+)
+
+// DSNRecipient holds the delivery status notification parameters of a recipient, see Context.RecipientDSN.
+// go-smtp doesn't know DSN, it is advertised and the MAIL parameters are handled by the connection
+// (see DSNEnvelope)
+type DSNRecipient struct {
+	// Notify lists the requested notifications, empty if the client didn't ask for any
+	Notify []string
+
+	// ORCPT is the original recipient address and ORCPTType its type, usually "rfc822"
+	ORCPT     string
+	ORCPTType string
+}
+
+// Wants reports whether the specified NOTIFY value got requested
+func (d DSNRecipient) Wants(notify string) bool {
+	for _, v := range d.Notify {
+		if strings.EqualFold(v, notify) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DSN RET values (RFC 3461 section 4.3)
+const (
+	DSNRetFull    = "FULL"
+	DSNRetHeaders = "HDRS"
+)
+
+// maxEnvIDLength is the RFC 3461 (section 4.4) limit of ENVID
+const maxEnvIDLength = 100
+
+var errBadMailParams = &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Invalid MAIL FROM parameters"}
+
+// DSNEnvelope holds the delivery status notification parameters of MAIL (RFC 3461 section 4.3 and 4.4)
+type DSNEnvelope struct {
+	// Ret is either "FULL" or "HDRS", empty if the client didn't specify it
+	Ret string
+
+	// EnvID is the envelope identifier of the client
+	EnvID string
+}
+
+// stripMailParams removes the RET and ENVID parameters (that go-smtp refuses) from the MAIL
+// commands of b and keeps them in c.dsnMail, the invalid ones (e.g: RET=SOME or given twice)
+// set c.mailErr instead, the parameters of the extensions are kept in c.mailParams (see
+// MailParamExtension) and BODY is noted in c.mailBody, it returns the new length of b
+func (c *conn) stripMailParams(b []byte) int {
+	if !bytes.Contains(bytes.ToUpper(b), []byte("MAIL FROM:")) {
+		return len(b)
+	}
+
+	out := make([]byte, 0, len(b))
+
+	for start := 0; start < len(b); {
+		end := bytes.IndexByte(b[start:], '\n')
+		if end < 0 {
+			end = len(b)
+		} else {
+			end += start + 1
+		}
+
+		line := b[start:end]
+		start = end
+
+		if end == len(b) && line[len(line)-1] != '\n' || !bytes.HasPrefix(bytes.ToUpper(line), []byte("MAIL FROM:")) {
+			out = append(out, line...)
+			continue
+		}
+
+		var envelope *DSNEnvelope
+		var ret, envID bool
+
+		c.mailErr, c.mailParams, c.mailBody = nil, nil, ""
+
+		fields := strings.Fields(string(line))
+		kept := fields[:0]
+
+		for _, field := range fields {
+			kv := strings.SplitN(field, "=", 2)
+
+			key := strings.ToUpper(kv[0])
+
+			value := ""
+			if len(kv) == 2 {
+				value = kv[1]
+			}
+
+			// BODY is checked by go-smtp which doesn't hand it over, and only knows the upper cased values
+			if key == "BODY" {
+				c.mailBody = strings.ToUpper(value)
+				field = "BODY=" + c.mailBody
+			}
+
+			if key != "RET" && key != "ENVID" {
+				if !c.isMailParam(key) {
+					kept = append(kept, field)
+					continue
+				}
+
+				if _, dup := c.mailParams[key]; dup {
+					c.mailErr = errBadMailParams
+				}
+
+				if c.mailParams == nil {
+					c.mailParams = map[string]string{}
+				}
+
+				c.mailParams[key] = value
+				continue
+			}
+
+			if envelope == nil {
+				envelope = &DSNEnvelope{}
+			}
+
+			if key == "RET" {
+				envelope.Ret = strings.ToUpper(value)
+				if ret || envelope.Ret != DSNRetFull && envelope.Ret != DSNRetHeaders {
+					c.mailErr = errBadMailParams
+				}
+
+				ret = true
+				continue
+			}
+
+			decoded, err := decodeXtext(value)
+			if envID || err != nil || !isXtext(value) || len(value) > maxEnvIDLength {
+				c.mailErr = errBadMailParams
+			}
+
+			envelope.EnvID, envID = decoded, true
+		}
+
+		c.dsnMail = envelope
+
+		out = append(out, strings.Join(kept, " ")+"\r\n"...)
+	}
+
+	return copy(b, out)
+}
+
+var errBadRcptParams = &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Invalid RCPT TO parameters"}
+
+// splitRcpt separates the address from the ESMTP parameters, go-smtp hands
+// the RCPT argument over as-is, e.g: "user@example.org> NOTIFY=SUCCESS"
+func splitRcpt(to string) (string, *DSNRecipient, error) {
+	fields := strings.Fields(to)
+	if len(fields) < 1 {
+		return to, nil, nil
+	}
+
+	addr := strings.Trim(fields[0], "<>")
+	if len(fields) < 2 {
+		return addr, nil, nil
+	}
+
+	dsn := &DSNRecipient{}
+
+	for _, param := range fields[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return "", nil, errBadRcptParams
+		}
+
+		switch strings.ToUpper(kv[0]) {
+		case "NOTIFY":
+			for _, v := range strings.Split(strings.ToUpper(kv[1]), ",") {
+				switch v {
+				case DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelay, DSNNotifyNever:
+					dsn.Notify = append(dsn.Notify, v)
+				default:
+					return "", nil, errBadRcptParams
+				}
+			}
+
+			if dsn.Wants(DSNNotifyNever) && len(dsn.Notify) > 1 {
+				return "", nil, errBadRcptParams
+			}
+		case "ORCPT":
+			parts := strings.SplitN(kv[1], ";", 2)
+			if len(parts) != 2 {
+				return "", nil, errBadRcptParams
+			}
+
+			orcpt, err := decodeXtext(parts[1])
+			if err != nil {
+				return "", nil, errBadRcptParams
+			}
+
+			dsn.ORCPTType, dsn.ORCPT = strings.ToLower(parts[0]), orcpt
+		default:
+			return "", nil, &smtp.SMTPError{Code: 555, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Unsupported RCPT TO parameter " + kv[0]}
+		}
+	}
+
+	return addr, dsn, nil
+}
+
+// decodeXtext decodes the RFC 3461 xtext encoding ("+" followed by two hex digits)
+// isXtext reports whether s is a valid RFC 3461 (section 4) xtext: the printable ASCII characters
+// but "+" and "=", and "+" followed by two upper case hex digits
+func isXtext(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return false
+			}
+
+			i += 2
+		case c < 33 || c > 126 || c == '=':
+			return false
+		}
+	}
+
+	return true
+}
+
+func isUpperHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F'
+}
+
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", errBadRcptParams
+		}
+
+		decoded, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", err
+		}
+
+		b.Write(decoded)
+		i += 2
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,180 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitRcpt(t *testing.T) {
+	tests := []struct {
+		arg    string
+		addr   string
+		notify []string
+		orcpt  string
+		err    bool
+	}{
+		{"john@example.com", "john@example.com", nil, "", false},
+		{"john@example.com> NOTIFY=SUCCESS,FAILURE", "john@example.com", []string{"SUCCESS", "FAILURE"}, "", false},
+		{"john@example.com> ORCPT=rfc822;john+40example.com", "john@example.com", nil, "john@example.com", false},
+		{"john@example.com> FOO=BAR", "", nil, "", true},
+		{"john@example.com> NOTIFY", "", nil, "", true},
+	}
+
+	for _, test := range tests {
+		addr, dsn, err := splitRcpt(test.arg)
+		if (err != nil) != test.err {
+			t.Errorf("splitRcpt(%q) error = %v", test.arg, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if addr != test.addr {
+			t.Errorf("splitRcpt(%q) address = %q, want %q", test.arg, addr, test.addr)
+		}
+
+		if dsn == nil {
+			if test.notify != nil || test.orcpt != "" {
+				t.Errorf("splitRcpt(%q) has no DSN", test.arg)
+			}
+			continue
+		}
+
+		if strings.Join(dsn.Notify, ",") != strings.Join(test.notify, ",") || dsn.ORCPT != test.orcpt {
+			t.Errorf("splitRcpt(%q) = %+v", test.arg, dsn)
+		}
+	}
+}
+
+func TestStripDSNMail(t *testing.T) {
+	tests := []struct {
+		input    string
+		output   string
+		envelope *DSNEnvelope
+		invalid  bool
+	}{
+		{"MAIL FROM:<a@example.org>\r\n", "MAIL FROM:<a@example.org>\r\n", nil, false},
+		{"MAIL FROM:<a@example.org> RET=hdrs ENVID=QQ314159\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{Ret: "HDRS", EnvID: "QQ314159"}, false},
+		{"mail from:<a@example.org> SIZE=100 ret=FULL\r\n", "mail from:<a@example.org> SIZE=100\r\n", &DSNEnvelope{Ret: "FULL"}, false},
+		{"MAIL FROM:<> ENVID=a+2Bb\r\n", "MAIL FROM:<>\r\n", &DSNEnvelope{EnvID: "a+b"}, false},
+		{"NOOP\r\nMAIL FROM:<a@example.org> RET=FULL\r\nRCPT TO:<b@example.com>\r\n", "NOOP\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<b@example.com>\r\n", &DSNEnvelope{Ret: "FULL"}, false},
+		{"MAIL FROM:<a@example.org> RET=FULL", "MAIL FROM:<a@example.org> RET=FULL", nil, false},
+		{"RCPT TO:<b@example.com> NOTIFY=NEVER\r\n", "RCPT TO:<b@example.com> NOTIFY=NEVER\r\n", nil, false},
+		{"MAIL FROM:<a@example.org> RET=SOME\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{Ret: "SOME"}, true},
+		{"MAIL FROM:<a@example.org> RET\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{}, true},
+		{"MAIL FROM:<a@example.org> RET=FULL RET=HDRS\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{Ret: "HDRS"}, true},
+		{"MAIL FROM:<a@example.org> ENVID=a=b\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{EnvID: "a=b"}, true},
+		{"MAIL FROM:<a@example.org> ENVID=a+2b\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{EnvID: "a+"}, true},
+		{"MAIL FROM:<a@example.org> ENVID=" + strings.Repeat("x", 101) + "\r\n", "MAIL FROM:<a@example.org>\r\n", &DSNEnvelope{EnvID: strings.Repeat("x", 101)}, true},
+	}
+
+	for _, test := range tests {
+		c := &conn{}
+		b := []byte(test.input)
+
+		if output := string(b[:c.stripMailParams(b)]); output != test.output {
+			t.Errorf("stripMailParams(%q) = %q, want %q", test.input, output, test.output)
+		}
+
+		if (c.dsnMail == nil) != (test.envelope == nil) || c.dsnMail != nil && *c.dsnMail != *test.envelope {
+			t.Errorf("stripMailParams(%q) kept %+v, want %+v", test.input, c.dsnMail, test.envelope)
+		}
+
+		if (c.mailErr != nil) != test.invalid {
+			t.Errorf("stripMailParams(%q) reply = %v, want invalid %v", test.input, c.mailErr, test.invalid)
+		}
+	}
+}
+
+func TestDSNPerRecipient(t *testing.T) {
+	type result struct {
+		john, jane *DSNRecipient
+		envelope   *DSNEnvelope
+	}
+
+	results := make(chan result, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		TLSConfig: testTLSConfig(t),
+		Handler: func(c *Context) error {
+			results <- result{c.RecipientDSN("john@example.com"), c.RecipientDSN("jane@example.com"), c.DSNEnvelope()}
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name     string
+		startTLS bool
+		split    bool
+	}{
+		{"plaintext", false, false},
+		{"STARTTLS", true, false},
+		{"split MAIL", false, true},
+		{"split MAIL over STARTTLS", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialTestServer(t, addr)
+			defer c.Close()
+
+			ehlo := c.expectCmd("EHLO client.example.org", 250)
+			if tt.startTLS {
+				c.startTLS()
+				ehlo = c.expectCmd("EHLO client.example.org", 250)
+			}
+
+			if !strings.Contains(ehlo, "250-DSN") {
+				t.Fatalf("DSN isn't advertised: %q", ehlo)
+			}
+
+			if tt.split {
+				// the MAIL line is spread over two reads of the server
+				c.write("MAIL FROM:<sender@example.org> RET=HD")
+				time.Sleep(50 * time.Millisecond)
+				c.write("RS ENVID=QQ314159\r\n")
+				c.expect(250)
+			} else {
+				c.expectCmd("MAIL FROM:<sender@example.org> RET=HDRS ENVID=QQ314159", 250)
+			}
+
+			c.expectCmd("RCPT TO:<john@example.com> NOTIFY=SUCCESS,FAILURE", 250)
+			c.expectCmd("RCPT TO:<jane@example.com> NOTIFY=NEVER", 250)
+			c.expectCmd("DATA", 354)
+			c.write("Subject: hi\r\n\r\nhello\r\n.\r\n")
+			c.expect(250)
+
+			r := <-results
+
+			if r.john == nil || !r.john.Wants(DSNNotifySuccess) || r.john.Wants(DSNNotifyNever) {
+				t.Errorf("john's DSN = %+v", r.john)
+			}
+
+			if r.jane == nil || !r.jane.Wants(DSNNotifyNever) {
+				t.Errorf("jane's DSN = %+v", r.jane)
+			}
+
+			if r.envelope == nil || r.envelope.Ret != "HDRS" || r.envelope.EnvID != "QQ314159" {
+				t.Errorf("DSNEnvelope() = %+v", r.envelope)
+			}
+		})
+	}
+}
+
+func TestDSNInvalidMailParams(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+
+	for _, params := range []string{"RET=SOME", "RET=FULL RET=HDRS", "ENVID=a=b", "ENVID=" + strings.Repeat("x", 101)} {
+		c.expectCmd("MAIL FROM:<sender@example.org> "+params, 501)
+	}
+
+	c.expectCmd("MAIL FROM:<sender@example.org> RET=FULL ENVID=a+2Bb", 250)
+}
@@ -0,0 +1,67 @@
+package smtpsrv
+
+import (
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errTooManyErrors = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many errors"}
+
+// errTooManyRecipients isn't counted as an error the first time in a transaction, the client is
+// expected to send the message again to the truncated recipients but not to keep sending RCPTs
+var errTooManyRecipients = &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 5, 3}, Message: "Too many recipients"}
+
+// replyCode returns the code of b if it is the last line of a reply, 0 otherwise
+func replyCode(b []byte) int {
+	if len(b) < 4 || b[3] != ' ' {
+		return 0
+	}
+
+	code := 0
+	for _, c := range b[:3] {
+		if c < '0' || c > '9' {
+			return 0
+		}
+
+		code = code*10 + int(c-'0')
+	}
+
+	return code
+}
+
+// countReplyError counts the 4xx/5xx replies of the connection (see ServerConfig.MaxErrors),
+// it reports whether the limit is exceeded
+func (c *conn) countReplyError(b []byte) bool {
+	if c.maxErrors < 1 {
+		return false
+	}
+
+	if code := replyCode(b); code < 400 || code == 421 || atomic.CompareAndSwapInt32(&c.exemptReply, 1, 0) {
+		return false
+	}
+
+	return atomic.AddInt32(&c.replyErrors, 1) > int32(c.maxErrors)
+}
+
+// replied converts the SMTPError returned by a command and counts it for ServerConfig.Tarpit,
+// the errors are counted for ServerConfig.MaxErrors by the connection as it writes them
+func (s *Session) replied(err error) error {
+	err = toSMTPError(err)
+
+	if err == nil || isSuccessReply(err) {
+		return err
+	}
+
+	if err == errTooManyRecipients && s.truncatedRcpts == 1 {
+		if c := s.conn(); c != nil {
+			atomic.StoreInt32(&c.exemptReply, 1)
+		}
+
+		return err
+	}
+
+	s.tarpit(err)
+
+	return err
+}
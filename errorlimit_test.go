@@ -0,0 +1,41 @@
+package smtpsrv
+
+import "testing"
+
+func TestReplyCode(t *testing.T) {
+	for _, tt := range []struct {
+		reply string
+		want  int
+	}{
+		{"250 2.0.0 OK\r\n", 250},
+		{"550 5.1.1 No such user here\r\n", 550},
+		{"421 4.7.0 Too many errors\r\n", 421},
+		{"250-PIPELINING\r\n", 0},
+		{"250\r\n", 0},
+		{"25 OK\r\n", 0},
+		{"2x0 OK\r\n", 0},
+		{"", 0},
+	} {
+		if got := replyCode([]byte(tt.reply)); got != tt.want {
+			t.Errorf("replyCode(%q) = %d, want %d", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestRepeatedTruncationCounts(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{MaxRecipients: 1, MaxErrors: 1, Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("RCPT TO:<a@example.com>", 250)
+
+	// the first truncation is expected, the next ones are errors
+	c.expectCmd("RCPT TO:<b@example.com>", 452)
+	c.expectCmd("RCPT TO:<c@example.com>", 452)
+	c.expectCmd("RCPT TO:<d@example.com>", 452)
+	c.expect(421)
+}
@@ -1,7 +1,103 @@
 package smtpsrv
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
 
 var (
-	ErrAuthDisabled = errors.New("auth is disabled")
+	ErrAuthDisabled      = errors.New("auth is disabled")
+	ErrNotFeedbackReport = errors.New("not a multipart/report feedback-report message")
+	ErrNotVERP           = errors.New("not a VERP address")
+	ErrNoTLSConfig       = errors.New("no TLSConfig specified")
+	ErrServerClosed      = errors.New("smtp server closed")
+	ErrInvalidAddress    = errors.New("invalid address")
+	ErrDomainNotMailable = errors.New("the domain has no MX nor A records")
+	ErrNoHandler         = errors.New("no Handler specified")
+	ErrMalformedMIME     = errors.New("malformed MIME structure")
+
+	ErrPrivilegesUnsupported = errors.New("dropping privileges isn't supported on this platform")
 )
+
+// SMTPError lets the handlers, the hooks and the callbacks choose the reply of a rejection,
+// e.g: &SMTPError{Code: 550, EnhancedCode: "5.7.1", Message: "Rejected by policy"} or
+// &SMTPError{Code: 451, EnhancedCode: "4.3.0", Message: "Try again later"}, it is detected
+// even when wrapped (see errors.As), the other errors are replied with the go-smtp defaults
+type SMTPError struct {
+	Code int
+
+	// EnhancedCode is the RFC 3463 status code (e.g: "5.7.1"), derived from Code when empty
+	EnhancedCode string
+
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	return e.Message
+}
+
+// reply converts e to the go-smtp error
+func (e *SMTPError) reply() *smtp.SMTPError {
+	reply := &smtp.SMTPError{Code: e.Code, EnhancedCode: smtp.EnhancedCodeNotSet, Message: e.Message}
+
+	parts := strings.Split(e.EnhancedCode, ".")
+	if len(parts) != 3 {
+		return reply
+	}
+
+	var code smtp.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return reply
+		}
+
+		code[i] = n
+	}
+
+	reply.EnhancedCode = code
+
+	return reply
+}
+
+// ErrAuthUnavailable is returned by the authentication callbacks (AuthFunc, SecretFunc ...) when the
+// credentials can't be verified for now, it is replied 454 and isn't counted as a failed attempt
+var ErrAuthUnavailable = &SMTPError{Code: 454, EnhancedCode: "4.7.0", Message: "Temporary authentication failure"}
+
+// ErrNoSuchUser is returned by Directory.Lookup for the unknown addresses (same as a mailbox that
+// doesn't exist), its other errors are replied 451 unless they are SMTPErrors
+var ErrNoSuchUser = &SMTPError{Code: 550, EnhancedCode: "5.1.1", Message: "No such user here"}
+
+// isTemporaryReply reports whether err is a 4xx reply
+func isTemporaryReply(err error) bool {
+	e, ok := err.(*smtp.SMTPError)
+
+	return ok && e.Code >= 400 && e.Code < 500
+}
+
+// queuedReply is the reply of an accepted message. go-smtp replies to DATA with whatever SMTPError
+// Data returns, so returning a 250 one is the only way to customize the text; it isn't a failure
+// and everything handling the errors of the commands must skip it (see isSuccessReply)
+func queuedReply(id string) error {
+	return &smtp.SMTPError{Code: 250, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "OK: queued as " + id}
+}
+
+// isSuccessReply reports whether err is a 2xx reply, see queuedReply
+func isSuccessReply(err error) bool {
+	e, ok := err.(*smtp.SMTPError)
+
+	return ok && e.Code >= 200 && e.Code < 300
+}
+
+// toSMTPError converts an SMTPError (if any) in err to the go-smtp error
+func toSMTPError(err error) error {
+	var e *SMTPError
+	if err == nil || !errors.As(err, &e) {
+		return err
+	}
+
+	return e.reply()
+}
@@ -0,0 +1,35 @@
+package smtpsrv
+
+import (
+	"net"
+	"time"
+)
+
+// AuthEvent describes a single authentication attempt
+type AuthEvent struct {
+	Time       time.Time
+	Success    bool
+	Mechanism  string
+	Username   string
+	RemoteAddr net.Addr
+	TLS        bool
+	Err        error
+}
+
+// AuthEventHandler receives the authentication events as they happen
+type AuthEventHandler func(AuthEvent)
+
+// AbuseEvent describes a single abuse of the server: an authentication failure, a DNSBL hit,
+// a harvesting attempt or a connection dropped for its protocol errors
+type AbuseEvent struct {
+	Time   time.Time
+	IP     net.IP
+	Reason BanReason
+
+	// Banned is set when the event made the IP reach ServerConfig.BanThreshold and got
+	// handed to the BanManager
+	Banned bool
+}
+
+// AbuseEventHandler receives the abuse events as they happen
+type AbuseEventHandler func(AbuseEvent)
@@ -0,0 +1,171 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Extension is an SMTP service extension go-smtp doesn't know, the connection handles it (see
+// ServerConfig.Extensions): its keyword is added to the EHLO reply, its commands are answered
+// before reaching go-smtp (see CommandExtension) and its MAIL FROM parameters are removed from
+// the command before go-smtp parses it, as it refuses the ones it doesn't know (see MailParamExtension)
+type Extension interface {
+	// Keyword returns the EHLO keyword of the extension followed by its parameters (if any),
+	// e.g: "XCLIENT NAME ADDR"
+	Keyword() string
+}
+
+// CommandExtension is an Extension adding commands
+type CommandExtension interface {
+	Extension
+
+	// Commands returns the verbs of the extension (e.g: "XCLIENT")
+	Commands() []string
+
+	// Command answers a command of the extension, args are the arguments following the verb
+	Command(c *ExtensionConn, verb, args string) *smtp.SMTPError
+}
+
+// MailParamExtension is an Extension adding MAIL FROM parameters
+type MailParamExtension interface {
+	Extension
+
+	// MailParams returns the names of the parameters of the extension (e.g: "HOLDFOR")
+	MailParams() []string
+
+	// Mail checks the parameters of the extension given to MAIL FROM (keyed by their upper cased
+	// names, without the ones the client didn't give), an error rejects the command
+	Mail(c *Context, params map[string]string) error
+}
+
+// ExtensionConn is the connection a command of a CommandExtension was received on
+type ExtensionConn struct {
+	RemoteAddr net.Addr
+
+	// TLS is the state of the TLS session, nil on the unencrypted connections
+	TLS *tls.ConnectionState
+
+	// Username is the authenticated user, empty unless the client authenticated
+	Username string
+}
+
+// extensions returns the extensions of the server: ServerConfig.Extensions and the built in ones
+func (cfg *ServerConfig) extensions() []Extension {
+	extensions := cfg.Extensions
+
+	if cfg.FutureRelease != nil && cfg.FutureRelease.Hold != nil {
+		extensions = append(extensions[:len(extensions):len(extensions)], futureRelease{cfg.FutureRelease, clockOrDefault(cfg.Clock)})
+	}
+
+	if cfg.DeliverBy != nil {
+		extensions = append(extensions[:len(extensions):len(extensions)], deliverBy{cfg.DeliverBy, clockOrDefault(cfg.Clock)})
+	}
+
+	if cfg.MTPriority != nil {
+		extensions = append(extensions[:len(extensions):len(extensions)], mtPriority{cfg.MTPriority})
+	}
+
+	return extensions
+}
+
+var replyExtensionOK = &smtp.SMTPError{Code: 250, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "OK"}
+
+// extensionCommand returns the extension handling the command line (if any) and the verb and
+// arguments of the command
+func (c *conn) extensionCommand(line []byte) (CommandExtension, string, string) {
+	fields := strings.SplitN(strings.TrimSpace(string(line)), " ", 2)
+	verb := strings.ToUpper(fields[0])
+
+	for _, ext := range c.extensions {
+		if ext, ok := ext.(CommandExtension); ok {
+			for _, cmd := range ext.Commands() {
+				if strings.EqualFold(cmd, verb) {
+					args := ""
+					if len(fields) == 2 {
+						args = strings.TrimSpace(fields[1])
+					}
+
+					return ext, verb, args
+				}
+			}
+		}
+	}
+
+	return nil, "", ""
+}
+
+// runExtension answers the command of an extension, the reply goes through Write so it is
+// counted as the go-smtp ones (see ServerConfig.MaxErrors and ServerConfig.Tarpit)
+func (c *conn) runExtension(ext CommandExtension, verb, args string) error {
+	ec := &ExtensionConn{RemoteAddr: c.RemoteAddr()}
+
+	if c.tls != nil {
+		state := c.tls.ConnectionState()
+		ec.TLS = &state
+	}
+
+	if c.session != nil && c.session.username != nil {
+		ec.Username = *c.session.username
+	}
+
+	reply := ext.Command(ec, verb, args)
+	if reply == nil {
+		reply = replyExtensionOK
+	}
+
+	var b bytes.Buffer
+	writeReply(&b, reply)
+
+	c.extendWriteDeadline()
+	_, err := c.Write(b.Bytes())
+	c.extendReadDeadline()
+
+	return err
+}
+
+// isMailParam reports whether name is a MAIL FROM parameter of an extension
+func (c *conn) isMailParam(name string) bool {
+	for _, ext := range c.extensions {
+		if ext, ok := ext.(MailParamExtension); ok {
+			for _, param := range ext.MailParams() {
+				if strings.EqualFold(param, name) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// checkMailParams runs the Mail check of the extensions with the parameters given to MAIL FROM
+func (s *Session) checkMailParams() error {
+	for _, ext := range s.config.extensions() {
+		ext, ok := ext.(MailParamExtension)
+		if !ok {
+			continue
+		}
+
+		var params map[string]string
+
+		for _, name := range ext.MailParams() {
+			if value, ok := s.mailParams[strings.ToUpper(name)]; ok {
+				if params == nil {
+					params = map[string]string{}
+				}
+
+				params[strings.ToUpper(name)] = value
+			}
+		}
+
+		if err := ext.Mail(&Context{session: s}, params); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// testExtension answers XPING and takes the XPRIO MAIL FROM parameter (a digit)
+type testExtension struct{}
+
+func (testExtension) Keyword() string      { return "XTEST 1" }
+func (testExtension) Commands() []string   { return []string{"XPING"} }
+func (testExtension) MailParams() []string { return []string{"XPRIO"} }
+
+func (testExtension) Command(c *ExtensionConn, verb, args string) *smtp.SMTPError {
+	if args == "" {
+		return &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Missing argument"}
+	}
+
+	return &smtp.SMTPError{Code: 250, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "pong " + args}
+}
+
+func (testExtension) Mail(c *Context, params map[string]string) error {
+	if prio, ok := params["XPRIO"]; ok && (len(prio) != 1 || prio[0] < '0' || prio[0] > '9') {
+		return &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Invalid XPRIO"}
+	}
+
+	return nil
+}
+
+func TestExtension(t *testing.T) {
+	prios := make(chan string, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Extensions: []Extension{testExtension{}},
+		Handler: func(c *Context) error {
+			prio, _ := c.MailParam("xprio")
+			prios <- prio
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); !strings.Contains(ehlo, "XTEST 1") {
+		t.Fatalf("the extension isn't advertised:\n%s", ehlo)
+	}
+
+	if reply := c.expectCmd("xping hello", 250); !strings.HasSuffix(reply, "pong hello") {
+		t.Fatalf("XPING got %q", reply)
+	}
+
+	c.expectCmd("XPING", 501)
+
+	// the commands pipelined around an extension command are answered in order
+	c.write("NOOP\r\nXPING a\r\nNOOP\r\n")
+	c.expect(250)
+
+	if reply := c.expect(250); !strings.HasSuffix(reply, "pong a") {
+		t.Fatalf("the pipelined XPING got %q", reply)
+	}
+
+	c.expect(250)
+
+	c.expectCmd("MAIL FROM:<sender@example.org> XPRIO=high", 501)
+	c.expectCmd("MAIL FROM:<sender@example.org> XPRIO=1 XPRIO=2", 501)
+
+	c.expectCmd("MAIL FROM:<sender@example.org> XPRIO=7", 250)
+	c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+	c.expectCmd("DATA", 354)
+	c.write("Subject: hi\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	if prio := <-prios; prio != "7" {
+		t.Errorf("MailParam(XPRIO) = %q", prio)
+	}
+}
@@ -0,0 +1,97 @@
+package smtpsrv
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errTooManyCommands = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many commands"}
+
+// CommandFloodPolicy detects sessions cycling MAIL/RSET without ever reaching DATA,
+// once half of a threshold is reached each further command is delayed (Delay
+// doubling up to MaxDelay), beyond the threshold the client gets
+// "421 too many commands" and is disconnected.
+//
+// NOOP and EHLO are answered by the SMTP engine itself and aren't counted.
+type CommandFloodPolicy struct {
+	// MaxTransactions is the number of MAIL commands without DATA (10 by default)
+	MaxTransactions int
+
+	// MaxResets is the number of RSET commands (20 by default)
+	MaxResets int
+
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Clock    Clock
+
+	delayed      int64
+	disconnected int64
+}
+
+// CommandFloodStats are the counters of a CommandFloodPolicy
+type CommandFloodStats struct {
+	Delayed      int64
+	Disconnected int64
+}
+
+// Stats returns the current counters
+func (p *CommandFloodPolicy) Stats() CommandFloodStats {
+	return CommandFloodStats{
+		Delayed:      atomic.LoadInt64(&p.delayed),
+		Disconnected: atomic.LoadInt64(&p.disconnected),
+	}
+}
+
+// check delays the caller as needed and reports whether the session must be dropped
+func (p *CommandFloodPolicy) check(count, threshold int) bool {
+	if count > threshold {
+		atomic.AddInt64(&p.disconnected, 1)
+		return true
+	}
+
+	over := count - threshold/2
+	if over < 1 {
+		return false
+	}
+
+	delay := p.Delay
+	if delay < 1 {
+		delay = 500 * time.Millisecond
+	}
+
+	maxDelay := p.MaxDelay
+	if maxDelay < 1 {
+		maxDelay = 10 * time.Second
+	}
+
+	for i := 1; i < over && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	atomic.AddInt64(&p.delayed, 1)
+	<-clockOrDefault(p.Clock).After(delay)
+
+	return false
+}
+
+func (p *CommandFloodPolicy) maxTransactions() int {
+	if p.MaxTransactions < 1 {
+		return 10
+	}
+
+	return p.MaxTransactions
+}
+
+func (p *CommandFloodPolicy) maxResets() int {
+	if p.MaxResets < 1 {
+		return 20
+	}
+
+	return p.MaxResets
+}
@@ -0,0 +1,88 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultMaxHold is the default FutureReleasePolicy.MaxInterval
+const DefaultMaxHold = 7 * 24 * time.Hour
+
+var errBadHold = &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Invalid HOLDFOR or HOLDUNTIL parameter"}
+
+// FutureReleasePolicy enables the FUTURERELEASE extension (RFC 4865): the clients ask for their
+// message to be released at a later time with the HOLDFOR (seconds) or HOLDUNTIL (RFC 3339 date)
+// MAIL FROM parameter, see Context.ReleaseTime. The server has no queue of its own, the held
+// messages are handed to Hold which stores them until their release time
+type FutureReleasePolicy struct {
+	// MaxInterval is the longest hold, DefaultMaxHold if not set
+	MaxInterval time.Duration
+
+	// Hold receives the held messages instead of the handler, FUTURERELEASE isn't advertised
+	// without it
+	Hold HandlerFunc
+}
+
+func (p *FutureReleasePolicy) maxInterval() time.Duration {
+	if p.MaxInterval > 0 {
+		return p.MaxInterval
+	}
+
+	return DefaultMaxHold
+}
+
+// futureRelease is the Extension of FutureReleasePolicy
+type futureRelease struct {
+	policy *FutureReleasePolicy
+	clock  Clock
+}
+
+func (f futureRelease) Keyword() string {
+	max := f.policy.maxInterval()
+
+	return fmt.Sprintf("FUTURERELEASE %d %s", int64(max/time.Second), f.clock.Now().Add(max).UTC().Format(time.RFC3339))
+}
+
+func (f futureRelease) MailParams() []string {
+	return []string{"HOLDFOR", "HOLDUNTIL"}
+}
+
+// Mail sets the release time of the transaction, the holds ending in the past release the message
+// right away
+func (f futureRelease) Mail(c *Context, params map[string]string) error {
+	holdFor, isFor := params["HOLDFOR"]
+	holdUntil, isUntil := params["HOLDUNTIL"]
+
+	now, max := f.clock.Now(), f.policy.maxInterval()
+	release := time.Time{}
+
+	switch {
+	case isFor && isUntil:
+		return errBadHold
+	case isFor:
+		seconds, err := strconv.ParseUint(holdFor, 10, 32)
+		if err != nil || len(holdFor) > 9 || time.Duration(seconds)*time.Second > max {
+			return errBadHold
+		}
+
+		if seconds > 0 {
+			release = now.Add(time.Duration(seconds) * time.Second)
+		}
+	case isUntil:
+		until, err := time.Parse(time.RFC3339, holdUntil)
+		if err != nil || until.After(now.Add(max)) {
+			return errBadHold
+		}
+
+		if until.After(now) {
+			release = until
+		}
+	}
+
+	c.session.release = release
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFutureRelease(t *testing.T) {
+	held, delivered := make(chan time.Time, 1), make(chan time.Time, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Clock: frozenClock{},
+		FutureRelease: &FutureReleasePolicy{Hold: func(c *Context) error {
+			held <- c.ReleaseTime()
+			return nil
+		}},
+		Handler: func(c *Context) error {
+			delivered <- c.ReleaseTime()
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); !strings.Contains(ehlo, "FUTURERELEASE 604800 1970-01-08T00:00:00Z") {
+		t.Fatalf("FUTURERELEASE isn't advertised:\n%s", ehlo)
+	}
+
+	for _, params := range []string{"HOLDFOR=604801", "HOLDFOR=-1", "HOLDFOR=60 HOLDUNTIL=1970-01-01T01:00:00Z", "HOLDUNTIL=1970-01-09T00:00:00Z", "HOLDUNTIL=tomorrow"} {
+		c.expectCmd("MAIL FROM:<sender@example.org> "+params, 501)
+	}
+
+	for _, tt := range []struct {
+		params  string
+		release time.Time
+		held    bool
+	}{
+		{"HOLDFOR=60", time.Unix(60, 0), true},
+		{"HOLDUNTIL=1970-01-01T01:00:00Z", time.Unix(3600, 0), true},
+		{"HOLDFOR=0", time.Time{}, false},
+		{"", time.Time{}, false},
+	} {
+		c.expectCmd("MAIL FROM:<sender@example.org> "+tt.params, 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write("Subject: hi\r\n\r\nhello\r\n.\r\n")
+		c.expect(250)
+
+		var release time.Time
+		select {
+		case release = <-held:
+			if !tt.held {
+				t.Errorf("%q: the message is held", tt.params)
+			}
+		case release = <-delivered:
+			if tt.held {
+				t.Errorf("%q: the message isn't held", tt.params)
+			}
+		}
+
+		if !release.Equal(tt.release) {
+			t.Errorf("%q: ReleaseTime() = %v, want %v", tt.params, release, tt.release)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 module github.com/alash3al/go-smtpsrv
 
 require (
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	github.com/emersion/go-smtp v0.13.0
-	github.com/miekg/dns v1.1.50 // indirect
-	github.com/zaccone/spf v0.0.0-20170817004109-76747b8658d9
-	golang.org/x/text v0.3.7 // indirect
+	github.com/miekg/dns v1.1.50
+	github.com/oschwald/maxminddb-golang v1.3.1
+	golang.org/x/text v0.13.0
 )
 
-go 1.13
+require (
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
+
+go 1.17
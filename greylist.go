@@ -0,0 +1,245 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// GreylistEntry is the state of a greylisted triplet (or of a client, see Greylist.AutoAllowlist)
+type GreylistEntry struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	// Passed is set once the triplet was retried after the delay, it is then allowlisted
+	Passed bool
+
+	// Count is the number of passed triplets of a client
+	Count int
+
+	// Expires is when the entry can be dropped
+	Expires time.Time
+}
+
+// GreylistStore persists the greylist entries, see NewMemoryGreylistStore
+type GreylistStore interface {
+	Get(key string) (*GreylistEntry, error)
+	Put(key string, entry *GreylistEntry) error
+}
+
+// Greylist defers the first delivery attempt of each (client network, sender, recipient)
+// triplet, legitimate MTAs retry later while most spam bots don't
+type Greylist struct {
+	// Store defaults to an in-memory store
+	Store GreylistStore
+
+	// Delay is the minimum time before a retry is accepted, 5 minutes by default
+	Delay time.Duration
+
+	// RetryWindow is the time a first seen triplet waits for its retry, 24 hours by default
+	RetryWindow time.Duration
+
+	// AllowFor is the time a passed triplet stays allowlisted since its last
+	// delivery, 35 days by default
+	AllowFor time.Duration
+
+	// AutoAllowlist (if set) allowlists the clients after that many passed triplets
+	AutoAllowlist int
+
+	// ExactIP keys the triplets by the client IP instead of its /24 (IPv4) or /64 (IPv6)
+	// network, the retries of the big providers usually come from another IP of their pool
+	ExactIP bool
+
+	// OnlyDNSBL only greylists the clients listed by a DNSBL with the DNSBLGreylist action
+	OnlyDNSBL bool
+
+	Clock Clock
+
+	once sync.Once
+	mu   sync.Mutex
+}
+
+func (g *Greylist) init() {
+	g.once.Do(func() {
+		if g.Store == nil {
+			g.Store = NewMemoryGreylistStore()
+		}
+	})
+}
+
+// Check reports whether the delivery of the triplet is allowed, it records the first attempts
+func (g *Greylist) Check(ip net.IP, from, to string) (bool, error) {
+	g.init()
+
+	delay := g.Delay
+	if delay < 1 {
+		delay = 5 * time.Minute
+	}
+
+	retryWindow := g.RetryWindow
+	if retryWindow < 1 {
+		retryWindow = 24 * time.Hour
+	}
+
+	allowFor := g.AllowFor
+	if allowFor < 1 {
+		allowFor = 35 * 24 * time.Hour
+	}
+
+	network := g.network(ip)
+	clientKey := "client/" + network
+	key := strings.Join([]string{network, strings.ToLower(from), strings.ToLower(to)}, "/")
+
+	now := clockOrDefault(g.Clock).Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.AutoAllowlist > 0 {
+		client, err := g.Store.Get(clientKey)
+		if err != nil {
+			return false, err
+		}
+
+		if client != nil && client.Count >= g.AutoAllowlist && now.Before(client.Expires) {
+			client.LastSeen, client.Expires = now, now.Add(allowFor)
+			return true, g.Store.Put(clientKey, client)
+		}
+	}
+
+	entry, err := g.Store.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	if entry == nil || !now.Before(entry.Expires) {
+		entry = &GreylistEntry{FirstSeen: now, LastSeen: now, Expires: now.Add(retryWindow)}
+		return false, g.Store.Put(key, entry)
+	}
+
+	entry.LastSeen = now
+
+	if !entry.Passed && now.Sub(entry.FirstSeen) < delay {
+		return false, g.Store.Put(key, entry)
+	}
+
+	passed := !entry.Passed
+	entry.Passed, entry.Expires = true, now.Add(allowFor)
+
+	if err := g.Store.Put(key, entry); err != nil {
+		return false, err
+	}
+
+	if passed && g.AutoAllowlist > 0 {
+		client, err := g.Store.Get(clientKey)
+		if err != nil {
+			return false, err
+		}
+
+		if client == nil || !now.Before(client.Expires) {
+			client = &GreylistEntry{FirstSeen: now}
+		}
+
+		client.Count++
+		client.LastSeen, client.Expires = now, now.Add(allowFor)
+
+		if err := g.Store.Put(clientKey, client); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (g *Greylist) network(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	if g.ExactIP {
+		return ip.String()
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+const maxGreylistEntries = 100000
+
+type memoryGreylistStore struct {
+	mu      sync.RWMutex
+	entries map[string]GreylistEntry
+}
+
+// NewMemoryGreylistStore returns an in-memory GreylistStore
+func NewMemoryGreylistStore() GreylistStore {
+	return &memoryGreylistStore{entries: map[string]GreylistEntry{}}
+}
+
+func (s *memoryGreylistStore) Get(key string) (*GreylistEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+func (s *memoryGreylistStore) Put(key string, entry *GreylistEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the expired entries are dropped relative to the time of the newest entry
+	if len(s.entries) > maxGreylistEntries {
+		for k, e := range s.entries {
+			if !entry.LastSeen.Before(e.Expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	s.entries[key] = *entry
+
+	return nil
+}
+
+// checkGreylist applies ServerConfig.Greylist to the recipient
+func (s *Session) checkGreylist(to string) error {
+	greylist := s.config.Greylist
+	if greylist == nil || s.username != nil || s.allowlisted() {
+		return nil
+	}
+
+	if greylist.OnlyDNSBL && !s.dnsblGreylisted() {
+		return nil
+	}
+
+	if !s.reputationGreylisted() {
+		return nil
+	}
+
+	from := ""
+	if s.From != nil {
+		from = s.From.Address
+	}
+
+	ok, err := greylist.Check(remoteIP(s.connState.RemoteAddr), from, to)
+	if err != nil {
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Greylist lookup failed, try again later"}
+	}
+
+	if !ok {
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Greylisted, please try again later"}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package smtpsrv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	g := &Greylist{Clock: clock}
+
+	check := func(ip, from, to string, want bool) {
+		t.Helper()
+
+		if ok, err := g.Check(net.ParseIP(ip), from, to); err != nil || ok != want {
+			t.Fatalf("Check(%s, %s, %s) = %v, %v, want %v", ip, from, to, ok, err, want)
+		}
+	}
+
+	check("192.0.2.1", "sender@example.org", "rcpt@example.com", false)
+
+	// retried too early
+	clock.now = clock.now.Add(time.Minute)
+	check("192.0.2.1", "sender@example.org", "rcpt@example.com", false)
+
+	// retried from another IP of the same /24 after the delay
+	clock.now = clock.now.Add(5 * time.Minute)
+	check("192.0.2.200", "Sender@Example.org", "rcpt@example.com", true)
+
+	// the passed triplet stays allowlisted, the other ones are greylisted
+	clock.now = clock.now.Add(30 * 24 * time.Hour)
+	check("192.0.2.1", "sender@example.org", "rcpt@example.com", true)
+	check("192.0.2.1", "sender@example.org", "other@example.com", false)
+	check("198.51.100.1", "sender@example.org", "rcpt@example.com", false)
+
+	// a first attempt not retried within the window is forgotten
+	clock.now = clock.now.Add(25 * time.Hour)
+	check("192.0.2.1", "sender@example.org", "other@example.com", false)
+	clock.now = clock.now.Add(5 * time.Minute)
+	check("192.0.2.1", "sender@example.org", "other@example.com", true)
+
+	// the allowlisting expires
+	clock.now = clock.now.Add(36 * 24 * time.Hour)
+	check("192.0.2.1", "sender@example.org", "rcpt@example.com", false)
+}
+
+func TestGreylistAutoAllowlist(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	g := &Greylist{Clock: clock, AutoAllowlist: 2, ExactIP: true}
+
+	for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+		g.Check(net.ParseIP("192.0.2.1"), "sender@example.org", rcpt)
+		clock.now = clock.now.Add(10 * time.Minute)
+
+		if ok, _ := g.Check(net.ParseIP("192.0.2.1"), "sender@example.org", rcpt); !ok {
+			t.Fatalf("%s: the retry is refused", rcpt)
+		}
+	}
+
+	if ok, _ := g.Check(net.ParseIP("192.0.2.1"), "sender@example.org", "c@example.com"); !ok {
+		t.Error("the client isn't allowlisted after 2 passed triplets")
+	}
+
+	if ok, _ := g.Check(net.ParseIP("192.0.2.2"), "sender@example.org", "c@example.com"); ok {
+		t.Error("ExactIP: another IP of the network is allowlisted")
+	}
+}
+
+func TestGreylistSession(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Clock:    clock,
+		Greylist: &Greylist{},
+		Auther:   func(username, password string) error { return nil },
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+
+	if reply := c.expectCmd("RCPT TO:<rcpt@example.com>", 451); reply[:9] != "451 4.7.1" {
+		t.Fatalf("got %q, want 451 4.7.1", reply)
+	}
+
+	// the authenticated clients aren't greylisted
+	c.expectCmd("RSET", 250)
+	c.expectCmd("AUTH PLAIN AGpvaG4Ac2VjcmV0", 235)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("RCPT TO:<other@example.com>", 250)
+}
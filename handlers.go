@@ -1,4 +1,37 @@
 package smtpsrv
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/mail"
+)
+
 type HandlerFunc func(*Context) error
 type AuthFunc func(username, password string) error
+type SecretFunc func(username string) (string, error)
+type OAuthFunc func(username, token string) error
+type CertAuthFunc func(identity string, cert *x509.Certificate) (string, error)
+type HeaderHandlerFunc func(*Context, mail.Header) error
+type DKIMVerifyFunc func(message []byte) ([]DMARCAuthResult, error)
+type SPFPolicyFunc func(c *Context, result SPFResult, explanation string) error
+
+// ConnectionPolicyFunc decides on a client before any SMTP dialogue, the score is exposed by
+// Context.ConnectionScore, an *smtp.SMTPError refuses the client with that reply and any other
+// error defers it with 421
+type ConnectionPolicyFunc func(ip net.IP) (score float64, err error)
+
+// The lifecycle hooks (see ServerConfig.OnConnect and the following fields), returning an
+// *smtp.SMTPError rejects the command with that reply
+type ConnectHookFunc func(addr net.Addr) error
+type HeloHookFunc func(c *Context, hostname string) error
+type TLSHookFunc func(c *Context, state tls.ConnectionState) error
+type AuthHookFunc func(c *Context, mechanism, username string) error
+type AddressHookFunc func(c *Context, address string) error
+type CloseHookFunc func(addr net.Addr)
+
+// RecipientFailureFunc receives the recipients failed by the handler of an accepted message, see RecipientErrors
+type RecipientFailureFunc func(c *Context, address string, err error)
+
+// PanicHandlerFunc receives the panics recovered while serving a client, see ServerConfig.OnPanic
+type PanicHandlerFunc func(addr net.Addr, value interface{}, stack []byte)
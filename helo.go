@@ -0,0 +1,173 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// HeloAction is what a HeloPolicy does when one of its checks fails
+type HeloAction int
+
+const (
+	// HeloIgnore disables the check
+	HeloIgnore HeloAction = iota
+
+	// HeloTag only reports the failure through Context.HeloFailures
+	HeloTag
+
+	// HeloScore also lowers the client reputation (see ServerConfig.Reputation)
+	HeloScore
+
+	// HeloReject rejects MAIL FROM with 550
+	HeloReject
+)
+
+// HeloCheck identifies a HeloPolicy check
+type HeloCheck string
+
+const (
+	HeloNotFQDN      HeloCheck = "not-fqdn"
+	HeloOwnName      HeloCheck = "own-name"
+	HeloUnresolvable HeloCheck = "unresolvable"
+	HeloRDNSMismatch HeloCheck = "rdns-mismatch"
+)
+
+// HeloPolicy validates the EHLO/HELO argument of the clients, go-smtp doesn't let
+// the hostname be refused at EHLO time so the checks run on the first MAIL FROM
+type HeloPolicy struct {
+	// NotFQDN fails when the hostname is neither a FQDN nor an address literal
+	NotFQDN HeloAction
+
+	// OwnName fails when the client claims to be the server (its BannerDomain, one
+	// of OwnNames or the literal of the address it connected to)
+	OwnName  HeloAction
+	OwnNames []string
+
+	// Unresolvable fails when the hostname has no A/AAAA record
+	Unresolvable HeloAction
+
+	// RDNSMismatch fails when the hostname isn't the forward-confirmed reverse DNS of the client
+	RDNSMismatch HeloAction
+}
+
+// check runs the enabled checks against the hostname of the session
+func (p *HeloPolicy) check(c *Context) ([]HeloCheck, error) {
+	s := c.session
+	helo := strings.TrimSuffix(strings.ToLower(s.connState.Hostname), ".")
+	literal := strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]")
+
+	failures := []HeloCheck{}
+	var reject error
+
+	fail := func(check HeloCheck, action HeloAction) {
+		switch action {
+		case HeloIgnore:
+			return
+		case HeloScore:
+			s.recordReputation(ReputationBadHelo)
+		case HeloReject:
+			if reject == nil {
+				reject = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Bad HELO/EHLO hostname (" + string(check) + ")"}
+			}
+		}
+
+		failures = append(failures, check)
+	}
+
+	if p.NotFQDN != HeloIgnore && !literal && !isFQDN(helo) {
+		fail(HeloNotFQDN, p.NotFQDN)
+	}
+
+	if p.OwnName != HeloIgnore && p.isOwnName(s, helo) {
+		fail(HeloOwnName, p.OwnName)
+	}
+
+	if p.Unresolvable != HeloIgnore && !literal && helo != "" {
+		ctx, cancel := context.WithTimeout(s.context(), s.lookupTimeout())
+		addrs, err := resolverOrDefault(s.config.Resolver).LookupIPAddr(ctx, helo)
+		cancel()
+
+		if len(addrs) < 1 && (err == nil || isNotFound(err)) {
+			fail(HeloUnresolvable, p.Unresolvable)
+		}
+	}
+
+	if p.RDNSMismatch != HeloIgnore && !literal {
+		if rdns := c.ReverseDNS(); rdns.Err == nil && (!rdns.Verified || !strings.EqualFold(rdns.Hostname, helo)) {
+			fail(HeloRDNSMismatch, p.RDNSMismatch)
+		}
+	}
+
+	return failures, reject
+}
+
+// checkHelo applies ServerConfig.HeloPolicy, once per announced hostname
+func (s *Session) checkHelo() error {
+	if s.config.HeloPolicy == nil && s.config.OnHelo == nil {
+		return nil
+	}
+
+	if s.heloChecked == nil || *s.heloChecked != s.connState.Hostname {
+		hostname := s.connState.Hostname
+		s.heloChecked = &hostname
+		s.heloFailures, s.heloErr = nil, nil
+
+		if s.config.HeloPolicy != nil {
+			s.heloFailures, s.heloErr = s.config.HeloPolicy.check(&Context{session: s})
+		}
+
+		if s.heloErr == nil && s.config.OnHelo != nil {
+			s.heloErr = s.config.OnHelo(&Context{session: s}, hostname)
+		}
+	}
+
+	return s.heloErr
+}
+
+func (p *HeloPolicy) isOwnName(s *Session, helo string) bool {
+	if helo == "" {
+		return false
+	}
+
+	if strings.EqualFold(helo, s.config.BannerDomain) || containsFold(p.OwnNames, helo) {
+		return true
+	}
+
+	if local := remoteIP(s.connState.LocalAddr); local != nil {
+		ip := net.ParseIP(strings.TrimPrefix(strings.Trim(helo, "[]"), "ipv6:"))
+		return ip != nil && ip.Equal(local)
+	}
+
+	return false
+}
+
+// isFQDN reports whether name is a syntactically valid fully qualified domain name
+func isFQDN(name string) bool {
+	if len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+
+	tld := labels[len(labels)-1]
+
+	return strings.Trim(tld, "0123456789") != ""
+}
@@ -1,11 +1,33 @@
 package smtpsrv
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// TraceHeader is the header carrying the tracing ID of each accepted message
+const TraceHeader = "X-SMTPSRV-ID"
+
+// newTraceID generates a unique-enough tracing ID (a base36 timestamp followed by random bytes)
+func newTraceID(clock Clock) string {
+	b := make([]byte, 6)
+	rand.Read(b)
+
+	return strings.ToUpper(strconv.FormatInt(clockOrDefault(clock).Now().UnixNano(), 36) + hex.EncodeToString(b))
+}
+
 // SplitAddress split the email@addre.ss to <user>@<domain>
 func SplitAddress(address string) (string, string, error) {
 	sepInd := strings.LastIndex(address, "@")
@@ -41,4 +63,117 @@ func SetDefaultServerConfig(cfg *ServerConfig) {
 	if cfg.MaxMessageBytes < 1 {
 		cfg.MaxMessageBytes = 1024 * 1024 * 2
 	}
+
+	if cfg.TLSConfig == nil && cfg.Certificates != nil {
+		cfg.TLSConfig = &tls.Config{}
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+
+	if cfg.AutoResponder != nil && cfg.AutoResponder.Clock == nil {
+		cfg.AutoResponder.Clock = cfg.Clock
+	}
+
+	if cfg.SenderDomainThrottle != nil && cfg.SenderDomainThrottle.Clock == nil {
+		cfg.SenderDomainThrottle.Clock = cfg.Clock
+	}
+
+	if limiter, ok := cfg.RateLimiter.(*TokenBucketLimiter); ok && limiter.Clock == nil {
+		limiter.Clock = cfg.Clock
+	}
+
+	if cfg.Reputation != nil && cfg.Reputation.Clock == nil {
+		cfg.Reputation.Clock = cfg.Clock
+	}
+
+	if lockout, ok := cfg.AuthLimiter.(*AuthLockout); ok && lockout.Clock == nil {
+		lockout.Clock = cfg.Clock
+	}
+
+	if cfg.SessionTickets != nil && cfg.SessionTickets.Clock == nil {
+		cfg.SessionTickets.Clock = cfg.Clock
+	}
+
+	if cfg.CommandFlood != nil && cfg.CommandFlood.Clock == nil {
+		cfg.CommandFlood.Clock = cfg.Clock
+	}
+
+	if cfg.Tarpit != nil && cfg.Tarpit.Clock == nil {
+		cfg.Tarpit.Clock = cfg.Clock
+	}
+
+	if bans, ok := cfg.BanManager.(*TempBanManager); ok && bans.Clock == nil {
+		bans.Clock = cfg.Clock
+	}
+
+	if cfg.Greylist != nil && cfg.Greylist.Clock == nil {
+		cfg.Greylist.Clock = cfg.Clock
+	}
+
+	if cfg.DMARC != nil && cfg.DMARC.Resolver == nil {
+		cfg.DMARC.Resolver = cfg.Resolver
+	}
+
+	if cfg.DMARC != nil && cfg.DMARC.Aggregator != nil {
+		if cfg.DMARC.Aggregator.Resolver == nil {
+			cfg.DMARC.Aggregator.Resolver = cfg.DMARC.Resolver
+		}
+
+		if cfg.DMARC.Aggregator.OrganizationalDomain == nil {
+			cfg.DMARC.Aggregator.OrganizationalDomain = cfg.DMARC.OrganizationalDomain
+		}
+	}
+
+	if cfg.BanThreshold < 1 {
+		cfg.BanThreshold = 5
+	}
+
+	if cfg.BanWindow < 1 {
+		cfg.BanWindow = 10 * time.Minute
+	}
+}
+
+// peekHeader reads the header section of the message, the returned reader
+// replays the whole message including the already consumed header bytes
+func peekHeader(r io.Reader) (mail.Header, io.Reader, error) {
+	var buf bytes.Buffer
+
+	br := bufio.NewReader(r)
+	tp := textproto.NewReader(bufio.NewReader(io.TeeReader(br, &buf)))
+
+	header, err := tp.ReadMIMEHeader()
+
+	return mail.Header(header), io.MultiReader(&buf, br), err
+}
+
+// remoteIP extracts the IP of a remote address, nil if it isn't an IP address
+func remoteIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	return net.ParseIP(host)
+}
+
+// clientCertificate returns the leaf of the first verified client certificate chain
+func clientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		return state.VerifiedChains[0][0]
+	}
+
+	return nil
 }
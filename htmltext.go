@@ -0,0 +1,179 @@
+package smtpsrv
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlSpaceRegexp      = regexp.MustCompile(`[ \t\r\n\f]+`)
+	htmlBlankLinesRegexp = regexp.MustCompile(`\n{3,}`)
+)
+
+// the elements that start on their own line
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "center": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "fieldset": true, "figure": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "main": true, "nav": true,
+	"ol": true, "p": true, "pre": true, "section": true, "table": true, "tr": true,
+	"ul": true,
+}
+
+// the elements whose content isn't rendered
+var htmlSkippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true, "template": true,
+}
+
+// HTMLToText derives a readable plaintext from an html document, the tags are
+// stripped, the entities are decoded, the links are kept as "text (url)" and
+// the line breaks of the block elements are preserved
+func HTMLToText(src string) string {
+	var out strings.Builder
+
+	pre, skip := 0, ""
+	link, linkStart := "", 0
+
+	text := func(s string) {
+		s = html.UnescapeString(s)
+		if pre < 1 {
+			s = htmlSpaceRegexp.ReplaceAllString(s, " ")
+			if str := out.String(); str == "" || strings.HasSuffix(str, "\n") || strings.HasSuffix(str, " ") {
+				s = strings.TrimLeft(s, " ")
+			}
+		}
+
+		out.WriteString(s)
+	}
+
+	// newline ends the current line, blank adds an empty line after it
+	newline := func(blank bool) {
+		str := strings.TrimRight(out.String(), " ")
+		out.Reset()
+		out.WriteString(str)
+
+		if str == "" {
+			return
+		}
+
+		if !strings.HasSuffix(str, "\n") {
+			out.WriteString("\n")
+		}
+
+		if blank && !strings.HasSuffix(out.String(), "\n\n") {
+			out.WriteString("\n")
+		}
+	}
+
+	for len(src) > 0 {
+		i := strings.IndexByte(src, '<')
+		if i < 0 {
+			if skip == "" {
+				text(src)
+			}
+			break
+		}
+
+		if i > 0 && skip == "" {
+			text(src[:i])
+		}
+		src = src[i:]
+
+		if strings.HasPrefix(src, "<!--") {
+			end := strings.Index(src, "-->")
+			if end < 0 {
+				break
+			}
+			src = src[end+3:]
+			continue
+		}
+
+		end := strings.IndexByte(src, '>')
+		if end < 0 {
+			if skip == "" {
+				text(src)
+			}
+			break
+		}
+
+		tag := src[1:end]
+		src = src[end+1:]
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/!?"))
+		if n := strings.IndexAny(name, " \t\r\n/"); n >= 0 {
+			name = name[:n]
+		}
+
+		if skip != "" {
+			if closing && name == skip {
+				skip = ""
+			}
+			continue
+		}
+
+		switch {
+		case htmlSkippedElements[name] && !closing && !strings.HasSuffix(tag, "/"):
+			skip = name
+		case name == "br":
+			out.WriteString("\n")
+		case name == "li" && !closing:
+			newline(false)
+			out.WriteString("- ")
+		case name == "td" || name == "th":
+			if str := out.String(); !closing && str != "" && !strings.HasSuffix(str, "\n") {
+				out.WriteString(" ")
+			}
+		case name == "img" && !closing:
+			if alt := htmlAttribute(tag, "alt"); alt != "" {
+				text(alt)
+			}
+		case name == "a" && !closing:
+			link, linkStart = htmlAttribute(tag, "href"), out.Len()
+		case name == "a" && closing:
+			label := strings.TrimSpace(out.String()[linkStart:])
+			if link != "" && !strings.HasPrefix(link, "#") && label != link && label != strings.TrimPrefix(link, "mailto:") {
+				out.WriteString(" (" + link + ")")
+			}
+			link = ""
+		case htmlBlockElements[name]:
+			if name == "pre" {
+				if closing && pre > 0 {
+					pre--
+				} else if !closing {
+					pre++
+				}
+			}
+			newline(name == "p" || name == "hr" || strings.HasPrefix(name, "h") && len(name) == 2)
+		}
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	// the leading spaces of a pre are kept
+	return strings.Trim(htmlBlankLinesRegexp.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"), "\n")
+}
+
+// htmlAttribute returns the value of the named attribute of the given raw tag
+func htmlAttribute(tag, name string) string {
+	re := regexp.MustCompile(`(?is)\b` + regexp.QuoteMeta(name) + `\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	if m := re.FindStringSubmatch(tag); m != nil {
+		return html.UnescapeString(m[1] + m[2] + m[3])
+	}
+
+	return ""
+}
+
+// PlainText returns the text body of the email, or the text derived from its
+// html body if it doesn't have one
+func (email *Email) PlainText() string {
+	if strings.TrimSpace(email.TextBody) != "" || email.HTMLBody == "" {
+		return email.TextBody
+	}
+
+	return HTMLToText(email.HTMLBody)
+}
@@ -0,0 +1,38 @@
+package smtpsrv
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	for _, tt := range []struct {
+		name, html, want string
+	}{
+		{"paragraphs", "<html><head><title>T</title><style>p{}</style></head><body><p>Hello &amp; <b>welcome</b></p><p>Second</p></body></html>", "Hello & welcome\n\nSecond"},
+		{"line breaks", "line one<br>line two<br/><br>line   three", "line one\nline two\n\nline three"},
+		{"list", "<p>Items:</p><ul><li>one</li><li>two</li></ul>", "Items:\n\n- one\n- two"},
+		{"links", `<a href="https://example.org/x">click</a> <a href="mailto:a@example.org">a@example.org</a> <a href="#top">top</a>`, "click (https://example.org/x) a@example.org top"},
+		{"table", "<table><tr><td>a</td><td>b</td></tr><tr><td>c</td><td>d</td></tr></table>", "a b\nc d"},
+		{"pre", "<pre>  keep\n    spaces</pre><p>after</p>", "  keep\n    spaces\n\nafter"},
+		{"skipped", `<img src="x.png" alt="Logo"> <!-- comment --> text<script>alert("<p>x</p>")</script> end`, "Logo text end"},
+		{"heading", "<h1>Title</h1>body<hr>footer", "Title\n\nbody\n\nfooter"},
+		{"unclosed tag", "a < b", "a < b"},
+	} {
+		if got := HTMLToText(tt.html); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	for _, tt := range []struct {
+		email *Email
+		want  string
+	}{
+		{&Email{TextBody: "text", HTMLBody: "<p>html</p>"}, "text"},
+		{&Email{TextBody: " \n", HTMLBody: "<p>html</p>"}, "html"},
+		{&Email{TextBody: "text"}, "text"},
+	} {
+		if got := tt.email.PlainText(); got != tt.want {
+			t.Errorf("PlainText() = %q, want %q", got, tt.want)
+		}
+	}
+}
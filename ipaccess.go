@@ -0,0 +1,108 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+var replyAccessDenied = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Access denied"}
+
+// IPMatcher matches IPs against a list of CIDR ranges, it is safe for concurrent use so it
+// can be shared with the Auther or Directory implementations
+type IPMatcher struct {
+	mu   sync.RWMutex
+	nets []*net.IPNet
+}
+
+// NewIPMatcher returns a matcher of the specified CIDR ranges (or single IPs)
+func NewIPMatcher(cidrs ...string) (*IPMatcher, error) {
+	m := &IPMatcher{}
+
+	for _, cidr := range cidrs {
+		if err := m.Add(cidr); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Add adds a CIDR range (or a single IP) to the matcher
+func (m *IPMatcher) Add(cidr string) error {
+	cidr = strings.TrimSpace(cidr)
+
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return &net.ParseError{Type: "IP address", Text: cidr}
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.nets = append(m.nets, ipnet)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Contains reports whether ip is in one of the ranges
+func (m *IPMatcher) Contains(ip net.IP) bool {
+	if m == nil || ip == nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, ipnet := range m.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContainsAddr reports whether the IP of addr (e.g: Context.RemoteAddr) is in one of the ranges
+func (m *IPMatcher) ContainsAddr(addr net.Addr) bool {
+	return m.Contains(remoteIP(addr))
+}
+
+// IPAccessPolicy accepts or denies the clients by IP before the greeting, the IPs of Allow
+// are always accepted (so it can carve exceptions out of Deny), then the IPs of Deny are
+// denied, the others are denied only with DefaultDeny
+type IPAccessPolicy struct {
+	Allow       *IPMatcher
+	Deny        *IPMatcher
+	DefaultDeny bool
+
+	// Close closes the denied connections right away instead of replying "554 Access denied"
+	Close bool
+}
+
+// Allowed reports whether the policy accepts ip
+func (p *IPAccessPolicy) Allowed(ip net.IP) bool {
+	if p.Allow.Contains(ip) {
+		return true
+	}
+
+	if p.Deny.Contains(ip) {
+		return false
+	}
+
+	return !p.DefaultDeny
+}
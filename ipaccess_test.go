@@ -0,0 +1,65 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPAccessPolicy(t *testing.T) {
+	if _, err := NewIPMatcher("192.0.2.0/33"); err == nil {
+		t.Error("NewIPMatcher accepts an invalid range")
+	}
+
+	if _, err := NewIPMatcher("example.org"); err == nil {
+		t.Error("NewIPMatcher accepts a hostname")
+	}
+
+	allow, _ := NewIPMatcher("192.0.2.10", "2001:db8::1")
+	deny, _ := NewIPMatcher("192.0.2.0/24", "2001:db8::/32")
+
+	for _, tt := range []struct {
+		policy *IPAccessPolicy
+		ip     string
+		want   bool
+	}{
+		{&IPAccessPolicy{Allow: allow, Deny: deny}, "192.0.2.10", true},
+		{&IPAccessPolicy{Allow: allow, Deny: deny}, "192.0.2.11", false},
+		{&IPAccessPolicy{Allow: allow, Deny: deny}, "2001:db8::1", true},
+		{&IPAccessPolicy{Allow: allow, Deny: deny}, "2001:db8::2", false},
+		{&IPAccessPolicy{Allow: allow, Deny: deny}, "198.51.100.1", true},
+		{&IPAccessPolicy{Allow: allow, DefaultDeny: true}, "198.51.100.1", false},
+		{&IPAccessPolicy{Allow: allow, DefaultDeny: true}, "::ffff:192.0.2.10", true},
+	} {
+		if got := tt.policy.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestIPAccessDenied(t *testing.T) {
+	deny, _ := NewIPMatcher("127.0.0.0/8")
+
+	for _, closeMode := range []bool{false, true} {
+		srv, addr := startTestServer(t, &ServerConfig{IPAccess: &IPAccessPolicy{Deny: deny, Close: closeMode}})
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		greeting, err := bufio.NewReader(conn).ReadString('\n')
+		if closeMode && (err == nil || greeting != "") {
+			t.Errorf("Close: got the greeting %q, want the connection closed", greeting)
+		} else if !closeMode && !strings.HasPrefix(greeting, "554 5.7.1") {
+			t.Errorf("got the greeting %q (%v), want 554 5.7.1", greeting, err)
+		}
+
+		conn.Close()
+		srv.Close()
+	}
+}
@@ -0,0 +1,145 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"time"
+)
+
+// ReceivedMessage is the JSON friendly representation of a received message,
+// the envelope as sent by the client and the parsed email
+type ReceivedMessage struct {
+	ID       string   `json:"id"`
+	Envelope Envelope `json:"envelope"`
+	Message  *Email   `json:"message"`
+}
+
+// Envelope is the SMTP envelope of a received message
+type Envelope struct {
+	MailFrom   string `json:"mail_from"`
+	RcptTo     string `json:"rcpt_to"`
+	RemoteAddr string `json:"remote_addr"`
+	TLS        bool   `json:"tls"`
+	User       string `json:"user,omitempty"`
+}
+
+type jsonAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type jsonFile struct {
+	Filename    string `json:"filename,omitempty"`
+	CID         string `json:"cid,omitempty"`
+	ContentType string `json:"content_type"`
+	Detected    string `json:"detected_type"`
+	Size        int    `json:"size"`
+	Data        []byte `json:"data"`
+}
+
+type jsonEmail struct {
+	Headers    mail.Header   `json:"headers"`
+	Subject    string        `json:"subject"`
+	From       []jsonAddress `json:"from"`
+	Sender     *jsonAddress  `json:"sender,omitempty"`
+	ReplyTo    []jsonAddress `json:"reply_to"`
+	To         []jsonAddress `json:"to"`
+	Cc         []jsonAddress `json:"cc"`
+	Bcc        []jsonAddress `json:"bcc"`
+	Date       *time.Time    `json:"date,omitempty"`
+	MessageID  string        `json:"message_id"`
+	InReplyTo  []string      `json:"in_reply_to"`
+	References []string      `json:"references"`
+
+	TextBody      string     `json:"text_body"`
+	HTMLBody      string     `json:"html_body"`
+	Attachments   []jsonFile `json:"attachments"`
+	EmbeddedFiles []jsonFile `json:"embedded_files"`
+	Messages      []*Email   `json:"messages,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, the attachments and embedded files are
+// base64 encoded, their readers are rewound so they can still be read afterwards
+func (email *Email) MarshalJSON() ([]byte, error) {
+	out := jsonEmail{
+		Headers:       email.Header,
+		Subject:       email.Subject,
+		From:          jsonAddresses(email.From),
+		ReplyTo:       jsonAddresses(email.ReplyTo),
+		To:            jsonAddresses(email.To),
+		Cc:            jsonAddresses(email.Cc),
+		Bcc:           jsonAddresses(email.Bcc),
+		MessageID:     email.MessageID,
+		InReplyTo:     email.InReplyTo,
+		References:    email.References,
+		TextBody:      email.TextBody,
+		HTMLBody:      email.HTMLBody,
+		Attachments:   []jsonFile{},
+		EmbeddedFiles: []jsonFile{},
+		Messages:      email.Messages,
+	}
+
+	if out.InReplyTo == nil {
+		out.InReplyTo = []string{}
+	}
+
+	if out.References == nil {
+		out.References = []string{}
+	}
+
+	if email.Sender != nil {
+		out.Sender = &jsonAddress{Name: email.Sender.Name, Address: email.Sender.Address}
+	}
+
+	if !email.Date.IsZero() {
+		out.Date = &email.Date
+	}
+
+	for i, at := range email.Attachments {
+		data, err := readAllRewind(&email.Attachments[i].Data)
+		if err != nil {
+			return nil, err
+		}
+
+		out.Attachments = append(out.Attachments, jsonFile{Filename: at.Filename, ContentType: at.ContentType, Detected: at.DetectedType, Size: len(data), Data: data})
+	}
+
+	for i, ef := range email.EmbeddedFiles {
+		data, err := readAllRewind(&email.EmbeddedFiles[i].Data)
+		if err != nil {
+			return nil, err
+		}
+
+		out.EmbeddedFiles = append(out.EmbeddedFiles, jsonFile{CID: ef.CID, ContentType: ef.ContentType, Detected: ef.DetectedType, Size: len(data), Data: data})
+	}
+
+	return json.Marshal(out)
+}
+
+func jsonAddresses(list []*mail.Address) []jsonAddress {
+	out := []jsonAddress{}
+	for _, addr := range list {
+		out = append(out, jsonAddress{Name: addr.Name, Address: addr.Address})
+	}
+
+	return out
+}
+
+// readAllRewind reads the whole reader and replaces it with a fresh one over the same bytes
+func readAllRewind(r *io.Reader) ([]byte, error) {
+	if *r == nil {
+		return []byte{}, nil
+	}
+
+	data, err := ioutil.ReadAll(*r)
+	if err != nil {
+		return nil, err
+	}
+
+	*r = bytes.NewReader(data)
+
+	return data, nil
+}
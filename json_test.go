@@ -0,0 +1,103 @@
+package smtpsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEmailJSON(t *testing.T) {
+	email, err := ParseEmail(strings.NewReader(strings.Replace(appleMailAttachment, "\n", "\r\n", -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Subject     string              `json:"subject"`
+		From        []jsonAddress       `json:"from"`
+		Cc          []jsonAddress       `json:"cc"`
+		References  []string            `json:"references"`
+		Date        *string             `json:"date"`
+		TextBody    string              `json:"text_body"`
+		Attachments []jsonFile          `json:"attachments"`
+		Embedded    []jsonFile          `json:"embedded_files"`
+		Headers     map[string][]string `json:"headers"`
+	}
+
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Subject != "Report" || len(got.From) != 1 || got.From[0].Address != "sender@example.com" || got.From[0].Name != "Sender" || got.TextBody != "see attached" {
+		t.Errorf("got %s", data)
+	}
+
+	if got.Headers["To"][0] != "rcpt@example.org" {
+		t.Errorf("got the headers %v", got.Headers)
+	}
+
+	// the empty lists are arrays and the missing date is omitted
+	for _, field := range []string{`"cc":[]`, `"references":[]`, `"embedded_files":[]`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("%s is missing from %s", field, data)
+		}
+	}
+
+	if got.Date != nil {
+		t.Errorf("got the date %q of a message without Date", *got.Date)
+	}
+
+	if len(got.Attachments) != 1 || got.Attachments[0].Filename != "report.pdf" || string(got.Attachments[0].Data) != "%PDF-1.4\n" || got.Attachments[0].Size != 9 {
+		t.Errorf("got the attachments %+v", got.Attachments)
+	}
+
+	// the attachment can still be read after the marshaling
+	if content, _ := ioutil.ReadAll(email.Attachments[0].Data); string(content) != "%PDF-1.4\n" {
+		t.Errorf("read %q after the marshaling", content)
+	}
+}
+
+func TestContextMessage(t *testing.T) {
+	messages := make(chan []byte, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Handler: func(c *Context) error {
+			msg, err := c.Message()
+			if err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(msg)
+			messages <- data
+			return err
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	if reply := c.send("sender@example.org", []string{"rcpt@example.com"}, "Subject: hi\n\nhello"); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("got %q", reply)
+	}
+
+	var got struct {
+		ID       string   `json:"id"`
+		Envelope Envelope `json:"envelope"`
+	}
+
+	if err := json.Unmarshal(<-messages, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID == "" || got.Envelope.MailFrom != "sender@example.org" || got.Envelope.RcptTo != "rcpt@example.com" || !strings.HasPrefix(got.Envelope.RemoteAddr, "127.0.0.1:") || got.Envelope.TLS {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,69 @@
+package smtpsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// WritePIDFile writes the process id to the specified file (replacing a stale one),
+// the returned function removes it and is meant to be deferred until the process exits
+func WritePIDFile(filename string) (func() error, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tmp.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return func() error {
+		return os.Remove(filename)
+	}, nil
+}
+
+// HandleSignals blocks until SIGINT or SIGTERM then gracefully shuts the server down, the active
+// connections get up to timeout to finish before being closed. SIGHUP calls reload (if set), e.g:
+// to reload the TLS certificate and the directory, and keeps serving.
+func (srv *Server) HandleSignals(timeout time.Duration, reload func()) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			if reload != nil {
+				reload()
+			}
+
+			continue
+		}
+
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
+}
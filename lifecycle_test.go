@@ -0,0 +1,44 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "smtpsrv.pid")
+	if err := ioutil.WriteFile(filename, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remove, err := WritePIDFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := strconv.Itoa(os.Getpid()) + "\n"; string(data) != want {
+		t.Fatalf("got %q, want %q", data, want)
+	}
+
+	if err := remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("the PID file wasn't removed: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// DefaultMaxCommandLineLength is the RFC 5321 (section 4.5.3.1.4) command line limit, CRLF included,
+	// to be set as ServerConfig.MaxCommandLineLength
+	DefaultMaxCommandLineLength = 512
+
+	// DefaultMaxTextLineLength is the RFC 5321 (section 4.5.3.1.6) text line limit, CRLF included,
+	// to be set as ServerConfig.MaxTextLineLength
+	DefaultMaxTextLineLength = 1000
+
+	// maxAuthLineLength is the RFC 4954 (section 4) limit of the AUTH command and responses
+	maxAuthLineLength = 12288
+)
+
+var errLineTooLong = errors.New("line too long")
+
+var replyLineTooLong = &smtp.SMTPError{Code: 500, EnhancedCode: smtp.EnhancedCode{5, 5, 2}, Message: "Line too long"}
+
+// lineLimit tracks the length of the current line of a connection, go-smtp only
+// limits the lines per read so a line spread over many reads is buffered whatever its length
+type lineLimit struct {
+	command int
+	text    int
+
+	length int
+	head   []byte
+
+	// auth is set when the next line is an AUTH response (after a 334 reply)
+	auth bool
+}
+
+// newLineLimit returns nil unless a line limit is configured
+func newLineLimit(cfg *ServerConfig) *lineLimit {
+	if cfg.MaxCommandLineLength < 1 && cfg.MaxTextLineLength < 1 {
+		return nil
+	}
+
+	return &lineLimit{command: cfg.MaxCommandLineLength, text: cfg.MaxTextLineLength}
+}
+
+// check counts the read bytes and reports whether a line exceeds its limit
+func (l *lineLimit) check(b []byte, data bool) bool {
+	for _, c := range b {
+		if c == '\n' {
+			l.length, l.head, l.auth = 0, l.head[:0], false
+			continue
+		}
+
+		l.length++
+
+		if len(l.head) < 5 {
+			l.head = append(l.head, c)
+		}
+
+		// the CR is counted in length, the LF isn't yet
+		if limit := l.limit(data); limit > 0 && l.length+1 > limit {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *lineLimit) limit(data bool) int {
+	if data {
+		return l.text
+	}
+
+	if l.command < 1 {
+		return 0
+	}
+
+	if l.auth || len(l.head) == 5 && bytes.EqualFold(l.head, []byte("AUTH ")) {
+		return maxAuthLineLength
+	}
+
+	return l.command
+}
+
+// checkLineLength applies the line limits to the bytes read from the connection,
+// the connection is closed right after the 500 reply once a line is too long
+func (c *conn) checkLineLength(b []byte, data bool) error {
+	if c.lines == nil || !c.lines.check(b, data) {
+		return nil
+	}
+
+	c.sendReply(replyLineTooLong)
+	c.Close()
+
+	return errLineTooLong
+}
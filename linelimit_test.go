@@ -0,0 +1,71 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		command int
+		text    int
+		want    []int
+	}{
+		{"default", 0, 0, []int{250, 250}},
+		{"command", DefaultMaxCommandLineLength, 0, []int{500}},
+		{"text", 0, DefaultMaxTextLineLength, []int{250, 500}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, addr := startTestServer(t, &ServerConfig{MaxCommandLineLength: tt.command, MaxTextLineLength: tt.text, Handler: func(c *Context) error { return nil }})
+			defer srv.Close()
+
+			c := dialTestServer(t, addr)
+			defer c.Close()
+
+			c.expectCmd("HELO client.example.org", 250)
+
+			c.expectCmd("NOOP "+strings.Repeat("a", 600), tt.want[0])
+			if len(tt.want) < 2 {
+				return
+			}
+
+			c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+			c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+			c.expectCmd("DATA", 354)
+			c.write("Subject: long\r\n\r\n" + strings.Repeat("a", 1200) + "\r\n.\r\n")
+			c.expect(tt.want[1])
+		})
+	}
+}
+
+func TestLineLimitCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		chunks []string
+		data   bool
+		auth   bool
+		want   bool
+	}{
+		{"command at the limit", []string{"NOOP " + strings.Repeat("a", 505) + "\r\n"}, false, false, false},
+		{"command over the limit", []string{"NOOP " + strings.Repeat("a", 506) + "\r\n"}, false, false, true},
+		{"command split over reads", []string{"NOOP ", strings.Repeat("a", 300), strings.Repeat("a", 206), "\r\n"}, false, false, true},
+		{"lines counted apart", []string{"NOOP " + strings.Repeat("a", 500) + "\r\nNOOP " + strings.Repeat("a", 500) + "\r\n"}, false, false, false},
+		{"AUTH command", []string{"auth PLAIN " + strings.Repeat("a", 4000) + "\r\n"}, false, false, false},
+		{"AUTH response", []string{strings.Repeat("a", 4000) + "\r\n"}, false, true, false},
+		{"AUTH response over the limit", []string{strings.Repeat("a", maxAuthLineLength) + "\r\n"}, false, true, true},
+		{"text at the limit", []string{strings.Repeat("a", 998) + "\r\n"}, true, false, false},
+		{"text over the limit", []string{strings.Repeat("a", 999) + "\r\n"}, true, false, true},
+	} {
+		l := &lineLimit{command: DefaultMaxCommandLineLength, text: DefaultMaxTextLineLength, auth: tt.auth}
+
+		got := false
+		for _, chunk := range tt.chunks {
+			got = got || l.check([]byte(chunk), tt.data)
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// listener tracks the accepted connections so the sessions are able to drop them
+type listener struct {
+	net.Listener
+	conns     *connRegistry
+	config    *ServerConfig
+	report    func(net.IP, BanReason)
+	tlsConfig *tls.Config
+
+	// serverTLS is the config of the TLS handshakes (see Server.tlsConfig), STARTTLS is
+	// offered when it is set, implicitTLS does the handshake right after accepting
+	serverTLS   *tls.Config
+	implicitTLS bool
+
+	// baseCtx is the ServerConfig.BaseContext of the listener
+	baseCtx context.Context
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	for l.discard(c) {
+		c.Close()
+
+		if c, err = l.Listener.Accept(); err != nil {
+			return nil, err
+		}
+	}
+
+	denied := l.config != nil && l.config.IPAccess != nil && !l.config.IPAccess.Allowed(remoteIP(c.RemoteAddr()))
+
+	wrapped := &conn{Conn: c, registry: l.conns, tlsConfig: l.tlsConfig, serverTLS: l.serverTLS, report: l.report}
+	wrapped.ctx, wrapped.cancel = context.WithCancel(l.connContext(c))
+	if l.implicitTLS {
+		// the handshake happens on the first read or write (the greeting)
+		wrapped.tls = tlsServer(wrapped)
+	}
+
+	admitted := l.conns.admit(wrapped, l.config)
+
+	if l.config != nil {
+		ip := remoteIP(c.RemoteAddr())
+		wrapped.tarpit = l.config.Tarpit
+		wrapped.maxErrors = l.config.MaxErrors
+		wrapped.readTimeout, wrapped.writeTimeout = l.config.ReadTimeout, l.config.WriteTimeout
+		wrapped.lines = newLineLimit(l.config)
+		wrapped.hideAuth = l.config.AuthRequiresTLS
+		wrapped.requireTLS = l.config.TLSConfig != nil
+		wrapped.extensions = l.config.extensions()
+
+		if l.config.ConnectionPolicy != nil || l.config.OnConnect != nil {
+			wrapped.policy = &connectionPolicy{fn: connectHooks(l.config, c.RemoteAddr())}
+		}
+
+		wrapped.onQuit, wrapped.onClose = l.config.OnQuit, l.config.OnClose
+
+		if p := l.config.ReputationProvider; p != nil && p.Provider != nil && p.OnConnect {
+			wrapped.reputation = &connectReputation{policy: p}
+		}
+
+		// the implicit TLS clients speak first (the handshake)
+		if !l.implicitTLS {
+			wrapped.greetDelay = l.config.GreetDelay
+		}
+
+		if denied {
+			wrapped.refusal = replyAccessDenied
+		} else if !admitted {
+			wrapped.refusal = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many connections"}
+		} else if l.config.RateLimiter != nil && !l.config.RateLimiter.Allow(RateLimitConnect, RateLimitKey{IP: ip}) {
+			wrapped.refusal = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many connections from your host, try again later"}
+		} else if l.config.DNSBL != nil && l.config.DNSBL.OnConnect && dnsListsEnabled(l.config) {
+			wrapped.dnsbl = startDNSBL(wrapped.ctx, l.config, ip)
+		}
+
+		// the greeting of the implicit TLS connections is written after the handshake,
+		// they are refused by the backend instead (see Backend.checkConn)
+		wrapped.gateGreeting = !l.implicitTLS && (wrapped.refusal != nil || wrapped.policy != nil || wrapped.reputation != nil || wrapped.dnsbl != nil || wrapped.greetDelay > 0)
+	}
+
+	return wrapped, nil
+}
+
+// connContext returns the parent context of the connection, see ServerConfig.ConnContext
+func (l *listener) connContext(c net.Conn) context.Context {
+	ctx := l.baseCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if l.config != nil && l.config.ConnContext != nil {
+		if connCtx := l.config.ConnContext(ctx, c); connCtx != nil {
+			ctx = connCtx
+		}
+	}
+
+	return ctx
+}
+
+// discard reports whether c is closed without any reply, i.e: the client is banned (see BanChecker)
+// or denied by ServerConfig.IPAccess in Close mode
+func (l *listener) discard(c net.Conn) bool {
+	if l.config == nil {
+		return false
+	}
+
+	ip := remoteIP(c.RemoteAddr())
+
+	if bans, ok := l.config.BanManager.(BanChecker); ok && ip != nil && bans.Banned(ip) {
+		return true
+	}
+
+	return l.config.IPAccess != nil && l.config.IPAccess.Close && !l.config.IPAccess.Allowed(ip)
+}
+
+type conn struct {
+	net.Conn
+	registry     *connRegistry
+	ctx          context.Context
+	cancel       context.CancelFunc
+	report       func(net.IP, BanReason)
+	tlsConfig    *tls.Config
+	closeOnWrite int32
+	closeOnce    sync.Once
+
+	// tls is the TLS session once it is up, the connection terminates TLS (see startTLS) so the
+	// SMTP stream is checked the same way whether it is encrypted or not, serverTLS is the config
+	// of the handshake, STARTTLS isn't offered without it
+	tls       *tls.Conn
+	serverTLS *tls.Config
+
+	// refusal is the reply refusing the client decided at connect time (e.g: rate limited)
+	refusal *smtp.SMTPError
+
+	// dnsbl is the lookup of the client started at connect time (see DNSBLPolicy.OnConnect),
+	// when gateGreeting is set the greeting waits for it and is replaced by the refusal
+	dnsbl        *dnsblCheck
+	gateGreeting bool
+	greeted      int32
+
+	// tarpit and errors implement ServerConfig.Tarpit
+	tarpit *TarpitPolicy
+	errors int32
+
+	// maxErrors and replyErrors implement ServerConfig.MaxErrors, exemptReply
+	// spares the next error reply (see Session.replied)
+	maxErrors   int
+	replyErrors int32
+	exemptReply int32
+
+	greetDelay   time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// data guards the DATA stream (see dataGuard), pending are the filtered bytes not returned yet
+	data    *dataGuard
+	pending []byte
+
+	// held are the bytes read but not returned yet (see readLines), readErr is the read error
+	// returned once they are, out are the replies held back (see holdReply)
+	held    []byte
+	readErr error
+	out     []byte
+
+	lines *lineLimit
+
+	// replacement (if set) replaces the next reply, the connection is then closed
+	replacement *smtp.SMTPError
+
+	// dsnMail holds the DSN parameters of the last MAIL command, mailParams the parameters of
+	// the extensions, mailBody its BODY and mailErr its invalid parameters reply, see stripMailParams
+	dsnMail    *DSNEnvelope
+	mailParams map[string]string
+	mailBody   string
+	mailErr    *smtp.SMTPError
+
+	// extensions are the extensions of the server, see ServerConfig.Extensions
+	extensions []Extension
+
+	// ehlo buffers the lines of the EHLO reply, hideAuth is ServerConfig.AuthRequiresTLS and
+	// requireTLS advertises REQUIRETLS on the encrypted connections (see capabilities)
+	ehlo       []string
+	hideAuth   bool
+	requireTLS bool
+
+	// session is the go-smtp session of the connection, once the client authenticated or sent MAIL
+	session *Session
+
+	policy *connectionPolicy
+
+	// reputation is the ReputationPolicy.OnConnect check, decided before the greeting
+	reputation *connectReputation
+
+	// onQuit and onClose are ServerConfig.OnQuit and ServerConfig.OnClose, quit is set
+	// once the client sent QUIT
+	onQuit  CloseHookFunc
+	onClose CloseHookFunc
+	quit    int32
+}
+
+// Read returns the command lines of the client (see readLines) and the filtered DATA stream (see dataGuard)
+func (c *conn) Read(b []byte) (int, error) {
+	if c.data != nil && (!c.data.done || len(c.pending) > 0) {
+		return c.readData(b)
+	}
+
+	return c.readLines(b)
+}
+
+// readLines returns the command lines read from the client one at a time, a partial line is held back
+// until its end is read (unless it doesn't fit in b) so each line is checked and rewritten as a whole,
+// and the lines go-smtp didn't handle yet are known (see Write). STARTTLS and the commands of the
+// extensions are handled by the connection (see startTLS and CommandExtension)
+func (c *conn) readLines(b []byte) (int, error) {
+	for bytes.IndexByte(c.held, '\n') < 0 && len(c.held) < len(b) && c.readErr == nil {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+
+		n, err := c.stream().Read(b)
+		if n > 0 {
+			if err := c.checkLineLength(b[:n], false); err != nil {
+				return 0, err
+			}
+
+			c.held = append(c.held, b[:n]...)
+		}
+
+		c.readErr = err
+	}
+
+	if len(c.held) < 1 {
+		err := c.readErr
+		c.readErr = nil
+		return 0, err
+	}
+
+	end := len(c.held)
+	if end > len(b) {
+		end = len(b)
+	}
+
+	if i := bytes.IndexByte(c.held[:end], '\n'); i >= 0 {
+		end = i + 1
+
+		if line := c.held[:end]; c.serverTLS != nil && isCommand(line, "STARTTLS") {
+			c.held = c.held[end:]
+			if err := c.startTLS(); err != nil {
+				return 0, err
+			}
+
+			return c.readLines(b)
+		} else if ext, verb, args := c.extensionCommand(line); ext != nil {
+			c.held = c.held[end:]
+			if err := c.runExtension(ext, verb, args); err != nil {
+				return 0, err
+			}
+
+			return c.readLines(b)
+		}
+	}
+
+	n := copy(b, c.held[:end])
+	c.held = c.held[end:]
+	n = c.stripMailParams(b[:n])
+
+	if c.onQuit != nil && indexCommand(b[:n], "QUIT") >= 0 {
+		atomic.StoreInt32(&c.quit, 1)
+	}
+
+	return n, nil
+}
+
+// stream is the connection the SMTP stream is read from and written to, the TLS session once it is up
+func (c *conn) stream() net.Conn {
+	if c.tls != nil {
+		return c.tls
+	}
+
+	return c.Conn
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.gateGreeting && atomic.CompareAndSwapInt32(&c.greeted, 0, 1) {
+		reply := c.refusal
+		if reply == nil && c.policy != nil {
+			reply = c.policy.decide(remoteIP(c.RemoteAddr()))
+		}
+
+		if reply == nil && c.reputation != nil {
+			reply = c.reputation.decide(remoteIP(c.RemoteAddr()))
+		}
+
+		if reply == nil && c.greetDelay > 0 && c.talksEarly() {
+			reply = errEarlyTalker
+		}
+
+		if reply == nil && c.dnsbl != nil {
+			<-c.dnsbl.done
+			reply = dnsblReply(remoteIP(c.RemoteAddr()), c.dnsbl.worst(), true)
+		}
+
+		c.extendWriteDeadline()
+
+		if reply != nil {
+			c.sendReply(reply)
+			c.Close()
+
+			return 0, errConnectionRefused
+		}
+	}
+
+	if c.replacement != nil {
+		c.extendWriteDeadline()
+		c.sendReply(c.replacement)
+		c.Close()
+
+		return len(b), nil
+	}
+
+	data := b
+
+	// go-smtp writes the EHLO/LHLO reply line by line, it is edited once complete
+	if c.ehlo != nil || bytes.HasPrefix(b, []byte("250-Hello ")) {
+		c.ehlo = append(c.ehlo, string(bytes.TrimRight(b[4:], "\r\n")))
+		if b[3] == '-' {
+			return len(b), nil
+		}
+
+		data, c.ehlo = c.capabilities(c.ehlo), nil
+	}
+
+	if c.tarpit != nil && isSyntaxErrorReply(b) {
+		c.tarpit.wait(int(atomic.AddInt32(&c.errors, 1)))
+		c.extendWriteDeadline()
+	}
+
+	tooManyErrors := c.countReplyError(b)
+
+	// the message follows the 354 reply (RFC 2920 makes DATA a synchronization point)
+	if replyCode(b) == 354 {
+		c.data = &dataGuard{}
+	}
+
+	if c.lines != nil && replyCode(b) == 334 {
+		c.lines.auth = true
+	}
+
+	var n int
+	var err error
+
+	// the replies of the pipelined commands are held back until the last one (RFC 2920 section 3.1)
+	if c.holdReply(b) {
+		c.out = append(c.out, data...)
+		n = len(b)
+	} else {
+		if len(c.out) > 0 {
+			data, c.out = append(c.out, data...), nil
+		}
+
+		// the written data may differ from b (e.g: the EHLO reply)
+		if n, err = c.stream().Write(data); err == nil || n > len(b) {
+			n = len(b)
+		}
+	}
+
+	if tooManyErrors {
+		c.sendReply(errTooManyErrors)
+		c.Close()
+
+		if c.report != nil {
+			c.report(remoteIP(c.RemoteAddr()), BanProtocolErrors)
+		}
+	}
+
+	if atomic.LoadInt32(&c.closeOnWrite) == 1 {
+		c.Close()
+	}
+
+	return n, err
+}
+
+// holdReply reports whether the reply b can wait for the ones of the next commands: the client
+// pipelined them (a complete line is held, see readLines) and doesn't wait for this one to go on
+func (c *conn) holdReply(b []byte) bool {
+	switch replyCode(b) {
+	case 221, 334, 354, 421:
+		return false
+	}
+
+	return atomic.LoadInt32(&c.closeOnWrite) == 0 && bytes.IndexByte(c.held, '\n') >= 0
+}
+
+// flush writes the replies held back (see holdReply)
+func (c *conn) flush() error {
+	if len(c.out) < 1 {
+		return nil
+	}
+
+	_, err := c.stream().Write(c.out)
+	c.out = nil
+
+	return err
+}
+
+// sendReply writes a reply bypassing the SMTP engine, after the replies held back
+func (c *conn) sendReply(reply *smtp.SMTPError) {
+	c.flush()
+	writeReply(c.stream(), reply)
+}
+
+// capabilities returns the EHLO reply of the go-smtp lines (the greeting then the capabilities)
+// edited for what the connection handles: DSN, the extensions, STARTTLS and REQUIRETLS, and AUTH hidden on the
+// unencrypted connections if ServerConfig.AuthRequiresTLS is set
+func (c *conn) capabilities(lines []string) []byte {
+	var b bytes.Buffer
+
+	out := make([]string, 0, len(lines)+3)
+	for i, line := range lines {
+		keyword := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if i > 0 && keyword == "AUTH" && c.hideAuth && c.tls == nil {
+			continue
+		}
+
+		out = append(out, line)
+
+		if keyword == "PIPELINING" {
+			out = append(out, "DSN")
+		}
+	}
+
+	for _, ext := range c.extensions {
+		out = append(out, ext.Keyword())
+	}
+
+	if c.serverTLS != nil && c.tls == nil {
+		out = append(out, "STARTTLS")
+	}
+
+	if c.requireTLS && c.tls != nil {
+		out = append(out, "REQUIRETLS")
+	}
+
+	for i, line := range out {
+		sep := "-"
+		if i == len(out)-1 {
+			sep = " "
+		}
+
+		fmt.Fprintf(&b, "250%s%s\r\n", sep, line)
+	}
+
+	return b.Bytes()
+}
+
+func (c *conn) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		c.registry.remove(c)
+		err = c.Conn.Close()
+		c.cancel()
+
+		if c.onQuit != nil && atomic.LoadInt32(&c.quit) == 1 {
+			c.onQuit(c.RemoteAddr())
+		}
+
+		if c.onClose != nil {
+			c.onClose(c.RemoteAddr())
+		}
+	})
+
+	return err
+}
+
+// extendWriteDeadline restarts the write timeout set by the SMTP engine before a write that
+// was delayed by the connection itself (e.g: the tarpit)
+func (c *conn) extendWriteDeadline() {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// extendReadDeadline restarts the read timeout set by the SMTP engine after a command handled
+// by the connection itself (e.g: STARTTLS)
+func (c *conn) extendReadDeadline() {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+}
+
+// writeReply writes a reply bypassing the SMTP engine
+func writeReply(w io.Writer, reply *smtp.SMTPError) {
+	fmt.Fprintf(w, "%d %d.%d.%d %s\r\n", reply.Code, reply.EnhancedCode[0], reply.EnhancedCode[1], reply.EnhancedCode[2], reply.Message)
+}
+
+// replaceReply makes the connection write reply instead of the next one of the SMTP engine
+// and close right after
+func (c *conn) replaceReply(reply *smtp.SMTPError) {
+	c.replacement = reply
+}
+
+// closeAfterReply makes the connection close right after the next reply is written
+func (c *conn) closeAfterReply() {
+	atomic.StoreInt32(&c.closeOnWrite, 1)
+}
+
+// indexCommand returns the offset right after the specified command line (without arguments),
+// -1 if there is none
+func indexCommand(b []byte, cmd string) int {
+	for start := 0; start < len(b); {
+		end := bytes.IndexByte(b[start:], '\n')
+		if end < 0 {
+			return -1
+		}
+
+		end += start + 1
+		if isCommand(b[start:end], cmd) {
+			return end
+		}
+
+		start = end
+	}
+
+	return -1
+}
+
+// isCommand reports whether line is the specified command (without arguments)
+func isCommand(line []byte, cmd string) bool {
+	return bytes.EqualFold(bytes.TrimSpace(line), []byte(cmd))
+}
+
+// hasPrefixFold reports whether line starts with prefix, case insensitively
+func hasPrefixFold(line []byte, prefix string) bool {
+	return len(line) >= len(prefix) && bytes.EqualFold(line[:len(prefix)], []byte(prefix))
+}
+
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*conn
+	perIP map[string]int
+}
+
+// admit adds the connection and reports whether it is within ServerConfig.MaxConnections
+// and ServerConfig.MaxConnectionsPerIP, the refused ones are tracked until they are closed
+func (r *connRegistry) admit(c *conn, cfg *ServerConfig) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conns == nil {
+		r.conns = map[string]*conn{}
+		r.perIP = map[string]int{}
+	}
+
+	ip := remoteIP(c.RemoteAddr()).String()
+	admitted := true
+
+	if cfg != nil && cfg.MaxConnections > 0 && len(r.conns) >= cfg.MaxConnections {
+		admitted = false
+	}
+
+	if cfg != nil && cfg.MaxConnectionsPerIP > 0 && r.perIP[ip] >= cfg.MaxConnectionsPerIP {
+		admitted = false
+	}
+
+	if _, ok := r.conns[c.RemoteAddr().String()]; !ok {
+		r.perIP[ip]++
+	}
+
+	r.conns[c.RemoteAddr().String()] = c
+
+	return admitted
+}
+
+func (r *connRegistry) remove(c *conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conns[c.RemoteAddr().String()] == c {
+		delete(r.conns, c.RemoteAddr().String())
+
+		ip := remoteIP(c.RemoteAddr()).String()
+		if r.perIP[ip]--; r.perIP[ip] < 1 {
+			delete(r.perIP, ip)
+		}
+	}
+}
+
+func (r *connRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.conns)
+}
+
+func (r *connRegistry) get(addr net.Addr) *conn {
+	if addr == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.conns[addr.String()]
+}
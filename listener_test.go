@@ -0,0 +1,85 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexCommand(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		cmd   string
+		want  int
+	}{
+		{"STARTTLS\r\n", "STARTTLS", 10},
+		{"starttls\r\n", "STARTTLS", 10},
+		{"  STARTTLS  \r\n", "STARTTLS", 14},
+		{"NOOP\r\nSTARTTLS\r\nMAIL FROM:<a@b.c>\r\n", "STARTTLS", 16},
+		{"STARTTLS\n", "STARTTLS", 9},
+		{"STARTTLS", "STARTTLS", -1},
+		{"STARTTLS now\r\n", "STARTTLS", -1},
+		{"MAIL FROM:<starttls@example.com>\r\n", "STARTTLS", -1},
+		{"", "STARTTLS", -1},
+	} {
+		if got := indexCommand([]byte(tt.input), tt.cmd); got != tt.want {
+			t.Errorf("indexCommand(%q, %q) = %d, want %d", tt.input, tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestRefusedStartTLSKeepsGuards(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{StrictLineEndings: true, MaxTextLineLength: 1000, Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	for _, message := range []string{
+		"Subject: bare\r\n\r\nbare\nline\r\n.\r\n",
+		"Subject: long\r\n\r\n" + strings.Repeat("a", 1200) + "\r\n.\r\n",
+	} {
+		c := dialTestServer(t, addr)
+
+		c.expectCmd("EHLO client.example.org", 250)
+		c.expectCmd("STARTTLS", 502)
+		c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write(message)
+		c.expect(500)
+
+		c.Close()
+	}
+}
+
+func TestPipelinedReplies(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{
+		OnRcpt: func(c *Context, address string) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		},
+		Handler: func(c *Context) error { return nil },
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.write("MAIL FROM:<sender@example.org>\r\nRCPT TO:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n")
+
+	// the replies come in a single write, the one of MAIL doesn't wait alone for the RCPT ones
+	b := make([]byte, 4096)
+
+	n, err := c.conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replies := strings.Count(string(b[:n]), "\r\n"); replies != 4 {
+		t.Fatalf("the pipelined commands got %d replies in the first write: %q", replies, b[:n])
+	}
+
+	c.write("Subject: hi\r\n\r\nhello\r\n.\r\nRSET\r\nNOOP\r\n")
+	c.expect(250)
+	c.expect(250)
+	c.expect(250)
+}
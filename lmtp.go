@@ -0,0 +1,101 @@
+package smtpsrv
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// RecipientErrors lets the handler fail some recipients of a message only, keyed by their RCPT
+// address (see Context.RcptTo), the recipients missing from it are delivered.
+// Over LMTP (see ServerConfig.LMTP) each recipient gets its own reply, over SMTP the message is
+// accepted unless all of them failed and the failures go to ServerConfig.OnRecipientFailure
+// (e.g: to bounce them), the temporary ones included since the client won't retry them
+type RecipientErrors map[string]error
+
+func (e RecipientErrors) Error() string {
+	return strconv.Itoa(len(e)) + " recipient(s) failed"
+}
+
+func (e RecipientErrors) lookup(address string) error {
+	if err, ok := e[address]; ok {
+		return err
+	}
+
+	for rcpt, err := range e {
+		if strings.EqualFold(rcpt, address) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acceptedRcpt is a recipient of the transaction, arg is the RCPT argument as go-smtp knows it
+type acceptedRcpt struct {
+	arg     string
+	address string
+	dsn     *DSNRecipient
+	mailbox *Mailbox
+}
+
+// deliver runs the handler of the transaction and applies its RecipientErrors
+func (s *Session) deliver(c *Context) error {
+	err := s.transactionHandler()(c)
+
+	var failures RecipientErrors
+	if !errors.As(err, &failures) {
+		return err
+	}
+
+	s.failures = map[string]error{}
+
+	var first error
+
+	for _, rcpt := range s.accepted {
+		if err := failures.lookup(rcpt.address); err != nil {
+			s.failures[strings.ToLower(rcpt.address)] = toSMTPError(err)
+
+			if first == nil {
+				first = s.failures[strings.ToLower(rcpt.address)]
+			}
+		}
+	}
+
+	if s.config.LMTP || first == nil {
+		return nil
+	}
+
+	if len(s.failures) == len(s.accepted) {
+		return first
+	}
+
+	if s.config.OnRecipientFailure != nil {
+		for _, rcpt := range s.accepted {
+			if err := s.failures[strings.ToLower(rcpt.address)]; err != nil {
+				s.config.OnRecipientFailure(c, rcpt.address, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LMTPData implements smtp.LMTPSession, the recipients failed by the handler get their
+// own reply, the others get the one of Data (the 250 of queuedReply once accepted)
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	err := s.Data(r)
+
+	for _, rcpt := range s.accepted {
+		if failure := s.failures[strings.ToLower(rcpt.address)]; failure != nil {
+			status.SetStatus(rcpt.arg, failure)
+		} else {
+			status.SetStatus(rcpt.arg, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,50 @@
+package smtpsrv
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLMTPRecipientStatus(t *testing.T) {
+	handler := func(c *Context) error {
+		return RecipientErrors{
+			"full@example.com":    &SMTPError{Code: 452, EnhancedCode: "4.2.2", Message: "Mailbox full"},
+			"UNKNOWN@example.com": ErrNoSuchUser,
+			"broken@example.com":  errors.New("disk failure"),
+		}
+	}
+
+	srv, addr := startTestServer(t, &ServerConfig{LMTP: true, Handler: handler})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("LHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+
+	tests := []struct {
+		rcpt  string
+		reply string
+	}{
+		{"john@example.com", "250 2.0.0 <john@example.com> OK: queued as "},
+		{"full@example.com", "452 4.2.2 <full@example.com> Mailbox full"},
+		{"unknown@example.com", "550 5.1.1 <unknown@example.com> No such user here"},
+		{"broken@example.com", "554 5.0.0 <broken@example.com> "},
+		{"jane@example.com", "250 2.0.0 <jane@example.com> OK: queued as "},
+	}
+
+	for _, tt := range tests {
+		c.expectCmd("RCPT TO:<"+tt.rcpt+">", 250)
+	}
+
+	c.expectCmd("DATA", 354)
+	c.write("Subject: lmtp\r\n\r\nhello\r\n.\r\n")
+
+	for _, tt := range tests {
+		if reply := c.reply(); !strings.HasPrefix(reply, tt.reply) {
+			t.Errorf("%s: got %q, want %q", tt.rcpt, reply, tt.reply)
+		}
+	}
+}
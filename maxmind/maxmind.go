@@ -0,0 +1,80 @@
+// Package maxmind reads the MaxMind DB (.mmdb) databases, e.g: GeoLite2-Country and
+// GeoLite2-ASN, for smtpsrv.GeoIPPolicy
+package maxmind
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is a MaxMind DB database, it implements smtpsrv.CountryLookup and smtpsrv.ASNLookup
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+// Open loads the specified database file
+func Open(filename string) (*DB, error) {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{reader: reader}, nil
+}
+
+// FromBytes parses a database already in memory
+func FromBytes(data []byte) (*DB, error) {
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{reader: reader}, nil
+}
+
+// Metadata returns the database metadata (database type, build epoch ...)
+func (db *DB) Metadata() maxminddb.Metadata {
+	return db.reader.Metadata
+}
+
+// Country returns the ISO code of the country of ip (GeoIP2/GeoLite2 Country and City databases)
+func (db *DB) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+
+	if record.Country.ISOCode == "" {
+		return record.RegisteredCountry.ISOCode, nil
+	}
+
+	return record.Country.ISOCode, nil
+}
+
+// ASN returns the autonomous system number and organization of ip (GeoLite2 ASN database)
+func (db *DB) ASN(ip net.IP) (uint, string, error) {
+	var record struct {
+		Number       uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
+
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return 0, "", err
+	}
+
+	return record.Number, record.Organization, nil
+}
+
+// Close releases the database
+func (db *DB) Close() error {
+	return db.reader.Close()
+}
@@ -0,0 +1,132 @@
+package maxmind
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"testing"
+)
+
+// encode writes v in the MaxMind DB data section format (string, uint32 and map only, shorter
+// than 285 bytes)
+func encode(b *bytes.Buffer, v interface{}) {
+	control := func(typ, size int) {
+		if size < 29 {
+			b.WriteByte(byte(typ<<5 | size))
+		} else {
+			b.Write([]byte{byte(typ<<5 | 29), byte(size - 29)})
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		b.WriteString(v)
+	case uint32:
+		control(6, 4)
+		b.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		control(7, len(v))
+		for _, key := range keys {
+			encode(b, key)
+			encode(b, v[key])
+		}
+	}
+}
+
+// testDB builds an IPv4 database (24 bits records) holding a record for network/24
+func testDB(t *testing.T, network net.IP, record map[string]interface{}) *DB {
+	t.Helper()
+
+	const nodeCount = 24
+
+	var b bytes.Buffer
+	writeRecord := func(n uint32) {
+		b.Write([]byte{byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+
+	// a chain of nodes following the network bits, the other branches are empty
+	prefix := network.To4()
+	for i := 0; i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = nodeCount + 16 // the first data section record
+		}
+
+		if prefix[i/8]>>(7-uint(i%8))&1 == 0 {
+			writeRecord(next)
+			writeRecord(nodeCount)
+		} else {
+			writeRecord(nodeCount)
+			writeRecord(next)
+		}
+	}
+
+	b.Write(make([]byte, 16))
+	encode(&b, record)
+
+	b.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(&b, map[string]interface{}{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"database_type":               "Test",
+		"ip_version":                  uint32(4),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint32(24),
+	})
+
+	db, err := FromBytes(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestCountry(t *testing.T) {
+	for _, tt := range []struct {
+		record map[string]interface{}
+		ip     string
+		want   string
+	}{
+		{map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}}, "192.0.2.1", "FR"},
+		{map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "DE"}}, "192.0.2.200", "DE"},
+		{map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}}, "198.51.100.1", ""},
+	} {
+		db := testDB(t, net.ParseIP("192.0.2.0"), tt.record)
+
+		if got, err := db.Country(net.ParseIP(tt.ip)); err != nil || got != tt.want {
+			t.Errorf("Country(%s) = %q, %v, want %q", tt.ip, got, err, tt.want)
+		}
+
+		if db.Metadata().DatabaseType != "Test" {
+			t.Errorf("Metadata().DatabaseType = %q", db.Metadata().DatabaseType)
+		}
+	}
+}
+
+func TestASN(t *testing.T) {
+	db := testDB(t, net.ParseIP("203.0.113.0"), map[string]interface{}{
+		"autonomous_system_number":       uint32(64496),
+		"autonomous_system_organization": "Example",
+	})
+	defer db.Close()
+
+	if asn, org, err := db.ASN(net.ParseIP("203.0.113.7")); err != nil || asn != 64496 || org != "Example" {
+		t.Errorf("ASN(203.0.113.7) = %d, %q, %v", asn, org, err)
+	}
+
+	if asn, _, err := db.ASN(net.ParseIP("192.0.2.1")); err != nil || asn != 0 {
+		t.Errorf("ASN(192.0.2.1) = %d, %v, want 0", asn, err)
+	}
+
+	if _, _, err := db.ASN(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("an IPv6 address is looked up in an IPv4 database")
+	}
+}
@@ -0,0 +1,776 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// the milter commands (server to milter)
+const (
+	milterCmdAbort   = 'A'
+	milterCmdBody    = 'B'
+	milterCmdConnect = 'C'
+	milterCmdMacro   = 'D'
+	milterCmdEOB     = 'E'
+	milterCmdHelo    = 'H'
+	milterCmdHeader  = 'L'
+	milterCmdMail    = 'M'
+	milterCmdEOH     = 'N'
+	milterCmdOptNeg  = 'O'
+	milterCmdQuit    = 'Q'
+	milterCmdRcpt    = 'R'
+	milterCmdData    = 'T'
+)
+
+// the milter replies
+const (
+	milterAccept     = 'a'
+	milterReplBody   = 'b'
+	milterContinue   = 'c'
+	milterDiscard    = 'd'
+	milterAddHeader  = 'h'
+	milterInsHeader  = 'i'
+	milterChgHeader  = 'm'
+	milterProgress   = 'p'
+	milterQuarantine = 'q'
+	milterReject     = 'r'
+	milterSkip       = 's'
+	milterTempfail   = 't'
+	milterReplyCode  = 'y'
+)
+
+// the actions the milters are allowed to take, the recipients and the sender can't be changed
+const (
+	milterActAddHeaders = 0x01
+	milterActChgBody    = 0x02
+	milterActChgHeaders = 0x10
+	milterActQuarantine = 0x20
+)
+
+// the protocol steps the milters are allowed to disable (no command) or not to reply to
+const (
+	milterNoConnect    = 0x01
+	milterNoHelo       = 0x02
+	milterNoMail       = 0x04
+	milterNoRcpt       = 0x08
+	milterNoBody       = 0x10
+	milterNoHeaders    = 0x20
+	milterNoEOH        = 0x40
+	milterNoReplyHdr   = 0x80
+	milterNoUnknown    = 0x100
+	milterNoData       = 0x200
+	milterSkipBody     = 0x400
+	milterNoReplyConn  = 0x1000
+	milterNoReplyHelo  = 0x2000
+	milterNoReplyMail  = 0x4000
+	milterNoReplyRcpt  = 0x8000
+	milterNoReplyData  = 0x10000
+	milterNoReplyUnkn  = 0x20000
+	milterNoReplyEOH   = 0x40000
+	milterNoReplyBody  = 0x80000
+	milterVersion      = 6
+	milterMaxChunkSize = 65535
+)
+
+var errMilterProtocol = errors.New("milter: protocol error")
+
+// Milter is a Sendmail filter (e.g: OpenDKIM, OpenDMARC, the rspamd proxy) consulted at each SMTP
+// phase, it is connected to at the first MAIL FROM of a session since go-smtp handles EHLO itself
+type Milter struct {
+	// Network and Addr locate the milter, e.g: tcp and 127.0.0.1:8891 or unix and /run/opendkim/opendkim.sock
+	Network string
+	Addr    string
+
+	// Timeout bounds every exchange with the milter, 10 seconds by default
+	Timeout time.Duration
+
+	// FailOpen ignores the unreachable or failing milter instead of replying 451
+	FailOpen bool
+}
+
+func (m *Milter) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+
+	return 10 * time.Second
+}
+
+// milterConn is the connection of a session to a Milter
+type milterConn struct {
+	milter   *Milter
+	conn     net.Conn
+	r        *bufio.Reader
+	protocol uint32
+
+	// accepted is set once the milter accepted the connection, skipped once it accepted
+	// (or discarded) the current message
+	accepted bool
+	skipped  bool
+	failed   bool
+
+	// mods are the modifications of the current message
+	mods []milterModification
+}
+
+// dialMilter connects to m and negotiates the protocol
+func dialMilter(m *Milter) (*milterConn, error) {
+	network := m.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	c, err := net.DialTimeout(network, m.Addr, m.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &milterConn{milter: m, conn: c, r: bufio.NewReader(c)}
+
+	const protocol = milterNoConnect | milterNoHelo | milterNoMail | milterNoRcpt | milterNoBody | milterNoHeaders |
+		milterNoEOH | milterNoReplyHdr | milterNoUnknown | milterNoData | milterSkipBody | milterNoReplyConn |
+		milterNoReplyHelo | milterNoReplyMail | milterNoReplyRcpt | milterNoReplyData | milterNoReplyUnkn |
+		milterNoReplyEOH | milterNoReplyBody
+
+	negotiation := make([]byte, 12)
+	binary.BigEndian.PutUint32(negotiation, milterVersion)
+	binary.BigEndian.PutUint32(negotiation[4:], milterActAddHeaders|milterActChgBody|milterActChgHeaders|milterActQuarantine)
+	binary.BigEndian.PutUint32(negotiation[8:], protocol)
+
+	if err := mc.send(milterCmdOptNeg, negotiation); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	code, data, err := mc.read()
+	if err == nil && (code != milterCmdOptNeg || len(data) < 12) {
+		err = errMilterProtocol
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	mc.protocol = binary.BigEndian.Uint32(data[8:]) & protocol
+
+	return mc, nil
+}
+
+func (mc *milterConn) send(cmd byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+
+	mc.conn.SetWriteDeadline(time.Now().Add(mc.milter.timeout()))
+
+	_, err := mc.conn.Write(append(packet, data...))
+
+	return err
+}
+
+func (mc *milterConn) read() (byte, []byte, error) {
+	mc.conn.SetReadDeadline(time.Now().Add(mc.milter.timeout()))
+
+	var size [4]byte
+	if _, err := io.ReadFull(mc.r, size[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 1 || n > 1<<20 {
+		return 0, nil, errMilterProtocol
+	}
+
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(mc.r, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+// command sends a command unless the milter disabled it (skip) and returns its reply, continue
+// if the milter doesn't reply to it (noReply)
+func (mc *milterConn) command(cmd byte, data []byte, skip, noReply uint32) (byte, []byte, error) {
+	if mc.protocol&skip != 0 {
+		return milterContinue, nil, nil
+	}
+
+	if err := mc.send(cmd, data); err != nil {
+		return 0, nil, err
+	}
+
+	if mc.protocol&noReply != 0 {
+		return milterContinue, nil, nil
+	}
+
+	for {
+		code, data, err := mc.read()
+		if err != nil || code != milterProgress {
+			return code, data, err
+		}
+	}
+}
+
+// macros defines the macros of the next command
+func (mc *milterConn) macros(cmd byte, pairs ...string) error {
+	data := []byte{cmd}
+	for _, s := range pairs {
+		data = append(append(data, s...), 0)
+	}
+
+	return mc.send(milterCmdMacro, data)
+}
+
+func (mc *milterConn) close() {
+	mc.send(milterCmdQuit, nil)
+	mc.conn.Close()
+}
+
+// active reports whether the milter is still consulted for the current message
+func (mc *milterConn) active() bool {
+	return !mc.accepted && !mc.skipped && !mc.failed
+}
+
+// milterFields splits a NUL terminated strings packet
+func milterFields(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+// openMilters connects to ServerConfig.Milters and runs the connect and helo phases
+func (s *Session) openMilters() error {
+	if s.milters != nil || len(s.config.Milters) < 1 {
+		return nil
+	}
+
+	ip := remoteIP(s.connState.RemoteAddr)
+
+	connect := []byte("[" + ip.String() + "]\x00")
+	switch {
+	case ip == nil:
+		connect = []byte("localhost\x00U")
+	case ip.To4() != nil:
+		connect = append(connect, '4')
+	default:
+		connect = append(connect, '6')
+	}
+
+	if ip != nil {
+		port := 0
+		if addr, ok := s.connState.RemoteAddr.(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+
+		connect = append(connect, byte(port>>8), byte(port))
+		connect = append(append(connect, ip.String()...), 0)
+	}
+
+	hostname := s.config.BannerDomain
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	s.milters = make([]*milterConn, 0, len(s.config.Milters))
+
+	for _, m := range s.config.Milters {
+		mc, err := dialMilter(m)
+		if err != nil {
+			mc = &milterConn{milter: m}
+			if err := s.milterFailed(mc); err != nil {
+				return err
+			}
+
+			s.milters = append(s.milters, mc)
+			continue
+		}
+
+		s.milters = append(s.milters, mc)
+
+		if err := mc.macros(milterCmdConnect, "j", hostname, "{daemon_name}", "smtpsrv"); err != nil {
+			return s.milterFailed(mc)
+		}
+
+		code, data, err := mc.command(milterCmdConnect, connect, milterNoConnect, milterNoReplyConn)
+		if reply, err := s.milterReply(mc, code, data, err, true); reply != nil || err != nil {
+			return orMilterError(reply, err)
+		}
+
+		if !mc.active() {
+			continue
+		}
+
+		code, data, err = mc.command(milterCmdHelo, []byte(s.connState.Hostname+"\x00"), milterNoHelo, milterNoReplyHelo)
+		if reply, err := s.milterReply(mc, code, data, err, true); reply != nil || err != nil {
+			return orMilterError(reply, err)
+		}
+	}
+
+	return nil
+}
+
+// orMilterError returns the reply if any, the error otherwise (avoiding the typed nil pitfall)
+func orMilterError(reply *smtp.SMTPError, err error) error {
+	if reply != nil {
+		return reply
+	}
+
+	return err
+}
+
+// milterFailed closes a failing milter, it returns the 451 reply unless Milter.FailOpen is set
+func (s *Session) milterFailed(mc *milterConn) error {
+	if mc.conn != nil {
+		mc.conn.Close()
+	}
+
+	mc.failed = true
+
+	if mc.milter.FailOpen {
+		return nil
+	}
+
+	return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Milter unavailable, try again later"}
+}
+
+// milterReply translates the reply of a milter, connecting is set during the connect and helo phases
+func (s *Session) milterReply(mc *milterConn, code byte, data []byte, err error, connecting bool) (*smtp.SMTPError, error) {
+	if err != nil {
+		return nil, s.milterFailed(mc)
+	}
+
+	switch code {
+	case milterContinue:
+		return nil, nil
+	case milterAccept:
+		if connecting {
+			mc.accepted = true
+		} else {
+			mc.skipped = true
+		}
+
+		return nil, nil
+	case milterDiscard:
+		if !connecting {
+			s.discard = true
+			mc.skipped = true
+		}
+
+		return nil, nil
+	case milterReject:
+		if connecting {
+			return replyAccessDenied, nil
+		}
+
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Command rejected"}, nil
+	case milterTempfail:
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Try again later"}, nil
+	case milterReplyCode:
+		if reply := parseMilterReplyCode(string(bytes.TrimRight(data, "\x00"))); reply != nil {
+			return reply, nil
+		}
+	}
+
+	return nil, s.milterFailed(mc)
+}
+
+// parseMilterReplyCode parses a "550 5.7.1 text" reply, nil if it isn't a 4xx/5xx one
+func parseMilterReplyCode(reply string) *smtp.SMTPError {
+	parts := strings.SplitN(reply, " ", 3)
+
+	code, err := strconv.Atoi(strings.SplitN(parts[0], "-", 2)[0])
+	if err != nil || code < 400 || code > 599 {
+		return nil
+	}
+
+	e := &smtp.SMTPError{Code: code, EnhancedCode: smtp.EnhancedCodeNotSet}
+
+	if len(parts) > 1 {
+		e.Message = strings.Join(parts[1:], " ")
+
+		enhanced := strings.Split(parts[1], ".")
+		if len(enhanced) == 3 && len(parts) > 2 {
+			var ec smtp.EnhancedCode
+			valid := true
+
+			for i, s := range enhanced {
+				if ec[i], err = strconv.Atoi(s); err != nil {
+					valid = false
+				}
+			}
+
+			if valid && ec[0] == code/100 {
+				e.EnhancedCode, e.Message = ec, parts[2]
+			}
+		}
+	}
+
+	// the continuation lines of a multiline reply are joined
+	e.Message = strings.Replace(strings.Replace(e.Message, "\r\n", " ", -1), "\n", " ", -1)
+
+	return e
+}
+
+// milterMail runs the MAIL phase of ServerConfig.Milters
+func (s *Session) milterMail(from string) error {
+	if len(s.config.Milters) < 1 {
+		return nil
+	}
+
+	s.abortMilters()
+
+	// the failing milters are retried unless they are allowed to fail
+	for _, mc := range s.milters {
+		if mc.failed && !mc.milter.FailOpen {
+			s.closeMilters()
+			break
+		}
+	}
+
+	if err := s.openMilters(); err != nil {
+		s.closeMilters()
+		return err
+	}
+
+	for _, mc := range s.milters {
+		mc.skipped = false
+	}
+
+	s.discard, s.quarantine = false, ""
+	s.milterTx = true
+
+	for _, mc := range s.milters {
+		if !mc.active() {
+			continue
+		}
+
+		macros := []string{"{mail_addr}", from}
+		if s.username != nil {
+			macros = append(macros, "{auth_authen}", *s.username)
+		}
+
+		if err := mc.macros(milterCmdMail, macros...); err != nil {
+			return orMilterError(nil, s.milterFailed(mc))
+		}
+
+		code, data, err := mc.command(milterCmdMail, []byte("<"+from+">\x00"), milterNoMail, milterNoReplyMail)
+		if reply, err := s.milterReply(mc, code, data, err, false); reply != nil || err != nil {
+			s.abortMilters()
+			return orMilterError(reply, err)
+		}
+	}
+
+	return nil
+}
+
+// milterRcpt runs the RCPT phase of ServerConfig.Milters
+func (s *Session) milterRcpt(to string) error {
+	for _, mc := range s.milters {
+		if !mc.active() {
+			continue
+		}
+
+		if err := mc.macros(milterCmdRcpt, "{rcpt_addr}", to); err != nil {
+			return orMilterError(nil, s.milterFailed(mc))
+		}
+
+		code, data, err := mc.command(milterCmdRcpt, []byte("<"+to+">\x00"), milterNoRcpt, milterNoReplyRcpt)
+		if reply, err := s.milterReply(mc, code, data, err, false); reply != nil || err != nil {
+			return orMilterError(reply, err)
+		}
+	}
+
+	return nil
+}
+
+// abortMilters aborts the current transaction of the milters
+func (s *Session) abortMilters() {
+	if !s.milterTx {
+		return
+	}
+
+	s.milterTx = false
+
+	for _, mc := range s.milters {
+		if !mc.accepted && !mc.failed {
+			mc.send(milterCmdAbort, nil)
+		}
+	}
+}
+
+// closeMilters ends the milter sessions
+func (s *Session) closeMilters() {
+	for _, mc := range s.milters {
+		if !mc.failed {
+			mc.close()
+		}
+	}
+
+	s.milters = nil
+	s.milterTx = false
+}
+
+// milterHeader is a header field of the message handed to the milters
+type milterHeader struct {
+	name  string
+	value string
+}
+
+// splitMilterMessage splits the header fields (folded lines joined with "\n") from the body,
+// nl is the line ending of the message
+func splitMilterMessage(data []byte) (fields []milterHeader, body []byte, nl string) {
+	nl = "\n"
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		nl = "\r\n"
+	}
+
+	rest := data
+
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			i = len(rest) - 1
+		}
+
+		line := strings.TrimRight(string(rest[:i+1]), "\r\n")
+
+		if line == "" {
+			return fields, rest[i+1:], nl
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += "\n" + line
+		} else if colon := strings.IndexByte(line, ':'); colon > 0 {
+			fields = append(fields, milterHeader{name: line[:colon], value: strings.TrimLeft(line[colon+1:], " \t")})
+		} else {
+			break
+		}
+
+		rest = rest[i+1:]
+	}
+
+	return fields, rest, nl
+}
+
+// joinMilterMessage is the reverse of splitMilterMessage
+func joinMilterMessage(fields []milterHeader, body []byte, nl string) []byte {
+	var b bytes.Buffer
+
+	for _, f := range fields {
+		value := strings.Replace(strings.Replace(f.value, "\r\n", "\n", -1), "\n", nl, -1)
+		b.WriteString(f.name + ": " + value + nl)
+	}
+
+	b.WriteString(nl)
+	b.Write(body)
+
+	return b.Bytes()
+}
+
+// milterData runs the DATA phase of ServerConfig.Milters, it returns the message modified by them
+func (s *Session) milterData(data []byte) ([]byte, error) {
+	if !s.milterTx {
+		return data, nil
+	}
+
+	fields, body, nl := splitMilterMessage(data)
+
+	// the milters expect the SMTP line endings
+	crlfBody := body
+	if nl == "\n" {
+		crlfBody = bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+	}
+
+	modified := false
+
+	for _, mc := range s.milters {
+		if !mc.active() {
+			continue
+		}
+
+		reply, err := s.milterMessage(mc, fields, crlfBody)
+		if reply != nil || err != nil {
+			return nil, orMilterError(reply, err)
+		}
+
+		// the modifications are read along with the end of body reply
+		if mc.mods == nil {
+			continue
+		}
+
+		for _, mod := range mc.mods {
+			fields, body = mod.apply(fields, body, nl)
+		}
+
+		mc.mods, modified = nil, true
+	}
+
+	s.milterTx = false
+
+	if !modified {
+		return data, nil
+	}
+
+	return joinMilterMessage(fields, body, nl), nil
+}
+
+// milterMessage hands a message to a milter, the returned reply (if any) refuses it
+func (s *Session) milterMessage(mc *milterConn, fields []milterHeader, body []byte) (*smtp.SMTPError, error) {
+	code, data, err := mc.command(milterCmdData, nil, milterNoData, milterNoReplyData)
+	if reply, err := s.milterReply(mc, code, data, err, false); reply != nil || err != nil || !mc.active() {
+		return reply, err
+	}
+
+	for _, f := range fields {
+		code, data, err := mc.command(milterCmdHeader, []byte(f.name+"\x00"+f.value+"\x00"), milterNoHeaders, milterNoReplyHdr)
+		if reply, err := s.milterReply(mc, code, data, err, false); reply != nil || err != nil || !mc.active() {
+			return reply, err
+		}
+	}
+
+	code, data, err = mc.command(milterCmdEOH, nil, milterNoEOH, milterNoReplyEOH)
+	if reply, err := s.milterReply(mc, code, data, err, false); reply != nil || err != nil || !mc.active() {
+		return reply, err
+	}
+
+	for chunk := body; len(chunk) > 0; {
+		n := len(chunk)
+		if n > milterMaxChunkSize {
+			n = milterMaxChunkSize
+		}
+
+		code, data, err := mc.command(milterCmdBody, chunk[:n], milterNoBody, milterNoReplyBody)
+		if err == nil && code == milterSkip {
+			break
+		}
+
+		if reply, err := s.milterReply(mc, code, data, err, false); reply != nil || err != nil || !mc.active() {
+			return reply, err
+		}
+
+		chunk = chunk[n:]
+	}
+
+	if err := mc.macros(milterCmdEOB, "i", s.id); err != nil {
+		return nil, s.milterFailed(mc)
+	}
+
+	if err := mc.send(milterCmdEOB, nil); err != nil {
+		return nil, s.milterFailed(mc)
+	}
+
+	var mods []milterModification
+
+	for {
+		code, data, err := mc.read()
+		if err != nil {
+			return nil, s.milterFailed(mc)
+		}
+
+		switch code {
+		case milterProgress:
+			continue
+		case milterReplBody:
+			// the replacement body spans the consecutive chunks
+			if last := len(mods) - 1; last >= 0 && mods[last].code == milterReplBody {
+				mods[last].data = append(mods[last].data, data...)
+				continue
+			}
+
+			fallthrough
+		case milterAddHeader, milterInsHeader, milterChgHeader:
+			mods = append(mods, milterModification{code: code, data: data})
+			continue
+		case milterQuarantine:
+			s.quarantine = string(bytes.TrimRight(data, "\x00"))
+			continue
+		}
+
+		reply, err := s.milterReply(mc, code, data, err, false)
+		if reply == nil && err == nil && !s.discard {
+			mc.mods = mods
+		}
+
+		return reply, err
+	}
+}
+
+// milterModification is a header or body modification requested at the end of the message
+type milterModification struct {
+	code byte
+	data []byte
+}
+
+// apply applies the modification, the malformed ones are ignored
+func (mod milterModification) apply(fields []milterHeader, body []byte, nl string) ([]milterHeader, []byte) {
+	data := mod.data
+	index := -1
+
+	if mod.code == milterInsHeader || mod.code == milterChgHeader {
+		if len(data) < 4 {
+			return fields, body
+		}
+
+		index, data = int(binary.BigEndian.Uint32(data)), data[4:]
+	}
+
+	if mod.code == milterReplBody {
+		return fields, bytes.Replace(data, []byte("\r\n"), []byte(nl), -1)
+	}
+
+	parts := milterFields(data)
+	if len(parts) < 2 {
+		return fields, body
+	}
+
+	header := milterHeader{name: parts[0], value: parts[1]}
+
+	switch mod.code {
+	case milterAddHeader:
+		return append(fields, header), body
+	case milterInsHeader:
+		if index > len(fields) {
+			index = len(fields)
+		}
+
+		fields = append(fields, milterHeader{})
+		copy(fields[index+1:], fields[index:])
+		fields[index] = header
+
+		return fields, body
+	}
+
+	// the index of a change is the (1-based) occurrence of the header name, an empty value deletes it
+	for i, f := range fields {
+		if !strings.EqualFold(f.name, header.name) {
+			continue
+		}
+
+		if index--; index > 0 {
+			continue
+		}
+
+		if header.value == "" {
+			return append(fields[:i], fields[i+1:]...), body
+		}
+
+		fields[i].value = header.value
+
+		return fields, body
+	}
+
+	if header.value != "" {
+		fields = append(fields, header)
+	}
+
+	return fields, body
+}
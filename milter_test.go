@@ -0,0 +1,257 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// milterPacket is a command or a reply of the milter protocol
+type milterPacket struct {
+	code byte
+	data string
+}
+
+// startMilter serves the milter protocol, the replies of each command are returned by reply (none
+// for the macros and abort commands), the received commands are sent on packets
+func startMilter(t *testing.T, reply func(p milterPacket) []milterPacket) (net.Listener, chan milterPacket) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan milterPacket, 100)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+
+				r := bufio.NewReader(c)
+
+				write := func(p milterPacket) {
+					packet := make([]byte, 5, 5+len(p.data))
+					binary.BigEndian.PutUint32(packet, uint32(len(p.data)+1))
+					packet[4] = p.code
+					c.Write(append(packet, p.data...))
+				}
+
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(r, size[:]); err != nil {
+						return
+					}
+
+					packet := make([]byte, binary.BigEndian.Uint32(size[:]))
+					if _, err := io.ReadFull(r, packet); err != nil {
+						return
+					}
+
+					p := milterPacket{code: packet[0], data: string(packet[1:])}
+					packets <- p
+
+					switch p.code {
+					case milterCmdOptNeg:
+						// all the steps are enabled and replied to
+						write(milterPacket{code: milterCmdOptNeg, data: p.data[:8] + "\x00\x00\x00\x00"})
+					case milterCmdMacro, milterCmdAbort:
+					case milterCmdQuit:
+						return
+					default:
+						for _, reply := range reply(p) {
+							write(reply)
+						}
+					}
+				}
+			}(c)
+		}
+	}()
+
+	return l, packets
+}
+
+// milterCommands returns the codes of the received commands
+func milterCommands(packets chan milterPacket) string {
+	var codes []byte
+
+	for {
+		select {
+		case p := <-packets:
+			codes = append(codes, p.code)
+		default:
+			return string(codes)
+		}
+	}
+}
+
+func TestMilterSession(t *testing.T) {
+	l, packets := startMilter(t, func(p milterPacket) []milterPacket {
+		switch {
+		case p.code == milterCmdMail && p.data == "<tempfail@example.org>\x00":
+			return []milterPacket{{code: milterTempfail}}
+		case p.code == milterCmdRcpt && p.data == "<blocked@example.com>\x00":
+			return []milterPacket{{code: milterReplyCode, data: "550 5.7.1 No such user\x00"}}
+		case p.code == milterCmdEOB:
+			return []milterPacket{
+				{code: milterProgress},
+				{code: milterChgHeader, data: "\x00\x00\x00\x01X-Old\x00\x00"},
+				{code: milterAddHeader, data: "X-Milter\x00checked\x00"},
+				{code: milterReplBody, data: "new "},
+				{code: milterReplBody, data: "body\r\n"},
+				{code: milterQuarantine, data: "suspicious\x00"},
+				{code: milterAccept},
+			}
+		}
+
+		return []milterPacket{{code: milterContinue}}
+	})
+	defer l.Close()
+
+	type delivery struct {
+		raw        string
+		quarantine string
+	}
+
+	deliveries := make(chan delivery, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Milters: []*Milter{{Addr: l.Addr().String()}},
+		Handler: func(c *Context) error {
+			raw, err := c.Raw()
+			if err != nil {
+				return err
+			}
+
+			deliveries <- delivery{raw: string(raw), quarantine: c.Quarantine()}
+
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+
+	if reply := c.expectCmd("RCPT TO:<blocked@example.com>", 550); reply != "550 5.7.1 No such user" {
+		t.Errorf("got %q, want the milter reply", reply)
+	}
+
+	c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+	c.expectCmd("DATA", 354)
+	c.write("Subject: hello\r\nX-Old: 1\r\n\r\nold body\r\n.\r\n")
+	c.expect(250)
+
+	got := <-deliveries
+	if !strings.Contains(got.raw, "Subject: hello\nX-Milter: checked\n\nnew body\n") || strings.Contains(got.raw, "X-Old") {
+		t.Errorf("delivered %q, want the milter modifications", got.raw)
+	}
+
+	if got.quarantine != "suspicious" {
+		t.Errorf("quarantine = %q, want suspicious", got.quarantine)
+	}
+
+	// negotiation, connect, helo, mail, rcpt (x2), data, headers (x2), end of headers, body and end of body
+	if commands := milterCommands(packets); commands != "ODCHDMDRDRTLLNBDE" {
+		t.Errorf("milter commands = %q", commands)
+	}
+
+	if reply := c.expectCmd("MAIL FROM:<tempfail@example.org>", 451); reply[:9] != "451 4.7.1" {
+		t.Errorf("got %q, want 451 4.7.1", reply)
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on the address anymore
+	unavailable := l.Addr().String()
+	l.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		srv, addr := startTestServer(t, &ServerConfig{
+			Milters: []*Milter{{Addr: unavailable, FailOpen: failOpen}},
+			Handler: func(c *Context) error { return nil },
+		})
+
+		c := dialTestServer(t, addr)
+
+		c.expectCmd("EHLO client.example.org", 250)
+
+		if failOpen {
+			c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+		} else if reply := c.expectCmd("MAIL FROM:<sender@example.org>", 451); reply[:9] != "451 4.3.0" {
+			t.Errorf("got %q, want 451 4.3.0", reply)
+		}
+
+		c.Close()
+		srv.Close()
+	}
+}
+
+func TestParseMilterReplyCode(t *testing.T) {
+	for _, tt := range []struct {
+		reply   string
+		code    int
+		message string
+	}{
+		{"550 5.7.1 Rejected by policy", 550, "Rejected by policy"},
+		{"451 4.7.1 Try again\r\n451-later", 451, "Try again 451-later"},
+		{"550 Rejected", 550, "Rejected"},
+		{"550 4.7.1 Mismatched class", 550, "4.7.1 Mismatched class"},
+		{"250 2.0.0 OK", 0, ""},
+		{"garbage", 0, ""},
+	} {
+		reply := parseMilterReplyCode(tt.reply)
+
+		if tt.code == 0 {
+			if reply != nil {
+				t.Errorf("%q: got %v, want nil", tt.reply, reply)
+			}
+
+			continue
+		}
+
+		if reply == nil || reply.Code != tt.code || reply.Message != tt.message {
+			t.Errorf("%q: got %v, want %d %q", tt.reply, reply, tt.code, tt.message)
+		}
+	}
+}
+
+func TestMilterModification(t *testing.T) {
+	message := "Received: a\r\nSubject: hello\r\nReceived: b\r\n\r\nbody\r\n"
+
+	for _, tt := range []struct {
+		name string
+		mod  milterModification
+		want string
+	}{
+		{"add", milterModification{milterAddHeader, []byte("X-Added\x00yes\x00")}, "Received: a\r\nSubject: hello\r\nReceived: b\r\nX-Added: yes\r\n\r\nbody\r\n"},
+		{"insert", milterModification{milterInsHeader, []byte("\x00\x00\x00\x00X-First\x00yes\x00")}, "X-First: yes\r\nReceived: a\r\nSubject: hello\r\nReceived: b\r\n\r\nbody\r\n"},
+		{"change second", milterModification{milterChgHeader, []byte("\x00\x00\x00\x02received\x00c\x00")}, "Received: a\r\nSubject: hello\r\nReceived: c\r\n\r\nbody\r\n"},
+		{"delete", milterModification{milterChgHeader, []byte("\x00\x00\x00\x01Subject\x00\x00")}, "Received: a\r\nReceived: b\r\n\r\nbody\r\n"},
+		{"change missing", milterModification{milterChgHeader, []byte("\x00\x00\x00\x01X-New\x00folded\r\n value\x00")}, "Received: a\r\nSubject: hello\r\nReceived: b\r\nX-New: folded\r\n value\r\n\r\nbody\r\n"},
+		{"replace body", milterModification{milterReplBody, []byte("new\r\n")}, "Received: a\r\nSubject: hello\r\nReceived: b\r\n\r\nnew\r\n"},
+		{"malformed", milterModification{milterChgHeader, []byte("\x00\x01")}, message},
+	} {
+		fields, body, nl := splitMilterMessage([]byte(message))
+		fields, body = tt.mod.apply(fields, body, nl)
+
+		if got := string(joinMilterMessage(fields, body, nl)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package smtpsrv
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxMIMEDepth limits the nesting of the multipart and message/rfc822 entities
+const maxMIMEDepth = 32
+
+// errSkipChildren is returned by a mimeVisitFunc so the walk doesn't descend into the entity
+var errSkipChildren = errors.New("skip the children entities")
+
+// mimePart is an entity of the MIME tree of a message
+type mimePart struct {
+	Header textproto.MIMEHeader
+
+	// Body is the content of the entity, still transfer encoded
+	Body io.Reader
+
+	// ContentType and Params are parsed from the Content-Type (text/plain by default), Err is
+	// the parsing error
+	ContentType string
+	Params      map[string]string
+	Err         error
+
+	// Parent is the entity containing this one, nil for the message itself
+	Parent *mimePart
+	Depth  int
+
+	// role is how the visit function handles the children of a multipart entity
+	role string
+}
+
+// mimeVisitFunc is called for each entity before its children
+type mimeVisitFunc func(p *mimePart) error
+
+// mimeWalker walks the MIME tree of the messages depth first, it is shared by ParseEmail,
+// WalkAttachments and AttachmentPolicy
+type mimeWalker struct {
+	// Messages descends into the message/rfc822 and message/global entities
+	Messages bool
+
+	// Malformed (if set) handles the structure errors (broken multipart, too deep nesting ...),
+	// the walk of the entity goes on with the next sibling when it returns nil
+	Malformed func(err error) error
+}
+
+func (w *mimeWalker) malformed(err error) error {
+	if w.Malformed == nil {
+		return err
+	}
+
+	return w.Malformed(err)
+}
+
+// walk visits the entity of header and body then its children
+func (w *mimeWalker) walk(header textproto.MIMEHeader, body io.Reader, visit mimeVisitFunc) error {
+	return w.entity(&mimePart{Header: header, Body: body}, visit)
+}
+
+func (w *mimeWalker) entity(p *mimePart, visit mimeVisitFunc) error {
+	if p.Depth > maxMIMEDepth {
+		return w.malformed(errors.New("too deeply nested"))
+	}
+
+	p.ContentType, p.Params, p.Err = parseContentType(p.Header.Get("Content-Type"))
+	if p.Err != nil && p.ContentType == "" {
+		// an unparsable type is an opaque content
+		p.ContentType = "application/octet-stream"
+	}
+
+	if err := visit(p); err == errSkipChildren {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(p.ContentType, "multipart/") {
+		mr := multipart.NewReader(transferDecoder(p.Body, p.Header.Get("Content-Transfer-Encoding")), p.Params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return w.malformed(err)
+			}
+
+			if err := w.entity(&mimePart{Header: part.Header, Body: part, Parent: p, Depth: p.Depth + 1}, visit); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.Messages && (p.ContentType == contentTypeMessageRFC822 || p.ContentType == "message/global") {
+		msg, err := mail.ReadMessage(transferDecoder(p.Body, p.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return w.malformed(err)
+		}
+
+		return w.entity(&mimePart{Header: textproto.MIMEHeader(msg.Header), Body: msg.Body, Parent: p, Depth: p.Depth + 1}, visit)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package smtpsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestMIMEWalker(t *testing.T) {
+	const message = "Content-Type: multipart/mixed; boundary=a\n\n" +
+		"--a\nContent-Type: multipart/alternative; boundary=b\n\n" +
+		"--b\nContent-Type: text/plain\n\nhello\n--b\nContent-Type: text/html\n\n<p>hello</p>\n--b--\n" +
+		"--a\nContent-Type: message/rfc822\n\nContent-Type: application/pdf\n\n%PDF-1.4\n" +
+		"--a--\n"
+
+	walk := func(w *mimeWalker, skip string) (visited []string, err error) {
+		msg, err := mail.ReadMessage(strings.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.walk(textproto.MIMEHeader(msg.Header), msg.Body, func(p *mimePart) error {
+			visited = append(visited, strings.Repeat(" ", p.Depth)+p.ContentType)
+			if p.ContentType == skip {
+				return errSkipChildren
+			}
+
+			return nil
+		})
+
+		return
+	}
+
+	for _, tt := range []struct {
+		walker *mimeWalker
+		skip   string
+		want   []string
+	}{
+		{&mimeWalker{}, "", []string{"multipart/mixed", " multipart/alternative", "  text/plain", "  text/html", " message/rfc822"}},
+		{&mimeWalker{Messages: true}, "", []string{"multipart/mixed", " multipart/alternative", "  text/plain", "  text/html", " message/rfc822", "  application/pdf"}},
+		{&mimeWalker{Messages: true}, "multipart/alternative", []string{"multipart/mixed", " multipart/alternative", " message/rfc822", "  application/pdf"}},
+	} {
+		visited, err := walk(tt.walker, tt.skip)
+		if err != nil || strings.Join(visited, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("visited %q, %v, want %q", visited, err, tt.want)
+		}
+	}
+}
+
+func TestMIMEWalkerDepth(t *testing.T) {
+	message := "text/plain"
+	for i := 0; i <= maxMIMEDepth; i++ {
+		boundary := fmt.Sprintf("b%d", i)
+		message = "multipart/mixed; boundary=" + boundary + "\n\n--" + boundary + "\nContent-Type: " + message
+	}
+
+	var malformed error
+	w := &mimeWalker{Malformed: func(err error) error {
+		malformed = err
+		return nil
+	}}
+
+	msg, err := mail.ReadMessage(strings.NewReader("Content-Type: " + message + "\n\nhello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deepest := 0
+	err = w.walk(textproto.MIMEHeader(msg.Header), msg.Body, func(p *mimePart) error {
+		if p.Depth > deepest {
+			deepest = p.Depth
+		}
+
+		return nil
+	})
+
+	if err != nil || malformed == nil || deepest != maxMIMEDepth {
+		t.Fatalf("got %v (malformed: %v), deepest entity %d, want %d", err, malformed, deepest, maxMIMEDepth)
+	}
+
+	if _, err := ParseEmail(strings.NewReader("Content-Type: " + message + "\n\nhello\n")); err == nil {
+		t.Error("ParseEmail accepts a too deeply nested message")
+	}
+
+	if err := (&AttachmentPolicy{}).Check(strings.NewReader("Content-Type: " + message + "\n\nhello\n")); !errors.Is(err, ErrMalformedMIME) {
+		t.Errorf("AttachmentPolicy: got %v, want ErrMalformedMIME", err)
+	}
+}
@@ -0,0 +1,73 @@
+package smtpsrv
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-smtp"
+)
+
+// The MT-PRIORITY range (RFC 6710 section 3), 0 is the priority of the messages without any
+const (
+	MinMTPriority = -9
+	MaxMTPriority = 9
+)
+
+var errBadMTPriority = &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "Invalid MT-PRIORITY parameter"}
+
+// MTPriorityPolicy enables the MT-PRIORITY extension (RFC 6710): the clients set the priority of
+// their message (-9 to 9) with the MT-PRIORITY MAIL FROM parameter, see Context.Priority
+type MTPriorityPolicy struct {
+	// Policy (if set) is the advertised priority assignment policy, e.g: "MIXER"
+	Policy string
+
+	// MaxPriority (if set) returns the highest priority the user (empty unless the client
+	// authenticated) may ask for, the higher ones are lowered to it as RFC 6710 (section 4.1)
+	// requires
+	MaxPriority func(username string) int
+}
+
+// mtPriority is the Extension of MTPriorityPolicy
+type mtPriority struct {
+	policy *MTPriorityPolicy
+}
+
+func (p mtPriority) Keyword() string {
+	if p.policy.Policy == "" {
+		return "MT-PRIORITY"
+	}
+
+	return "MT-PRIORITY " + p.policy.Policy
+}
+
+func (p mtPriority) MailParams() []string {
+	return []string{"MT-PRIORITY"}
+}
+
+func (p mtPriority) Mail(c *Context, params map[string]string) error {
+	c.session.priority = 0
+
+	value, ok := params["MT-PRIORITY"]
+	if !ok {
+		return nil
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil || priority < MinMTPriority || priority > MaxMTPriority {
+		return errBadMTPriority
+	}
+
+	if p.policy.MaxPriority != nil {
+		username := ""
+		if c.session.username != nil {
+			username = *c.session.username
+		}
+
+		if max := p.policy.MaxPriority(username); priority > max {
+			priority = max
+		}
+	}
+
+	c.session.priority = priority
+
+	return nil
+}
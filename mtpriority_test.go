@@ -0,0 +1,64 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestMTPriority(t *testing.T) {
+	priorities := make(chan int, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		MTPriority: &MTPriorityPolicy{
+			Policy: "MIXER",
+			MaxPriority: func(username string) int {
+				if username == "john" {
+					return 5
+				}
+
+				return 0
+			},
+		},
+		Auther: func(username, password string) error { return nil },
+		Handler: func(c *Context) error {
+			priorities <- c.Priority()
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	send := func(c *testClient, params string, want int) {
+		t.Helper()
+
+		c.expectCmd("MAIL FROM:<sender@example.org> "+params, 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write("Subject: hi\r\n\r\nhello\r\n.\r\n")
+		c.expect(250)
+
+		if got := <-priorities; got != want {
+			t.Errorf("%q: Priority() = %d, want %d", params, got, want)
+		}
+	}
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); !strings.Contains(ehlo, "MT-PRIORITY MIXER") {
+		t.Fatalf("MT-PRIORITY isn't advertised:\n%s", ehlo)
+	}
+
+	for _, value := range []string{"10", "-10", "high", ""} {
+		c.expectCmd("MAIL FROM:<sender@example.org> MT-PRIORITY="+value, 501)
+	}
+
+	send(c, "MT-PRIORITY=4", 0)
+	send(c, "MT-PRIORITY=-3", -3)
+	send(c, "", 0)
+
+	c.expectCmd("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00john\x00secret")), 235)
+
+	send(c, "MT-PRIORITY=4", 4)
+	send(c, "MT-PRIORITY=9", 5)
+}
@@ -0,0 +1,215 @@
+package smtpsrv
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errRelayDenied = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Relay access denied"}
+	errOtherRoute  = &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 5, 3}, Message: "Too many recipients, send the others separately"}
+)
+
+// Mux routes the messages to a handler by the recipient address or domain, the recipients without
+// a route are refused at RCPT time, set it as ServerConfig.Mux (the Handler is then optional).
+// The recipients of a transaction must share the same route, the others are deferred with
+// 452 so the client sends them in a new transaction. That includes the known and unknown
+// recipients of a domain with both a domain route and a catch-all (see HandleCatchAll).
+type Mux struct {
+	mu        sync.RWMutex
+	addresses map[string]*muxRoute
+	patterns  []*muxRoute
+	domains   map[string]*muxRoute
+	wildcards map[string]*muxRoute
+	catchAlls map[string]*muxRoute
+	fallback  *muxRoute
+}
+
+type muxRoute struct {
+	handler HandlerFunc
+	pattern *regexp.Regexp
+}
+
+// HandleDomain routes the specified domain pattern to handler, the pattern is either a domain
+// ("example.com"), a wildcard matching its subdomains ("*.example.com", the most specific one wins)
+// or "*" for the domains matching nothing else
+func (m *Mux) HandleDomain(pattern string, handler HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	route := &muxRoute{handler: handler}
+	pattern = normalizeDomain(pattern)
+
+	switch {
+	case pattern == "*":
+		m.fallback = route
+	case strings.HasPrefix(pattern, "*."):
+		m.wildcards[pattern[2:]] = route
+	default:
+		m.domains[pattern] = route
+	}
+}
+
+// HandleAddress routes the specified address pattern to handler before the domain routes, the
+// pattern is either an address ("support@example.com") or a local part of any domain ("support@*").
+// The recipients are canonicalized (see CanonicalizeEmail), so "support@example.com" also routes
+// "Support+1234@example.com", the handler still gets the original one (see Context.Subaddress)
+func (m *Mux) HandleAddress(pattern string, handler HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	local, domain, _ := SplitAddress(pattern)
+	local, _ = SplitSubaddress(strings.ToLower(local))
+
+	m.addresses[local+"@"+normalizeDomain(domain)] = &muxRoute{handler: handler}
+}
+
+// HandleCatchAll routes the recipients of the specified domain that the ServerConfig.Directory doesn't
+// know to handler instead of refusing them, it is also the domain route if HandleDomain has none.
+// The handler gets these recipients from Context.CatchAll. When the domain has its own route, the
+// catch-all is a separate route: a transaction mixing known and unknown recipients of the domain
+// gets the ones of the other route deferred with 452, so each handler gets its own transaction
+func (m *Mux) HandleCatchAll(domain string, handler HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+
+	m.catchAlls[normalizeDomain(domain)] = &muxRoute{handler: handler}
+}
+
+// HandleRegexp routes the recipient addresses matching pattern to handler, after the address routes
+// and before the domain ones, in the order they were added, e.g: `^bounce-(\d+)@example\.com$`.
+// The handler gets the capture groups from Context.RouteMatches
+func (m *Mux) HandleRegexp(pattern *regexp.Regexp, handler HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.patterns = append(m.patterns, &muxRoute{handler: handler, pattern: pattern})
+}
+
+func (m *Mux) init() {
+	if m.domains == nil {
+		m.addresses = map[string]*muxRoute{}
+		m.domains = map[string]*muxRoute{}
+		m.wildcards = map[string]*muxRoute{}
+		m.catchAlls = map[string]*muxRoute{}
+	}
+}
+
+// Handler returns the handler of the specified recipient address, nil if it has no route
+func (m *Mux) Handler(address string) HandlerFunc {
+	if route := m.match(address); route != nil {
+		return route.handler
+	}
+
+	return nil
+}
+
+func (m *Mux) match(address string) *muxRoute {
+	canonical, err := CanonicalizeEmail(address)
+	if err != nil {
+		return nil
+	}
+
+	local, domain, _ := SplitAddress(canonical)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if route := m.addresses[canonical]; route != nil {
+		return route
+	}
+
+	if route := m.addresses[local+"@*"]; route != nil {
+		return route
+	}
+
+	for _, route := range m.patterns {
+		if route.pattern.MatchString(address) {
+			return route
+		}
+	}
+
+	if route := m.domains[domain]; route != nil {
+		return route
+	}
+
+	if route := m.catchAlls[domain]; route != nil {
+		return route
+	}
+
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+
+		if route := m.wildcards[domain]; route != nil {
+			return route
+		}
+	}
+
+	return m.fallback
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// routeRcpt returns the ServerConfig.Mux route of a recipient, see checkRoute
+func (s *Session) routeRcpt(address string) (*muxRoute, error) {
+	if s.config.Mux == nil {
+		return nil, nil
+	}
+
+	route := s.config.Mux.match(address)
+	if route == nil {
+		return nil, errRelayDenied
+	}
+
+	return route, nil
+}
+
+// routeCatchAll returns the ServerConfig.Mux catch-all route of a recipient, nil if its domain has none
+func (s *Session) routeCatchAll(address string) *muxRoute {
+	if s.config.Mux == nil {
+		return nil
+	}
+
+	_, domain, err := SplitAddress(address)
+	if err != nil {
+		return nil
+	}
+
+	s.config.Mux.mu.RLock()
+	defer s.config.Mux.mu.RUnlock()
+
+	return s.config.Mux.catchAlls[normalizeDomain(domain)]
+}
+
+// checkRoute defers the recipients of another route than the one of the transaction
+func (s *Session) checkRoute(route *muxRoute) error {
+	if s.route != nil && s.route != route {
+		return errOtherRoute
+	}
+
+	return nil
+}
+
+// transactionHandler returns the handler of the current transaction
+func (s *Session) transactionHandler() HandlerFunc {
+	if !s.release.IsZero() && s.config.FutureRelease != nil {
+		return s.config.FutureRelease.Hold
+	}
+
+	if s.route != nil {
+		return s.route.handler
+	}
+
+	return s.handler
+}
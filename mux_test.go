@@ -0,0 +1,54 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMuxCatchAllTransactions(t *testing.T) {
+	known := directoryFunc(func(address string) (*Mailbox, error) {
+		if strings.HasPrefix(address, "john@") {
+			return &Mailbox{Address: address, Exists: true}, nil
+		}
+
+		return nil, ErrNoSuchUser
+	})
+
+	delivered := make(chan string, 2)
+
+	mux := &Mux{}
+	mux.HandleDomain("example.com", func(c *Context) error {
+		delivered <- "domain " + strings.Join(c.RcptTo(), ",")
+		return nil
+	})
+	mux.HandleCatchAll("example.com", func(c *Context) error {
+		delivered <- "catch-all " + strings.Join(c.CatchAll(), ",")
+		return nil
+	})
+
+	srv, addr := startTestServer(t, &ServerConfig{Directory: known, Mux: mux})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("RCPT TO:<john@example.com>", 250)
+	c.expectCmd("RCPT TO:<unknown@example.com>", 452)
+	c.expectCmd("DATA", 354)
+	c.write("Subject: mixed\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	if got := <-delivered; got != "domain john@example.com" {
+		t.Fatalf("got %q", got)
+	}
+
+	if reply := c.send("sender@example.org", []string{"unknown@example.com"}, "Subject: deferred\n\nhello"); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("DATA: got %q", reply)
+	}
+
+	if got := <-delivered; got != "catch-all unknown@example.com" {
+		t.Fatalf("got %q", got)
+	}
+}
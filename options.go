@@ -0,0 +1,131 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Option configures the Server built by New, the invalid values are reported by New
+type Option func(*ServerConfig) error
+
+// New creates a Server from the specified options, unlike NewServer the configuration is validated
+// up front and owned by the server so it can't be changed once serving, e.g:
+//
+//	srv, err := smtpsrv.New(smtpsrv.WithAddr(":25"), smtpsrv.WithHandler(handler), smtpsrv.WithMaxSize(10<<20))
+func New(opts ...Option) (*Server, error) {
+	cfg := &ServerConfig{}
+
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Handler == nil && cfg.Mux == nil {
+		return nil, ErrNoHandler
+	}
+
+	if cfg.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+			return nil, fmt.Errorf("invalid listen address: %w", err)
+		}
+	}
+
+	if cfg.AuthRequiresTLS && cfg.TLSConfig == nil && cfg.Certificates == nil {
+		return nil, ErrNoTLSConfig
+	}
+
+	return NewServer(cfg), nil
+}
+
+// WithAddr sets the listen address (ListenAddr), "[::]:25025" by default
+func WithAddr(addr string) Option {
+	return func(cfg *ServerConfig) error {
+		cfg.ListenAddr = addr
+		return nil
+	}
+}
+
+// WithBannerDomain sets the domain announced in the greeting (BannerDomain), "localhost" by default
+func WithBannerDomain(domain string) Option {
+	return func(cfg *ServerConfig) error {
+		cfg.BannerDomain = domain
+		return nil
+	}
+}
+
+// WithTLS enables STARTTLS (and ListenAndServeTLS) using the specified config
+func WithTLS(config *tls.Config) Option {
+	return func(cfg *ServerConfig) error {
+		if config == nil {
+			return ErrNoTLSConfig
+		}
+
+		cfg.TLSConfig = config
+		return nil
+	}
+}
+
+// WithHandler sets the handler of the accepted messages, it is required unless WithMux is used
+func WithHandler(handler HandlerFunc) Option {
+	return func(cfg *ServerConfig) error {
+		if handler == nil {
+			return ErrNoHandler
+		}
+
+		cfg.Handler = handler
+		return nil
+	}
+}
+
+// WithMux routes the messages by their recipient domain (see Mux), it replaces WithHandler
+func WithMux(mux *Mux) Option {
+	return func(cfg *ServerConfig) error {
+		cfg.Mux = mux
+		return nil
+	}
+}
+
+// WithAuth enables AUTH LOGIN/PLAIN using the specified credentials checker
+func WithAuth(auther AuthFunc) Option {
+	return func(cfg *ServerConfig) error {
+		cfg.Auther = auther
+		return nil
+	}
+}
+
+// WithMaxSize sets the maximum message size in bytes (MaxMessageBytes), 2MiB by default
+func WithMaxSize(size int) Option {
+	return func(cfg *ServerConfig) error {
+		if size < 1 {
+			return errors.New("invalid max message size")
+		}
+
+		cfg.MaxMessageBytes = size
+		return nil
+	}
+}
+
+// WithTimeouts sets the read and write timeouts, 2 seconds each by default
+func WithTimeouts(read, write time.Duration) Option {
+	return func(cfg *ServerConfig) error {
+		if read < 0 || write < 0 {
+			return errors.New("invalid timeout")
+		}
+
+		cfg.ReadTimeout, cfg.WriteTimeout = read, write
+		return nil
+	}
+}
+
+// WithConfig sets the remaining ServerConfig fields (filters, limits, hooks ...), fn must not keep
+// the config since it belongs to the server
+func WithConfig(fn func(cfg *ServerConfig)) Option {
+	return func(cfg *ServerConfig) error {
+		fn(cfg)
+		return nil
+	}
+}
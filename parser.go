@@ -7,13 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"mime"
-	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
 	"strings"
 	"time"
 
-	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 const contentTypeMultipartMixed = "multipart/mixed"
@@ -22,8 +22,44 @@ const contentTypeMultipartRelated = "multipart/related"
 const contentTypeTextHtml = "text/html"
 const contentTypeTextPlain = "text/plain"
 
+// DefaultMessageDepth is how deep ParseEmail descends into nested message/rfc822 parts, see
+// ParseEmailDepth and ServerConfig.MaxMessageDepth
+const DefaultMessageDepth = 3
+
 // Parse an email message read from io.Reader into parsemail.Email struct
 func ParseEmail(r io.Reader) (email *Email, err error) {
+	return ParseEmailDepth(r, DefaultMessageDepth)
+}
+
+// ParseEmailDepth is ParseEmail with a custom nested message/rfc822 depth limit, 0 and less don't parse them
+func ParseEmailDepth(r io.Reader, depth int) (email *Email, err error) {
+	email, err = parseEmail(r)
+	if err != nil || depth < 1 {
+		return
+	}
+
+	for i, at := range email.Attachments {
+		if !strings.EqualFold(at.ContentType, contentTypeMessageRFC822) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(at.Data)
+		if err != nil {
+			return email, err
+		}
+
+		email.Attachments[i].Data = bytes.NewReader(data)
+
+		// a malformed nested message stays a plain attachment
+		if child, err := ParseEmailDepth(bytes.NewReader(data), depth-1); err == nil {
+			email.Messages = append(email.Messages, child)
+		}
+	}
+
+	return
+}
+
+func parseEmail(r io.Reader) (email *Email, err error) {
 	msg, err := mail.ReadMessage(r)
 	if err != nil {
 		return
@@ -35,19 +71,19 @@ func ParseEmail(r io.Reader) (email *Email, err error) {
 	}
 
 	email.ContentType = msg.Header.Get("Content-Type")
-	contentType, params, err := parseContentType(email.ContentType)
+	contentType, _, err := parseContentType(email.ContentType)
 	if err != nil {
 		return
 	}
 
 
 	switch contentType {
-	case contentTypeMultipartMixed:
-		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartMixed(msg.Body, params["boundary"])
+	case contentTypeMultipartMixed, "multipart/signed", "multipart/report", "multipart/digest", "multipart/parallel":
+		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipart(msg.Header, msg.Body, roleMixed)
 	case contentTypeMultipartAlternative:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartAlternative(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipart(msg.Header, msg.Body, roleAlternative)
 	case contentTypeMultipartRelated:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartRelated(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipart(msg.Header, msg.Body, roleRelated)
 	case contentTypeTextPlain:
 		newPart, err := decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"), msg.Header.Get("Content-Type"))
 		if err != nil {
@@ -122,238 +158,171 @@ func parseContentType(contentTypeHeader string) (contentType string, params map[
 	return mime.ParseMediaType(contentTypeHeader)
 }
 
-func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
-	pmr := multipart.NewReader(msg, boundary)
-	for {
-		part, err := pmr.NextPart()
-
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
-		}
+// decodeCharset converts the content to UTF-8 according to the charset parameter of the
+// Content-Type, unknown charsets are returned as-is
+func decodeCharset(content io.Reader, contentTypeWithCharset string) (io.Reader) {
+	_, params, err := mime.ParseMediaType(contentTypeWithCharset)
+	if err != nil || params["charset"] == "" {
+		return content
+	}
 
-		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	switch charset := strings.ToLower(strings.Trim(params["charset"], " \"'\n\r")); charset {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return content
+	default:
+		enc, err := htmlindex.Get(charset)
 		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			return content
 		}
 
-		switch contentType {
-		case contentTypeTextPlain:
-			ppContent, err := ioutil.ReadAll(part)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeTextHtml:
-			ppContent, err := ioutil.ReadAll(part)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeMultipartAlternative:
-			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += hb
-			textBody += tb
-			embeddedFiles = append(embeddedFiles, ef...)
-		default:
-			if isEmbeddedFile(part) {
-				ef, err := decodeEmbeddedFile(part)
-				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
-				}
-
-				embeddedFiles = append(embeddedFiles, ef)
-			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("Can't process multipart/related inner mime type: %s", contentType)
-			}
-		}
+		return enc.NewDecoder().Reader(content)
 	}
-
-	return textBody, htmlBody, embeddedFiles, err
 }
 
-func decodeCharset(content io.Reader, contentTypeWithCharset string) (io.Reader) {
-
-	charset := "default"
-	if strings.Contains(contentTypeWithCharset, "; charset=") {
-		split := strings.Split(contentTypeWithCharset, "; charset=")
-		charset = strings.Trim(split[1], " \"'\n\r")
-	}
+// the roles of the multipart entities in parseMultipart
+const (
+	roleMixed       = "mixed"
+	roleAlternative = "alternative"
+	roleRelated     = "related"
+)
 
-	tr := content
-	if charset != "default" {
-		switch charset {
-		case "Windows-1252":
-			tr = charmap.Windows1252.NewDecoder().Reader(content)
-		case "iso-8859-1", "ISO-8859-1":
-			tr = charmap.ISO8859_1.NewDecoder().Reader(content)
-		default:
+// parseMultipart collects the bodies, the attachments and the embedded files of a multipart
+// message, how a part is handled depends on the role of the multipart entity containing it
+func parseMultipart(header mail.Header, body io.Reader, role string) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
+	addBody := func(part *mimePart) error {
+		content, err := decodeBody(part)
+		if part.ContentType == contentTypeTextHtml {
+			htmlBody += content
+		} else {
+			textBody += content
 		}
-	}
-
-	return tr
-}
-
-func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
-	pmr := multipart.NewReader(msg, boundary)
-	for {
-		part, err := pmr.NextPart()
 
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
-		}
+		return err
+	}
 
-		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	addAttachment := func(part *mimePart) error {
+		at, err := decodeAttachment(part)
 		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			return err
 		}
 
-		switch contentType {
-		case contentTypeTextPlain:
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			ppContent, err := ioutil.ReadAll(newPart)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+		attachments = append(attachments, at)
 
-		case contentTypeTextHtml:
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			ppContent, err := ioutil.ReadAll(newPart)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+		return errSkipChildren
+	}
 
-		case contentTypeMultipartRelated:
-			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
+	addEmbeddedFile := func(part *mimePart) error {
+		ef, err := decodeEmbeddedFile(part)
+		if err != nil {
+			return err
+		}
 
-			htmlBody += hb
-			textBody += tb
-			embeddedFiles = append(embeddedFiles, ef...)
+		embeddedFiles = append(embeddedFiles, ef)
 
-		default:
-			if isEmbeddedFile(part) {
-				ef, err := decodeEmbeddedFile(part)
-				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
-				}
-
-				embeddedFiles = append(embeddedFiles, ef)
-			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("Can't process multipart/alternative inner mime type: %s", contentType)
-			}
-		}
+		return errSkipChildren
 	}
 
-	return textBody, htmlBody, embeddedFiles, err
-}
-
-func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
-	mr := multipart.NewReader(msg, boundary)
-	for {
-		part, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
+	w := &mimeWalker{}
+	err = w.walk(textproto.MIMEHeader(header), body, func(part *mimePart) error {
+		if part.Err != nil {
+			return part.Err
 		}
 
-		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
+		if part.Parent == nil {
+			part.role = role
+			return nil
 		}
 
-		if contentType == contentTypeMultipartAlternative {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartAlternative(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-		} else if contentType == contentTypeMultipartRelated {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartRelated(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+		isText := part.ContentType == contentTypeTextPlain || part.ContentType == contentTypeTextHtml
+
+		switch part.Parent.role {
+		case roleRelated:
+			switch {
+			case isText:
+				return addBody(part)
+			case part.ContentType == contentTypeMultipartAlternative:
+				part.role = roleAlternative
+			case isEmbeddedFile(part):
+				return addEmbeddedFile(part)
+			default:
+				return fmt.Errorf("Can't process multipart/related inner mime type: %s", part.ContentType)
 			}
-		} else if contentType == contentTypeTextPlain {
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+		case roleAlternative:
+			switch {
+			case isText:
+				return addBody(part)
+			case part.ContentType == contentTypeMultipartRelated:
+				part.role = roleRelated
+			case strings.HasPrefix(part.ContentType, "multipart/"):
+				// e.g: Apple Mail puts the HTML body and its attachments in a nested multipart/mixed
+				part.role = roleMixed
+			case part.Header.Get("Content-Id") != "":
+				return addEmbeddedFile(part)
+			default:
+				// the other alternatives (text/calendar invites, text/enriched ...) are kept as attachments
+				return addAttachment(part)
 			}
-
-			ppContent, err := ioutil.ReadAll(newPart)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+		default:
+			switch {
+			case isAttachmentDisposition(part):
+				return addAttachment(part)
+			case part.ContentType == contentTypeMultipartAlternative:
+				part.role = roleAlternative
+			case part.ContentType == contentTypeMultipartRelated:
+				part.role = roleRelated
+			case strings.HasPrefix(part.ContentType, "multipart/"):
+				// nested multipart/mixed, multipart/signed, multipart/report ...
+				part.role = roleMixed
+			case isText:
+				return addBody(part)
+			default:
+				// the named and unnamed parts (message/rfc822, application/pgp-signature ...) are kept as attachments
+				return addAttachment(part)
 			}
+		}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		} else if contentType == contentTypeTextHtml {
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
+		return nil
+	})
 
-			ppContent, err := ioutil.ReadAll(newPart)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
+	return textBody, htmlBody, attachments, embeddedFiles, err
+}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		} else if isAttachment(part) {
-			at, err := decodeAttachment(part)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
+// decodeBody returns the decoded text of a body part
+func decodeBody(part *mimePart) (string, error) {
+	newPart, err := decodeContent(part.Body, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
 
-			attachments = append(attachments, at)
-		} else {
-			return textBody, htmlBody, attachments, embeddedFiles, fmt.Errorf("Unknown multipart/mixed nested mime type: %s", contentType)
-		}
+	ppContent, err := ioutil.ReadAll(newPart)
+	if err != nil {
+		return "", err
 	}
 
-	return textBody, htmlBody, attachments, embeddedFiles, err
+	return strings.TrimSuffix(string(ppContent[:]), "\n"), nil
 }
 
-func decodeMimeSentence(s string) string {
-	result := []string{}
-	ss := strings.Split(s, " ")
-
-	for _, word := range ss {
-		dec := new(mime.WordDecoder)
-		w, err := dec.Decode(word)
+// wordDecoder decodes RFC 2047 encoded-words of any charset known to x/text
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
 		if err != nil {
-			if len(result) == 0 {
-				w = word
-			} else {
-				w = " " + word
-			}
+			return nil, err
 		}
 
-		result = append(result, w)
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// decodeMimeSentence decodes the RFC 2047 encoded-words of a header value, the whitespace
+// between adjacent encoded-words is dropped, the value is returned as-is when it's malformed
+func decodeMimeSentence(s string) string {
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
 	}
 
-	return strings.Join(result, "")
+	return decoded
 }
 
 func decodeHeaderMime(header mail.Header) (mail.Header, error) {
@@ -372,37 +341,39 @@ func decodeHeaderMime(header mail.Header) (mail.Header, error) {
 	return mail.Header(parsedHeader), nil
 }
 
-func isEmbeddedFile(part *multipart.Part) bool {
+func isEmbeddedFile(part *mimePart) bool {
 	return part.Header.Get("Content-Transfer-Encoding") != ""
 }
 
-func decodeEmbeddedFile(part *multipart.Part) (ef EmbeddedFile, err error) {
+func decodeEmbeddedFile(part *mimePart) (ef EmbeddedFile, err error) {
 	cid := decodeMimeSentence(part.Header.Get("Content-Id"))
-	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
+	decoded, err := decodeContent(part.Body, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
 	if err != nil {
 		return
 	}
 
 	ef.CID = strings.Trim(cid, "<>")
-	ef.Data = decoded
+	ef.DetectedType, ef.Data = sniffReader(decoded)
 	ef.ContentType = part.Header.Get("Content-Type")
 
 	return
 }
 
-func isAttachment(part *multipart.Part) bool {
-	return part.FileName() != ""
+func isAttachmentDisposition(part *mimePart) bool {
+	disposition, _, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+
+	return err == nil && disposition == "attachment"
 }
 
-func decodeAttachment(part *multipart.Part) (at Attachment, err error) {
-	filename := decodeMimeSentence(part.FileName())
-	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
+func decodeAttachment(part *mimePart) (at Attachment, err error) {
+	filename := entityFilename(part.Params, part.Header.Get("Content-Disposition"))
+	decoded, err := decodeContent(part.Body, part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Type"))
 	if err != nil {
 		return
 	}
 
 	at.Filename = filename
-	at.Data = decoded
+	at.DetectedType, at.Data = sniffReader(decoded)
 	at.ContentType = strings.Split(part.Header.Get("Content-Type"), ";")[0]
 
 	return
@@ -410,7 +381,7 @@ func decodeAttachment(part *multipart.Part) (at Attachment, err error) {
 
 func decodeContent(content io.Reader, encoding string, contentTypeWithCharset string) (io.Reader, error) {
 
-	switch encoding {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
 	case "base64":
 		decoded := base64.NewDecoder(base64.StdEncoding, content)
 		b, err := ioutil.ReadAll(decoded)
@@ -420,7 +391,7 @@ func decodeContent(content io.Reader, encoding string, contentTypeWithCharset st
 
 		return decodeCharset(bytes.NewReader(b), contentTypeWithCharset), nil
 
-	case "7bit":
+	case "7bit", "8bit", "binary":
 		dd, err := ioutil.ReadAll(content)
 		if err != nil {
 			return nil, err
@@ -438,13 +409,21 @@ func decodeContent(content io.Reader, encoding string, contentTypeWithCharset st
 		return decodeCharset(bytes.NewReader(b), contentTypeWithCharset), nil
 
 	case "":
-		return decodeCharset(content, contentTypeWithCharset), nil
+		// buffered, the multipart parts are only readable until moving to the next one
+		dd, err := ioutil.ReadAll(content)
+		if err != nil {
+			return nil, err
+		}
+
+		return decodeCharset(bytes.NewReader(dd), contentTypeWithCharset), nil
 
 	default:
 		return nil, fmt.Errorf("unknown encoding: %s", encoding)
 	}
 }
 
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
 type headerParser struct {
 	header *mail.Header
 	err    error
@@ -456,7 +435,7 @@ func (hp headerParser) parseAddress(s string) (ma *mail.Address) {
 	}
 
 	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddress(s)
+		ma, hp.err = addressParser.Parse(s)
 
 		return ma
 	}
@@ -470,7 +449,7 @@ func (hp headerParser) parseAddressList(s string) (ma []*mail.Address) {
 	}
 
 	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddressList(s)
+		ma, hp.err = addressParser.ParseList(s)
 		return
 	}
 
@@ -523,16 +502,18 @@ func (hp headerParser) parseMessageIdList(s string) (result []string) {
 
 // Attachment with filename, content type and data (as a io.Reader)
 type Attachment struct {
-	Filename    string
-	ContentType string
-	Data        io.Reader
+	Filename     string
+	ContentType  string
+	DetectedType string
+	Data         io.Reader
 }
 
 // EmbeddedFile with content id, content type and data (as a io.Reader)
 type EmbeddedFile struct {
-	CID         string
-	ContentType string
-	Data        io.Reader
+	CID          string
+	ContentType  string
+	DetectedType string
+	Data         io.Reader
 }
 
 // Email with fields for all the headers defined in RFC5322 with it's attachments and
@@ -567,4 +548,8 @@ type Email struct {
 
 	Attachments   []Attachment
 	EmbeddedFiles []EmbeddedFile
+
+	// Messages are the parsed message/rfc822 attachments (forwarded mails, bounces ...),
+	// they are still available as Attachments too
+	Messages []*Email
 }
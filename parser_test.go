@@ -0,0 +1,163 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// outlookInvite is a meeting request as sent by Outlook, the invitation is an alternative to the text and HTML bodies
+const outlookInvite = `From: Organizer <organizer@example.com>
+To: attendee@example.org
+Subject: Weekly sync
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="_000_invite_"
+
+--_000_invite_
+Content-Type: text/plain; charset="us-ascii"
+
+Weekly sync
+--_000_invite_
+Content-Type: text/html; charset="us-ascii"
+
+<html><body>Weekly sync</body></html>
+--_000_invite_
+Content-Type: text/calendar; charset="utf-8"; method=REQUEST
+
+BEGIN:VCALENDAR
+METHOD:REQUEST
+END:VCALENDAR
+--_000_invite_--
+`
+
+// appleMailAttachment is a message with an attachment as sent by Apple Mail, the HTML body
+// and the attachment are in a multipart/mixed alternative
+const appleMailAttachment = `From: Sender <sender@example.com>
+To: rcpt@example.org
+Subject: Report
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="Apple-Mail=_ALT"
+
+--Apple-Mail=_ALT
+Content-Transfer-Encoding: 7bit
+Content-Type: text/plain; charset=us-ascii
+
+see attached
+--Apple-Mail=_ALT
+Content-Type: multipart/mixed; boundary="Apple-Mail=_MIX"
+
+--Apple-Mail=_MIX
+Content-Transfer-Encoding: 7bit
+Content-Type: text/html; charset=us-ascii
+
+<html><body>see attached</body></html>
+--Apple-Mail=_MIX
+Content-Disposition: attachment; filename=report.pdf
+Content-Type: application/pdf; name="report.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--Apple-Mail=_MIX
+Content-Transfer-Encoding: 7bit
+Content-Type: text/html; charset=us-ascii
+
+<html><body>thanks</body></html>
+--Apple-Mail=_MIX--
+
+--Apple-Mail=_ALT--
+`
+
+func TestParseEmailAlternative(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		message     string
+		text        string
+		html        string
+		filename    string
+		contentType string
+		content     string
+	}{
+		{"outlook invite", outlookInvite, "Weekly sync", "<html><body>Weekly sync</body></html>", "", "text/calendar", "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nEND:VCALENDAR"},
+		{"apple mail", appleMailAttachment, "see attached", "<html><body>see attached</body></html><html><body>thanks</body></html>", "report.pdf", "application/pdf", "%PDF-1.4\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			email, err := ParseEmail(strings.NewReader(strings.Replace(tt.message, "\n", "\r\n", -1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if email.TextBody != tt.text || email.HTMLBody != tt.html {
+				t.Fatalf("got the bodies %q and %q", email.TextBody, email.HTMLBody)
+			}
+
+			if len(email.Attachments) != 1 {
+				t.Fatalf("got %d attachments, want 1", len(email.Attachments))
+			}
+
+			at := email.Attachments[0]
+			if at.Filename != tt.filename || at.ContentType != tt.contentType {
+				t.Fatalf("got the attachment %q of type %s", at.Filename, at.ContentType)
+			}
+
+			if content, _ := ioutil.ReadAll(at.Data); string(content) != tt.content {
+				t.Fatalf("got the attachment content %q", content)
+			}
+		})
+	}
+}
+
+func TestParseMessageDepth(t *testing.T) {
+	// each level forwards the previous one as a message/rfc822 attachment
+	message := "Subject: level 0\r\n\r\nhello\r\n"
+	for i := 1; i <= 4; i++ {
+		message = fmt.Sprintf("Subject: level %d\r\nContent-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\nContent-Type: message/rfc822\r\n\r\n%s\r\n--b%d--\r\n", i, i, i, message, i)
+	}
+
+	depth := func(email *Email) (n int) {
+		for len(email.Messages) > 0 {
+			email, n = email.Messages[0], n+1
+		}
+
+		return
+	}
+
+	for _, tt := range []struct {
+		maxDepth int
+		want     int
+	}{
+		{0, DefaultMessageDepth},
+		{-1, 0},
+		{1, 1},
+		{10, 4},
+	} {
+		depths := make(chan int, 1)
+
+		srv, addr := startTestServer(t, &ServerConfig{
+			MaxMessageDepth: tt.maxDepth,
+			Handler: func(c *Context) error {
+				email, err := c.Parse()
+				if err != nil {
+					return err
+				}
+
+				depths <- depth(email)
+				return nil
+			},
+		})
+
+		c := dialTestServer(t, addr)
+		c.expectCmd("EHLO client.example.org", 250)
+		c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write(message + ".\r\n")
+		c.expect(250)
+		c.Close()
+		srv.Close()
+
+		if got := <-depths; got != tt.want {
+			t.Errorf("MaxMessageDepth %d: parsed %d nested messages, want %d", tt.maxDepth, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+)
+
+// PipelineStep is a single delivery handler of a Pipeline
+type PipelineStep struct {
+	Name    string
+	Handler HandlerFunc
+
+	// Fallback (if set) is tried when Handler fails, the step succeeds if the fallback does
+	Fallback HandlerFunc
+
+	// Required steps make the whole delivery fail, otherwise the step is best-effort
+	Required bool
+
+	// StopOnError skips the remaining steps once this one failed
+	StopOnError bool
+}
+
+// Pipeline runs multiple delivery handlers in order (e.g. archive -> webhook -> maildir),
+// each of them reads its own copy of the message, use Handle as the server Handler.
+type Pipeline struct {
+	Steps []PipelineStep
+
+	// OnError (if set) receives the failures of all the steps, including the best-effort ones
+	OnError func(step string, err error)
+}
+
+// Handle implements HandlerFunc
+func (p *Pipeline) Handle(c *Context) error {
+	data, err := ioutil.ReadAll(c.session.body)
+	if err != nil {
+		return err
+	}
+
+	var failure error
+
+	for _, step := range p.Steps {
+		err := p.run(c, step.Handler, data)
+		if err != nil && step.Fallback != nil {
+			err = p.run(c, step.Fallback, data)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if p.OnError != nil {
+			p.OnError(step.Name, err)
+		}
+
+		if step.Required && failure == nil {
+			failure = err
+		}
+
+		if step.StopOnError {
+			break
+		}
+	}
+
+	return failure
+}
+
+func (p *Pipeline) run(c *Context, handler HandlerFunc, data []byte) error {
+	c.session.body = bytes.NewReader(data)
+
+	return handler(c)
+}
@@ -0,0 +1,22 @@
+package smtpsrv
+
+import (
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errEarlyTalker = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 5, 1}, Message: "Protocol error: data sent before the greeting"}
+
+// talksEarly waits for ServerConfig.GreetDelay and reports whether the client sent data in
+// the meantime, SMTP clients must wait for the greeting (RFC 5321 section 3.1) while
+// many bots don't
+func (c *conn) talksEarly() bool {
+	c.Conn.SetReadDeadline(time.Now().Add(c.greetDelay))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	n, _ := c.Conn.Read(b[:])
+
+	return n > 0
+}
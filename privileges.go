@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package smtpsrv
+
+import (
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges switches the process to the specified user and its primary group, it is
+// called once the privileged ports (e.g: 25) are bound, the supplementary groups are cleared
+func DropPrivileges(username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+
+	return syscall.Setuid(uid)
+}
@@ -0,0 +1,6 @@
+package smtpsrv
+
+// DropPrivileges isn't supported on windows, the service account is chosen when installing the service
+func DropPrivileges(username string) error {
+	return ErrPrivilegesUnsupported
+}
@@ -0,0 +1,117 @@
+package smtpsrv
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errProfileTLS      = &smtp.SMTPError{Code: 530, EnhancedCode: smtp.EnhancedCode{5, 7, 0}, Message: "Must issue a STARTTLS command first"}
+	errProfileSender   = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sender not allowed for this recipient"}
+	errProfileTooLarge = &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}, Message: "Message too big for this recipient"}
+)
+
+// DomainProfile is the policy of the recipients of a domain, so a single server can host
+// domains with different requirements, see ServerConfig.DomainProfiles
+type DomainProfile struct {
+	// MaxMessageBytes (if set) lowers the message size limit of the domain recipients
+	MaxMessageBytes int
+
+	// RequireTLS refuses the domain recipients on the unencrypted sessions
+	RequireTLS bool
+
+	// AllowedSenders (if set) are the only senders accepted for the domain recipients, either
+	// addresses ("john@example.com") or domains ("@example.com"), "<>" allows the null sender
+	AllowedSenders []string
+
+	// SpamRejectScore (if set) rejects the messages the ServerConfig.SpamFilter scores at least this high
+	SpamRejectScore float64
+}
+
+func (p *DomainProfile) allowsSender(from string) bool {
+	if len(p.AllowedSenders) < 1 {
+		return true
+	}
+
+	_, domain, _ := SplitAddress(from)
+
+	for _, sender := range p.AllowedSenders {
+		switch {
+		case sender == "<>":
+			if from == "" {
+				return true
+			}
+		case strings.HasPrefix(sender, "@"):
+			if from != "" && strings.EqualFold(sender[1:], domain) {
+				return true
+			}
+		case strings.EqualFold(sender, from):
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkDomainProfile applies the ServerConfig.DomainProfiles entry of the recipient, it returns nil if there is none
+func (s *Session) checkDomainProfile(address string) (*DomainProfile, error) {
+	if s.config.DomainProfiles == nil {
+		return nil, nil
+	}
+
+	_, domain, err := SplitAddress(address)
+	if err != nil {
+		return nil, nil
+	}
+
+	profile := s.config.DomainProfiles[normalizeDomain(domain)]
+	if profile == nil {
+		return nil, nil
+	}
+
+	if profile.RequireTLS && !s.connState.TLS.HandshakeComplete {
+		return nil, errProfileTLS
+	}
+
+	from := ""
+	if s.From != nil {
+		from = s.From.Address
+	}
+
+	if !profile.allowsSender(from) {
+		return nil, errProfileSender
+	}
+
+	if profile.MaxMessageBytes > 0 && s.size > profile.MaxMessageBytes {
+		return nil, errProfileTooLarge
+	}
+
+	return profile, nil
+}
+
+// profileMaxSize returns the lowest message size limit of the transaction recipients profiles, 0 if none
+func (s *Session) profileMaxSize() int {
+	size := 0
+
+	for _, profile := range s.profiles {
+		if profile.MaxMessageBytes > 0 && (size == 0 || profile.MaxMessageBytes < size) {
+			size = profile.MaxMessageBytes
+		}
+	}
+
+	return size
+}
+
+// profileSpamScore returns the lowest spam score rejection of the transaction recipients profiles, 0 if none
+func (s *Session) profileSpamScore() float64 {
+	score := 0.0
+
+	for _, profile := range s.profiles {
+		if profile.SpamRejectScore > 0 && (score == 0 || profile.SpamRejectScore < score) {
+			score = profile.SpamRejectScore
+		}
+	}
+
+	return score
+}
@@ -0,0 +1,253 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// SenderDomainThrottle limits the number of messages accepted per MAIL FROM
+// domain, it is a token bucket per domain that holds up to Limit tokens and
+// is refilled with Limit tokens every Interval.
+type SenderDomainThrottle struct {
+	Limit    int
+	Interval time.Duration
+
+	// Quotas overrides Limit for specific domains
+	Quotas map[string]int
+
+	Clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// Allow reports whether another message from the specified domain is allowed
+func (t *SenderDomainThrottle) Allow(domain string) bool {
+	domain = strings.ToLower(domain)
+
+	limit := t.Limit
+	if quota, ok := t.Quotas[domain]; ok {
+		limit = quota
+	}
+
+	if limit < 1 {
+		return true
+	}
+
+	interval := t.Interval
+	if interval < 1 {
+		interval = time.Hour
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.buckets == nil {
+		t.buckets = map[string]*tokenBucket{}
+	}
+
+	now := clockOrDefault(t.Clock).Now()
+
+	if len(t.buckets) > maxTokenBuckets {
+		pruneTokenBuckets(t.buckets, interval, now)
+	}
+
+	bucket := t.buckets[domain]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(limit), last: now}
+		t.buckets[domain] = bucket
+	}
+
+	return bucket.take(limit, interval, now)
+}
+
+const maxTokenBuckets = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(capacity int, interval time.Duration, now time.Time) bool {
+	b.tokens += float64(capacity) * float64(now.Sub(b.last)) / float64(interval)
+	if b.tokens > float64(capacity) {
+		b.tokens = float64(capacity)
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// pruneTokenBuckets drops the buckets that are refilled anyway
+func pruneTokenBuckets(buckets map[string]*tokenBucket, interval time.Duration, now time.Time) {
+	for key, bucket := range buckets {
+		if now.Sub(bucket.last) > interval {
+			delete(buckets, key)
+		}
+	}
+}
+
+// RateLimitStage is the SMTP stage a RateLimiter is consulted at
+type RateLimitStage int
+
+const (
+	// RateLimitConnect is consulted when a client connects, it is refused with 421
+	RateLimitConnect RateLimitStage = iota
+
+	// RateLimitMail is consulted at MAIL FROM, it is deferred with 450
+	RateLimitMail
+
+	// RateLimitRcpt is consulted at RCPT TO, it is deferred with 450
+	RateLimitRcpt
+)
+
+// RateLimitKey identifies the client of a rate limited event, User and Domain (of MAIL FROM)
+// are empty when they aren't known yet
+type RateLimitKey struct {
+	IP     net.IP
+	User   string
+	Domain string
+}
+
+// RateLimiter limits the rate of the connections, transactions and recipients, see TokenBucketLimiter
+type RateLimiter interface {
+	Allow(stage RateLimitStage, key RateLimitKey) bool
+}
+
+// RateLimitScope is the part of the RateLimitKey a rule counts the events by
+type RateLimitScope int
+
+const (
+	RateLimitByIP RateLimitScope = iota
+	RateLimitByUser
+	RateLimitByDomain
+)
+
+// RateLimitRule allows up to Limit events of Stage per Interval (1 hour by default) and per Scope,
+// the events without the scoped key (e.g: unauthenticated clients for RateLimitByUser) aren't counted
+type RateLimitRule struct {
+	Stage    RateLimitStage
+	Scope    RateLimitScope
+	Limit    int
+	Interval time.Duration
+}
+
+// TokenBucketLimiter is the default RateLimiter, a token bucket per rule and key
+type TokenBucketLimiter struct {
+	Rules []RateLimitRule
+	Clock Clock
+
+	mu      sync.Mutex
+	buckets map[int]map[string]*tokenBucket
+}
+
+// Allow reports whether the event is allowed by all the rules of the stage, the denied events
+// don't consume the tokens of the other rules
+func (l *TokenBucketLimiter) Allow(stage RateLimitStage, key RateLimitKey) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = map[int]map[string]*tokenBucket{}
+	}
+
+	now := clockOrDefault(l.Clock).Now()
+
+	var taken []*tokenBucket
+
+	for i, rule := range l.Rules {
+		value := rule.key(key)
+		if rule.Stage != stage || rule.Limit < 1 || value == "" {
+			continue
+		}
+
+		interval := rule.interval()
+
+		buckets := l.buckets[i]
+		if buckets == nil {
+			buckets = map[string]*tokenBucket{}
+			l.buckets[i] = buckets
+		}
+
+		if len(buckets) > maxTokenBuckets {
+			pruneTokenBuckets(buckets, interval, now)
+		}
+
+		bucket := buckets[value]
+		if bucket == nil {
+			bucket = &tokenBucket{tokens: float64(rule.Limit), last: now}
+			buckets[value] = bucket
+		}
+
+		if !bucket.take(rule.Limit, interval, now) {
+			for _, b := range taken {
+				b.tokens++
+			}
+
+			return false
+		}
+
+		taken = append(taken, bucket)
+	}
+
+	return true
+}
+
+func (rule RateLimitRule) interval() time.Duration {
+	if rule.Interval < 1 {
+		return time.Hour
+	}
+
+	return rule.Interval
+}
+
+func (rule RateLimitRule) key(key RateLimitKey) string {
+	switch rule.Scope {
+	case RateLimitByIP:
+		if key.IP == nil {
+			return ""
+		}
+
+		return key.IP.String()
+	case RateLimitByUser:
+		return strings.ToLower(key.User)
+	case RateLimitByDomain:
+		return strings.ToLower(key.Domain)
+	}
+
+	return ""
+}
+
+// checkRateLimit consults ServerConfig.RateLimiter at MAIL FROM or RCPT TO
+func (s *Session) checkRateLimit(stage RateLimitStage) error {
+	if s.config.RateLimiter == nil || s.allowlisted() {
+		return nil
+	}
+
+	key := RateLimitKey{IP: remoteIP(s.connState.RemoteAddr)}
+
+	if s.username != nil {
+		key.User = *s.username
+	}
+
+	if s.From != nil {
+		_, key.Domain, _ = SplitAddress(s.From.Address)
+	}
+
+	if !s.config.RateLimiter.Allow(stage, key) {
+		return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Rate limit exceeded, try again later"}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	clock := &manualClock{now: time.Unix(0, 0)}
+	l := &TokenBucketLimiter{Clock: clock, Rules: []RateLimitRule{
+		{Stage: RateLimitMail, Scope: RateLimitByIP, Limit: 3, Interval: time.Minute},
+		{Stage: RateLimitMail, Scope: RateLimitByDomain, Limit: 2, Interval: time.Minute},
+		{Stage: RateLimitRcpt, Scope: RateLimitByUser, Limit: 1},
+	}}
+
+	ip := net.ParseIP("192.0.2.1")
+	allow := func(stage RateLimitStage, key RateLimitKey, want bool) {
+		t.Helper()
+
+		if got := l.Allow(stage, key); got != want {
+			t.Fatalf("Allow(%d, %+v) = %v, want %v", stage, key, got, want)
+		}
+	}
+
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "example.org"}, true)
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "Example.org"}, true)
+
+	// the domain rule denies, the IP token isn't consumed
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "example.org"}, false)
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "example.net"}, true)
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "example.net"}, false)
+	allow(RateLimitMail, RateLimitKey{IP: net.ParseIP("192.0.2.2"), Domain: "example.com"}, true)
+
+	// the buckets refill over the interval
+	clock.now = clock.now.Add(30 * time.Second)
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "example.com"}, true)
+	allow(RateLimitMail, RateLimitKey{IP: ip, Domain: "example.com"}, false)
+
+	// the rules of the other stages and without the scoped key don't apply
+	allow(RateLimitConnect, RateLimitKey{IP: ip}, true)
+	allow(RateLimitRcpt, RateLimitKey{IP: ip}, true)
+	allow(RateLimitRcpt, RateLimitKey{IP: ip}, true)
+	allow(RateLimitRcpt, RateLimitKey{IP: ip, User: "john"}, true)
+	allow(RateLimitRcpt, RateLimitKey{IP: ip, User: "John"}, false)
+}
+
+func TestRateLimitSession(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{
+		Clock: frozenClock{},
+		RateLimiter: &TokenBucketLimiter{Rules: []RateLimitRule{
+			{Stage: RateLimitConnect, Scope: RateLimitByIP, Limit: 1},
+			{Stage: RateLimitRcpt, Scope: RateLimitByDomain, Limit: 1},
+		}},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("RCPT TO:<a@example.com>", 250)
+
+	if reply := c.expectCmd("RCPT TO:<b@example.com>", 450); reply[:9] != "450 4.7.1" {
+		t.Fatalf("got %q, want 450 4.7.1", reply)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	second := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if reply := second.expect(421); reply[:9] != "421 4.7.0" {
+		t.Fatalf("second connection: got %q, want 421 4.7.0", reply)
+	}
+}
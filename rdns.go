@@ -0,0 +1,114 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// maxPTRNames bounds the PTR names that are forward-confirmed
+const maxPTRNames = 10
+
+// ReverseDNS is the reverse DNS of a client IP and its forward confirmation (FCrDNS)
+type ReverseDNS struct {
+	IP net.IP
+
+	// Names are the PTR names of the IP
+	Names []string
+
+	// Hostname is the first forward-confirmed name, or the first PTR name if none is
+	Hostname string
+
+	// Verified reports whether Hostname resolves back to the IP
+	Verified bool
+
+	// Err is the lookup error, a missing PTR record isn't an error
+	Err error
+}
+
+// LookupReverseDNS looks up the PTR names of ip and verifies that they resolve back to it
+func LookupReverseDNS(ctx context.Context, resolver Resolver, ip net.IP) *ReverseDNS {
+	rdns := &ReverseDNS{IP: ip}
+	if ip == nil {
+		return rdns
+	}
+
+	resolver = resolverOrDefault(resolver)
+
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if !isNotFound(err) {
+			rdns.Err = err
+		}
+
+		return rdns
+	}
+
+	for _, name := range names {
+		rdns.Names = append(rdns.Names, strings.TrimSuffix(name, "."))
+	}
+
+	if len(rdns.Names) > 0 {
+		rdns.Hostname = rdns.Names[0]
+	}
+
+	for i, name := range rdns.Names {
+		if i >= maxPTRNames {
+			break
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil && !isNotFound(err) && rdns.Err == nil {
+			rdns.Err = err
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				rdns.Hostname, rdns.Verified, rdns.Err = name, true, nil
+				return rdns
+			}
+		}
+	}
+
+	return rdns
+}
+
+// ReceivedClause renders the Received header "from" clause, e.g:
+// "from mx.example.com (mx.example.com [192.0.2.1])", the host is "unknown"
+// when the reverse DNS isn't forward-confirmed
+func (rdns *ReverseDNS) ReceivedClause(helo string) string {
+	host := "unknown"
+	if rdns.Verified {
+		host = rdns.Hostname
+	}
+
+	if helo == "" {
+		helo = host
+	}
+
+	return "from " + helo + " (" + host + " [" + rdns.IP.String() + "])"
+}
+
+// rdnsCheck is the (pending) reverse DNS lookup of the client
+type rdnsCheck struct {
+	done   chan struct{}
+	result *ReverseDNS
+}
+
+// startReverseDNS starts the reverse DNS lookup of the client, bounded by the lookup timeout
+func (s *Session) startReverseDNS() *rdnsCheck {
+	check := &rdnsCheck{done: make(chan struct{})}
+	s.rdns = check
+
+	ip, resolver := remoteIP(s.connState.RemoteAddr), s.config.Resolver
+	ctx, cancel := context.WithTimeout(s.context(), s.lookupTimeout())
+
+	go func() {
+		defer close(check.done)
+		defer cancel()
+
+		check.result = LookupReverseDNS(ctx, resolver, ip)
+	}()
+
+	return check
+}
@@ -0,0 +1,30 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errInternal = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Internal error"}
+
+// recoverPanic replies 451 to the command that panicked (e.g: in the handler) instead of dropping
+// the connection, the panic is reported to ServerConfig.OnPanic or written to stderr
+func (s *Session) recoverPanic(err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	stack := debug.Stack()
+
+	if s.config.OnPanic != nil {
+		s.config.OnPanic(s.connState.RemoteAddr, v, stack)
+	} else {
+		fmt.Fprintf(os.Stderr, "smtpsrv: panic serving %v: %v\n%s", s.connState.RemoteAddr, v, stack)
+	}
+
+	*err = errInternal
+}
@@ -0,0 +1,287 @@
+package smtpsrv
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReputationEvent is something an IP did that affects its reputation
+type ReputationEvent int
+
+const (
+	ReputationAccepted ReputationEvent = iota
+	ReputationRejected
+	ReputationSPFPass
+	ReputationSPFFail
+	ReputationDKIMPass
+	ReputationDKIMFail
+	ReputationInvalidRcpt
+	ReputationAuthFailure
+	ReputationBadHelo
+	ReputationDNSBL
+)
+
+// IPHistory is the tracked history of a single IP
+type IPHistory struct {
+	Accepted     int
+	Rejected     int
+	SPFPass      int
+	SPFFail      int
+	DKIMPass     int
+	DKIMFail     int
+	InvalidRcpt  int
+	AuthFailures int
+	BadHelo      int
+	DNSBL        int
+	LastSeen     time.Time
+	BlockedUntil time.Time
+
+	// DecayedAt is when the counters were last halved, see Reputation.HalfLife
+	DecayedAt time.Time
+}
+
+// decay halves the counters once per halfLife elapsed since they were last halved,
+// so an IP recovers from its old offenses
+func (h *IPHistory) decay(now time.Time, halfLife time.Duration) {
+	if h.DecayedAt.IsZero() {
+		h.DecayedAt = now
+		return
+	}
+
+	periods := now.Sub(h.DecayedAt) / halfLife
+	if periods < 1 {
+		return
+	}
+
+	shift := uint(63)
+	if periods < 63 {
+		shift = uint(periods)
+	}
+
+	for _, counter := range []*int{&h.Accepted, &h.Rejected, &h.SPFPass, &h.SPFFail, &h.DKIMPass, &h.DKIMFail, &h.InvalidRcpt, &h.AuthFailures, &h.BadHelo, &h.DNSBL} {
+		*counter >>= shift
+	}
+
+	h.DecayedAt = h.DecayedAt.Add(periods * halfLife)
+}
+
+// ReputationStore persists the IP histories, see NewMemoryReputationStore
+type ReputationStore interface {
+	Get(ip string) (*IPHistory, error)
+	Put(ip string, history *IPHistory) error
+}
+
+// ReputationScoreFunc computes the score of a history, the lower the worse
+type ReputationScoreFunc func(*IPHistory) float64
+
+// DefaultReputationScore weights the negative events more than the positive ones
+func DefaultReputationScore(h *IPHistory) float64 {
+	score := float64(h.Accepted) + 0.5*float64(h.SPFPass+h.DKIMPass)
+	score -= float64(h.Rejected) + float64(h.InvalidRcpt) + float64(h.BadHelo)
+	score -= 2 * float64(h.SPFFail+h.DKIMFail+h.DNSBL)
+	score -= 3 * float64(h.AuthFailures)
+
+	return score
+}
+
+// Reputation tracks the per-IP history and blocks the worst offenders for a while
+type Reputation struct {
+	// Store defaults to an in-memory store
+	Store ReputationStore
+
+	// Score defaults to DefaultReputationScore
+	Score ReputationScoreFunc
+
+	// BlockThreshold is the score at (or below) which an IP is blocked for BlockFor (1 hour by default),
+	// zero disables the automatic blocking
+	BlockThreshold float64
+	BlockFor       time.Duration
+
+	// HalfLife is how often the counters of a history are halved, 24 hours by default
+	HalfLife time.Duration
+
+	Clock Clock
+
+	once sync.Once
+	mu   sync.Mutex
+}
+
+func (r *Reputation) init() {
+	r.once.Do(func() {
+		if r.Store == nil {
+			r.Store = NewMemoryReputationStore()
+		}
+
+		if r.Score == nil {
+			r.Score = DefaultReputationScore
+		}
+	})
+}
+
+// Record adds an event to the history of the specified IP
+func (r *Reputation) Record(ip string, event ReputationEvent) error {
+	r.init()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, err := r.Store.Get(ip)
+	if err != nil {
+		return err
+	}
+
+	if h == nil {
+		h = &IPHistory{}
+	}
+
+	now := clockOrDefault(r.Clock).Now()
+	h.decay(now, r.halfLife())
+
+	switch event {
+	case ReputationAccepted:
+		h.Accepted++
+	case ReputationRejected:
+		h.Rejected++
+	case ReputationSPFPass:
+		h.SPFPass++
+	case ReputationSPFFail:
+		h.SPFFail++
+	case ReputationDKIMPass:
+		h.DKIMPass++
+	case ReputationDKIMFail:
+		h.DKIMFail++
+	case ReputationInvalidRcpt:
+		h.InvalidRcpt++
+	case ReputationAuthFailure:
+		h.AuthFailures++
+	case ReputationBadHelo:
+		h.BadHelo++
+	case ReputationDNSBL:
+		h.DNSBL++
+	}
+
+	h.LastSeen = now
+
+	if r.BlockThreshold != 0 && r.Score(h) <= r.BlockThreshold {
+		blockFor := r.BlockFor
+		if blockFor < 1 {
+			blockFor = time.Hour
+		}
+
+		h.BlockedUntil = h.LastSeen.Add(blockFor)
+	}
+
+	return r.Store.Put(ip, h)
+}
+
+// ScoreOf returns the current score of the specified IP
+func (r *Reputation) ScoreOf(ip string) (float64, error) {
+	r.init()
+
+	h, err := r.Store.Get(ip)
+	if err != nil || h == nil {
+		return 0, err
+	}
+
+	h.decay(clockOrDefault(r.Clock).Now(), r.halfLife())
+
+	return r.Score(h), nil
+}
+
+func (r *Reputation) halfLife() time.Duration {
+	if r.HalfLife < 1 {
+		return 24 * time.Hour
+	}
+
+	return r.HalfLife
+}
+
+// Blocked reports whether the specified IP is temporarily blocked
+func (r *Reputation) Blocked(ip string) bool {
+	r.init()
+
+	h, err := r.Store.Get(ip)
+	if err != nil || h == nil {
+		return false
+	}
+
+	return clockOrDefault(r.Clock).Now().Before(h.BlockedUntil)
+}
+
+const (
+	maxReputationEntries = 100000
+
+	// reputationTTL is how long the memory store keeps the histories of the IPs it didn't see
+	reputationTTL = 7 * 24 * time.Hour
+)
+
+type memoryReputationStore struct {
+	mu        sync.RWMutex
+	histories map[string]IPHistory
+}
+
+// NewMemoryReputationStore returns an in-memory ReputationStore, it forgets the IPs unseen for
+// a week and, once full, the least recently seen ones
+func NewMemoryReputationStore() ReputationStore {
+	return &memoryReputationStore{histories: map[string]IPHistory{}}
+}
+
+func (s *memoryReputationStore) Get(ip string) (*IPHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h, ok := s.histories[ip]
+	if !ok {
+		return nil, nil
+	}
+
+	return &h, nil
+}
+
+func (s *memoryReputationStore) Put(ip string, history *IPHistory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.histories[ip]; !ok && len(s.histories) >= maxReputationEntries {
+		s.evict(history.LastSeen)
+	}
+
+	s.histories[ip] = *history
+
+	return nil
+}
+
+// evict drops the expired histories relative to now, then the least recently seen unblocked
+// ones until a tenth of the store is free so the next Puts don't evict again
+func (s *memoryReputationStore) evict(now time.Time) {
+	for ip, h := range s.histories {
+		if now.Sub(h.LastSeen) > reputationTTL && !now.Before(h.BlockedUntil) {
+			delete(s.histories, ip)
+		}
+	}
+
+	keep := maxReputationEntries * 9 / 10
+	if len(s.histories) <= keep {
+		return
+	}
+
+	ips := make([]string, 0, len(s.histories))
+	for ip := range s.histories {
+		ips = append(ips, ip)
+	}
+
+	// the blocked IPs go last, evicting them would unblock them
+	sort.Slice(ips, func(i, j int) bool {
+		hi, hj := s.histories[ips[i]], s.histories[ips[j]]
+		if blockedI, blockedJ := now.Before(hi.BlockedUntil), now.Before(hj.BlockedUntil); blockedI != blockedJ {
+			return blockedJ
+		}
+
+		return hi.LastSeen.Before(hj.LastSeen)
+	})
+
+	for _, ip := range ips[:len(ips)-keep] {
+		delete(s.histories, ip)
+	}
+}
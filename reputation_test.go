@@ -0,0 +1,86 @@
+package smtpsrv
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// manualClock only moves when the test advances it
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time                         { return c.now }
+func (c *manualClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func TestIPHistoryDecay(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{0, 8},
+		{23 * time.Hour, 8},
+		{24 * time.Hour, 4},
+		{72 * time.Hour, 1},
+		{100 * 24 * time.Hour, 0},
+	} {
+		h := &IPHistory{Rejected: 8, DecayedAt: start}
+		h.decay(start.Add(tt.elapsed), 24*time.Hour)
+
+		if h.Rejected != tt.want {
+			t.Errorf("after %v: got %d, want %d", tt.elapsed, h.Rejected, tt.want)
+		}
+	}
+}
+
+func TestReputationRecovers(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	r := &Reputation{Clock: clock}
+
+	for i := 0; i < 4; i++ {
+		r.Record("192.0.2.1", ReputationAuthFailure)
+	}
+
+	if score, _ := r.ScoreOf("192.0.2.1"); score != -12 {
+		t.Fatalf("got %v, want -12", score)
+	}
+
+	clock.now = clock.now.Add(48 * time.Hour)
+
+	if score, _ := r.ScoreOf("192.0.2.1"); score != -3 {
+		t.Fatalf("two days later: got %v, want -3", score)
+	}
+}
+
+func TestMemoryReputationStoreEviction(t *testing.T) {
+	store := NewMemoryReputationStore().(*memoryReputationStore)
+	now := time.Unix(1600000000, 0)
+
+	store.Put("stale", &IPHistory{LastSeen: now.Add(-2 * reputationTTL)})
+	store.Put("blocked", &IPHistory{LastSeen: now.Add(-2 * reputationTTL), BlockedUntil: now.Add(48 * time.Hour)})
+
+	for i := len(store.histories); i < maxReputationEntries; i++ {
+		store.Put(strconv.Itoa(i), &IPHistory{LastSeen: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	store.Put("new", &IPHistory{LastSeen: now.Add(time.Duration(maxReputationEntries) * time.Second)})
+
+	if len(store.histories) > maxReputationEntries*9/10+1 {
+		t.Fatalf("got %d histories, want at most %d", len(store.histories), maxReputationEntries*9/10+1)
+	}
+
+	for _, ip := range []string{"stale", "2"} {
+		if h, _ := store.Get(ip); h != nil {
+			t.Errorf("%s wasn't evicted", ip)
+		}
+	}
+
+	for _, ip := range []string{"blocked", "new", strconv.Itoa(maxReputationEntries - 1)} {
+		if h, _ := store.Get(ip); h == nil {
+			t.Errorf("%s got evicted", ip)
+		}
+	}
+}
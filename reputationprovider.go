@@ -0,0 +1,136 @@
+package smtpsrv
+
+import (
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ReputationStage is the point of the session a ReputationProvider is consulted at
+type ReputationStage int
+
+const (
+	ReputationAtConnect ReputationStage = iota
+	ReputationAtMail
+)
+
+// ReputationProvider scores the clients, the lower the worse (e.g: a local database or an
+// external reputation service), from is empty at connect time
+type ReputationProvider interface {
+	Score(ip net.IP, stage ReputationStage, from string) (float64, error)
+}
+
+// ReputationProviderFunc adapts a function to the ReputationProvider interface
+type ReputationProviderFunc func(ip net.IP, stage ReputationStage, from string) (float64, error)
+
+// Score implements ReputationProvider
+func (fn ReputationProviderFunc) Score(ip net.IP, stage ReputationStage, from string) (float64, error) {
+	return fn(ip, stage, from)
+}
+
+// ReputationCheck is the outcome of a ReputationProvider consultation, see Context.ReputationChecks
+type ReputationCheck struct {
+	Stage ReputationStage
+	Score float64
+	Err   error
+}
+
+// ReputationPolicy consults a ReputationProvider at MAIL FROM (and before the greeting with OnConnect),
+// the provider errors are recorded and the client is accepted
+type ReputationPolicy struct {
+	Provider  ReputationProvider
+	OnConnect bool
+
+	// RejectThreshold is the score at (or below) which the client is rejected, zero disables the rejection
+	RejectThreshold float64
+
+	// GreylistThreshold (if set) restricts ServerConfig.Greylist to the clients scoring at (or below) it
+	GreylistThreshold float64
+}
+
+func (p *ReputationPolicy) check(ip net.IP, stage ReputationStage, from string) *ReputationCheck {
+	score, err := p.Provider.Score(ip, stage, from)
+
+	return &ReputationCheck{Stage: stage, Score: score, Err: err}
+}
+
+// reply returns the reply rejecting the client, nil if it is accepted
+func (p *ReputationPolicy) reply(check *ReputationCheck) *smtp.SMTPError {
+	if check == nil || check.Err != nil || p.RejectThreshold == 0 || check.Score > p.RejectThreshold {
+		return nil
+	}
+
+	if check.Stage == ReputationAtConnect {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Access denied due to poor reputation"}
+	}
+
+	return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Rejected due to poor reputation"}
+}
+
+// connectReputation is the (lazily computed) ReputationPolicy.OnConnect check of a connection
+type connectReputation struct {
+	once   sync.Once
+	policy *ReputationPolicy
+	check  *ReputationCheck
+}
+
+// decide consults the provider once and returns the reply refusing the client, nil if it is accepted
+func (r *connectReputation) decide(ip net.IP) *smtp.SMTPError {
+	r.once.Do(func() {
+		r.check = r.policy.check(ip, ReputationAtConnect, "")
+	})
+
+	return r.policy.reply(r.check)
+}
+
+// checkReputationProvider applies ServerConfig.ReputationProvider at MAIL FROM
+func (s *Session) checkReputationProvider() error {
+	s.reputation = nil
+
+	policy := s.config.ReputationProvider
+	if policy == nil || policy.Provider == nil || s.username != nil {
+		return nil
+	}
+
+	s.reputation = policy.check(remoteIP(s.connState.RemoteAddr), ReputationAtMail, s.From.Address)
+
+	if reply := policy.reply(s.reputation); reply != nil {
+		return reply
+	}
+
+	return nil
+}
+
+// reputationChecks returns the checks of the connection and of the current transaction
+func (s *Session) reputationChecks() []ReputationCheck {
+	var checks []ReputationCheck
+
+	if c := s.conn(); c != nil && c.reputation != nil {
+		c.reputation.decide(remoteIP(s.connState.RemoteAddr))
+		checks = append(checks, *c.reputation.check)
+	}
+
+	if s.reputation != nil {
+		checks = append(checks, *s.reputation)
+	}
+
+	return checks
+}
+
+// reputationGreylisted reports whether the client is subject to greylisting by its latest score
+func (s *Session) reputationGreylisted() bool {
+	policy := s.config.ReputationProvider
+	if policy == nil || policy.GreylistThreshold == 0 {
+		return true
+	}
+
+	checks := s.reputationChecks()
+	for i := len(checks) - 1; i >= 0; i-- {
+		if checks[i].Err == nil {
+			return checks[i].Score <= policy.GreylistThreshold
+		}
+	}
+
+	return true
+}
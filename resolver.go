@@ -0,0 +1,23 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver is the DNS resolver used by the SPF, MX, PTR and DNSBL lookups,
+// *net.Resolver and the caching resolver of the dnscache subpackage implement it
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func resolverOrDefault(r Resolver) Resolver {
+	if r == nil {
+		return net.DefaultResolver
+	}
+
+	return r
+}
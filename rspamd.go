@@ -0,0 +1,181 @@
+package smtpsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// RspamdFilter is a SpamFilter submitting the messages to the rspamd /checkv2 endpoint
+type RspamdFilter struct {
+	// URL is the rspamd normal worker, http://127.0.0.1:11333 by default
+	URL string
+
+	// Password (if set) is sent as the Password header (required by the controller worker)
+	Password string
+
+	Client *http.Client
+}
+
+// rspamdResult is the subset of the /checkv2 reply the filter needs
+type rspamdResult struct {
+	Score         float64           `json:"score"`
+	RequiredScore float64           `json:"required_score"`
+	Action        string            `json:"action"`
+	Messages      map[string]string `json:"messages"`
+	Milter        struct {
+		AddHeaders map[string]json.RawMessage `json:"add_headers"`
+	} `json:"milter"`
+}
+
+// Check implements SpamFilter
+func (f *RspamdFilter) Check(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error) {
+	url := f.URL
+	if url == "" {
+		url = "http://127.0.0.1:11333"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+"/checkv2", message)
+	if err != nil {
+		return SpamVerdict{}, err
+	}
+
+	if ip := remoteIP(envelope.RemoteAddr); ip != nil {
+		req.Header.Set("IP", ip.String())
+	}
+
+	if envelope.Helo != "" {
+		req.Header.Set("Helo", envelope.Helo)
+	}
+
+	req.Header.Set("From", envelope.From)
+
+	for _, to := range envelope.To {
+		req.Header.Add("Rcpt", to)
+	}
+
+	if envelope.ID != "" {
+		req.Header.Set("Queue-Id", envelope.ID)
+	}
+
+	if envelope.User != "" {
+		req.Header.Set("User", envelope.User)
+	}
+
+	if f.Password != "" {
+		req.Header.Set("Password", f.Password)
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return SpamVerdict{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return SpamVerdict{}, fmt.Errorf("rspamd: unexpected status %s", resp.Status)
+	}
+
+	var result rspamdResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return SpamVerdict{}, fmt.Errorf("rspamd: %s", err)
+	}
+
+	return result.verdict(), nil
+}
+
+// verdict translates the rspamd action, the unknown actions are accepted
+func (r *rspamdResult) verdict() SpamVerdict {
+	verdict := SpamVerdict{Score: r.Score, Headers: r.headers()}
+
+	message := r.Messages["smtp_message"]
+
+	switch r.Action {
+	case "reject":
+		verdict.Action = SpamReject
+		if message != "" {
+			verdict.Reply = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: message}
+		}
+	case "soft reject", "greylist":
+		verdict.Action = SpamDefer
+		if message != "" {
+			verdict.Reply = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: message}
+		}
+	case "add header", "rewrite subject":
+		verdict.Action = SpamTag
+
+		tagged := false
+		for _, h := range verdict.Headers {
+			tagged = tagged || strings.EqualFold(h.Name, "X-Spam")
+		}
+
+		if !tagged {
+			verdict.Headers = append(verdict.Headers, SpamHeader{Name: "X-Spam", Value: "Yes"})
+		}
+	}
+
+	verdict.Headers = append(verdict.Headers, SpamHeader{
+		Name:  "X-Spam-Score",
+		Value: strconv.FormatFloat(r.Score, 'f', 2, 64) + " / " + strconv.FormatFloat(r.RequiredScore, 'f', 2, 64),
+	})
+
+	return verdict
+}
+
+// headers decodes milter.add_headers, a header value is either a string, a {"value", "order"}
+// object or a list of such objects
+func (r *rspamdResult) headers() []SpamHeader {
+	type orderedHeader struct {
+		Value string `json:"value"`
+		Order int    `json:"order"`
+	}
+
+	names := make([]string, 0, len(r.Milter.AddHeaders))
+	for name := range r.Milter.AddHeaders {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var headers []SpamHeader
+
+	for _, name := range names {
+		raw := r.Milter.AddHeaders[name]
+
+		var value string
+		if json.Unmarshal(raw, &value) == nil {
+			headers = append(headers, SpamHeader{Name: name, Value: value})
+			continue
+		}
+
+		var values []orderedHeader
+		if json.Unmarshal(raw, &values) != nil {
+			var single orderedHeader
+			if json.Unmarshal(raw, &single) != nil {
+				continue
+			}
+
+			values = []orderedHeader{single}
+		}
+
+		sort.SliceStable(values, func(i, j int) bool { return values[i].Order < values[j].Order })
+
+		for _, v := range values {
+			headers = append(headers, SpamHeader{Name: name, Value: v.Value})
+		}
+	}
+
+	return headers
+}
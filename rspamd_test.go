@@ -0,0 +1,151 @@
+package smtpsrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRspamdFilter(t *testing.T) {
+	var request *http.Request
+	var body string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		request, body = r, string(data)
+
+		switch {
+		case r.URL.Path != "/checkv2":
+			http.NotFound(w, r)
+		case strings.Contains(body, "malformed"):
+			io.WriteString(w, "{")
+		case strings.Contains(body, "viagra"):
+			io.WriteString(w, `{"score": 16.5, "required_score": 15, "action": "reject", "messages": {"smtp_message": "Spam message rejected"}}`)
+		default:
+			io.WriteString(w, `{"score": 6.2, "required_score": 15, "action": "add header", "milter": {"add_headers": {"X-Spamd-Bar": "++++++"}}}`)
+		}
+	}))
+	defer ts.Close()
+
+	envelope := &SpamEnvelope{
+		ID:         "1",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		Helo:       "mx.example.com",
+		From:       "sender@example.com",
+		To:         []string{"a@example.org", "b@example.org"},
+		User:       "alice",
+	}
+
+	filter := &RspamdFilter{URL: ts.URL + "/", Password: "secret"}
+
+	verdict, err := filter.Check(context.Background(), envelope, strings.NewReader("Subject: hello\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != "Subject: hello\r\n\r\nhello\r\n" {
+		t.Errorf("body = %q", body)
+	}
+
+	for name, want := range map[string]string{
+		"IP":       "192.0.2.1",
+		"Helo":     "mx.example.com",
+		"From":     "sender@example.com",
+		"Rcpt":     "a@example.org,b@example.org",
+		"Queue-Id": "1",
+		"User":     "alice",
+		"Password": "secret",
+	} {
+		if got := strings.Join(request.Header[http.CanonicalHeaderKey(name)], ","); got != want {
+			t.Errorf("%s header = %q, want %q", name, got, want)
+		}
+	}
+
+	if verdict.Action != SpamTag || verdict.Score != 6.2 {
+		t.Errorf("verdict = %d %.2f, want tag 6.20", verdict.Action, verdict.Score)
+	}
+
+	headers := []SpamHeader{{Name: "X-Spamd-Bar", Value: "++++++"}, {Name: "X-Spam", Value: "Yes"}, {Name: "X-Spam-Score", Value: "6.20 / 15.00"}}
+	if len(verdict.Headers) != len(headers) {
+		t.Fatalf("headers = %v, want %v", verdict.Headers, headers)
+	}
+
+	for i := range headers {
+		if verdict.Headers[i] != headers[i] {
+			t.Errorf("header %d = %v, want %v", i, verdict.Headers[i], headers[i])
+		}
+	}
+
+	verdict, err = filter.Check(context.Background(), &SpamEnvelope{}, strings.NewReader("Subject: viagra\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verdict.Action != SpamReject || verdict.Reply == nil || verdict.Reply.Code != 554 || verdict.Reply.Message != "Spam message rejected" {
+		t.Errorf("verdict = %+v, want a 554 reject", verdict)
+	}
+
+	if _, err := filter.Check(context.Background(), &SpamEnvelope{}, strings.NewReader("malformed")); err == nil {
+		t.Error("malformed reply: expected an error")
+	}
+
+	filter.URL = ts.URL + "/missing"
+	if _, err := filter.Check(context.Background(), &SpamEnvelope{}, strings.NewReader("")); err == nil {
+		t.Error("404 reply: expected an error")
+	}
+}
+
+func TestRspamdVerdict(t *testing.T) {
+	for _, tt := range []struct {
+		result  string
+		action  SpamAction
+		reply   int
+		headers []string
+	}{
+		{`{"action": "no action", "score": 1, "required_score": 15}`, SpamAccept, 0, []string{"X-Spam-Score: 1.00 / 15.00"}},
+		{`{"action": "unknown"}`, SpamAccept, 0, []string{"X-Spam-Score: 0.00 / 0.00"}},
+		{`{"action": "reject"}`, SpamReject, 0, []string{"X-Spam-Score: 0.00 / 0.00"}},
+		{`{"action": "soft reject", "messages": {"smtp_message": "Try again later"}}`, SpamDefer, 451, []string{"X-Spam-Score: 0.00 / 0.00"}},
+		{`{"action": "greylist"}`, SpamDefer, 0, []string{"X-Spam-Score: 0.00 / 0.00"}},
+		{`{"action": "rewrite subject", "milter": {"add_headers": {"X-Spam": "Yes"}}}`, SpamTag, 0, []string{"X-Spam: Yes", "X-Spam-Score: 0.00 / 0.00"}},
+		{`{"action": "add header", "milter": {"add_headers": {
+			"X-Spam-Status": {"value": "Yes, score=8", "order": 0},
+			"Authentication-Results": [{"value": "second", "order": 1}, {"value": "first", "order": 0}],
+			"X-Broken": 42
+		}}}`, SpamTag, 0, []string{
+			"Authentication-Results: first", "Authentication-Results: second", "X-Spam-Status: Yes, score=8",
+			"X-Spam: Yes", "X-Spam-Score: 0.00 / 0.00",
+		}},
+	} {
+		var result rspamdResult
+		if err := json.Unmarshal([]byte(tt.result), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		verdict := result.verdict()
+
+		code := 0
+		if verdict.Reply != nil {
+			code = verdict.Reply.Code
+		}
+
+		if verdict.Action != tt.action || code != tt.reply {
+			t.Errorf("%s: verdict = %d %d, want %d %d", tt.result, verdict.Action, code, tt.action, tt.reply)
+		}
+
+		var headers []string
+		for _, h := range verdict.Headers {
+			headers = append(headers, h.Name+": "+h.Value)
+		}
+
+		if strings.Join(headers, "\n") != strings.Join(tt.headers, "\n") {
+			t.Errorf("%s: headers = %q, want %q", tt.result, headers, tt.headers)
+		}
+	}
+}
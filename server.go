@@ -1,8 +1,12 @@
 package smtpsrv
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -17,44 +21,483 @@ type ServerConfig struct {
 	Auther          AuthFunc
 	MaxMessageBytes int
 	TLSConfig       *tls.Config
+
+	// MaxConnections and MaxConnectionsPerIP (if set) limit the concurrent connections,
+	// the excess ones are replied "421 Too many connections" and closed
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// IPAccess (if set) accepts or denies the clients by IP before the greeting
+	IPAccess *IPAccessPolicy
+
+	// ConnectionPolicy (if set) accepts, refuses or scores the clients before the greeting (e.g:
+	// by country or autonomous system, see GeoIPPolicy)
+	ConnectionPolicy ConnectionPolicyFunc
+
+	// Certificates (if set) picks the certificate of each TLS handshake by its SNI
+	// server name, so every hosted domain can present its own one
+	Certificates CertificateProvider
+
+	// SessionTickets (if set) rotates the TLS session ticket keys while serving
+	SessionTickets *SessionTicketRotator
+
+	// Secret (if set) returns the shared secret of a user and enables AUTH CRAM-MD5,
+	// so the password never crosses the wire
+	Secret SecretFunc
+
+	// OAuth (if set) validates OAuth 2.0 bearer tokens and enables AUTH XOAUTH2
+	OAuth OAuthFunc
+
+	// CertAuth (if set) enables AUTH EXTERNAL for clients that presented a verified
+	// TLS certificate (TLSConfig.ClientAuth must request one), it receives the requested
+	// authorization identity and the certificate and returns the authenticated username
+	CertAuth CertAuthFunc
+
+	// AuthLimiter (if set) rejects AUTH from IPs it locked out after too many failures,
+	// the connection is dropped with 421 instead when AuthLockoutDrop is set
+	AuthLimiter     AuthLimiter
+	AuthLockoutDrop bool
+
+	// RequireTLS rejects MAIL, RCPT and DATA with 530 on unencrypted connections,
+	// clients have to issue STARTTLS first (not to be confused with the REQUIRETLS extension)
+	RequireTLS bool
+
+	// AuthRequiresTLS hides AUTH from the EHLO response and refuses it with 538 until the
+	// connection is encrypted (implicit TLS or after STARTTLS)
+	AuthRequiresTLS bool
+
+	// RequireAuth rejects MAIL with 530 until the client authenticated, e.g: on a submission port
+	RequireAuth bool
+
+	// Clock is the time source of the server, it is also handed to the
+	// configured policies that don't have their own, SystemClock by default
+	Clock Clock
+
+	// OnHeaders (if set) is called once the message header is received and
+	// before the body is consumed, returning an error rejects the message
+	OnHeaders HeaderHandlerFunc
+
+	// OnConnect (if set) is called before the greeting, OnHelo at the first MAIL FROM of the
+	// session (go-smtp handles EHLO/HELO itself), OnStartTLS before the first AUTH or MAIL FROM
+	// of the encrypted sessions, OnAuth once the credentials are verified, OnMailFrom and OnRcpt
+	// once the built-in checks passed and OnData right before the handler, returning an error
+	// rejects the client, the command or the message
+	OnConnect  ConnectHookFunc
+	OnHelo     HeloHookFunc
+	OnStartTLS TLSHookFunc
+	OnAuth     AuthHookFunc
+	OnMailFrom AddressHookFunc
+	OnRcpt     AddressHookFunc
+	OnData     HandlerFunc
+
+	// OnQuit (if set) is called when a client ends its session with QUIT, OnClose once any
+	// connection is closed
+	OnQuit  CloseHookFunc
+	OnClose CloseHookFunc
+
+	// OnPanic (if set) receives the panics of the handler, the hooks and the filters, the command
+	// that panicked is replied with 451, they are written to stderr by default
+	OnPanic PanicHandlerFunc
+
+	// AutoResponder (if set) is invoked in the background for each recipient after the handler accepted the message
+	AutoResponder *AutoResponder
+
+	// OnAuthEvent (if set) is called after every authentication attempt
+	OnAuthEvent AuthEventHandler
+
+	// SenderDomainThrottle (if set) defers MAIL FROM domains exceeding their budget with 450
+	SenderDomainThrottle *SenderDomainThrottle
+
+	// Reputation (if set) tracks the per-IP history, blocked IPs are deferred with 450
+	Reputation *Reputation
+
+	// ReputationProvider (if set) scores the clients at MAIL FROM (and optionally at connect time) to
+	// reject or greylist the worst ones, the scores are available through Context.ReputationChecks
+	ReputationProvider *ReputationPolicy
+
+	// BanManager (if set) is notified once an IP hits BanThreshold (5 by default)
+	// abuse events of the same kind within BanWindow (10 minutes by default), the
+	// clients it reports as banned (see BanChecker) are disconnected right away
+	BanManager   BanManager
+	BanThreshold int
+	BanWindow    time.Duration
+
+	// OnAbuseEvent (if set) is called for every abuse event, whether or not it leads to a ban
+	OnAbuseEvent AbuseEventHandler
+
+	// CommandFlood (if set) slows down then drops sessions cycling transactions without sending any message
+	CommandFlood *CommandFloodPolicy
+
+	// Disposable (if set) flags the disposable senders/recipients and optionally rejects them
+	Disposable *DisposablePolicy
+
+	// AttachmentPolicy (if set) rejects messages with forbidden attachments with 554 5.7.1 (and by default the
+	// malformed ones with 554 5.6.0) before the handler runs, note that it requires buffering the whole message in memory
+	AttachmentPolicy *AttachmentPolicy
+
+	// SpamFilter (if set) checks each message before the handler runs (see SpamFilterChain), it may
+	// reject, defer or tag the message, it gets SpamFilterTimeout (30 seconds by default) to decide
+	// and its failures are replied with 451, note that it requires buffering the whole message in memory
+	SpamFilter        SpamFilter
+	SpamFilterTimeout time.Duration
+
+	// Milters (if set) are consulted in order at MAIL FROM, RCPT TO and DATA, they may reject, defer,
+	// discard, quarantine (see Context.Quarantine) or change the headers and the body of the messages
+	Milters []*Milter
+
+	// DMARC (if set) evaluates the DMARC policy of the From domain of each message before the
+	// handler runs, the result is available through Context.DMARC
+	DMARC *DMARCVerifier
+
+	// Resolver (if set) is used for the DNS lookups instead of net.DefaultResolver, it is also
+	// handed to the configured policies that don't have their own, see the dnscache subpackage
+	Resolver Resolver
+
+	// LookupTimeout bounds the SPF, MX and reverse DNS checks, DefaultLookupTimeout by default
+	LookupTimeout time.Duration
+
+	// SenderChecks (if set) starts the selected sender checks in the background at MAIL FROM
+	SenderChecks *SenderChecks
+
+	// HeloPolicy (if set) validates the EHLO/HELO hostname of the clients
+	HeloPolicy *HeloPolicy
+
+	// DNSBL (if set) looks up the clients in DNS blocklists
+	DNSBL *DNSBLPolicy
+
+	// DNSWL (if set) looks up the clients in DNS allowlists, see DNSWLPolicy
+	DNSWL *DNSWLPolicy
+
+	// Greylist (if set) greylists the recipients of the unauthenticated clients that aren't DNS allowlisted
+	Greylist *Greylist
+
+	// RateLimiter (if set) limits the connections, MAIL FROM and RCPT TO commands, see TokenBucketLimiter
+	RateLimiter RateLimiter
+
+	// Tarpit (if set) delays the replies to the clients making too many errors
+	Tarpit *TarpitPolicy
+
+	// MaxErrors (if set) is the number of 4xx/5xx replies after which a connection is
+	// replied "421 Too many errors" and dropped
+	MaxErrors int
+
+	// MaxRecipients (if set) is the number of recipients per message, the next ones are
+	// replied "452 4.5.3 Too many recipients" (see Context.TruncatedRecipients)
+	MaxRecipients int
+
+	// MaxMessageDepth (if set) is how deep Context.Parse descends into the nested message/rfc822
+	// parts, DefaultMessageDepth by default, a negative depth doesn't parse them
+	MaxMessageDepth int
+
+	// GreetDelay (if set) delays the greeting of the plaintext connections, the clients that
+	// talk before it (early talkers, mostly bots) are replied 554 and disconnected
+	GreetDelay time.Duration
+
+	// StrictLineEndings replies 500 to the messages with bare CR or LF line endings instead of
+	// passing them through, only <CRLF>.<CRLF> ends a message anyway
+	StrictLineEndings bool
+
+	// MaxCommandLineLength and MaxTextLineLength (if set) are the line length limits (CRLF included) of
+	// the commands and the messages, e.g: DefaultMaxCommandLineLength and DefaultMaxTextLineLength (the
+	// RFC 5321 ones), the longer lines are replied "500 Line too long" and the
+	// connection is closed
+	MaxCommandLineLength int
+	MaxTextLineLength    int
+
+	// SPFPolicy (if set) rejects or defers the senders by their SPF result at MAIL FROM time
+	SPFPolicy *SPFPolicy
+
+	// AuthenticationResults adds an Authentication-Results header (RFC 8601) stamped with the
+	// BannerDomain on top of each message, with the auth, spf, dkim and dmarc results
+	AuthenticationResults bool
+
+	// Directory (if set) is consulted at RCPT time for the recipient existence, aliases and quota
+	Directory Directory
+
+	// Aliases (if set) expands the recipients to their internal destinations at RCPT time, the aliases
+	// skip the Directory, see Context.Destinations
+	Aliases AliasResolver
+
+	// LMTP serves LMTP (RFC 2033) instead of SMTP: the clients greet with LHLO and get a reply per
+	// recipient at the end of DATA, see RecipientErrors
+	LMTP bool
+
+	// OnRecipientFailure (if set) receives the recipients failed by the handler of the messages
+	// accepted over SMTP, see RecipientErrors
+	OnRecipientFailure RecipientFailureFunc
+
+	// DomainProfiles (if set) are the policies of the recipient domains (keyed by the lower cased domain),
+	// applied at RCPT and DATA time
+	DomainProfiles map[string]*DomainProfile
+
+	// FutureRelease (if set) enables the FUTURERELEASE extension, the held messages are handed to its Hold
+	FutureRelease *FutureReleasePolicy
+
+	// DeliverBy (if set) enables the DELIVERBY extension
+	DeliverBy *DeliverByPolicy
+
+	// MTPriority (if set) enables the MT-PRIORITY extension
+	MTPriority *MTPriorityPolicy
+
+	// Extensions are the service extensions go-smtp doesn't know (e.g: XCLIENT or a custom verb),
+	// each one is advertised in the EHLO reply, see Extension
+	Extensions []Extension
+
+	// Mux (if set) routes the messages to a handler by their recipient domain instead of Handler
+	Mux *Mux
+
+	// BaseContext (if set) returns the base context of the connections accepted by a listener,
+	// ConnContext (if set) derives the context of each connection from it (as net/http does), the
+	// context of a connection (see Context.Context) is cancelled once it is closed, including when
+	// the server is closed
+	BaseContext func(net.Listener) context.Context
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
 }
 
-func ListenAndServe(cfg *ServerConfig) error {
-	s := smtp.NewServer(NewBackend(cfg.Auther, cfg.Handler))
+// Server is an smtp server built from a ServerConfig
+type Server struct {
+	config  *ServerConfig
+	smtp    *smtp.Server
+	backend *Backend
 
-	SetDefaultServerConfig(cfg)
+	mu        sync.Mutex
+	listeners []net.Listener
+	closing   bool
+	certs     CertificateStore
 
-	s.Addr = cfg.ListenAddr
-	s.Domain = cfg.BannerDomain
-	s.ReadTimeout = cfg.ReadTimeout
-	s.WriteTimeout = cfg.WriteTimeout
-	s.MaxMessageBytes = cfg.MaxMessageBytes
-	s.AllowInsecureAuth = true
-	s.AuthDisabled = true
-	s.EnableSMTPUTF8 = false
+	// tls is the TLS config of the handshakes (see tlsConfig), the connections terminate TLS
+	// themselves so go-smtp has none
+	tls *tls.Config
+}
+
+// NewServer creates a new Server from the specified config
+func NewServer(cfg *ServerConfig) *Server {
+	s, bkd := newServer(cfg)
 
-	fmt.Println("⇨ smtp server started on", s.Addr)
+	srv := &Server{
+		config:  cfg,
+		smtp:    s,
+		backend: bkd,
+	}
 
-	return s.ListenAndServe()
+	if cfg.TLSConfig != nil {
+		srv.tls = srv.tlsConfig(cfg.TLSConfig)
+	}
+
+	return srv
 }
 
-func ListenAndServeTLS(cfg *ServerConfig) error {
-	s := smtp.NewServer(NewBackend(cfg.Auther, cfg.Handler))
+// ReloadTLS loads the specified certificate/key pair and serves it on the new TLS
+// handshakes, it is safe to call while serving (e.g: on SIGHUP after a renewal)
+func (srv *Server) ReloadTLS(certFile, keyFile string) error {
+	if srv.tls == nil {
+		return ErrNoTLSConfig
+	}
+
+	return srv.certs.Load(certFile, keyFile)
+}
+
+// ListenerConfig is the TLS policy of a single listener, so e.g: port 25, 465 and 587
+// can behave differently while being served by the same Server
+type ListenerConfig struct {
+	Addr string
+
+	// ImplicitTLS does the TLS handshake right after accepting the connection (SMTPS),
+	// otherwise STARTTLS is offered when a TLS config is available
+	ImplicitTLS bool
+
+	// TLSConfig (if set) overrides the ServerConfig.TLSConfig for this listener (min version,
+	// cipher suites, client auth ...)
+	TLSConfig *tls.Config
+}
+
+// ListenAndServe listens on the configured address and serves plain (STARTTLS capable if TLSConfig is set) smtp
+func (srv *Server) ListenAndServe() error {
+	return srv.ListenAndServeListener(ListenerConfig{Addr: srv.smtp.Addr})
+}
+
+// ListenAndServeTLS listens on the configured address and serves smtp over implicit TLS,
+// the TLS handshake happens right after accepting the connection and before the greeting
+func (srv *Server) ListenAndServeTLS() error {
+	return srv.ListenAndServeSMTPS(srv.smtp.Addr)
+}
+
+// ListenAndServeSMTPS listens on the specified address (":465" if empty) and serves smtp over
+// implicit TLS, it can run beside ListenAndServe so one server handles both STARTTLS and SMTPS
+func (srv *Server) ListenAndServeSMTPS(addr string) error {
+	if addr == "" {
+		addr = ":465"
+	}
+
+	return srv.ListenAndServeListener(ListenerConfig{Addr: addr, ImplicitTLS: true})
+}
+
+// ListenAndServeListener listens and serves smtp using the TLS policy of the specified listener config
+func (srv *Server) ListenAndServeListener(lc ListenerConfig) error {
+	if err := srv.checkListener(lc); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.ServeListener(l, lc)
+}
+
+// ServeListener serves smtp on an already bound listener using the TLS policy of the specified
+// listener config (its Addr is ignored), e.g: port 25 bound before dropping the root privileges
+// or a socket inherited from systemd
+func (srv *Server) ServeListener(l net.Listener, lc ListenerConfig) error {
+	if err := srv.checkListener(lc); err != nil {
+		return err
+	}
+
+	tracked := &listener{Listener: l, conns: &srv.backend.conns, config: srv.config, report: srv.backend.reportAbuse, tlsConfig: lc.TLSConfig, implicitTLS: lc.ImplicitTLS}
+
+	if tracked.serverTLS = srv.tls; tracked.serverTLS == nil && lc.TLSConfig != nil {
+		tracked.serverTLS = srv.tlsConfig(lc.TLSConfig)
+	}
+
+	if srv.config.BaseContext != nil {
+		tracked.baseCtx = srv.config.BaseContext(l)
+	}
+
+	if lc.ImplicitTLS {
+		fmt.Println("⇨ smtps server started on", l.Addr())
+	} else {
+		fmt.Println("⇨ smtp server started on", l.Addr())
+	}
+
+	return srv.serve(tracked)
+}
+
+// checkListener reports the implicit TLS listener configs no TLS config was given for
+func (srv *Server) checkListener(lc ListenerConfig) error {
+	if lc.ImplicitTLS && lc.TLSConfig == nil && srv.tls == nil {
+		return ErrNoTLSConfig
+	}
+
+	return nil
+}
+
+func (srv *Server) serve(l net.Listener) error {
+	if srv.config.SessionTickets != nil {
+		if err := srv.config.SessionTickets.Start(); err != nil {
+			return err
+		}
+	}
 
+	srv.mu.Lock()
+	srv.listeners = append(srv.listeners, l)
+	srv.mu.Unlock()
+
+	err := srv.smtp.Serve(l)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing {
+		return ErrServerClosed
+	}
+
+	return err
+}
+
+// Close closes the listeners and all the active connections
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closing = true
+	srv.mu.Unlock()
+
+	srv.stopSessionTickets()
+	srv.smtp.Close()
+
+	return nil
+}
+
+// Shutdown gracefully shuts down the server, it closes the listeners then waits for the active
+// connections to finish until the context is done, after which the remaining ones are closed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	for _, l := range srv.listeners {
+		l.Close()
+	}
+	srv.mu.Unlock()
+
+	// the polling uses the wall clock, a fake Clock must not stall the shutdown
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for srv.backend.conns.count() > 0 {
+		select {
+		case <-ctx.Done():
+			srv.stopSessionTickets()
+			srv.smtp.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	srv.stopSessionTickets()
+	srv.smtp.Close()
+
+	return nil
+}
+
+func (srv *Server) stopSessionTickets() {
+	if srv.config.SessionTickets != nil {
+		srv.config.SessionTickets.Stop()
+	}
+}
+
+// Pause keeps the listeners open but answers new MAIL commands with 421, so the server can be drained
+func (srv *Server) Pause() {
+	atomic.StoreInt32(&srv.backend.paused, 1)
+}
+
+// Resume accepts transactions again after Pause
+func (srv *Server) Resume() {
+	atomic.StoreInt32(&srv.backend.paused, 0)
+}
+
+// Paused reports whether the server is paused
+func (srv *Server) Paused() bool {
+	return srv.backend.isPaused()
+}
+
+func newServer(cfg *ServerConfig) (*smtp.Server, *Backend) {
 	SetDefaultServerConfig(cfg)
 
+	bkd := NewBackend(cfg.Auther, cfg.Handler)
+	bkd.config = cfg
+
+	s := smtp.NewServer(bkd)
+
 	s.Addr = cfg.ListenAddr
 	s.Domain = cfg.BannerDomain
 	s.ReadTimeout = cfg.ReadTimeout
 	s.WriteTimeout = cfg.WriteTimeout
 	s.MaxMessageBytes = cfg.MaxMessageBytes
+	// ServerConfig.AuthRequiresTLS is enforced by the backend (go-smtp would answer 523)
 	s.AllowInsecureAuth = true
-	s.AuthDisabled = true
+	s.AuthDisabled = cfg.Auther == nil && cfg.Secret == nil && cfg.OAuth == nil && cfg.CertAuth == nil
 	s.EnableSMTPUTF8 = false
-	s.EnableREQUIRETLS = true
-	s.TLSConfig = cfg.TLSConfig
+	// the connections terminate TLS themselves (see conn.startTLS)
+	s.EnableREQUIRETLS = cfg.TLSConfig != nil
+	s.LMTP = cfg.LMTP
+
+	enableAuthMechanisms(s, bkd)
+
+	return s, bkd
+}
 
-	fmt.Println("⇨ smtp server started on", s.Addr)
+func ListenAndServe(cfg *ServerConfig) error {
+	return NewServer(cfg).ListenAndServe()
+}
 
-	return s.ListenAndServeTLS()
+func ListenAndServeTLS(cfg *ServerConfig) error {
+	return NewServer(cfg).ListenAndServeTLS()
 }
@@ -0,0 +1,242 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer serves cfg on a free local port, the caller closes the returned server
+func startTestServer(t *testing.T, cfg *ServerConfig) (*Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ListenAddr = l.Addr().String()
+	l.Close()
+
+	srv := NewServer(cfg)
+	go srv.ListenAndServe()
+
+	for i := 0; i < 100; i++ {
+		srv.mu.Lock()
+		started := len(srv.listeners) > 0
+		srv.mu.Unlock()
+
+		if started {
+			return srv, cfg.ListenAddr
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the server didn't start")
+
+	return nil, ""
+}
+
+// testClient speaks raw SMTP to a test server
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialTestServer connects to addr and reads the greeting
+func dialTestServer(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect(220)
+
+	return c
+}
+
+// reply reads a (possibly multiline) reply, the lines are joined by "\n"
+func (c *testClient) reply() string {
+	c.t.Helper()
+
+	var lines []string
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading the reply: %v (got %q)", err, lines)
+		}
+
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+
+		if len(line) < 4 || line[3] != '-' {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+// cmd sends a command line and returns its reply
+func (c *testClient) cmd(line string) string {
+	c.t.Helper()
+
+	c.write(line + "\r\n")
+
+	return c.reply()
+}
+
+func (c *testClient) write(data string) {
+	c.t.Helper()
+
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads a reply and fails the test unless it has the specified code
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+
+	reply := c.reply()
+	if !strings.HasPrefix(reply, strconv.Itoa(code)) {
+		c.t.Fatalf("expected %d, got %q", code, reply)
+	}
+
+	return reply
+}
+
+// expectCmd sends a command line and fails the test unless its reply has the specified code
+func (c *testClient) expectCmd(line string, code int) string {
+	c.t.Helper()
+
+	c.write(line + "\r\n")
+
+	return c.expect(code)
+}
+
+// send runs a whole transaction and returns the final reply
+func (c *testClient) send(from string, to []string, message string) string {
+	c.t.Helper()
+
+	c.expectCmd("MAIL FROM:<"+from+">", 250)
+
+	for _, rcpt := range to {
+		c.expectCmd("RCPT TO:<"+rcpt+">", 250)
+	}
+
+	c.expectCmd("DATA", 354)
+	c.write(strings.Replace(message, "\n", "\r\n", -1) + "\r\n.\r\n")
+
+	return c.reply()
+}
+
+func (c *testClient) Close() error {
+	return c.conn.Close()
+}
+
+// startTLS issues STARTTLS and does the handshake
+func (c *testClient) startTLS() {
+	c.t.Helper()
+
+	c.expectCmd("STARTTLS", 220)
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake: %v", err)
+	}
+
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+}
+
+// testTLSConfig returns a TLS config serving a self-signed certificate of localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// frozenClock never advances
+type frozenClock struct{}
+
+func (frozenClock) Now() time.Time                         { return time.Unix(0, 0) }
+func (frozenClock) After(d time.Duration) <-chan time.Time { return nil }
+
+func TestShutdownWaitsForConnections(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{Clock: frozenClock{}, Handler: func(c *Context) error { return nil }})
+
+	c := dialTestServer(t, addr)
+	c.expectCmd("HELO client.example.org", 250)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.conn.Write([]byte("QUIT\r\n"))
+		c.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestPauseClosesConnection(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	srv.Pause()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 421)
+
+	if line, err := c.r.ReadString('\n'); err == nil {
+		t.Fatalf("the connection is still open after 421, got %q", line)
+	}
+
+	srv.Resume()
+
+	c = dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+}
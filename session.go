@@ -1,59 +1,699 @@
 package smtpsrv
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
 
 // A Session is returned after successful login.
 type Session struct {
-	connState *smtp.ConnectionState
-	From      *mail.Address
-	To        *mail.Address
-	handler   HandlerFunc
-	body      io.Reader
-	username  *string
-	password  *string
+	connState      *smtp.ConnectionState
+	backend        *Backend
+	config         *ServerConfig
+	From           *mail.Address
+	To             *mail.Address
+	handler        HandlerFunc
+	body           io.Reader
+	raw            []byte
+	traceLen       int
+	header         mail.Header
+	size           int
+	mailbox        *Mailbox
+	route          *muxRoute
+	destinations   []string
+	profiles       []*DomainProfile
+	accepted       []acceptedRcpt
+	failures       map[string]error
+	catchAll       []string
+	dmarc          *DMARCResult
+	dkim           []DMARCAuthResult
+	spf            *spfCheck
+	mx             *mxCheck
+	rdns           *rdnsCheck
+	heloChecked    *string
+	heloFailures   []HeloCheck
+	heloErr        error
+	dnsblCheck     *dnsblCheck
+	reputation     *ReputationCheck
+	spam           *SpamVerdict
+	milters        []*milterConn
+	quarantine     string
+	discard        bool
+	dsnEnvelope    *DSNEnvelope
+	mailParams     map[string]string
+	release        time.Time
+	deliverBy      *DeliverBy
+	priority       int
+	bodyType       string
+	rcpts          int
+	truncatedRcpts int
+	id             string
+	mails          int
+	disposableFrom bool
+	disposableTo   bool
+	resets         int
+	received       bool
+	transaction    bool
+	milterTx       bool
+	requireTLS     bool
+	username       *string
+	password       *string
 }
 
 // NewSession initialize a new session
 func NewSession(state *smtp.ConnectionState, handler HandlerFunc, username, password *string) *Session {
 	return &Session{
 		connState: state,
+		config:    &ServerConfig{},
 		handler:   handler,
+		username:  username,
+		password:  password,
 	}
 }
 
+var errAuthRequired = &smtp.SMTPError{Code: 530, EnhancedCode: smtp.EnhancedCode{5, 7, 0}, Message: "Authentication required"}
+
+// errPaused answers MAIL while the server is paused (see Server.Pause), the connection is closed
+// after it as RFC 5321 section 3.8 requires for 421
+var errPaused = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 3, 2}, Message: "Service temporarily unavailable"}
+
 func (s *Session) Mail(from string, opts smtp.MailOptions) (err error) {
-	s.From, err = mail.ParseAddress(from)
+	defer func() { err = s.replied(err) }()
+	defer s.recoverPanic(&err)
+
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+
+	if s.config.RequireAuth && s.username == nil {
+		return errAuthRequired
+	}
+
+	// the invalid DSN and extension parameters, see stripMailParams
+	if c := s.conn(); c != nil && c.mailErr != nil {
+		return c.mailErr
+	}
+
+	if s.backend != nil && s.backend.isPaused() {
+		return s.drop(errPaused)
+	}
+
+	if flood := s.config.CommandFlood; flood != nil {
+		s.mails++
+		if flood.check(s.mails, flood.maxTransactions()) {
+			return s.drop(errTooManyCommands)
+		}
+	}
+
+	s.size = opts.Size
+	s.requireTLS = opts.RequireTLS
+	s.spf, s.mx = nil, nil
+	s.rcpts, s.truncatedRcpts = 0, 0
+
+	if c := s.conn(); c != nil {
+		s.dsnEnvelope, c.dsnMail = c.dsnMail, nil
+		s.mailParams, c.mailParams = c.mailParams, nil
+		s.bodyType, c.mailBody = c.mailBody, ""
+	}
+
+	// the null reverse-path (MAIL FROM:<>) of the bounces and auto-replies must be accepted
+	if from == "" {
+		s.From = &mail.Address{}
+	} else if s.From, err = mail.ParseAddress(from); err != nil {
+		return &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 1, 7}, Message: "Bad sender address syntax"}
+	}
+
+	// the lookups run concurrently, the checks below wait for the results they need
+	if dnsListsEnabled(s.config) {
+		s.startDNSLists()
+	}
+
+	s.startSenderChecks()
+
+	if err := s.checkHelo(); err != nil {
+		return err
+	}
+
+	if err := s.checkDNSBL(); err != nil {
+		return err
+	}
+
+	if s.config.Disposable != nil && s.From.Address != "" {
+		s.disposableFrom = s.config.Disposable.list().ContainsAddress(s.From.Address)
+		if s.disposableFrom && s.config.Disposable.RejectSender {
+			return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Disposable sender addresses are not accepted"}
+		}
+	}
+
+	if s.config.SenderDomainThrottle != nil && s.From.Address != "" && !s.allowlisted() {
+		_, domain, err := SplitAddress(s.From.Address)
+		if err != nil {
+			return &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 1, 7}, Message: "Bad sender address syntax"}
+		}
+
+		if !s.config.SenderDomainThrottle.Allow(domain) {
+			return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Sender domain rate limit exceeded, try again later"}
+		}
+	}
+
+	if err := s.checkRateLimit(RateLimitMail); err != nil {
+		return err
+	}
+
+	if err := s.checkReputationProvider(); err != nil {
+		return err
+	}
+
+	if s.config.SPFPolicy != nil && s.From.Address != "" {
+		if err := s.config.SPFPolicy.check(&Context{session: s}); err != nil {
+			return err
+		}
+	}
+
+	if err := s.checkMailParams(); err != nil {
+		return err
+	}
+
+	if s.config.OnMailFrom != nil {
+		if err := s.config.OnMailFrom(&Context{session: s}, s.From.Address); err != nil {
+			return err
+		}
+	}
+
+	if err := s.milterMail(s.From.Address); err != nil {
+		return err
+	}
+
+	s.transaction = true
+
 	return
 }
 
 func (s *Session) Rcpt(to string) (err error) {
-	s.To, err = mail.ParseAddress(to)
-	return
+	defer func() { err = s.replied(err) }()
+	defer s.recoverPanic(&err)
+
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+
+	if s.config.MaxRecipients > 0 && s.rcpts >= s.config.MaxRecipients {
+		s.truncatedRcpts++
+		return errTooManyRecipients
+	}
+
+	// go-smtp identifies the recipients by their raw argument (see LMTPData)
+	arg := to
+
+	to, dsn, err := splitRcpt(to)
+	if err != nil {
+		return err
+	}
+
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return &smtp.SMTPError{Code: 501, EnhancedCode: smtp.EnhancedCode{5, 1, 3}, Message: "Bad destination mailbox address syntax"}
+	}
+
+	if s.config.Disposable != nil && s.config.Disposable.list().ContainsAddress(addr.Address) {
+		if s.config.Disposable.RejectRecipient {
+			return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Disposable recipient addresses are not accepted"}
+		}
+
+		s.disposableTo = true
+	}
+
+	route, err := s.routeRcpt(addr.Address)
+	if err != nil {
+		return err
+	}
+
+	profile, err := s.checkDomainProfile(addr.Address)
+	if err != nil {
+		return err
+	}
+
+	destinations, err := s.resolveAliases(addr.Address)
+	if err != nil {
+		return err
+	}
+
+	caught := false
+	s.mailbox = nil
+
+	if s.config.Directory != nil && destinations == nil {
+		mailbox, err := s.config.Directory.Lookup(addr.Address)
+		if errors.Is(err, ErrNoSuchUser) || err == nil && mailbox == nil {
+			mailbox, err = &Mailbox{Address: addr.Address}, nil
+		}
+
+		if err != nil {
+			if reply, ok := toSMTPError(err).(*smtp.SMTPError); ok {
+				return reply
+			}
+
+			return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Mailbox lookup failed, try again later"}
+		}
+
+		if !mailbox.Exists && len(mailbox.Aliases) < 1 {
+			catchAll := s.routeCatchAll(addr.Address)
+			if catchAll == nil {
+				s.recordReputation(ReputationInvalidRcpt)
+				s.reportAbuse(BanHarvesting)
+				return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user here"}
+			}
+
+			route, caught = catchAll, true
+		}
+
+		if !mailbox.Fits(int64(s.size)) {
+			return errMailboxFull
+		}
+
+		s.mailbox = mailbox
+	}
+
+	if err := s.checkRoute(route); err != nil {
+		return err
+	}
+
+	if err := s.checkRateLimit(RateLimitRcpt); err != nil {
+		return err
+	}
+
+	if err := s.checkGreylist(addr.Address); err != nil {
+		return err
+	}
+
+	if s.config.OnRcpt != nil {
+		if err := s.config.OnRcpt(&Context{session: s}, addr.Address); err != nil {
+			return err
+		}
+	}
+
+	if err := s.milterRcpt(addr.Address); err != nil {
+		return err
+	}
+
+	if destinations == nil {
+		destinations = []string{addr.Address}
+	}
+
+	s.To = addr
+	s.route = route
+
+	if profile != nil {
+		s.profiles = append(s.profiles, profile)
+	}
+
+	if caught {
+		s.catchAll = append(s.catchAll, addr.Address)
+	}
+	s.destinations = appendDestinations(s.destinations, destinations)
+	s.accepted = append(s.accepted, acceptedRcpt{arg: arg, address: addr.Address, dsn: dsn, mailbox: s.mailbox})
+	s.rcpts++
+
+	return nil
 }
 
-func (s *Session) Data(r io.Reader) error {
-	if s.handler == nil {
-		return errors.New("internal error: no handler")
+func (s *Session) Data(r io.Reader) (err error) {
+	defer func() { err = s.replied(err) }()
+	defer s.recoverPanic(&err)
+
+	if err := s.checkTLS(); err != nil {
+		return err
+	}
+
+	if s.transactionHandler() == nil {
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "internal error: no handler"}
 	}
 
 	s.body = r
 
+	if s.config.StrictLineEndings {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if s.bareLineEnding() {
+			return errBareLineEnding
+		}
+
+		r = bytes.NewReader(data)
+	}
+
+	if limit := s.profileMaxSize(); limit > 0 {
+		data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return err
+		}
+
+		if len(data) > limit {
+			return errProfileTooLarge
+		}
+
+		r = bytes.NewReader(data)
+	}
+
+	if r, err = s.checkQuota(r); err != nil {
+		return err
+	}
+
+	if s.config.AttachmentPolicy != nil {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if err := s.config.AttachmentPolicy.Check(bytes.NewReader(data)); err != nil {
+			s.recordReputation(ReputationRejected)
+
+			if errors.Is(err, ErrMalformedMIME) {
+				return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Message rejected: malformed MIME structure"}
+			}
+
+			return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Message rejected: " + err.Error()}
+		}
+
+		r = bytes.NewReader(data)
+	}
+
+	s.id = newTraceID(s.config.Clock)
+
+	if s.milterTx {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if data, err = s.milterData(data); err != nil {
+			s.recordReputation(ReputationRejected)
+			return err
+		}
+
+		// the message is accepted but silently dropped
+		if s.discard {
+			return queuedReply(s.id)
+		}
+
+		r = bytes.NewReader(data)
+	}
+
+	if s.config.SpamFilter != nil {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if data, err = s.checkSpam(data); err != nil {
+			s.recordReputation(ReputationRejected)
+			return err
+		}
+
+		r = bytes.NewReader(data)
+	}
+	s.dmarc = nil
+	s.dkim = nil
+	s.raw = nil
+	// go-smtp hands the message with LF line endings, the trace fields use them too
+	s.traceLen = len(TraceHeader + ": " + s.id + "\n")
+	r = io.MultiReader(strings.NewReader(TraceHeader+": "+s.id+"\n"), r)
+	s.body = r
+
 	c := Context{
 		session: s,
 	}
 
-	return s.handler(&c)
+	if s.config.OnHeaders != nil || s.config.AutoResponder != nil || s.config.DMARC != nil {
+		header, body, err := peekHeader(r)
+		if err == nil {
+			s.header = header
+		}
+
+		s.body = body
+
+		if s.config.DMARC != nil && s.header != nil {
+			if err := s.checkDMARC(&c); err != nil {
+				s.recordReputation(ReputationRejected)
+				return err
+			}
+		}
+	}
+
+	if s.config.AuthenticationResults {
+		s.prependHeader("Authentication-Results", s.authenticationResults(&c))
+	}
+
+	if s.config.OnHeaders != nil && s.header != nil {
+		if err := s.config.OnHeaders(&c, s.header); err != nil {
+			s.recordReputation(ReputationRejected)
+			return err
+		}
+	}
+
+	if s.config.OnData != nil {
+		if err := s.config.OnData(&c); err != nil {
+			s.recordReputation(ReputationRejected)
+			return err
+		}
+	}
+
+	s.received = true
+
+	if err := s.deliver(&c); err != nil {
+		s.recordReputation(ReputationRejected)
+		return err
+	}
+
+	s.recordReputation(ReputationAccepted)
+	s.mails = 0
+
+	if s.config.AutoResponder != nil && s.header != nil {
+		s.autoRespond()
+	}
+
+	return queuedReply(s.id)
+}
+
+// startHooks runs ServerConfig.OnStartTLS and ServerConfig.OnAuth (for the authenticated sessions)
+// as the session starts
+func (s *Session) startHooks(mechanism, username string) (err error) {
+	defer func() { err = toSMTPError(err) }()
+	defer s.recoverPanic(&err)
+
+	c := &Context{session: s}
+
+	if s.config.OnStartTLS != nil && s.connState.TLS.HandshakeComplete {
+		if err := s.config.OnStartTLS(c, s.connState.TLS); err != nil {
+			return err
+		}
+	}
+
+	if s.config.OnAuth != nil && s.username != nil {
+		if err := s.config.OnAuth(c, mechanism, username); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTLS enforces ServerConfig.RequireTLS
+func (s *Session) checkTLS() error {
+	if s.config.RequireTLS && !s.connState.TLS.HandshakeComplete {
+		return &smtp.SMTPError{Code: 530, EnhancedCode: smtp.EnhancedCode{5, 7, 0}, Message: "Must issue a STARTTLS command first"}
+	}
+
+	return nil
+}
+
+// checkDMARC evaluates ServerConfig.DMARC and rejects the message when it is enforced
+func (s *Session) checkDMARC(c *Context) error {
+	verifier := s.config.DMARC
+
+	from, err := s.header.AddressList("From")
+	if err != nil || len(from) < 1 {
+		return nil
+	}
+
+	_, fromDomain, err := SplitAddress(from[0].Address)
+	if err != nil {
+		return nil
+	}
+
+	spfResult, spfDomain := SPFNone, ""
+	if s.From != nil && s.From.Address != "" {
+		_, spfDomain, _ = SplitAddress(s.From.Address)
+		spfResult, _, _ = c.SPF()
+	}
+
+	dkim, err := s.verifyDKIM(c)
+	if err != nil {
+		return err
+	}
+
+	result, _ := verifier.Evaluate(s.context(), fromDomain, spfDomain, spfResult, dkim)
+	s.dmarc = result
+	verifier.record(remoteIP(s.connState.RemoteAddr), result)
+
+	if verifier.Mode == DMARCEnforce && result.Disposition == DMARCDispositionReject {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Message rejected by the DMARC policy of " + result.Domain}
+	}
+
+	return nil
+}
+
+// verifyDKIM runs the DKIM verifier of ServerConfig.DMARC once per message
+func (s *Session) verifyDKIM(c *Context) ([]DMARCAuthResult, error) {
+	if s.dkim != nil || s.config.DMARC == nil || s.config.DMARC.DKIM == nil {
+		return s.dkim, nil
+	}
+
+	raw, err := c.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	s.dkim, _ = s.config.DMARC.DKIM(raw)
+	if s.dkim == nil {
+		s.dkim = []DMARCAuthResult{}
+	}
+
+	s.recordDKIM(s.dkim)
+
+	return s.dkim, nil
+}
+
+// prependHeader adds a header field on top of the message, it is part of the
+// trace fields so Context.Raw still returns the message as received
+func (s *Session) prependHeader(name, value string) {
+	line := name + ": " + value + "\n"
+
+	if s.raw != nil {
+		s.raw = append([]byte(line), s.raw...)
+		s.body = bytes.NewReader(s.raw)
+	} else {
+		s.body = io.MultiReader(strings.NewReader(line), s.body)
+	}
+
+	s.traceLen += len(line)
+
+	if s.header != nil {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		s.header[name] = append([]string{strings.Replace(value, "\n\t", " ", -1)}, s.header[name]...)
+	}
+}
+
+func (s *Session) recordReputation(event ReputationEvent) {
+	if s.config.Reputation == nil {
+		return
+	}
+
+	s.config.Reputation.Record(remoteIP(s.connState.RemoteAddr).String(), event)
+}
+
+// recordDKIM records the DKIM outcome of a message, a single valid signature is enough to pass
+func (s *Session) recordDKIM(results []DMARCAuthResult) {
+	failed := false
+
+	for _, sig := range results {
+		switch strings.ToLower(sig.Result) {
+		case "pass":
+			s.recordReputation(ReputationDKIMPass)
+			return
+		case "fail":
+			failed = true
+		}
+	}
+
+	if failed {
+		s.recordReputation(ReputationDKIMFail)
+	}
+}
+
+func (s *Session) reportAbuse(reason BanReason) {
+	if s.backend != nil {
+		s.backend.reportAbuse(remoteIP(s.connState.RemoteAddr), reason)
+	}
+}
+
+// context returns the context of the connection, see ServerConfig.ConnContext
+func (s *Session) context() context.Context {
+	if c := s.conn(); c != nil && c.ctx != nil {
+		return c.ctx
+	}
+
+	return context.Background()
+}
+
+// drop makes the connection close once the specified error is replied
+func (s *Session) drop(err error) error {
+	if c := s.conn(); c != nil {
+		c.closeAfterReply()
+	}
+
+	return err
+}
+
+// conn returns the underlying connection, nil if it isn't tracked
+func (s *Session) conn() *conn {
+	if s.backend == nil {
+		return nil
+	}
+
+	return s.backend.conns.get(s.connState.RemoteAddr)
 }
 
 func (s *Session) Reset() {
+	if flood := s.config.CommandFlood; flood != nil && !s.received {
+		s.resets++
+		if flood.check(s.resets, flood.maxResets()) {
+			// Reset can't choose its reply, the one go-smtp writes next is replaced
+			if c := s.conn(); c != nil {
+				c.replaceReply(errTooManyCommands)
+			}
+		}
+	}
+
+	s.transaction = false
+	s.received = false
+	s.header = nil
+	s.size = 0
+	s.mailbox = nil
+	s.route = nil
+	s.destinations = nil
+	s.profiles = nil
+	s.accepted = nil
+	s.failures = nil
+	s.catchAll = nil
+	s.dsnEnvelope = nil
+	s.mailParams = nil
+	s.release = time.Time{}
+	s.deliverBy = nil
+	s.priority = 0
+	s.bodyType = ""
+	s.spf = nil
+	s.mx = nil
+	s.requireTLS = false
+	s.disposableFrom = false
+	s.disposableTo = false
+	s.rcpts = 0
+	s.truncatedRcpts = 0
+	s.abortMilters()
 }
 
 func (s *Session) Logout() error {
+	s.closeMilters()
+
 	return nil
 }
@@ -0,0 +1,221 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTraceFields(t *testing.T) {
+	type received struct {
+		id        string
+		full, raw string
+	}
+
+	messages := make(chan received, 1)
+	handler := func(c *Context) error {
+		raw, err := c.Raw()
+		if err != nil {
+			return err
+		}
+
+		full, err := ioutil.ReadAll(c)
+		if err != nil {
+			return err
+		}
+
+		messages <- received{c.ID(), string(full), string(raw)}
+
+		return nil
+	}
+
+	srv, addr := startTestServer(t, &ServerConfig{AuthenticationResults: true, Handler: handler})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO client.example.org", 250)
+
+	message := "Subject: trace\n\nhello\n"
+	if reply := c.send("sender@example.org", []string{"john@example.com"}, strings.TrimSuffix(message, "\n")); !strings.HasPrefix(reply, "250 2.0.0 OK: queued as ") {
+		t.Fatalf("DATA: got %q", reply)
+	}
+
+	m := <-messages
+
+	if m.raw != message {
+		t.Fatalf("Raw: got %q, want %q", m.raw, message)
+	}
+
+	if strings.Contains(m.full, "\r") {
+		t.Fatalf("the message mixes the line endings: %q", m.full)
+	}
+
+	if !strings.Contains(m.full, TraceHeader+": "+m.id+"\n") || !strings.HasSuffix(m.full, "\n"+message) {
+		t.Fatalf("got %q", m.full)
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	senders := make(chan string, 1)
+	handler := func(c *Context) error {
+		senders <- c.From().Address
+		return nil
+	}
+
+	srv, addr := startTestServer(t, &ServerConfig{Disposable: &DisposablePolicy{RejectSender: true}, Handler: handler})
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		mail string
+		code int
+	}{
+		{"MAIL FROM:<>", 250},
+		{"MAIL FROM:<> SIZE=100", 250},
+		{"MAIL FROM:<> BODY=8BITMIME", 250},
+		{"MAIL FROM:<@>", 501},
+		{"MAIL FROM:<not-an-address>", 501},
+	} {
+		t.Run(tt.mail, func(t *testing.T) {
+			c := dialTestServer(t, addr)
+			defer c.Close()
+
+			c.expectCmd("EHLO client.example.org", 250)
+			c.expectCmd(tt.mail, tt.code)
+
+			if tt.code != 250 {
+				return
+			}
+
+			c.expectCmd("RCPT TO:<postmaster@example.com>", 250)
+			c.expectCmd("DATA", 354)
+			c.write("Subject: bounce\r\n\r\nundeliverable\r\n.\r\n")
+			c.expect(250)
+
+			if from := <-senders; from != "" {
+				t.Fatalf("got the sender %q, want the null one", from)
+			}
+		})
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	type counts struct {
+		recipients, truncated int
+	}
+
+	for _, tt := range []struct {
+		max, sent int
+	}{
+		{0, 5},
+		{1, 1},
+		{1, 3},
+		{3, 2},
+		{3, 5},
+	} {
+		t.Run(strconv.Itoa(tt.max)+"/"+strconv.Itoa(tt.sent), func(t *testing.T) {
+			got := make(chan counts, 1)
+			handler := func(c *Context) error {
+				got <- counts{c.Recipients(), c.TruncatedRecipients()}
+				return nil
+			}
+
+			srv, addr := startTestServer(t, &ServerConfig{MaxRecipients: tt.max, Handler: handler})
+			defer srv.Close()
+
+			c := dialTestServer(t, addr)
+			defer c.Close()
+
+			c.expectCmd("HELO client.example.org", 250)
+			c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+
+			want := counts{tt.sent, 0}
+			if tt.max > 0 && tt.sent > tt.max {
+				want = counts{tt.max, tt.sent - tt.max}
+			}
+
+			for i := 0; i < tt.sent; i++ {
+				code := 250
+				if i >= want.recipients {
+					code = 452
+				}
+
+				c.expectCmd("RCPT TO:<rcpt"+strconv.Itoa(i)+"@example.com>", code)
+			}
+
+			c.expectCmd("DATA", 354)
+			c.write("Subject: many\r\n\r\nhello\r\n.\r\n")
+			c.expect(250)
+
+			if g := <-got; g != want {
+				t.Fatalf("got %+v, want %+v", g, want)
+			}
+		})
+	}
+}
+
+func TestRepliedSkipsSuccess(t *testing.T) {
+	s := &Session{config: &ServerConfig{}}
+
+	for _, err := range []error{nil, queuedReply("id"), errTooManyRecipients} {
+		if got := s.replied(err); got != err {
+			t.Errorf("replied(%v) = %v", err, got)
+		}
+	}
+}
+
+func TestBodyType(t *testing.T) {
+	type result struct {
+		body string
+		raw  []byte
+	}
+
+	results := make(chan result, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		StrictLineEndings: true,
+		Handler: func(c *Context) error {
+			raw, err := c.Raw()
+			if err != nil {
+				return err
+			}
+
+			results <- result{c.BodyType(), raw}
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org> BODY=UNKNOWN", 500)
+
+	for _, tt := range []struct {
+		params string
+		body   string
+	}{
+		{"BODY=8bitmime", BodyType8BitMIME},
+		{"BODY=7BIT", BodyType7Bit},
+		{"", ""},
+	} {
+		c.expectCmd("MAIL FROM:<sender@example.org> "+tt.params, 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write("Subject: caf\xc3\xa9\r\n\r\nna\xefve \xe9t\xe9\r\n.\r\n")
+		c.expect(250)
+
+		r := <-results
+		if r.body != tt.body {
+			t.Errorf("%q: BodyType() = %q, want %q", tt.params, r.body, tt.body)
+		}
+
+		// go-smtp hands the message with LF line endings, the 8-bit bytes are untouched
+		if want := "Subject: caf\xc3\xa9\n\nna\xefve \xe9t\xe9\n"; string(r.raw) != want {
+			t.Errorf("%q: the message is %q, want %q", tt.params, r.raw, want)
+		}
+	}
+}
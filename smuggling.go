@@ -0,0 +1,156 @@
+package smtpsrv
+
+import (
+	"github.com/emersion/go-smtp"
+)
+
+var errBareLineEnding = &smtp.SMTPError{Code: 500, EnhancedCode: smtp.EnhancedCode{5, 5, 2}, Message: "Bare CR or LF line endings are not allowed"}
+
+const (
+	dataLineStart = iota
+	dataBareLineStart
+	dataText
+	dataDot
+	dataDotCR
+)
+
+// dataGuard filters the DATA stream against SMTP smuggling: the dot reader of the SMTP
+// engine also ends the message on <LF>.<LF>, <LF>.<CRLF> and <CRLF>.<LF>, so a message
+// relayed as is by a more lenient server could smuggle a second one, the dots starting
+// the lines that follow a bare LF (or followed by one) are stuffed so only <CRLF>.<CRLF>
+// ends the message, the content is otherwise unchanged
+type dataGuard struct {
+	state int
+	cr    bool
+	done  bool
+
+	// bare is set when a bare CR or LF was seen
+	bare bool
+}
+
+// filter returns the filtered input and the bytes following the end of the message
+func (g *dataGuard) filter(in []byte) (out, rest []byte) {
+	out = make([]byte, 0, len(in)+8)
+
+	for i := 0; i < len(in); i++ {
+		if g.done {
+			return out, in[i:]
+		}
+
+		c := in[i]
+
+		switch g.state {
+		case dataLineStart:
+			if c == '.' {
+				// held back until the end of the line is known
+				g.state = dataDot
+				continue
+			}
+		case dataBareLineStart:
+			if c == '.' {
+				out = append(out, '.', '.')
+				g.state = dataText
+				continue
+			}
+		case dataDot:
+			if c == '\r' {
+				out = append(out, '.', '\r')
+				g.state = dataDotCR
+				continue
+			}
+
+			if c == '\n' {
+				g.bare = true
+				out = append(out, '.', '.', '\n')
+				g.state = dataBareLineStart
+				continue
+			}
+
+			out = append(out, '.')
+		case dataDotCR:
+			if c == '\n' {
+				out = append(out, '\n')
+				g.done = true
+				continue
+			}
+
+			g.bare = true
+		}
+
+		g.state = dataText
+
+		if c == '\n' {
+			if g.cr {
+				g.state = dataLineStart
+			} else {
+				g.bare = true
+				g.state = dataBareLineStart
+			}
+		} else if g.cr {
+			g.bare = true
+		}
+
+		g.cr = c == '\r'
+		out = append(out, c)
+	}
+
+	return out, nil
+}
+
+// readData reads the filtered DATA stream, the bytes following the message are held back for
+// readLines (the held bytes were already checked against the line limits)
+func (c *conn) readData(b []byte) (int, error) {
+	for len(c.pending) < 1 {
+		in := c.held
+		c.held = nil
+
+		if len(in) < 1 {
+			if err := c.flush(); err != nil {
+				return 0, err
+			}
+
+			if c.readErr != nil {
+				err := c.readErr
+				c.readErr = nil
+				return 0, err
+			}
+
+			n, err := c.stream().Read(b)
+			if n > 0 {
+				if err := c.checkLineLength(b[:n], true); err != nil {
+					return 0, err
+				}
+			}
+
+			c.readErr = err
+			in = b[:n]
+		}
+
+		var rest []byte
+		c.pending, rest = c.data.filter(in)
+		if len(rest) > 0 {
+			c.held = append([]byte(nil), rest...)
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	if len(c.pending) < 1 && len(c.held) < 1 && c.readErr != nil {
+		err := c.readErr
+		c.readErr = nil
+		return n, err
+	}
+
+	return n, nil
+}
+
+// bareLineEnding reports whether the message being received had bare CR or LF line endings
+func (s *Session) bareLineEnding() bool {
+	c := s.conn()
+	if c == nil || c.data == nil {
+		return false
+	}
+
+	return c.data.bare
+}
@@ -0,0 +1,91 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDataGuard(t *testing.T) {
+	for _, tt := range []struct {
+		in, out, rest string
+		bare          bool
+	}{
+		{"hello\r\n.\r\nQUIT\r\n", "hello\r\n.\r\n", "QUIT\r\n", false},
+		{"a\r\n..\r\n.\r\n", "a\r\n..\r\n.\r\n", "", false},
+		{"a\n.\nb\r\n.\r\n", "a\n..\nb\r\n.\r\n", "", true},
+		{"a\r\n.\nb\r\n.\r\n", "a\r\n..\nb\r\n.\r\n", "", true},
+		{"a\n.\r\nb\r\n.\r\n", "a\n..\r\nb\r\n.\r\n", "", true},
+		{"a\r\n.\rb\r\n.\r\n", "a\r\n.\rb\r\n.\r\n", "", true},
+		{"a\rb\r\n.\r\n", "a\rb\r\n.\r\n", "", true},
+	} {
+		// the whole input at once then byte by byte, the state is kept across the reads
+		for _, chunk := range []int{len(tt.in), 1} {
+			g := &dataGuard{}
+
+			var out, rest []byte
+			for i := 0; i < len(tt.in) && rest == nil; i += chunk {
+				end := i + chunk
+				if end > len(tt.in) {
+					end = len(tt.in)
+				}
+
+				filtered, r := g.filter([]byte(tt.in[i:end]))
+				out = append(out, filtered...)
+				if r != nil {
+					rest = append(r, tt.in[end:]...)
+				}
+			}
+
+			if string(out) != tt.out || string(rest) != tt.rest || g.bare != tt.bare {
+				t.Errorf("%q (chunks of %d): got %q, rest %q, bare %v, want %q, rest %q, bare %v", tt.in, chunk, out, rest, g.bare, tt.out, tt.rest, tt.bare)
+			}
+		}
+	}
+}
+
+func TestSmuggling(t *testing.T) {
+	const message = "Subject: hi\r\n\r\nhello\n.\r\nMAIL FROM:<admin@example.com>\r\nRCPT TO:<victim@example.com>\r\nDATA\r\n\r\nsmuggled\r\n.\r\n"
+
+	for _, strict := range []bool{false, true} {
+		bodies := make(chan string, 2)
+
+		srv, addr := startTestServer(t, &ServerConfig{
+			StrictLineEndings: strict,
+			Handler: func(c *Context) error {
+				body, _ := ioutil.ReadAll(c)
+				bodies <- string(body)
+				return nil
+			},
+		})
+
+		c := dialTestServer(t, addr)
+		c.expectCmd("EHLO client.example.org", 250)
+		c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+		c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.expectCmd("DATA", 354)
+		c.write(message)
+
+		if strict {
+			if reply := c.expect(500); !strings.HasPrefix(reply, "500 5.5.2") {
+				t.Errorf("StrictLineEndings: got %q, want 500 5.5.2", reply)
+			}
+		} else {
+			c.expect(250)
+
+			// a single message, the smuggled commands are part of its body
+			if body := <-bodies; !strings.Contains(body, "MAIL FROM:<admin@example.com>") || !strings.HasSuffix(body, "smuggled\n") {
+				t.Errorf("got the body %q", body)
+			}
+		}
+
+		c.expectCmd("NOOP", 250)
+
+		if len(bodies) > 0 {
+			t.Errorf("StrictLineEndings %v: got a second message %q", strict, <-bodies)
+		}
+
+		c.Close()
+		srv.Close()
+	}
+}
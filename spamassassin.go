@@ -0,0 +1,186 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SpamAssassinTagging is the header tagging mode of SpamAssassinFilter
+type SpamAssassinTagging int
+
+const (
+	// SpamAssassinTagSpam adds X-Spam-Flag and X-Spam-Status to the messages spamd considers spam
+	SpamAssassinTagSpam SpamAssassinTagging = iota
+
+	// SpamAssassinTagAll adds X-Spam-Status to every message and X-Spam-Flag to the spam
+	SpamAssassinTagAll
+
+	// SpamAssassinTagNone doesn't add any header
+	SpamAssassinTagNone
+)
+
+// SpamAssassinFilter is a SpamFilter speaking the spamd (spamc) protocol
+type SpamAssassinFilter struct {
+	// Network and Addr locate spamd, tcp and 127.0.0.1:783 by default (e.g: unix and /var/run/spamd.sock)
+	Network string
+	Addr    string
+
+	// User (if set) selects the per-user spamd configuration
+	User string
+
+	// RejectThreshold is the score at (or above) which the messages are rejected, zero disables the rejection
+	RejectThreshold float64
+
+	Tagging SpamAssassinTagging
+}
+
+// Check implements SpamFilter
+func (f *SpamAssassinFilter) Check(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error) {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return SpamVerdict{}, err
+	}
+
+	network, addr := f.Network, f.Addr
+	if network == "" {
+		network = "tcp"
+	}
+
+	if addr == "" {
+		addr = "127.0.0.1:783"
+	}
+
+	var dialer net.Dialer
+
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return SpamVerdict{}, err
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	request := "SYMBOLS SPAMC/1.5\r\nContent-length: " + strconv.Itoa(len(data)) + "\r\n"
+	if f.User != "" {
+		request += "User: " + f.User + "\r\n"
+	}
+
+	if _, err := io.WriteString(c, request+"\r\n"); err != nil {
+		return SpamVerdict{}, err
+	}
+
+	if _, err := c.Write(data); err != nil {
+		return SpamVerdict{}, err
+	}
+
+	spam, score, required, symbols, err := readSpamdResponse(bufio.NewReader(c))
+	if err != nil {
+		return SpamVerdict{}, err
+	}
+
+	return f.verdict(spam, score, required, symbols), nil
+}
+
+// verdict applies the reject threshold and the tagging mode
+func (f *SpamAssassinFilter) verdict(spam bool, score, required float64, symbols string) SpamVerdict {
+	verdict := SpamVerdict{Score: score}
+
+	if f.RejectThreshold != 0 && score >= f.RejectThreshold {
+		verdict.Action = SpamReject
+		return verdict
+	}
+
+	if spam {
+		verdict.Action = SpamTag
+	}
+
+	if f.Tagging == SpamAssassinTagNone || (!spam && f.Tagging != SpamAssassinTagAll) {
+		return verdict
+	}
+
+	status := "No"
+	if spam {
+		status = "Yes"
+		verdict.Headers = append(verdict.Headers, SpamHeader{Name: "X-Spam-Flag", Value: "YES"})
+	}
+
+	status += fmt.Sprintf(", score=%.1f required=%.1f", score, required)
+	if symbols != "" {
+		status += " tests=" + symbols
+	}
+
+	verdict.Headers = append(verdict.Headers, SpamHeader{Name: "X-Spam-Status", Value: status})
+
+	return verdict
+}
+
+// readSpamdResponse parses a SYMBOLS response, e.g:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Spam: True ; 15.3 / 5.0
+//
+//	BAYES_99,HTML_MESSAGE
+func readSpamdResponse(r *bufio.Reader) (spam bool, score, required float64, symbols string, err error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return false, 0, 0, "", err
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return false, 0, 0, "", fmt.Errorf("spamd: bad response %q", strings.TrimSpace(status))
+	}
+
+	if fields[1] != "0" {
+		return false, 0, 0, "", fmt.Errorf("spamd: %s", strings.Join(fields[1:], " "))
+	}
+
+	found := false
+
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			if err != nil && err != io.EOF {
+				return false, 0, 0, "", err
+			}
+
+			break
+		}
+
+		name := strings.SplitN(line, ":", 2)
+		if len(name) == 2 && strings.EqualFold(name[0], "Spam") {
+			// True ; 15.3 / 5.0
+			parts := strings.FieldsFunc(name[1], func(r rune) bool { return r == ';' || r == '/' })
+			if len(parts) != 3 {
+				return false, 0, 0, "", fmt.Errorf("spamd: bad Spam header %q", line)
+			}
+
+			spam = strings.EqualFold(strings.TrimSpace(parts[0]), "True") || strings.EqualFold(strings.TrimSpace(parts[0]), "Yes")
+			score, _ = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			required, _ = strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+			found = true
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if !found {
+		return false, 0, 0, "", fmt.Errorf("spamd: missing Spam header")
+	}
+
+	body, _ := ioutil.ReadAll(r)
+
+	return spam, score, required, strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,155 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startSpamd answers the SYMBOLS requests, the messages containing "viagra" are spam, the
+// headers of the received requests are sent on requests
+func startSpamd(t *testing.T) (net.Listener, chan textproto.MIMEHeader) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan textproto.MIMEHeader, 10)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+
+				r := textproto.NewReader(bufio.NewReader(c))
+
+				line, err := r.ReadLine()
+				if err != nil || line != "SYMBOLS SPAMC/1.5" {
+					io.WriteString(c, "SPAMD/1.5 76 Bad header line: "+line+"\r\n")
+					return
+				}
+
+				header, err := r.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+
+				length, _ := strconv.Atoi(header.Get("Content-length"))
+
+				body, err := ioutil.ReadAll(io.LimitReader(r.R, int64(length)))
+				if err != nil || len(body) != length {
+					return
+				}
+
+				requests <- header
+
+				if strings.Contains(string(body), "viagra") {
+					io.WriteString(c, "SPAMD/1.1 0 EX_OK\r\nContent-length: 23\r\nSpam: True ; 15.3 / 5.0\r\n\r\nBAYES_99,HTML_MESSAGE\r\n")
+				} else {
+					io.WriteString(c, "SPAMD/1.1 0 EX_OK\r\nSpam: False ; 1.2 / 5.0\r\n\r\nBAYES_00\r\n")
+				}
+			}(c)
+		}
+	}()
+
+	return l, requests
+}
+
+func TestSpamAssassinFilter(t *testing.T) {
+	l, requests := startSpamd(t)
+	defer l.Close()
+
+	ham := "Subject: hello\r\n\r\nhello\r\n"
+	spam := "Subject: cheap viagra\r\n\r\nbuy viagra\r\n"
+
+	for _, tt := range []struct {
+		name    string
+		filter  SpamAssassinFilter
+		message string
+		action  SpamAction
+		score   float64
+		headers []SpamHeader
+	}{
+		{"ham", SpamAssassinFilter{}, ham, SpamAccept, 1.2, nil},
+		{"spam", SpamAssassinFilter{}, spam, SpamTag, 15.3, []SpamHeader{
+			{Name: "X-Spam-Flag", Value: "YES"},
+			{Name: "X-Spam-Status", Value: "Yes, score=15.3 required=5.0 tests=BAYES_99,HTML_MESSAGE"},
+		}},
+		{"tag all", SpamAssassinFilter{Tagging: SpamAssassinTagAll}, ham, SpamAccept, 1.2, []SpamHeader{
+			{Name: "X-Spam-Status", Value: "No, score=1.2 required=5.0 tests=BAYES_00"},
+		}},
+		{"tag none", SpamAssassinFilter{Tagging: SpamAssassinTagNone}, spam, SpamTag, 15.3, nil},
+		{"reject", SpamAssassinFilter{RejectThreshold: 10}, spam, SpamReject, 15.3, nil},
+		{"below threshold", SpamAssassinFilter{RejectThreshold: 20, User: "alice"}, spam, SpamTag, 15.3, []SpamHeader{
+			{Name: "X-Spam-Flag", Value: "YES"},
+			{Name: "X-Spam-Status", Value: "Yes, score=15.3 required=5.0 tests=BAYES_99,HTML_MESSAGE"},
+		}},
+	} {
+		tt.filter.Addr = l.Addr().String()
+
+		verdict, err := tt.filter.Check(context.Background(), &SpamEnvelope{ID: "1"}, strings.NewReader(tt.message))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		header := <-requests
+		if header.Get("Content-length") != strconv.Itoa(len(tt.message)) || header.Get("User") != tt.filter.User {
+			t.Errorf("%s: request headers = %v", tt.name, header)
+		}
+
+		if verdict.Action != tt.action || verdict.Score != tt.score {
+			t.Errorf("%s: verdict = %d %.1f, want %d %.1f", tt.name, verdict.Action, verdict.Score, tt.action, tt.score)
+		}
+
+		if len(verdict.Headers) != len(tt.headers) {
+			t.Errorf("%s: headers = %v, want %v", tt.name, verdict.Headers, tt.headers)
+			continue
+		}
+
+		for i := range tt.headers {
+			if verdict.Headers[i] != tt.headers[i] {
+				t.Errorf("%s: header %d = %v, want %v", tt.name, i, verdict.Headers[i], tt.headers[i])
+			}
+		}
+	}
+}
+
+func TestReadSpamdResponse(t *testing.T) {
+	for _, tt := range []struct {
+		response string
+		spam     bool
+		score    float64
+		symbols  string
+		err      bool
+	}{
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: True ; 15.3 / 5.0\r\n\r\nBAYES_99\r\n", true, 15.3, "BAYES_99", false},
+		{"SPAMD/1.1 0 EX_OK\r\nspam: yes ; -0.5 / 5.0\r\n\r\n", true, -0.5, "", false},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: False ; 0.0 / 5.0", false, 0, "", false},
+		{"SPAMD/1.0 76 Bad header line\r\n", false, 0, "", true},
+		{"HTTP/1.1 400 Bad Request\r\n", false, 0, "", true},
+		{"SPAMD/1.1 0 EX_OK\r\n\r\nBAYES_99\r\n", false, 0, "", true},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: True\r\n\r\n", false, 0, "", true},
+		{"", false, 0, "", true},
+	} {
+		spam, score, _, symbols, err := readSpamdResponse(bufio.NewReader(strings.NewReader(tt.response)))
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err = %v", tt.response, err)
+			continue
+		}
+
+		if spam != tt.spam || score != tt.score || symbols != tt.symbols {
+			t.Errorf("%q: got %v %.1f %q, want %v %.1f %q", tt.response, spam, score, symbols, tt.spam, tt.score, tt.symbols)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// SpamAction is what a SpamFilter decided for a message, the higher the stronger
+type SpamAction int
+
+const (
+	// SpamAccept delivers the message as is
+	SpamAccept SpamAction = iota
+
+	// SpamTag delivers the message with the verdict headers (e.g: X-Spam-Flag)
+	SpamTag
+
+	// SpamQuarantine delivers the message with the verdict headers, the handler is expected
+	// to divert it (see Context.SpamVerdict)
+	SpamQuarantine
+
+	// SpamDefer replies 451 (e.g: greylisting)
+	SpamDefer
+
+	// SpamReject replies 550
+	SpamReject
+)
+
+func (a SpamAction) String() string {
+	switch a {
+	case SpamTag:
+		return "tag"
+	case SpamQuarantine:
+		return "quarantine"
+	case SpamDefer:
+		return "defer"
+	case SpamReject:
+		return "reject"
+	}
+
+	return "accept"
+}
+
+// SpamHeader is a header field added to the message by a SpamFilter
+type SpamHeader struct {
+	Name  string
+	Value string
+}
+
+// SpamVerdict is the decision of a SpamFilter
+type SpamVerdict struct {
+	Action SpamAction
+	Score  float64
+
+	// Reply (if set) replaces the default reply of SpamDefer and SpamReject
+	Reply *smtp.SMTPError
+
+	// Virus is the signature found in the message by a virus scanner (see ClamAVFilter)
+	Virus string
+
+	// Headers are prepended to the delivered message
+	Headers []SpamHeader
+}
+
+// SpamEnvelope describes the message being checked
+type SpamEnvelope struct {
+	ID         string
+	RemoteAddr net.Addr
+	Helo       string
+	From       string
+	To         []string
+
+	// User is the authenticated user, empty for the anonymous clients
+	User string
+}
+
+// SpamFilter checks a whole message between the DATA receipt and the Handler, see ServerConfig.SpamFilter
+type SpamFilter interface {
+	Check(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error)
+}
+
+// SpamFilterFunc adapts a function to the SpamFilter interface
+type SpamFilterFunc func(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error)
+
+// Check implements SpamFilter
+func (fn SpamFilterFunc) Check(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error) {
+	return fn(ctx, envelope, message)
+}
+
+// SpamFilterChain runs multiple filters in order, each of them reads its own copy of the message,
+// it stops at the first deferring or rejecting filter, otherwise the strongest action wins, the
+// scores are summed and the headers of all the filters are kept
+type SpamFilterChain struct {
+	Filters []SpamFilter
+
+	// IgnoreErrors skips the failing filters instead of failing the whole chain
+	IgnoreErrors bool
+}
+
+// Check implements SpamFilter
+func (chain *SpamFilterChain) Check(ctx context.Context, envelope *SpamEnvelope, message io.Reader) (SpamVerdict, error) {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return SpamVerdict{}, err
+	}
+
+	var verdict SpamVerdict
+
+	for _, filter := range chain.Filters {
+		v, err := filter.Check(ctx, envelope, bytes.NewReader(data))
+		if err != nil {
+			if chain.IgnoreErrors {
+				continue
+			}
+
+			return verdict, err
+		}
+
+		verdict.Score += v.Score
+		verdict.Headers = append(verdict.Headers, v.Headers...)
+
+		if v.Virus != "" {
+			verdict.Virus = v.Virus
+		}
+
+		if v.Action > verdict.Action {
+			verdict.Action, verdict.Reply = v.Action, v.Reply
+		}
+
+		if v.Action >= SpamDefer {
+			break
+		}
+	}
+
+	return verdict, nil
+}
+
+// checkSpam runs ServerConfig.SpamFilter on data, it returns the message to deliver (with
+// the verdict headers) or the reply refusing it
+func (s *Session) checkSpam(data []byte) ([]byte, error) {
+	s.spam = nil
+
+	timeout := s.config.SpamFilterTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(s.context(), timeout)
+	defer cancel()
+
+	envelope := &SpamEnvelope{
+		ID:         s.id,
+		RemoteAddr: s.connState.RemoteAddr,
+		Helo:       s.connState.Hostname,
+	}
+
+	if s.From != nil {
+		envelope.From = s.From.Address
+	}
+
+	if s.To != nil {
+		envelope.To = []string{s.To.Address}
+	}
+
+	if s.username != nil {
+		envelope.User = *s.username
+	}
+
+	verdict, err := s.config.SpamFilter.Check(ctx, envelope, bytes.NewReader(data))
+	if err != nil {
+		return nil, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Spam filter unavailable, try again later"}
+	}
+
+	if score := s.profileSpamScore(); score > 0 && verdict.Score >= score {
+		verdict.Action = SpamReject
+	}
+
+	s.spam = &verdict
+
+	switch verdict.Action {
+	case SpamReject:
+		if verdict.Reply != nil {
+			return nil, verdict.Reply
+		}
+
+		return nil, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Message rejected as spam"}
+	case SpamDefer:
+		if verdict.Reply != nil {
+			return nil, verdict.Reply
+		}
+
+		return nil, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Message deferred, try again later"}
+	}
+
+	if len(verdict.Headers) < 1 {
+		return data, nil
+	}
+
+	var header strings.Builder
+	for _, h := range verdict.Headers {
+		header.WriteString(h.Name + ": " + h.Value + "\n")
+	}
+
+	return append([]byte(header.String()), data...), nil
+}
@@ -0,0 +1,742 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// the processing limits of RFC 7208 section 4.6.4
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+	spfMaxNames       = 10
+)
+
+var (
+	errSPFLookupLimit     = errors.New("spf: too many DNS lookups")
+	errSPFVoidLookupLimit = errors.New("spf: too many void DNS lookups")
+	errSPFMultipleRecords = errors.New("spf: multiple SPF records")
+	errSPFNoRecord        = errors.New("spf: the included or redirected domain has no SPF record")
+)
+
+// SPFChecker evaluates the SPF policies (RFC 7208), macros included
+type SPFChecker struct {
+	// Resolver defaults to net.DefaultResolver
+	Resolver Resolver
+
+	// Helo is the EHLO/HELO hostname of the client, for the %{h} macro
+	Helo string
+
+	// Receiver is the receiving host, for the %{r} macro of the explanations
+	Receiver string
+
+	Clock Clock
+}
+
+// CheckSPF checks whether ip is allowed to send mail for sender, from domain
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, domain, sender string) (SPFResult, string, error) {
+	checker := &SPFChecker{Resolver: resolver}
+
+	return checker.Check(ctx, ip, domain, sender)
+}
+
+// Check checks whether ip is allowed to send mail for sender, from domain (the domain of
+// the sender, or the HELO hostname for the null sender), it returns the result and the
+// explanation the domain published for failures
+func (c *SPFChecker) Check(ctx context.Context, ip net.IP, domain, sender string) (SPFResult, string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !spfValidDomain(domain) {
+		return SPFNone, "", nil
+	}
+
+	if ip == nil {
+		return SPFNone, "", errors.New("spf: no client IP")
+	}
+
+	if sender == "" {
+		sender = "postmaster@" + domain
+	}
+
+	local, senderDomain := "postmaster", sender
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		local, senderDomain = sender[:i], sender[i+1:]
+		if local == "" {
+			local = "postmaster"
+		}
+	}
+
+	e := &spfEval{
+		checker:      c,
+		ctx:          ctx,
+		resolver:     resolverOrDefault(c.Resolver),
+		ip:           ip,
+		sender:       local + "@" + senderDomain,
+		local:        local,
+		senderDomain: senderDomain,
+	}
+
+	result, explanation, err := e.check(domain)
+	if err != nil && result != SPFTempError {
+		result = SPFPermError
+	}
+
+	return result, explanation, err
+}
+
+// spfEval is the state of a single evaluation
+type spfEval struct {
+	checker  *SPFChecker
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+
+	sender       string
+	local        string
+	senderDomain string
+
+	lookups int
+	voids   int
+}
+
+// check is the check_host() function of RFC 7208 section 4
+func (e *spfEval) check(domain string) (SPFResult, string, error) {
+	record, err := e.record(domain)
+	if err != nil {
+		return spfErrorResult(err), "", err
+	} else if record == "" {
+		return SPFNone, "", nil
+	}
+
+	var mechanisms []string
+	var redirect, exp string
+
+	for _, term := range strings.Fields(record)[1:] {
+		name, value, isModifier := spfModifier(term)
+		if !isModifier {
+			mechanisms = append(mechanisms, term)
+			continue
+		}
+
+		switch name {
+		case "redirect":
+			if redirect != "" {
+				return SPFPermError, "", fmt.Errorf("spf: duplicate redirect modifier in %q", domain)
+			}
+
+			redirect = value
+		case "exp":
+			if exp != "" {
+				return SPFPermError, "", fmt.Errorf("spf: duplicate exp modifier in %q", domain)
+			}
+
+			exp = value
+		}
+	}
+
+	for _, term := range mechanisms {
+		qualifier := SPFPass
+
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftfail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		match, err := e.mechanism(domain, term)
+		if err != nil {
+			return spfErrorResult(err), "", err
+		}
+
+		if !match {
+			continue
+		}
+
+		if qualifier == SPFFail && exp != "" {
+			return qualifier, e.explain(domain, exp), nil
+		}
+
+		return qualifier, "", nil
+	}
+
+	if redirect == "" {
+		return SPFNeutral, "", nil
+	}
+
+	if err := e.count(); err != nil {
+		return SPFPermError, "", err
+	}
+
+	target, err := e.expand(redirect, domain, false)
+	if err != nil {
+		return SPFPermError, "", err
+	}
+
+	result, explanation, err := e.check(target)
+	if result == SPFNone {
+		return SPFPermError, "", errSPFNoRecord
+	}
+
+	return result, explanation, err
+}
+
+// record returns the SPF record of domain, empty if there is none
+func (e *spfEval) record(domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	record := ""
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower != "v=spf1" && !strings.HasPrefix(lower, "v=spf1 ") {
+			continue
+		}
+
+		if record != "" {
+			return "", errSPFMultipleRecords
+		}
+
+		record = txt
+	}
+
+	return record, nil
+}
+
+// mechanism reports whether the client IP matches the mechanism term (without its qualifier)
+func (e *spfEval) mechanism(domain, term string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, spfSyntaxError(term)
+		}
+
+		return true, nil
+
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, spfSyntaxError(term)
+		}
+
+		if err := e.count(); err != nil {
+			return false, err
+		}
+
+		target, err := e.expand(arg[1:], domain, false)
+		if err != nil {
+			return false, err
+		}
+
+		switch result, _, err := e.check(target); result {
+		case SPFPass:
+			return true, nil
+		case SPFFail, SPFSoftfail, SPFNeutral:
+			return false, nil
+		case SPFTempError:
+			return false, err
+		case SPFNone:
+			return false, errSPFNoRecord
+		default:
+			if err == nil {
+				err = fmt.Errorf("spf: permerror in the included %q", target)
+			}
+
+			return false, err
+		}
+
+	case "a":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+
+		target, v4, v6, err := e.targetCIDR(arg, domain)
+		if err != nil {
+			return false, spfSyntaxError(term)
+		}
+
+		return e.matchHost(target, v4, v6)
+
+	case "mx":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+
+		target, v4, v6, err := e.targetCIDR(arg, domain)
+		if err != nil {
+			return false, spfSyntaxError(term)
+		}
+
+		mxs, err := e.resolver.LookupMX(e.ctx, target)
+		if err := e.void(len(mxs), err); err != nil {
+			return false, err
+		}
+
+		if len(mxs) > spfMaxNames {
+			return false, errSPFLookupLimit
+		}
+
+		for _, mx := range mxs {
+			if match, err := e.matchHost(mx.Host, v4, v6); match || err != nil {
+				return match, err
+			}
+		}
+
+		return false, nil
+
+	case "ptr":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+
+		target := domain
+		if arg != "" {
+			if !strings.HasPrefix(arg, ":") {
+				return false, spfSyntaxError(term)
+			}
+
+			var err error
+			if target, err = e.expand(arg[1:], domain, false); err != nil {
+				return false, err
+			}
+		}
+
+		// the ptr failures are ignored (RFC 7208 section 5.5)
+		names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+		if err != nil {
+			return false, nil
+		}
+
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		for i, name := range names {
+			if i >= spfMaxNames {
+				break
+			}
+
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != target && !strings.HasSuffix(name, "."+target) {
+				continue
+			}
+
+			addrs, _ := e.resolver.LookupIPAddr(e.ctx, name)
+			for _, addr := range addrs {
+				if addr.IP.Equal(e.ip) {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, spfSyntaxError(term)
+		}
+
+		v4 := strings.ToLower(name) == "ip4"
+
+		network := arg[1:]
+		if !strings.Contains(network, "/") && v4 {
+			network += "/32"
+		} else if !strings.Contains(network, "/") {
+			network += "/128"
+		}
+
+		ip, ipnet, err := net.ParseCIDR(network)
+		if err != nil || (ip.To4() != nil) != v4 {
+			return false, spfSyntaxError(term)
+		}
+
+		return ipnet.Contains(e.ip), nil
+
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, spfSyntaxError(term)
+		}
+
+		if err := e.count(); err != nil {
+			return false, err
+		}
+
+		target, err := e.expand(arg[1:], domain, false)
+		if err != nil {
+			return false, err
+		}
+
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, target)
+		found := 0
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				found++
+			}
+		}
+
+		if err := e.void(found, err); err != nil {
+			return false, err
+		}
+
+		return found > 0, nil
+	}
+
+	return false, spfSyntaxError(term)
+}
+
+// matchHost reports whether the client IP is in the networks of the addresses of host
+func (e *spfEval) matchHost(host string, v4, v6 int) (bool, error) {
+	addrs, err := e.resolver.LookupIPAddr(e.ctx, host)
+	if err := e.void(len(addrs), err); err != nil {
+		return false, err
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil && e.ip.To4() != nil {
+			if addr.IP.Mask(net.CIDRMask(v4, 32)).Equal(e.ip.Mask(net.CIDRMask(v4, 32))) {
+				return true, nil
+			}
+		} else if addr.IP.To4() == nil && e.ip.To4() == nil {
+			if addr.IP.Mask(net.CIDRMask(v6, 128)).Equal(e.ip.Mask(net.CIDRMask(v6, 128))) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// targetCIDR parses the [":" domain-spec] [ip4-cidr-length] ["/" ip6-cidr-length] argument of a and mx
+func (e *spfEval) targetCIDR(arg, domain string) (string, int, int, error) {
+	target, v4, v6 := domain, 32, 128
+
+	if strings.HasPrefix(arg, ":") {
+		spec := arg[1:]
+		arg = ""
+		if i := strings.Index(spec, "/"); i >= 0 {
+			spec, arg = spec[:i], spec[i:]
+		}
+
+		var err error
+		if target, err = e.expand(spec, domain, false); err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	if arg == "" {
+		return target, v4, v6, nil
+	}
+
+	parts := strings.SplitN(arg, "//", 2)
+
+	if parts[0] != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(parts[0], "/"))
+		if err != nil || !strings.HasPrefix(parts[0], "/") || n < 0 || n > 32 {
+			return "", 0, 0, errors.New("invalid ip4-cidr-length")
+		}
+
+		v4 = n
+	}
+
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, errors.New("invalid ip6-cidr-length")
+		}
+
+		v6 = n
+	}
+
+	return target, v4, v6, nil
+}
+
+// explain returns the explanation published at the exp domain, empty on any error
+func (e *spfEval) explain(domain, exp string) string {
+	target, err := e.expand(exp, domain, false)
+	if err != nil {
+		return ""
+	}
+
+	txts, err := e.resolver.LookupTXT(e.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+
+	explanation, err := e.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+
+	return explanation
+}
+
+// count accounts for a DNS querying term
+func (e *spfEval) count() error {
+	e.lookups++
+	if e.lookups > spfMaxLookups {
+		return errSPFLookupLimit
+	}
+
+	return nil
+}
+
+// void accounts for the lookups that returned no answer, and passes the other errors through
+func (e *spfEval) void(answers int, err error) error {
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if answers < 1 {
+		e.voids++
+		if e.voids > spfMaxVoidLookups {
+			return errSPFVoidLookupLimit
+		}
+	}
+
+	return nil
+}
+
+// expand expands the macros of a domain-spec (or of an explanation string) (RFC 7208 section 7)
+func (e *spfEval) expand(spec, domain string, explanation bool) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+
+		if i+1 >= len(spec) {
+			return "", spfSyntaxError(spec)
+		}
+
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", spfSyntaxError(spec)
+			}
+
+			value, err := e.macro(spec[i+1:i+end], domain, explanation)
+			if err != nil {
+				return "", err
+			}
+
+			out.WriteString(value)
+			i += end
+		default:
+			return "", spfSyntaxError(spec)
+		}
+	}
+
+	if explanation {
+		return out.String(), nil
+	}
+
+	// long names are truncated from the left (RFC 7208 section 7.3)
+	expanded := strings.TrimSuffix(out.String(), ".")
+	for len(expanded) > 253 {
+		i := strings.IndexByte(expanded, '.')
+		if i < 0 {
+			break
+		}
+
+		expanded = expanded[i+1:]
+	}
+
+	return expanded, nil
+}
+
+// macro expands a single macro (the content of %{...})
+func (e *spfEval) macro(macro, domain string, explanation bool) (string, error) {
+	if macro == "" {
+		return "", spfSyntaxError("%{}")
+	}
+
+	letter := macro[0]
+	lower := letter | 0x20
+
+	var value string
+	switch lower {
+	case 's':
+		value = e.sender
+	case 'l':
+		value = e.local
+	case 'o':
+		value = e.senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		value = spfDottedIP(e.ip)
+	case 'p':
+		// the validated domain name is expensive and discouraged (RFC 7208 section 7.3)
+		value = "unknown"
+	case 'v':
+		value = "in-addr"
+		if e.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = e.checker.Helo
+	case 'c', 'r', 't':
+		if !explanation {
+			return "", spfSyntaxError("%{" + macro + "}")
+		}
+
+		switch lower {
+		case 'c':
+			value = e.ip.String()
+		case 'r':
+			value = e.checker.Receiver
+			if value == "" {
+				value = "unknown"
+			}
+		case 't':
+			value = strconv.FormatInt(clockOrDefault(e.checker.Clock).Now().Unix(), 10)
+		}
+	default:
+		return "", spfSyntaxError("%{" + macro + "}")
+	}
+
+	// transformers: digits, "r" and the delimiters
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", spfSyntaxError("%{" + macro + "}")
+		}
+
+		keep = n
+	}
+
+	rest = rest[digits:]
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+
+	if strings.Trim(rest, ".-+,/_=") != "" {
+		return "", spfSyntaxError("%{" + macro + "}")
+	}
+
+	delimiters := rest
+	if delimiters == "" {
+		delimiters = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+
+	value = strings.Join(parts, ".")
+
+	if letter != lower {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+
+	return value, nil
+}
+
+// spfModifier splits a name=value modifier term
+func spfModifier(term string) (string, string, bool) {
+	i := strings.IndexByte(term, '=')
+	if i < 1 || strings.ContainsAny(term[:i], ":/") {
+		return "", "", false
+	}
+
+	name := strings.ToLower(term[:i])
+	for j, r := range name {
+		if !(r >= 'a' && r <= 'z' || j > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')) {
+			return "", "", false
+		}
+	}
+
+	return name, term[i+1:], true
+}
+
+// spfDottedIP renders the %{i} macro, the IPv6 addresses are dot separated nibbles
+func spfDottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip16 {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+// spfValidDomain reports whether domain is a multi-label name with valid label lengths
+func spfValidDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// spfErrorResult maps an evaluation error to temperror (DNS failures) or permerror
+func spfErrorResult(err error) SPFResult {
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return SPFTempError
+	}
+
+	if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsNotFound {
+		return SPFTempError
+	}
+
+	return SPFPermError
+}
+
+func spfSyntaxError(term string) error {
+	return fmt.Errorf("spf: invalid term %q", term)
+}
@@ -0,0 +1,59 @@
+package smtpsrv
+
+import (
+	"github.com/emersion/go-smtp"
+)
+
+// SPFPolicy enforces the SPF result of the sender at MAIL FROM time, the results that
+// aren't rejected are accepted and tagged (see Context.SPF and the Authentication-Results)
+type SPFPolicy struct {
+	// RejectFail and RejectSoftfail reject with 550 5.7.23
+	RejectFail     bool
+	RejectSoftfail bool
+
+	// DeferTempError replies 451 4.7.24 on DNS errors so the client retries later
+	DeferTempError bool
+
+	// RejectPermError rejects broken SPF records with 550 5.7.24
+	RejectPermError bool
+
+	// Message (if set) replaces the default reply text
+	Message string
+
+	// Func (if set) decides instead of the options above, returning an error rejects the
+	// sender (an *smtp.SMTPError is replied as is)
+	Func SPFPolicyFunc
+}
+
+// check applies the policy to the sender of the current transaction
+func (p *SPFPolicy) check(c *Context) error {
+	result, explanation, _ := c.SPF()
+
+	if p.Func != nil {
+		return p.Func(c, result, explanation)
+	}
+
+	var code int
+	var enhanced smtp.EnhancedCode
+
+	switch {
+	case result == SPFFail && p.RejectFail, result == SPFSoftfail && p.RejectSoftfail:
+		code, enhanced = 550, smtp.EnhancedCode{5, 7, 23}
+	case result == SPFTempError && p.DeferTempError:
+		code, enhanced = 451, smtp.EnhancedCode{4, 7, 24}
+	case result == SPFPermError && p.RejectPermError:
+		code, enhanced = 550, smtp.EnhancedCode{5, 7, 24}
+	default:
+		return nil
+	}
+
+	message := p.Message
+	if message == "" {
+		message = "SPF check failed (" + result.String() + ")"
+		if explanation != "" {
+			message += ": " + explanation
+		}
+	}
+
+	return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: message}
+}
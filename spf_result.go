@@ -1,5 +1,35 @@
 package smtpsrv
 
-import "github.com/zaccone/spf"
+// SPFResult is the result of an SPF check (RFC 7208 section 2.6)
+type SPFResult int
 
-type SPFResult = spf.Result
+const (
+	SPFNone SPFResult = iota
+	SPFNeutral
+	SPFPass
+	SPFFail
+	SPFSoftfail
+	SPFTempError
+	SPFPermError
+)
+
+func (r SPFResult) String() string {
+	switch r {
+	case SPFNone:
+		return "none"
+	case SPFNeutral:
+		return "neutral"
+	case SPFPass:
+		return "pass"
+	case SPFFail:
+		return "fail"
+	case SPFSoftfail:
+		return "softfail"
+	case SPFTempError:
+		return "temperror"
+	case SPFPermError:
+		return "permerror"
+	}
+
+	return "unknown"
+}
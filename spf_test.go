@@ -0,0 +1,143 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// staticResolver answers from fixed records, the missing names don't exist
+type staticResolver struct {
+	txt map[string][]string
+	mx  map[string][]*net.MX
+	ip  map[string][]string
+}
+
+func (r *staticResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *staticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "temperror.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+
+	return nil, r.notFound(name)
+}
+
+func (r *staticResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[strings.TrimSuffix(name, ".")]; ok {
+		return mx, nil
+	}
+
+	return nil, r.notFound(name)
+}
+
+func (r *staticResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, r.notFound(addr)
+}
+
+func (r *staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ip[strings.TrimSuffix(host, ".")]
+	if !ok {
+		return nil, r.notFound(host)
+	}
+
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addrs, nil
+}
+
+func TestSPFCheck(t *testing.T) {
+	resolver := &staticResolver{
+		txt: map[string][]string{
+			"ip4.example":      {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"a.example":        {"v=spf1 a -all"},
+			"mx.example":       {"v=spf1 mx ~all"},
+			"include.example":  {"v=spf1 include:ip4.example ?all"},
+			"redirect.example": {"v=spf1 redirect=ip4.example"},
+			"neutral.example":  {"v=spf1 ?all"},
+			"nospf.example":    {"some other record"},
+			"twice.example":    {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":   {"v=spf1 include:nospf.example -all"},
+			"exp.example":      {"v=spf1 -all exp=explain.exp.example"},
+			"explain.exp.example": {
+				"%{i} is not one of %{d}'s designated mail servers",
+			},
+			"macro.example":            {"v=spf1 exists:%{l}.users.macro.example -all"},
+			"john.users.macro.example": {"v=spf1"},
+			"loop.example":             {"v=spf1 include:loop.example -all"},
+			"helo.example":             {"v=spf1 a:mail.helo.example -all"},
+			"tempfail.example":         {"v=spf1 include:temperror.example -all"},
+		},
+		mx: map[string][]*net.MX{
+			"mx.example": {{Host: "mail.mx.example.", Pref: 10}},
+		},
+		ip: map[string][]string{
+			"a.example":                {"192.0.2.10"},
+			"mail.mx.example":          {"198.51.100.7"},
+			"john.users.macro.example": {"127.0.0.2"},
+			"mail.helo.example":        {"192.0.2.25"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		ip     string
+		domain string
+		sender string
+		want   SPFResult
+	}{
+		{"ip4 pass", "192.0.2.1", "ip4.example", "user@ip4.example", SPFPass},
+		{"ip4 fail", "203.0.113.1", "ip4.example", "user@ip4.example", SPFFail},
+		{"a pass", "192.0.2.10", "a.example", "user@a.example", SPFPass},
+		{"mx pass", "198.51.100.7", "mx.example", "user@mx.example", SPFPass},
+		{"mx softfail", "198.51.100.8", "mx.example", "user@mx.example", SPFSoftfail},
+		{"include pass", "192.0.2.1", "include.example", "user@include.example", SPFPass},
+		{"include no match", "203.0.113.1", "include.example", "user@include.example", SPFNeutral},
+		{"redirect", "203.0.113.1", "redirect.example", "user@redirect.example", SPFFail},
+		{"neutral", "192.0.2.1", "neutral.example", "user@neutral.example", SPFNeutral},
+		{"no record", "192.0.2.1", "nospf.example", "user@nospf.example", SPFNone},
+		{"no domain", "192.0.2.1", "missing.example", "user@missing.example", SPFNone},
+		{"multiple records", "192.0.2.1", "twice.example", "user@twice.example", SPFPermError},
+		{"include without record", "192.0.2.1", "broken.example", "user@broken.example", SPFPermError},
+		{"macro", "192.0.2.1", "macro.example", "john@macro.example", SPFPass},
+		{"macro no match", "192.0.2.1", "macro.example", "jane@macro.example", SPFFail},
+		{"include loop", "192.0.2.1", "loop.example", "user@loop.example", SPFPermError},
+		{"temperror", "192.0.2.1", "tempfail.example", "user@tempfail.example", SPFTempError},
+		{"null sender helo", "192.0.2.25", "helo.example", "", SPFPass},
+		{"null sender helo fail", "192.0.2.26", "helo.example", "", SPFFail},
+		{"invalid domain", "192.0.2.1", "localhost", "user@localhost", SPFNone},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, _ := CheckSPF(context.Background(), resolver, net.ParseIP(tt.ip), tt.domain, tt.sender)
+			if got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("explanation", func(t *testing.T) {
+		result, explanation, err := CheckSPF(context.Background(), resolver, net.ParseIP("203.0.113.1"), "exp.example", "user@exp.example")
+		if result != SPFFail || err != nil || explanation != "203.0.113.1 is not one of exp.example's designated mail servers" {
+			t.Fatalf("got %v %q %v", result, explanation, err)
+		}
+	})
+
+	t.Run("lookup limit", func(t *testing.T) {
+		_, _, err := CheckSPF(context.Background(), resolver, net.ParseIP("192.0.2.1"), "loop.example", "user@loop.example")
+		if !errors.Is(err, errSPFLookupLimit) {
+			t.Fatalf("got %v, want %v", err, errSPFLookupLimit)
+		}
+	})
+}
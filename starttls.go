@@ -0,0 +1,72 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	replyStartTLS        = &smtp.SMTPError{Code: 220, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "Ready to start TLS"}
+	errAlreadyTLS        = &smtp.SMTPError{Code: 502, EnhancedCode: smtp.EnhancedCode{5, 5, 1}, Message: "Already running in TLS"}
+	errStartTLSInSession = &smtp.SMTPError{Code: 503, EnhancedCode: smtp.EnhancedCode{5, 5, 1}, Message: "STARTTLS must be issued before AUTH and MAIL"}
+)
+
+var errStartTLSPipelined = errors.New("commands pipelined after STARTTLS")
+
+// tlsTransport is the raw stream under the TLS session of a conn
+type tlsTransport struct {
+	*conn
+}
+
+func (t tlsTransport) Read(b []byte) (int, error) {
+	return t.Conn.Read(b)
+}
+
+func (t tlsTransport) Write(b []byte) (int, error) {
+	return t.Conn.Write(b)
+}
+
+// tlsServer returns the server side of the TLS session of c
+func tlsServer(c *conn) *tls.Conn {
+	return tls.Server(tlsTransport{c}, c.serverTLS)
+}
+
+// startTLS answers STARTTLS and does the handshake, the connection terminates TLS itself so the
+// encrypted stream goes through the same checks as the plaintext one. The commands pipelined after
+// STARTTLS (CVE-2011-0411 like) would be executed once the TLS session is up, RFC 3207 requires
+// STARTTLS to be the last command of a pipeline so such a client is hostile and is disconnected
+// right after the 220 reply. STARTTLS is refused once a go-smtp session exists (after AUTH or
+// MAIL) since the session can't forget what it learned in plaintext
+func (c *conn) startTLS() error {
+	reply := replyStartTLS
+	if c.tls != nil {
+		reply = errAlreadyTLS
+	} else if c.session != nil {
+		reply = errStartTLSInSession
+	}
+
+	c.extendWriteDeadline()
+	c.sendReply(reply)
+	c.extendReadDeadline()
+
+	if reply != replyStartTLS {
+		return nil
+	}
+
+	if len(c.held) > 0 {
+		c.Close()
+		return errStartTLSPipelined
+	}
+
+	tlsConn := tlsServer(c)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Close()
+		return err
+	}
+
+	c.tls = tlsConn
+
+	return nil
+}
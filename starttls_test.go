@@ -0,0 +1,123 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartTLS(t *testing.T) {
+	handshakes := make(chan bool, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		TLSConfig:         testTLSConfig(t),
+		StrictLineEndings: true,
+		MaxTextLineLength: DefaultMaxTextLineLength,
+		Handler: func(c *Context) error {
+			handshakes <- c.TLS().HandshakeComplete
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); !strings.Contains(ehlo, "STARTTLS") || strings.Contains(ehlo, "REQUIRETLS") {
+		t.Fatalf("unexpected plaintext EHLO reply:\n%s", ehlo)
+	}
+
+	c.startTLS()
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); strings.Contains(ehlo, "STARTTLS") || !strings.Contains(ehlo, "REQUIRETLS") {
+		t.Fatalf("unexpected encrypted EHLO reply:\n%s", ehlo)
+	}
+
+	c.expectCmd("STARTTLS", 502)
+
+	if reply := c.send("sender@example.org", []string{"rcpt@example.com"}, "Subject: hi\n\nhello"); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("the message got %q", reply)
+	}
+
+	if !<-handshakes {
+		t.Fatal("the session doesn't know about the TLS session")
+	}
+
+	// the guards of the stream apply to the TLS sessions too
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("RCPT TO:<rcpt@example.com>", 250)
+	c.expectCmd("DATA", 354)
+	c.write("Subject: bare\r\n\r\nbare\nline\r\n.\r\n")
+	c.expect(500)
+}
+
+func TestStartTLSRefused(t *testing.T) {
+	srv, addr := startTestServer(t, &ServerConfig{TLSConfig: testTLSConfig(t), Handler: func(c *Context) error { return nil }})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.expectCmd("MAIL FROM:<sender@example.org>", 250)
+	c.expectCmd("STARTTLS", 503)
+
+	// the commands pipelined after STARTTLS would run in the TLS session
+	c = dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("EHLO client.example.org", 250)
+	c.write("STARTTLS\r\nMAIL FROM:<sender@example.org>\r\n")
+	c.expect(220)
+
+	if line, err := c.r.ReadString('\n'); err == nil {
+		t.Fatalf("the connection is still open after a pipelined STARTTLS, got %q", line)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	handshakes := make(chan bool, 1)
+
+	srv := NewServer(&ServerConfig{
+		TLSConfig: testTLSConfig(t),
+		Handler: func(c *Context) error {
+			handshakes <- c.TLS().HandshakeComplete
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.ServeListener(l, ListenerConfig{ImplicitTLS: true})
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	defer c.Close()
+
+	c.expect(220)
+
+	if ehlo := c.expectCmd("EHLO client.example.org", 250); strings.Contains(ehlo, "STARTTLS") || !strings.Contains(ehlo, "DSN") {
+		t.Fatalf("unexpected EHLO reply:\n%s", ehlo)
+	}
+
+	if reply := c.send("sender@example.org", []string{"rcpt@example.com"}, "Subject: hi\n\nhello"); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("the message got %q", reply)
+	}
+
+	if !<-handshakes {
+		t.Fatal("the session doesn't know about the TLS session")
+	}
+}
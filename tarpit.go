@@ -0,0 +1,90 @@
+package smtpsrv
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// TarpitPolicy slows down the clients making too many errors (e.g: dictionary attacks), once a
+// connection got more than After error replies each further error reply is delayed (Delay
+// doubling up to MaxDelay), like the smtpd_error_sleep_time of postfix.
+//
+// The errors are the rejected MAIL, RCPT and DATA commands and the syntax errors (500 to 504), the
+// ones replied by the SMTP engine itself (e.g: unknown commands).
+type TarpitPolicy struct {
+	// After is the number of errors before tarpitting (3 by default)
+	After int
+
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Clock    Clock
+
+	delayed int64
+}
+
+// Delayed returns the number of delayed replies
+func (p *TarpitPolicy) Delayed() int64 {
+	return atomic.LoadInt64(&p.delayed)
+}
+
+// wait delays the caller as needed for the specified count of errors
+func (p *TarpitPolicy) wait(errors int) {
+	after := p.After
+	if after < 1 {
+		after = 3
+	}
+
+	over := errors - after
+	if over < 1 {
+		return
+	}
+
+	delay := p.Delay
+	if delay < 1 {
+		delay = time.Second
+	}
+
+	maxDelay := p.MaxDelay
+	if maxDelay < 1 {
+		maxDelay = 30 * time.Second
+	}
+
+	for i := 1; i < over && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	atomic.AddInt64(&p.delayed, 1)
+	<-clockOrDefault(p.Clock).After(delay)
+}
+
+// isSyntaxErrorReply reports whether b is the (last line of a) 500 to 504 reply
+func isSyntaxErrorReply(b []byte) bool {
+	code := replyCode(b)
+
+	return code >= 500 && code <= 504
+}
+
+// tarpit counts the error returned by a command and delays it as needed, the syntax errors
+// are counted by the connection as it writes them
+func (s *Session) tarpit(err error) {
+	if err == nil || s.config.Tarpit == nil {
+		return
+	}
+
+	c := s.conn()
+	if c == nil {
+		return
+	}
+
+	if e, ok := err.(*smtp.SMTPError); ok && e.Code >= 500 && e.Code <= 504 {
+		return
+	}
+
+	s.config.Tarpit.wait(int(atomic.AddInt32(&c.errors, 1)))
+}
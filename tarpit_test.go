@@ -0,0 +1,24 @@
+package smtpsrv
+
+import "testing"
+
+func TestIsSyntaxErrorReply(t *testing.T) {
+	for _, tt := range []struct {
+		reply string
+		want  bool
+	}{
+		{"500 5.5.2 Syntax error, command unrecognized\r\n", true},
+		{"501 5.5.4 Syntax error in parameters\r\n", true},
+		{"502 5.5.1 Command not implemented\r\n", true},
+		{"503 5.5.1 Bad sequence of commands\r\n", true},
+		{"504 5.5.4 Command parameter not implemented\r\n", true},
+		{"550 5.1.1 No such user here\r\n", false},
+		{"451 4.3.0 Try again later\r\n", false},
+		{"500-first line\r\n", false},
+		{"250 2.0.0 OK\r\n", false},
+	} {
+		if got := isSyntaxErrorReply([]byte(tt.reply)); got != tt.want {
+			t.Errorf("isSyntaxErrorReply(%q) = %v, want %v", tt.reply, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package smtpsrv
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// SessionTicketKeySource returns the session ticket keys to use, the first one
+// encrypts the new tickets and all of them decrypt, e.g: keys shared by a cluster
+type SessionTicketKeySource func() ([][32]byte, error)
+
+// SessionTicketRotator rotates the TLS session ticket keys every Interval (12h by default),
+// so a long running server never keeps a static key, the Keep (2 by default) previous
+// keys are still accepted so the recently issued tickets stay valid
+type SessionTicketRotator struct {
+	Interval time.Duration
+	Keep     int
+
+	// Source (if set) provides the keys instead of generating random ones
+	Source SessionTicketKeySource
+
+	Clock    Clock
+	ErrorLog func(error)
+
+	mu      sync.Mutex
+	keys    [][32]byte
+	configs []*tls.Config
+	done    chan struct{}
+}
+
+// Rotate installs new keys on all the attached configs
+func (r *SessionTicketRotator) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys [][32]byte
+
+	if r.Source != nil {
+		var err error
+		if keys, err = r.Source(); err != nil {
+			return err
+		}
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		keys = append([][32]byte{key}, r.keys...)
+		if keep := r.keep() + 1; len(keys) > keep {
+			keys = keys[:keep]
+		}
+	}
+
+	if len(keys) < 1 {
+		return nil
+	}
+
+	r.keys = keys
+	for _, cfg := range r.configs {
+		cfg.SetSessionTicketKeys(keys)
+	}
+
+	return nil
+}
+
+// Start rotates the keys right away then every Interval until Stop is called
+func (r *SessionTicketRotator) Start() error {
+	if err := r.Rotate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.done != nil {
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.done = make(chan struct{})
+	done := r.done
+	r.mu.Unlock()
+
+	go func() {
+		clock := clockOrDefault(r.Clock)
+
+		for {
+			select {
+			case <-clock.After(r.interval()):
+				if err := r.Rotate(); err != nil && r.ErrorLog != nil {
+					r.ErrorLog(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the rotation started by Start
+func (r *SessionTicketRotator) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+}
+
+// attach makes the rotator manage the keys of the specified config
+func (r *SessionTicketRotator) attach(cfg *tls.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.configs = append(r.configs, cfg)
+	if len(r.keys) > 0 {
+		cfg.SetSessionTicketKeys(r.keys)
+	}
+}
+
+func (r *SessionTicketRotator) interval() time.Duration {
+	if r.Interval <= 0 {
+		return 12 * time.Hour
+	}
+
+	return r.Interval
+}
+
+func (r *SessionTicketRotator) keep() int {
+	if r.Keep < 1 {
+		return 2
+	}
+
+	return r.Keep
+}
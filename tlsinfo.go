@@ -0,0 +1,75 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// TLSInfo is a human friendly summary of the TLS session of a connection
+type TLSInfo struct {
+	Version          string
+	CipherSuite      string
+	ServerName       string
+	Resumed          bool
+	PeerCertificates []CertificateSummary
+}
+
+// CertificateSummary describes a peer certificate
+type CertificateSummary struct {
+	Subject  string
+	Issuer   string
+	NotAfter time.Time
+	Verified bool
+}
+
+// NewTLSInfo summarizes the specified connection state, nil if the handshake didn't complete
+func NewTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil || !state.HandshakeComplete {
+		return nil
+	}
+
+	info := &TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		Resumed:     state.DidResume,
+	}
+
+	verified := clientCertificate(state)
+	for _, cert := range state.PeerCertificates {
+		info.PeerCertificates = append(info.PeerCertificates, CertificateSummary{
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			NotAfter: cert.NotAfter,
+			Verified: verified != nil && verified.Equal(cert),
+		})
+	}
+
+	return info
+}
+
+// ReceivedClause renders the Received header "with" clause, e.g:
+// "with ESMTPS (version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256)"
+func (info *TLSInfo) ReceivedClause() string {
+	if info == nil {
+		return "with ESMTP"
+	}
+
+	return fmt.Sprintf("with ESMTPS (version=%s cipher=%s)", info.Version, info.CipherSuite)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+
+	return fmt.Sprintf("0x%04X", version)
+}
@@ -0,0 +1,142 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// DefaultRoleAccounts are the local parts treated as role accounts
+var DefaultRoleAccounts = []string{
+	"abuse", "admin", "administrator", "billing", "contact", "help", "hostmaster",
+	"info", "mailer-daemon", "marketing", "noc", "no-reply", "noreply", "postmaster",
+	"root", "sales", "security", "support", "webmaster",
+}
+
+// AddressValidationOptions controls what ValidateAddress checks
+type AddressValidationOptions struct {
+	// CheckDomain verifies that the domain has an MX record (or at least an A/AAAA one)
+	CheckDomain bool
+
+	// RoleAccounts overrides DefaultRoleAccounts
+	RoleAccounts []string
+
+	// Resolver defaults to net.DefaultResolver
+	Resolver Resolver
+}
+
+// AddressValidation is the outcome of ValidateAddress
+type AddressValidation struct {
+	Address   string
+	LocalPart string
+	Domain    string
+	HasMX     bool
+	HasA      bool
+	Role      bool
+}
+
+// ValidateAddress checks the syntax of the address, optionally that its domain
+// is able to receive mail, and detects role accounts.
+func ValidateAddress(ctx context.Context, addr string, opts *AddressValidationOptions) (*AddressValidation, error) {
+	if opts == nil {
+		opts = &AddressValidationOptions{}
+	}
+
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return nil, ErrInvalidAddress
+	}
+
+	local, domain, err := SplitAddress(parsed.Address)
+	if err != nil || local == "" || domain == "" {
+		return nil, ErrInvalidAddress
+	}
+
+	result := &AddressValidation{
+		Address:   parsed.Address,
+		LocalPart: local,
+		Domain:    domain,
+		Role:      isRoleAccount(local, opts.RoleAccounts),
+	}
+
+	if !opts.CheckDomain {
+		return result, nil
+	}
+
+	resolver := resolverOrDefault(opts.Resolver)
+
+	result.HasMX, err = hasMX(ctx, resolver, domain)
+	if err != nil && !isNotFound(err) {
+		return result, err
+	}
+
+	if !result.HasMX {
+		addrs, err := resolver.LookupIPAddr(ctx, domain)
+		if err != nil && !isNotFound(err) {
+			return result, err
+		}
+
+		result.HasA = len(addrs) > 0
+	}
+
+	if !result.HasMX && !result.HasA {
+		return result, ErrDomainNotMailable
+	}
+
+	return result, nil
+}
+
+func hasMX(ctx context.Context, resolver Resolver, domain string) (bool, error) {
+	mxhosts, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	return len(mxhosts) > 0, nil
+}
+
+// CanonicalizeEmail returns the canonical form of the address, lower cased and without
+// the subaddress (e.g: "Support+1234@Example.com" becomes "support@example.com")
+func CanonicalizeEmail(address string) (string, error) {
+	local, domain, err := SplitAddress(address)
+	if err != nil || local == "" || domain == "" {
+		return "", ErrInvalidAddress
+	}
+
+	local, _ = SplitSubaddress(strings.ToLower(local))
+
+	return local + "@" + normalizeDomain(domain), nil
+}
+
+// SplitSubaddress splits a local part to its base and subaddress (e.g: "support+1234"
+// to "support" and "1234"), the subaddress is empty if there is none
+func SplitSubaddress(local string) (string, string) {
+	if plusInd := strings.Index(local, "+"); plusInd != -1 {
+		return local[:plusInd], local[plusInd+1:]
+	}
+
+	return local, ""
+}
+
+func isRoleAccount(local string, roles []string) bool {
+	if roles == nil {
+		roles = DefaultRoleAccounts
+	}
+
+	local, _ = SplitSubaddress(strings.ToLower(local))
+
+	for _, role := range roles {
+		if local == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+
+	return ok && dnsErr.IsNotFound
+}
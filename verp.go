@@ -0,0 +1,80 @@
+package smtpsrv
+
+import "strings"
+
+// VERP encodes/decodes variable envelope return paths (e.g. bounces+user=example.com@list.example.org)
+type VERP struct {
+	// the separator between the return path local part and the encoded recipient, "+" by default
+	Delimiter string
+
+	// the replacement of the "@" of the encoded recipient, "=" by default
+	Separator string
+}
+
+// DefaultVERP uses the common "+" delimiter and "=" separator
+var DefaultVERP = VERP{Delimiter: "+", Separator: "="}
+
+// Encode returns the return path to use when sending to the specified recipient
+func (v VERP) Encode(returnPath, rcpt string) (string, error) {
+	v = v.withDefaults()
+
+	local, domain, err := SplitAddress(returnPath)
+	if err != nil {
+		return "", err
+	}
+
+	rcptLocal, rcptDomain, err := SplitAddress(rcpt)
+	if err != nil {
+		return "", err
+	}
+
+	return local + v.Delimiter + rcptLocal + v.Separator + rcptDomain + "@" + domain, nil
+}
+
+// Decode extracts the original return path and the recipient from a VERP address
+func (v VERP) Decode(address string) (string, string, error) {
+	v = v.withDefaults()
+
+	local, domain, err := SplitAddress(address)
+	if err != nil {
+		return "", "", err
+	}
+
+	delimInd := strings.Index(local, v.Delimiter)
+	if delimInd == -1 {
+		return "", "", ErrNotVERP
+	}
+
+	encoded := local[delimInd+len(v.Delimiter):]
+	sepInd := strings.LastIndex(encoded, v.Separator)
+	if sepInd < 1 || sepInd == len(encoded)-len(v.Separator) {
+		return "", "", ErrNotVERP
+	}
+
+	returnPath := local[:delimInd] + "@" + domain
+	rcpt := encoded[:sepInd] + "@" + encoded[sepInd+len(v.Separator):]
+
+	return returnPath, rcpt, nil
+}
+
+func (v VERP) withDefaults() VERP {
+	if v.Delimiter == "" {
+		v.Delimiter = DefaultVERP.Delimiter
+	}
+
+	if v.Separator == "" {
+		v.Separator = DefaultVERP.Separator
+	}
+
+	return v
+}
+
+// VERPEncode encodes the recipient into the return path using DefaultVERP
+func VERPEncode(returnPath, rcpt string) (string, error) {
+	return DefaultVERP.Encode(returnPath, rcpt)
+}
+
+// VERPDecode decodes a VERP address using DefaultVERP
+func VERPDecode(address string) (string, string, error) {
+	return DefaultVERP.Decode(address)
+}
@@ -0,0 +1,57 @@
+package smtpsrv
+
+import "testing"
+
+func TestVERPDecode(t *testing.T) {
+	tests := []struct {
+		address    string
+		returnPath string
+		rcpt       string
+		err        error
+	}{
+		{"bounces+john=example.com@list.example.org", "bounces@list.example.org", "john@example.com", nil},
+		{"bounces+john.doe=sub=example.com@list.example.org", "bounces@list.example.org", "john.doe=sub@example.com", nil},
+		{"bounces@list.example.org", "", "", ErrNotVERP},
+		{"bounces+john@list.example.org", "", "", ErrNotVERP},
+		{"bounces+john=@list.example.org", "", "", ErrNotVERP},
+	}
+
+	for _, test := range tests {
+		returnPath, rcpt, err := VERPDecode(test.address)
+		if returnPath != test.returnPath || rcpt != test.rcpt || err != test.err {
+			t.Errorf("VERPDecode(%q) = %q, %q, %v, want %q, %q, %v", test.address, returnPath, rcpt, err, test.returnPath, test.rcpt, test.err)
+		}
+	}
+}
+
+func TestVERPBounce(t *testing.T) {
+	recipients := make(chan string, 1)
+
+	srv, addr := startTestServer(t, &ServerConfig{
+		Handler: func(c *Context) error {
+			rcpt, err := c.VERPRecipient()
+			if err != nil {
+				return err
+			}
+
+			recipients <- rcpt
+			return nil
+		},
+	})
+	defer srv.Close()
+
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.expectCmd("HELO mx.example.com", 250)
+
+	// the bounces are sent with the null reverse-path
+	reply := c.send("", []string{"bounces+john=example.com@list.example.org"}, "Subject: Undelivered Mail\n\nNo such user")
+	if reply[:3] != "250" {
+		t.Fatalf("the bounce got %q", reply)
+	}
+
+	if rcpt := <-recipients; rcpt != "john@example.com" {
+		t.Errorf("VERPRecipient() = %q, want john@example.com", rcpt)
+	}
+}